@@ -1,4 +1,10 @@
 export GOOS=linux 
 
-go build -o dist/controller controller/*.go
-go build -o dist/edge edge/*.go
\ No newline at end of file
+VERSION=$(git describe --tags --always 2>/dev/null || echo dev)
+COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+BUILD_DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+PKG=github.com/ICKelin/cframe/pkg/version
+LDFLAGS="-X $PKG.Version=$VERSION -X $PKG.Commit=$COMMIT -X $PKG.BuildDate=$BUILD_DATE"
+
+go build -ldflags "$LDFLAGS" -o dist/controller controller/*.go
+go build -ldflags "$LDFLAGS" -o dist/edge edge/*.go
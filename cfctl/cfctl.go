@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/ICKelin/cframe/codec"
 	"github.com/ICKelin/cframe/pkg/etcdstorage"
 	cli "github.com/urfave/cli/v2"
 )
@@ -91,15 +92,46 @@ func main() {
 							Required: true,
 							Usage:    "eg: 172.18.0.0/16",
 						},
+						&cli.UintFlag{
+							Name:  "vni",
+							Usage: "virtual network identifier",
+						},
+						&cli.BoolFlag{
+							Name:  "standby",
+							Usage: "standby of the edge with the same cidr",
+						},
+						&cli.IntFlag{
+							Name:  "weight",
+							Usage: "weight among edges with the same cidr",
+						},
+						&cli.StringFlag{
+							Name:  "transport",
+							Usage: "transport of data packets to the edge, udp or tcp",
+						},
+						&cli.BoolFlag{
+							Name:  "resolve",
+							Usage: "reject listener whose host does not resolve",
+						},
+						&cli.StringSliceFlag{
+							Name:  "route",
+							Usage: "extra route via a peer edge, eg: 192.168.100.0/24=edge2",
+						},
 					},
 					Action: func(ctx *cli.Context) error {
 						ns := ctx.String("ns")
 						edgeName := ctx.String("name")
 						listen := ctx.String("listener")
 						cidr := ctx.String("cidr")
+						vni := uint32(ctx.Uint("vni"))
+						standby := ctx.Bool("standby")
+						weight := ctx.Int("weight")
+						transport := ctx.String("transport")
+						routes, err := codec.ParseStaticRoutes(strings.Join(ctx.StringSlice("route"), ","))
+						if err != nil {
+							return err
+						}
 
-						addEdge(ns, edgeName, listen, cidr, store)
-						return nil
+						return addEdge(ns, edgeName, listen, cidr, vni, standby, weight, transport, ctx.Bool("resolve"), routes, store)
 					},
 				},
 				{
@@ -169,13 +201,18 @@ func main() {
 							Usage:    "dst cidr block",
 							Required: true,
 						},
+						&cli.UintFlag{
+							Name:  "vni",
+							Usage: "virtual network identifier",
+						},
 					},
 					Action: func(ctx *cli.Context) error {
 						ns := ctx.String("namespace")
 						name := ctx.String("name")
 						listener := ctx.String("listener")
 						cidr := ctx.String("cidr")
-						addRoute(ns, name, listener, cidr, store)
+						vni := uint32(ctx.Uint("vni"))
+						addRoute(ns, name, listener, cidr, vni, store)
 						return nil
 					},
 				},
@@ -8,14 +8,24 @@ import (
 	"github.com/ICKelin/cframe/pkg/etcdstorage"
 )
 
-func addEdge(ns, edgeName, listenAddr, cidr string, store *etcdstorage.Etcd) {
+func addEdge(ns, edgeName, listenAddr, cidr string, vni uint32, standby bool, weight int, transport string, resolve bool, routes []*codec.StaticRoute, store *etcdstorage.Etcd) error {
 	edgeMgr := models.NewEdgeManager(store)
-	edgeMgr.AddEdge(ns, &codec.Edge{
+	edgeMgr.SetResolve(resolve)
+	err := edgeMgr.AddEdge(ns, &codec.Edge{
 		Name:       edgeName,
 		Cidr:       cidr,
 		ListenAddr: listenAddr,
+		Vni:        vni,
+		Standby:    standby,
+		Weight:     weight,
+		Transport:  transport,
+		Routes:     routes,
 	})
+	if err != nil {
+		return err
+	}
 	fmt.Printf("create edge %s cidr %s OK\n", listenAddr, cidr)
+	return nil
 }
 
 func delEdge(ns, edgeName string, store *etcdstorage.Etcd) {
@@ -29,9 +39,9 @@ func listEdges(ns string, store *etcdstorage.Etcd) {
 	edges := edgeMgr.GetEdges(ns)
 
 	fmt.Println("edge list:")
-	fmt.Printf("      %-15s %-25s %-15s\n", "Name", "Listener", "CIDR")
-	fmt.Println("-----------------------------------------------------------")
+	fmt.Printf("      %-15s %-25s %-20s %-8s %-8s %-8s\n", "Name", "Listener", "CIDR", "VNI", "Standby", "Weight")
+	fmt.Println("--------------------------------------------------------------------------------------------")
 	for i, edge := range edges {
-		fmt.Printf("%-5d %-15s %-25s %-15s\n", i+1, edge.Name, edge.ListenAddr, edge.Cidr)
+		fmt.Printf("%-5d %-15s %-25s %-20s %-8d %-8v %-8d\n", i+1, edge.Name, edge.ListenAddr, edge.Cidr, edge.Vni, edge.Standby, edge.Weight)
 	}
 }
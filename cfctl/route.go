@@ -18,12 +18,13 @@ func delRoute(ns, name string, store *etcdstorage.Etcd) {
 	fmt.Printf("del route %s OK\n", name)
 }
 
-func addRoute(ns, name, listener, cidr string, store *etcdstorage.Etcd) {
+func addRoute(ns, name, listener, cidr string, vni uint32, store *etcdstorage.Etcd) {
 	routeMgr := models.NewRouteManager(store)
 	err := routeMgr.AddRoute(ns, &codec.Route{
 		Name:    name,
 		CIDR:    cidr,
 		Nexthop: listener,
+		Vni:     vni,
 	})
 	if err != nil {
 		fmt.Printf("add route %s ret: %v", name, err)
@@ -43,6 +43,12 @@ const (
 
 	// exit edge
 	CmdExit
+
+	// controller replaces all peers of edge
+	CmdSetPeers
+
+	// controller adds and removes a batch of peers of edge
+	CmdPeerDelta
 )
 
 // version: 1byte
@@ -82,6 +88,13 @@ func Read(conn net.Conn) (Header, []byte, error) {
 		return h, nil, err
 	}
 
+	if h.Compressed() {
+		body, err = inflate(body)
+		if err != nil {
+			return h, nil, err
+		}
+	}
+
 	return h, body, nil
 }
 
@@ -89,10 +102,14 @@ func Read(conn net.Conn) (Header, []byte, error) {
 // cmd: header.cmd
 // body: payload
 func Write(conn net.Conn, cmd int, body []byte) error {
+	return write(conn, 0x01, cmd, body)
+}
+
+func write(conn net.Conn, version byte, cmd int, body []byte) error {
 	bodylen := make([]byte, 2)
 	binary.BigEndian.PutUint16(bodylen, uint16(len(body)))
 
-	hdr := []byte{0x01, byte(cmd)}
+	hdr := []byte{version, byte(cmd)}
 	hdr = append(hdr, bodylen...)
 
 	writebody := make([]byte, 0)
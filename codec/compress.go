@@ -0,0 +1,95 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// control plane compression negotiated on register,
+// edge lists supported ones and controller picks one
+const CompressDeflate = "deflate"
+
+// header version of frames with deflate compressed body,
+// read inflates them whatever was negotiated
+const versionDeflate = 0x02
+
+// bodies shorter than compressMin are sent as is
+const compressMin = 256
+
+// inflated body larger than maxInflated is rejected
+const maxInflated = 1 << 24
+
+// Compressed reports whether body of the frame is compressed
+func (h Header) Compressed() bool {
+	return h[0] == versionDeflate
+}
+
+func deflate(body []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func inflate(body []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(body))
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxInflated+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxInflated {
+		return nil, fmt.Errorf("inflated body exceeds %d bytes", maxInflated)
+	}
+	return b, nil
+}
+
+// WriteCompressed writes body deflated if it is large enough
+// and shrinks, only used once compression is negotiated
+func WriteCompressed(conn net.Conn, cmd int, body []byte) error {
+	if len(body) < compressMin {
+		return Write(conn, cmd, body)
+	}
+
+	z, err := deflate(body)
+	if err != nil || len(z) >= len(body) {
+		return Write(conn, cmd, body)
+	}
+	if len(z) > 0xffff {
+		return fmt.Errorf("compressed body %d bytes too large", len(z))
+	}
+	return write(conn, versionDeflate, cmd, z)
+}
+
+// WriteJSONCompressed wraps WriteCompressed with json encoder
+func WriteJSONCompressed(conn net.Conn, cmd int, obj interface{}) error {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return WriteCompressed(conn, cmd, body)
+}
+
+// NegotiateCompress returns compression supported by both sides,
+// empty if none
+func NegotiateCompress(offered []string) string {
+	for _, c := range offered {
+		if c == CompressDeflate {
+			return c
+		}
+	}
+	return ""
+}
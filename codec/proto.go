@@ -11,6 +11,8 @@ package codec
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"strings"
 )
 
 type CSPType int
@@ -25,6 +27,8 @@ type Route struct {
 	CIDR    string
 	Nexthop string
 	Name    string
+	// virtual network the route belongs to
+	Vni uint32
 }
 
 func (r *Route) String() string {
@@ -36,6 +40,50 @@ type Edge struct {
 	Cidr       string  `json:"cidr"`
 	ListenAddr string  `json:"listen_addr"`
 	Type       CSPType `json:"type"`
+	// virtual network identifier, 24 bits
+	// edges in different vni may use the same cidr
+	Vni uint32 `json:"vni"`
+	// standby edge serves the cidr of the primary edge
+	// only when the primary is down
+	Standby bool `json:"standby"`
+	// edges with weight serving the same cidr are equal peers,
+	// flows are distributed proportionally to weight
+	Weight int `json:"weight"`
+	// extra routes of the edge via its peers
+	Routes []*StaticRoute `json:"routes,omitempty"`
+	// ip/cidr of the tun device reported by edge, eg: 10.0.1.1/24
+	TunAddr string `json:"tun_addr,omitempty"`
+	// transport of data packets to the edge, udp or tcp,
+	// empty takes transport of the sending edge
+	Transport string `json:"transport,omitempty"`
+}
+
+// StaticRoute routes cidr via the peer edge named Peer
+type StaticRoute struct {
+	Cidr string `json:"cidr"`
+	Peer string `json:"peer"`
+}
+
+// ParseStaticRoutes parses comma separated cidr=peer pairs,
+// eg: 192.168.100.0/24=edge2,10.10.0.0/16=edge3
+func ParseStaticRoutes(s string) ([]*StaticRoute, error) {
+	routes := make([]*StaticRoute, 0)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("invalid static route %s, expect cidr=peer", pair)
+		}
+		if _, _, err := net.ParseCIDR(kv[0]); err != nil {
+			return nil, fmt.Errorf("invalid static route %s: %v", pair, err)
+		}
+		routes = append(routes, &StaticRoute{Cidr: kv[0], Peer: kv[1]})
+	}
+	return routes, nil
 }
 
 // edge register req
@@ -43,6 +91,17 @@ type RegisterReq struct {
 	Namespace string
 	SecretKey string
 	Name      string
+	// edge build version
+	Version string
+	// ip/cidr of the edge tun device
+	TunAddr string
+	// control plane compression supported by edge, eg: deflate
+	Compress []string `json:",omitempty"`
+	// edge applies batched peer changes of CmdPeerDelta
+	PeerDelta bool `json:",omitempty"`
+	// edge only queries its peers and routes, eg: by selftest,
+	// the connection is closed after reply without a session
+	Query bool `json:",omitempty"`
 }
 
 func (e *Edge) String() string {
@@ -60,6 +119,12 @@ type RegisterReply struct {
 	EdgeList []*Edge
 	CSPInfo  *CSPInfo
 	Routes   []*Route
+	// extra routes of the registered edge
+	StaticRoutes []*StaticRoute
+	// cidr of the registered edge, tun address is taken from it
+	Cidr string `json:",omitempty"`
+	// compression of messages from controller, empty if none
+	Compress string `json:",omitempty"`
 }
 
 func (r *RegisterReply) String() string {
@@ -77,6 +142,18 @@ type BroadcastOnlineMsg struct {
 
 	// offline edge network subnet(192.168.10.0/24)
 	Cidr string
+
+	// virtual network of the edge
+	Vni uint32
+
+	// standby edge of the cidr
+	Standby bool
+
+	// weight among equal edges of the cidr
+	Weight int
+
+	// transport of data packets to the edge, empty for default
+	Transport string
 }
 
 // broadcase edge offline
@@ -89,6 +166,15 @@ type BroadcastOfflineMsg struct {
 
 	// offlined edge network subnet
 	Cidr string
+
+	// virtual network of the edge
+	Vni uint32
+
+	// standby edge of the cidr
+	Standby bool
+
+	// weight among equal edges of the cidr
+	Weight int
 }
 
 // edge report host
@@ -108,9 +194,27 @@ type ReportMsg struct {
 	TrafficIn  int64
 	TrafficOut int64
 	Error      []string
+	// local hosts seen since last report
+	Hosts []string
+}
+
+// controller pushes the full peer set to edge,
+// peers not in the set are removed by edge
+type SetPeersMsg struct {
+	Peers []*Edge
+}
+
+// controller pushes peers added and removed since last push,
+// applied by edge at once
+type PeerDeltaMsg struct {
+	Add []*Edge `json:",omitempty"`
+	Del []*Edge `json:",omitempty"`
 }
 
-type Heartbeat struct{}
+// heartbeat from edge keeps its tun address updated
+type Heartbeat struct {
+	TunAddr string `json:",omitempty"`
+}
 
 // controller deploy route added to edges
 type AddRouteMsg struct {
@@ -119,6 +223,8 @@ type AddRouteMsg struct {
 	// next hop edge listen address
 	// ip:port
 	Nexthop string
+	// virtual network of the route
+	Vni uint32
 }
 
 // controller deploy route deleted to edges
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+// http api of controller for operators
+// eg: 127.0.0.1:58425
+type ApiServer struct {
+	addr     string
+	registry *RegistryServer
+	mux      *http.ServeMux
+
+	// bearer tokens of operators allowed to write,
+	// key: operator name, writes are refused if empty
+	tokens map[string]string
+}
+
+func NewApiServer(addr string, r *RegistryServer) *ApiServer {
+	s := &ApiServer{
+		addr:     addr,
+		registry: r,
+		mux:      http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/api/v1/edges", s.onEdges)
+	s.mux.HandleFunc("/api/v1/edges/push", s.onPushPeers)
+	s.mux.HandleFunc("/api/v1/routes/export", s.onExportRoutes)
+	s.mux.HandleFunc("/api/v1/topology", s.onTopology)
+	s.mux.HandleFunc("/readyz", s.onReadyz)
+	s.mux.Handle("/metrics", metrics.Handler())
+	return s
+}
+
+// SetTokens sets bearer tokens of operators by name
+func (s *ApiServer) SetTokens(tokens map[string]string) {
+	s.tokens = tokens
+}
+
+func (s *ApiServer) ListenAndServe() error {
+	log.Info("api server listen on %s", s.addr)
+	return http.ListenAndServe(s.addr, s.mux)
+}
+
+// onPushPeers pushes peers to a single edge,
+// eg: POST /api/v1/edges/push?namespace=default&name=edge1
+func (s *ApiServer) onPushPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+	if _, ok := s.authorize(w, r); !ok {
+		return
+	}
+
+	ns := r.URL.Query().Get("namespace")
+	if len(ns) == 0 {
+		ns = "default"
+	}
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "edge name required"})
+		return
+	}
+
+	err := s.registry.PushPeers(ns, name)
+	if err != nil {
+		log.Error("push peers to %s fail: %v", name, err)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
+
+// onEdges adds or modifies edge in body by PUT and deletes edge
+// of name by DELETE, changes are audited with the operator
+// of the bearer token
+// eg: DELETE /api/v1/edges?namespace=default&name=edge1
+func (s *ApiServer) onEdges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+	operator, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+
+	ns := r.URL.Query().Get("namespace")
+	if len(ns) == 0 {
+		ns = "default"
+	}
+	edges := s.registry.edgeManager
+	src := adminSource(r, operator)
+
+	if r.Method == http.MethodDelete {
+		name := r.URL.Query().Get("name")
+		if len(name) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "edge name required"})
+			return
+		}
+		s.registry.audit.attribute(ns, name, src)
+		edges.DelEdge(ns, name)
+		writeJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	edg := codec.Edge{}
+	if err := json.NewDecoder(r.Body).Decode(&edg); err != nil || len(edg.Name) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid edge"})
+		return
+	}
+	s.registry.audit.attribute(ns, edg.Name, src)
+	if err := edges.AddEdge(ns, &edg); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
+
+// onReadyz returns 503 while etcd is unreachable,
+// watches miss updates of edges and routes meanwhile
+func (s *ApiServer) onReadyz(w http.ResponseWriter, r *http.Request) {
+	h := s.registry.etcd
+	if h == nil {
+		writeJSON(w, http.StatusOK, map[string]string{"etcd": "unknown"})
+		return
+	}
+
+	healthy, since, err := h.status()
+	if !healthy {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"etcd":  "unreachable",
+			"error": err.Error(),
+			"since": since.Format(time.RFC3339),
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"etcd":  "ok",
+		"since": since.Format(time.RFC3339),
+	})
+}
+
+// writable rejects writes to a read-only replica
+func (s *ApiServer) writable(w http.ResponseWriter) bool {
+	if s.registry.readOnly {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": errReadOnly.Error()})
+		return false
+	}
+	return true
+}
+
+// authorize returns the operator of the bearer token of r,
+// rejects requests without a configured token by 401
+func (s *ApiServer) authorize(w http.ResponseWriter, r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for name, t := range s.tokens {
+			if len(t) > 0 && subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+				return name, true
+			}
+		}
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	return "", false
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(obj)
+	if err != nil {
+		log.Error("write json fail: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// changes of this controller not seen by the edge watch
+// within auditPending are attributed to the writer in etcd
+var auditPending = time.Second * 30
+
+// audit actions of edges
+const (
+	auditAdd    = "add"
+	auditModify = "modify"
+	auditDelete = "delete"
+)
+
+// AuditSource is who changed an edge
+type AuditSource struct {
+	// admin:<operator>, edge:<name>, or etcd
+	// for writers other than this controller, eg: cfctl
+	Identity   string `json:"identity"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// AuditRecord is an edge change in the audit log, one json per line
+type AuditRecord struct {
+	Time      time.Time   `json:"time"`
+	Action    string      `json:"action"`
+	Namespace string      `json:"namespace"`
+	Edge      string      `json:"edge"`
+	Source    AuditSource `json:"source"`
+	Before    *codec.Edge `json:"before,omitempty"`
+	After     *codec.Edge `json:"after,omitempty"`
+}
+
+// auditLog records every edge change seen by the edge watch,
+// changes written by this controller carry their source
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	// sources of changes written by this controller
+	// key: namespace/edge name
+	pending map[string]*pendingSource
+}
+
+type pendingSource struct {
+	src AuditSource
+	at  time.Time
+}
+
+func newAuditLog(w io.Writer) *auditLog {
+	return &auditLog{
+		w:       w,
+		pending: make(map[string]*pendingSource),
+	}
+}
+
+// openAuditLog opens audit log file of path for append
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return newAuditLog(f), nil
+}
+
+// SetAuditLog records edge changes to audit, disabled if nil
+func (s *RegistryServer) SetAuditLog(audit *auditLog) {
+	s.audit = audit
+}
+
+// attribute marks the next change of edge name to src,
+// called before this controller writes the edge
+func (a *auditLog) attribute(namespace, name string, src AuditSource) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending[namespace+"/"+name] = &pendingSource{src: src, at: time.Now()}
+}
+
+// source takes the source of the change of edge name
+func (a *auditLog) source(namespace, name string, now time.Time) AuditSource {
+	key := namespace + "/" + name
+	p := a.pending[key]
+	delete(a.pending, key)
+	for k, p := range a.pending {
+		if now.Sub(p.at) > auditPending {
+			delete(a.pending, k)
+		}
+	}
+	if p == nil || now.Sub(p.at) > auditPending {
+		return AuditSource{Identity: "etcd"}
+	}
+	return p.src
+}
+
+// record writes change of edge from before to after,
+// before is nil for new edges and after nil for deleted
+func (a *auditLog) record(namespace string, before, after *codec.Edge) {
+	if a == nil {
+		return
+	}
+	rec := &AuditRecord{
+		Time:      time.Now(),
+		Namespace: namespace,
+		Before:    before,
+		After:     after,
+	}
+	switch {
+	case after == nil:
+		rec.Action, rec.Edge = auditDelete, before.Name
+	case before == nil:
+		rec.Action, rec.Edge = auditAdd, after.Name
+	default:
+		rec.Action, rec.Edge = auditModify, after.Name
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rec.Source = a.source(namespace, rec.Edge, rec.Time)
+	b, _ := json.Marshal(rec)
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		log.Error("write audit log fail: %v", err)
+	}
+}
+
+// auditEdge records edge put or deleted as seen by the edge watch,
+// called before the topology is updated which holds the previous edge
+func (s *RegistryServer) auditEdge(namespace string, edg *codec.Edge, deleted bool) {
+	if s.audit == nil {
+		return
+	}
+	before := s.topo.get(namespace, edg.Name)
+	if deleted {
+		if before == nil {
+			before = edg
+		}
+		s.audit.record(namespace, before, nil)
+		return
+	}
+	after := *edg
+	s.audit.record(namespace, before, &after)
+}
+
+// adminSource identifies api request r by operator,
+// authorized by the bearer token of r
+func adminSource(r *http.Request, operator string) AuditSource {
+	return AuditSource{Identity: "admin:" + operator, RemoteAddr: r.RemoteAddr}
+}
+
+// edgeSource identifies edge of name connected from remote
+func edgeSource(name, remote string) AuditSource {
+	return AuditSource{Identity: "edge:" + name, RemoteAddr: remote}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/controller/models"
+	"github.com/ICKelin/cframe/pkg/storage"
+)
+
+func TestAuditEdge(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := NewRegistryServer("", nil, nil, nil)
+	r.SetAuditLog(newAuditLog(buf))
+
+	// watch event of a change made through the api
+	req := httptest.NewRequest("PUT", "/api/v1/edges", nil)
+	req.RemoteAddr = "10.0.0.9:40000"
+	added := &codec.Edge{Name: "edge1", ListenAddr: "1.1.1.1:58423", Cidr: "10.0.1.0/24"}
+	r.audit.attribute("default", "edge1", adminSource(req, "alice"))
+	r.auditEdge("default", added, false)
+	r.ModifyEdge("default", added)
+
+	// changed in etcd by another writer
+	modified := &codec.Edge{Name: "edge1", ListenAddr: "1.1.1.1:58423", Cidr: "10.0.2.0/24"}
+	r.auditEdge("default", modified, false)
+	r.ModifyEdge("default", modified)
+
+	r.audit.attribute("default", "edge1", edgeSource("edge1", "1.1.1.1:40000"))
+	r.auditEdge("default", &codec.Edge{Name: "edge1"}, true)
+	r.DelEdge("default", modified)
+
+	records := make([]*AuditRecord, 0)
+	sc := bufio.NewScanner(buf)
+	for sc.Scan() {
+		rec := &AuditRecord{}
+		if err := json.Unmarshal(sc.Bytes(), rec); err != nil {
+			t.Fatalf("invalid audit record %s: %v", sc.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 audit records, got %d", len(records))
+	}
+
+	add := records[0]
+	if add.Action != auditAdd || add.Namespace != "default" || add.Edge != "edge1" ||
+		add.Before != nil || add.After == nil || add.After.Cidr != "10.0.1.0/24" || add.Time.IsZero() {
+		t.Fatalf("unexpected add record %+v", add)
+	}
+	if add.Source.RemoteAddr != "10.0.0.9:40000" || add.Source.Identity != "admin:alice" {
+		t.Fatalf("unexpected source of add %+v", add.Source)
+	}
+
+	mod := records[1]
+	if mod.Action != auditModify || mod.Before == nil || mod.Before.Cidr != "10.0.1.0/24" ||
+		mod.After == nil || mod.After.Cidr != "10.0.2.0/24" || mod.Source.Identity != "etcd" {
+		t.Fatalf("unexpected modify record %+v", mod)
+	}
+
+	del := records[2]
+	if del.Action != auditDelete || del.After != nil || del.Before == nil || del.Before.Cidr != "10.0.2.0/24" ||
+		del.Source.Identity != "edge:edge1" || del.Source.RemoteAddr != "1.1.1.1:40000" {
+		t.Fatalf("unexpected delete record %+v", del)
+	}
+}
+
+func TestApiEdgesAuth(t *testing.T) {
+	store := storage.NewMemory()
+	r := NewRegistryServer("", models.NewEdgeManager(store), models.NewRouteManager(store), nil)
+	api := NewApiServer("", r)
+	api.SetTokens(map[string]string{"alice": "secret-token"})
+
+	put := func(auth string) int {
+		body := `{"name":"edge1","listen_addr":"1.1.1.1:58423","cidr":"10.0.1.0/24"}`
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/edges", strings.NewReader(body))
+		if len(auth) > 0 {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		api.mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// writes without a configured token are refused
+	for _, auth := range []string{"", "Bearer", "Bearer other-token", "secret-token"} {
+		if code := put(auth); code != http.StatusUnauthorized {
+			t.Fatalf("expected %q unauthorized, got %d", auth, code)
+		}
+	}
+	if r.edgeManager.GetEdge("default", "edge1") != nil {
+		t.Fatalf("edge written by unauthorized request")
+	}
+
+	if code := put("Bearer secret-token"); code != http.StatusOK {
+		t.Fatalf("expected authorized write, got %d", code)
+	}
+}
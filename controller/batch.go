@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// peerBatch collects edge online/offline changes of a namespace
+// for window and pushes them as one peer delta, instead of a
+// message per change. a later change of the same peer replaces
+// the pending one
+type peerBatch struct {
+	mu      sync.Mutex
+	window  time.Duration
+	pending map[string]*pendingDelta
+}
+
+type pendingDelta struct {
+	add map[string]*codec.Edge
+	del map[string]*codec.Edge
+}
+
+// SetPeerBatch batches peer changes pushed to edges for window,
+// edges not supporting peer delta receive them one by one.
+// 0 pushes every change at once
+func (s *RegistryServer) SetPeerBatch(window time.Duration) {
+	if window <= 0 {
+		s.batch = nil
+		return
+	}
+	s.batch = &peerBatch{
+		window:  window,
+		pending: make(map[string]*pendingDelta),
+	}
+}
+
+// batchPeer queues edge added or deleted of namespace, the
+// first change of a batch schedules its flush
+func (s *RegistryServer) batchPeer(namespace string, edge *codec.Edge, deleted bool) {
+	b := s.batch
+	key := edge.ListenAddr + "/" + edge.Cidr
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d := b.pending[namespace]
+	if d == nil {
+		d = &pendingDelta{
+			add: make(map[string]*codec.Edge),
+			del: make(map[string]*codec.Edge),
+		}
+		b.pending[namespace] = d
+		time.AfterFunc(b.window, func() { s.flushPeers(namespace) })
+	}
+	if deleted {
+		delete(d.add, key)
+		d.del[key] = edge
+	} else {
+		delete(d.del, key)
+		d.add[key] = edge
+	}
+}
+
+// flushPeers pushes pending changes of namespace to its edges,
+// changes of an edge itself are not sent to it
+func (s *RegistryServer) flushPeers(namespace string) {
+	b := s.batch
+	b.mu.Lock()
+	d := b.pending[namespace]
+	delete(b.pending, namespace)
+	b.mu.Unlock()
+	if d == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, sess := range s.sess[namespace] {
+		msg := &codec.PeerDeltaMsg{}
+		for _, edge := range d.add {
+			if edge.ListenAddr != addr {
+				msg.Add = append(msg.Add, peerOf(edge))
+			}
+		}
+		for _, edge := range d.del {
+			if edge.ListenAddr != addr {
+				msg.Del = append(msg.Del, peerOf(edge))
+			}
+		}
+		if len(msg.Add)+len(msg.Del) == 0 {
+			continue
+		}
+
+		if !sess.peerDelta {
+			for _, edge := range msg.Add {
+				go s.online(sess.conn, edge)
+			}
+			for _, edge := range msg.Del {
+				go s.offline(sess.conn, edge)
+			}
+			continue
+		}
+		go s.pushDelta(sess.conn, sess.compress, msg)
+	}
+}
+
+func (s *RegistryServer) pushDelta(conn net.Conn, compress string, msg *codec.PeerDeltaMsg) {
+	log.Info("send peer delta of %d added %d deleted to %s",
+		len(msg.Add), len(msg.Del), conn.RemoteAddr())
+
+	conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	err := writeEdge(conn, compress, codec.CmdPeerDelta, msg)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		log.Error("write json fail: %v", err)
+		return
+	}
+	peerDeltas.Inc()
+}
+
+// peerOf returns the fields of edge pushed to its peers
+func peerOf(edge *codec.Edge) *codec.Edge {
+	return &codec.Edge{
+		ListenAddr: edge.ListenAddr,
+		Cidr:       edge.Cidr,
+		Vni:        edge.Vni,
+		Standby:    edge.Standby,
+		Weight:     edge.Weight,
+		Transport:  edge.Transport,
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestPeerBatch(t *testing.T) {
+	r := NewRegistryServer("", nil, nil, nil)
+	r.SetPeerBatch(time.Millisecond * 50)
+	edge1, peer1 := net.Pipe()
+	edge2, peer2 := net.Pipe()
+	defer edge1.Close()
+	defer edge2.Close()
+	r.sess["default"] = map[string]*Session{
+		"1.1.1.1:58423": {edge: &codec.Edge{Name: "edge1", ListenAddr: "1.1.1.1:58423"}, conn: peer1, peerDelta: true},
+		// older edge without peer delta
+		"2.2.2.2:58423": {edge: &codec.Edge{Name: "edge2", ListenAddr: "2.2.2.2:58423"}, conn: peer2},
+	}
+
+	edge3 := &codec.Edge{Name: "edge3", ListenAddr: "3.3.3.3:58423", Cidr: "10.0.3.0/24"}
+	edge4 := &codec.Edge{Name: "edge4", ListenAddr: "4.4.4.4:58423", Cidr: "10.0.4.0/24"}
+	edge5 := &codec.Edge{Name: "edge5", ListenAddr: "5.5.5.5:58423", Cidr: "10.0.5.0/24"}
+	r.broadcastOnline("default", edge3)
+	r.broadcastOnline("default", edge4)
+	r.broadcastOnline("default", edge5)
+	// edge5 offline before pushed
+	r.broadcastOffline("default", edge5)
+	// edge2 itself is not sent to edge2
+	r.broadcastOnline("default", &codec.Edge{Name: "edge2", ListenAddr: "2.2.2.2:58423", Cidr: "10.0.2.0/24"})
+
+	sent := peerDeltas.Value()
+	edge1.SetReadDeadline(time.Now().Add(time.Second))
+	hdr, body, err := codec.Read(edge1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Cmd() != codec.CmdPeerDelta {
+		t.Fatalf("expected peer delta, got cmd %d", hdr.Cmd())
+	}
+	msg := codec.PeerDeltaMsg{}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		t.Fatal(err)
+	}
+	adds := make([]string, 0)
+	for _, p := range msg.Add {
+		adds = append(adds, p.Cidr)
+	}
+	sort.Strings(adds)
+	if len(adds) != 3 || adds[0] != "10.0.2.0/24" || adds[1] != "10.0.3.0/24" || adds[2] != "10.0.4.0/24" {
+		t.Fatalf("unexpected peers added %v", adds)
+	}
+	if len(msg.Del) != 1 || msg.Del[0].Cidr != "10.0.5.0/24" {
+		t.Fatalf("unexpected peers deleted %+v", msg.Del)
+	}
+
+	// one message per change for edge2
+	cmds := make(map[int]int)
+	for i := 0; i < 3; i++ {
+		edge2.SetReadDeadline(time.Now().Add(time.Second))
+		hdr, _, err := codec.Read(edge2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmds[hdr.Cmd()]++
+	}
+	if cmds[codec.CmdAdd] != 2 || cmds[codec.CmdDel] != 1 {
+		t.Fatalf("unexpected messages to edge2 %v", cmds)
+	}
+	edge2.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, _, err := codec.Read(edge2); err == nil {
+		t.Fatalf("own change sent to edge2")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for peerDeltas.Value() == sent && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if peerDeltas.Value() != sent+1 {
+		t.Fatalf("peer delta not counted")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// LoadTLS loads tls config of registry from cert and key files,
+// client certificates signed by clientCA are required if set
+func LoadTLS(cert, key, clientCA string) (*tls.Config, error) {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(clientCA) > 0 {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", clientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// SetTLS serves edges over tls, with client certificates
+// verified the edge name registered must be the certificate's
+func (s *RegistryServer) SetTLS(cfg *tls.Config) {
+	s.tls = cfg
+}
+
+// certIdentities returns edge names of certificate, the
+// common name and dns names of subject alternative names
+func certIdentities(cert *x509.Certificate) []string {
+	ids := make([]string, 0, len(cert.DNSNames)+1)
+	if len(cert.Subject.CommonName) > 0 {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return append(ids, cert.DNSNames...)
+}
+
+// verifyCertIdentity checks edge name claimed by registration
+// on conn is an identity of the client certificate, so an edge
+// can not register as another one. connections without client
+// certificate are not checked
+func verifyCertIdentity(conn net.Conn, name string) error {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+
+	ids := certIdentities(certs[0])
+	for _, id := range ids {
+		if id == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("edge %s does not match certificate identities %v", name, ids)
+}
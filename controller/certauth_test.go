@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// issue signs a certificate of cn and dns names by ca,
+// self signed ca if ca is nil
+func issue(t *testing.T, ca *tls.Certificate, cn string, dns ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dns,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCertIdentity(t *testing.T) {
+	ca := issue(t, nil, "edge ca")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	srvCert := issue(t, &ca, "controller")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistryServer(lis.Addr().String(), nil, nil, nil)
+	r.SetTLS(&tls.Config{
+		Certificates: []tls.Certificate{srvCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	go r.Serve(lis)
+	defer r.Shutdown()
+
+	dial := func(cert tls.Certificate) *tls.Conn {
+		conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// edge2 claims to be edge1
+	fail := registerFailures.Value()
+	conn := dial(issue(t, &ca, "edge2"))
+	defer conn.Close()
+	codec.WriteJSON(conn, codec.CmdRegister, &codec.RegisterReq{Namespace: "default", Name: "edge1"})
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected impersonating edge closed, got %v", err)
+	}
+	if registerFailures.Value() != fail+1 {
+		t.Fatalf("register failure not counted")
+	}
+
+	// identity by common name or dns san
+	for _, cert := range []tls.Certificate{
+		issue(t, &ca, "edge1"),
+		issue(t, &ca, "", "edge3", "edge1"),
+	} {
+		client, server := net.Pipe()
+		sc := tls.Server(server, r.tls)
+		go tls.Client(client, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			ServerName:   "127.0.0.1",
+		}).Handshake()
+		if err := sc.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyCertIdentity(sc, "edge1"); err != nil {
+			t.Fatalf("expected edge1 accepted, got %v", err)
+		}
+		if err := verifyCertIdentity(sc, "edge2"); err == nil {
+			t.Fatalf("expected edge2 rejected by certificate of %v", certIdentities(cert.Leaf))
+		}
+		client.Close()
+		server.Close()
+	}
+
+	// plain connections are not checked
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err := verifyCertIdentity(server, "edge2"); err != nil {
+		t.Fatalf("plain connection checked: %v", err)
+	}
+}
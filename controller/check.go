@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ICKelin/cframe/pkg/etcdstorage"
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/proxyproto"
+)
+
+// checkConfig parses and validates config file of path without
+// starting controller, problems are reported to w.
+// etcd is pinged if pingEtcd is set. returns exit code
+func checkConfig(w io.Writer, path string, pingEtcd bool) int {
+	conf, err := ParseConfig(path)
+	if err != nil {
+		fmt.Fprintf(w, "%s: %v\n", path, err)
+		return 1
+	}
+
+	errs := conf.Validate()
+	if pingEtcd && len(conf.Etcd) > 0 {
+		store := etcdstorage.NewEtcdWithOptions(conf.Etcd, etcdstorage.Options{
+			DialTimeout: time.Duration(conf.EtcdDialTimeout) * time.Second,
+		})
+		if err := store.Ping(); err != nil {
+			errs = append(errs, fmt.Errorf("etcd %s unreachable: %v", strings.Join(conf.Etcd, ","), err))
+		}
+	}
+
+	if len(errs) > 0 {
+		fmt.Fprintf(w, "%s: %d problems\n", path, len(errs))
+		for _, err := range errs {
+			fmt.Fprintf(w, "  %v\n", err)
+		}
+		return 1
+	}
+	fmt.Fprintf(w, "%s: ok\n", path)
+	return 0
+}
+
+// Validate checks values of config, returns all problems found
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+	addr := func(key, val string, required bool) {
+		if len(val) == 0 {
+			if required {
+				errs = append(errs, fmt.Errorf("%s is required", key))
+			}
+			return
+		}
+		if err := checkAddr(val); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %s: %v", key, val, err))
+		}
+	}
+
+	addr("listen_addr", c.ListenAddr, !c.ReadOnly)
+	addr("api_addr", c.ApiAddr, c.ReadOnly)
+	addr("rpc_addr", c.RpcAddr, false)
+
+	if len(c.Etcd) == 0 {
+		errs = append(errs, fmt.Errorf("etcd is required"))
+	}
+	for _, endpoint := range c.Etcd {
+		host := strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://")
+		if err := checkAddr(host); err != nil {
+			errs = append(errs, fmt.Errorf("invalid etcd endpoint %s: %v", endpoint, err))
+		}
+	}
+
+	for _, opt := range []struct {
+		key string
+		val int64
+	}{
+		{"idle_timeout", c.IdleTimeout},
+		{"edge_ttl", c.EdgeTTL},
+		{"etcd_wait", c.EtcdWait},
+		{"etcd_dial_timeout", c.EtcdDialTimeout},
+		{"etcd_keepalive_time", c.EtcdKeepAliveTime},
+		{"etcd_keepalive_timeout", c.EtcdKeepAliveTimeout},
+		{"etcd_health_interval", c.EtcdHealthInterval},
+		{"watch_buffer", int64(c.WatchBuffer)},
+		{"peer_batch_ms", c.PeerBatchMs},
+	} {
+		if opt.val < 0 {
+			errs = append(errs, fmt.Errorf("invalid %s %d", opt.key, opt.val))
+		}
+	}
+
+	if len(c.IpamPool) > 0 {
+		_, pool, err := net.ParseCIDR(c.IpamPool)
+		if err != nil || pool.IP.To4() == nil {
+			errs = append(errs, fmt.Errorf("invalid ipam_pool %s", c.IpamPool))
+		} else if ones, _ := pool.Mask.Size(); c.IpamPrefix != 0 && (c.IpamPrefix < ones || c.IpamPrefix > 30) {
+			errs = append(errs, fmt.Errorf("invalid ipam_prefix %d of pool %s", c.IpamPrefix, c.IpamPool))
+		}
+	}
+
+	tokens := make(map[string]string)
+	for name, token := range c.ApiTokens {
+		if len(token) == 0 {
+			errs = append(errs, fmt.Errorf("empty api token of %s", name))
+			continue
+		}
+		if other, ok := tokens[token]; ok {
+			errs = append(errs, fmt.Errorf("api token of %s reused by %s", other, name))
+		}
+		tokens[token] = name
+	}
+
+	if len(c.AuditLog) > 0 {
+		dir := filepath.Dir(c.AuditLog)
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("audit log directory %s not found", dir))
+		}
+	}
+	if _, err := proxyproto.ParseTrusted(c.ProxyTrusted); err != nil {
+		errs = append(errs, err)
+	}
+	if c.ProxyProtocol && len(c.ProxyTrusted) == 0 {
+		errs = append(errs, fmt.Errorf("proxy_trusted is required by proxy_protocol"))
+	}
+	if (len(c.TLSCert) > 0) != (len(c.TLSKey) > 0) {
+		errs = append(errs, fmt.Errorf("tls_cert and tls_key are required together"))
+	}
+	if len(c.TLSClientCA) > 0 && len(c.TLSCert) == 0 {
+		errs = append(errs, fmt.Errorf("tls_client_ca requires tls_cert"))
+	}
+	for _, f := range []struct{ key, path string }{
+		{"tls_cert", c.TLSCert},
+		{"tls_key", c.TLSKey},
+		{"tls_client_ca", c.TLSClientCA},
+	} {
+		if len(f.path) == 0 {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s not found", f.key, f.path))
+		}
+	}
+	if len(c.Log.Level) > 0 && !log.ValidLevel(c.Log.Level) {
+		errs = append(errs, fmt.Errorf("invalid log level %s", c.Log.Level))
+	}
+	if len(c.Log.Path) > 0 && !strings.HasPrefix(c.Log.Path, "syslog") {
+		dir := filepath.Dir(c.Log.Path)
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("log directory %s not found", dir))
+		}
+	}
+	return errs
+}
+
+// checkAddr checks addr is host:port, host may be empty
+func checkAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %s", port)
+	}
+	return nil
+}
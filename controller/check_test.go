@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	good := write("good.toml", `
+listen_addr = ":58422"
+api_addr = "127.0.0.1:58425"
+api_tokens = { alice = "secret-token" }
+etcd = ["127.0.0.1:2379", "http://10.0.0.2:2379"]
+ipam_pool = "10.100.0.0/16"
+ipam_prefix = 24
+[log]
+level = "debug"
+path = "`+filepath.Join(dir, "controller.log")+`"
+`)
+	out := &bytes.Buffer{}
+	if code := checkConfig(out, good, false); code != 0 {
+		t.Fatalf("expected good config pass, got %d: %s", code, out)
+	}
+
+	bad := write("bad.toml", `
+listen_addr = "58422"
+etcd = []
+ipam_pool = "10.100.0.0/33"
+edge_ttl = -1
+read_only = true
+proxy_protocol = true
+[log]
+level = "verbose"
+path = "/nonexistent/dir/controller.log"
+`)
+	out.Reset()
+	if code := checkConfig(out, bad, false); code == 0 {
+		t.Fatalf("expected bad config fail: %s", out)
+	}
+	for _, expect := range []string{
+		"8 problems",
+		"invalid listen_addr 58422",
+		"api_addr is required",
+		"etcd is required",
+		"invalid edge_ttl -1",
+		"invalid ipam_pool 10.100.0.0/33",
+		"proxy_trusted is required by proxy_protocol",
+		"invalid log level verbose",
+		"log directory /nonexistent/dir not found",
+	} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("report missing %q:\n%s", expect, out)
+		}
+	}
+
+	out.Reset()
+	if code := checkConfig(out, write("syntax.toml", "listen_addr = \n"), false); code == 0 {
+		t.Fatalf("expected unparsable config fail: %s", out)
+	}
+}
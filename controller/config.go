@@ -14,7 +14,51 @@ type Config struct {
 	DBName         string   `toml:"dbname"`
 	UserCenterAddr string   `toml:"usercenter_addr"`
 	RpcAddr        string   `toml:"rpc_addr"`
-	Log            Log      `toml:"log"`
+	// http api listen address, disabled if empty
+	ApiAddr string `toml:"api_addr"`
+	// bearer tokens of operators by name, api writes
+	// are refused without one of them
+	ApiTokens map[string]string `toml:"api_tokens"`
+	// close edge connection idle for seconds
+	IdleTimeout int64 `toml:"idle_timeout"`
+	// edge offline once not refreshed by heartbeat
+	// for seconds, 0 disables edge presence
+	EdgeTTL int64 `toml:"edge_ttl"`
+	// wait for etcd at startup for seconds, 0 does not wait
+	EtcdWait int64 `toml:"etcd_wait"`
+	// etcd client timeouts in seconds, 0 takes client defaults
+	EtcdDialTimeout      int64 `toml:"etcd_dial_timeout"`
+	EtcdKeepAliveTime    int64 `toml:"etcd_keepalive_time"`
+	EtcdKeepAliveTimeout int64 `toml:"etcd_keepalive_timeout"`
+	// probe etcd every seconds for readiness, 0 takes 5
+	EtcdHealthInterval int64 `toml:"etcd_health_interval"`
+	// keys pending between etcd watch and callbacks
+	WatchBuffer int `toml:"watch_buffer"`
+	// edges without cidr are allocated a subnet of
+	// prefix ipam_prefix from ipam_pool, disabled if empty
+	IpamPool   string `toml:"ipam_pool"`
+	IpamPrefix int    `toml:"ipam_prefix"`
+	// read-only replica only serves api from etcd,
+	// edges are not accepted
+	ReadOnly bool `toml:"read_only"`
+	// peer changes are pushed to edges in batches
+	// collected for milliseconds, 0 pushes each change
+	PeerBatchMs int64 `toml:"peer_batch_ms"`
+	// edges connect through a load balancer
+	// sending PROXY protocol headers
+	// headers are read only from proxy_trusted,
+	// cidrs or addresses of the load balancers
+	ProxyProtocol bool     `toml:"proxy_protocol"`
+	ProxyTrusted  []string `toml:"proxy_trusted"`
+	// edge changes with their source are appended
+	// to the audit log, disabled if empty
+	AuditLog string `toml:"audit_log"`
+	// edges connect over tls, with client certificates
+	// signed by tls_client_ca required if set
+	TLSCert     string `toml:"tls_cert"`
+	TLSKey      string `toml:"tls_key"`
+	TLSClientCA string `toml:"tls_client_ca"`
+	Log         Log    `toml:"log"`
 }
 
 type Log struct {
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// backoff between etcd probes at startup
+var (
+	minEtcdBackoff = time.Millisecond * 500
+	maxEtcdBackoff = time.Second * 10
+)
+
+// waitEtcd probes etcd until it is available with backoff,
+// gives up after maxWait
+func waitEtcd(ping func() error, maxWait time.Duration) error {
+	deadline := time.Now().Add(maxWait)
+	backoff := minEtcdBackoff
+	for {
+		err := ping()
+		if err == nil {
+			return nil
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			return fmt.Errorf("etcd unavailable after %v: %v", maxWait, err)
+		}
+		if backoff > left {
+			backoff = left
+		}
+		log.Warn("etcd unavailable: %v, retry in %v", err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxEtcdBackoff {
+			backoff = maxEtcdBackoff
+		}
+	}
+}
+
+// default interval of etcd health probes
+const defaultEtcdHealthInterval = time.Second * 5
+
+// delay before watching again once a watch ended
+var rewatchDelay = time.Second
+
+// etcdHealth probes etcd periodically, the controller is not
+// ready while etcd is unreachable as it misses updates
+type etcdHealth struct {
+	ping     func() error
+	interval time.Duration
+
+	// called once etcd is back after a loss
+	onRecover func()
+
+	mu      sync.Mutex
+	healthy bool
+	lastErr error
+	since   time.Time
+}
+
+func newEtcdHealth(ping func() error, interval time.Duration) *etcdHealth {
+	if interval <= 0 {
+		interval = defaultEtcdHealthInterval
+	}
+	etcdUp.Set(1)
+	return &etcdHealth{
+		ping:     ping,
+		interval: interval,
+		healthy:  true,
+		since:    time.Now(),
+	}
+}
+
+func (h *etcdHealth) run() {
+	tick := time.NewTicker(h.interval)
+	defer tick.Stop()
+	for now := range tick.C {
+		h.check(now)
+	}
+}
+
+// check probes etcd once and records the transition
+func (h *etcdHealth) check(now time.Time) {
+	err := h.ping()
+
+	h.mu.Lock()
+	was := h.healthy
+	h.healthy, h.lastErr = err == nil, err
+	if was != h.healthy {
+		h.since = now
+	}
+	h.mu.Unlock()
+
+	switch {
+	case was && err != nil:
+		log.Error("etcd connection lost: %v", err)
+		etcdUp.Set(0)
+	case !was && err == nil:
+		log.Info("etcd connection recovered")
+		etcdUp.Set(1)
+		if h.onRecover != nil {
+			h.onRecover()
+		}
+	}
+}
+
+// status returns whether etcd is reachable,
+// since when it is in that state and the last error
+func (h *etcdHealth) status() (bool, time.Time, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.healthy, h.since, h.lastErr
+}
+
+// keepWatching runs watch again once it returns,
+// eg: watch channel closed by compaction after etcd loss
+func keepWatching(name string, watch func()) {
+	for {
+		watch()
+		log.Warn("%s watch ended, watch again in %v", name, rewatchDelay)
+		time.Sleep(rewatchDelay)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitEtcd(t *testing.T) {
+	minEtcdBackoff, maxEtcdBackoff = time.Millisecond*10, time.Millisecond*40
+	defer func() {
+		minEtcdBackoff, maxEtcdBackoff = time.Millisecond*500, time.Second*10
+	}()
+
+	// etcd up after 200ms
+	up := time.Now().Add(time.Millisecond * 200)
+	probes := int32(0)
+	ping := func() error {
+		atomic.AddInt32(&probes, 1)
+		if time.Now().Before(up) {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	}
+
+	beg := time.Now()
+	if err := waitEtcd(ping, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(beg); elapsed < time.Millisecond*200 || elapsed > time.Second {
+		t.Fatalf("proceeded after %v, expected about 200ms", elapsed)
+	}
+	if n := atomic.LoadInt32(&probes); n < 3 {
+		t.Fatalf("expected retries with backoff, probed %d times", n)
+	}
+
+	// never up
+	beg = time.Now()
+	err := waitEtcd(func() error { return fmt.Errorf("connection refused") }, time.Millisecond*100)
+	if err == nil {
+		t.Fatal("expected error while etcd is down")
+	}
+	if elapsed := time.Since(beg); elapsed > time.Millisecond*300 {
+		t.Fatalf("waited %v beyond max wait", elapsed)
+	}
+}
+
+func TestEtcdHealthReadiness(t *testing.T) {
+	down := int32(0)
+	ping := func() error {
+		if atomic.LoadInt32(&down) == 1 {
+			return fmt.Errorf("context deadline exceeded")
+		}
+		return nil
+	}
+	recovered := 0
+	h := newEtcdHealth(ping, time.Second)
+	h.onRecover = func() { recovered++ }
+	r := NewRegistryServer("", nil, nil, nil)
+	r.SetEtcdHealth(h)
+	api := NewApiServer("", r)
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		api.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+
+	now := time.Now()
+	h.check(now)
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("expected ready, got %d", code)
+	}
+
+	// etcd lost
+	atomic.StoreInt32(&down, 1)
+	h.check(now.Add(time.Second))
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready while etcd is lost, got %d", code)
+	}
+	if etcdUp.Value() != 0 {
+		t.Fatalf("expected etcd up metric 0")
+	}
+	h.check(now.Add(time.Second * 2))
+	if _, since, _ := h.status(); !since.Equal(now.Add(time.Second)) {
+		t.Fatalf("expected lost since first failure, got %v", since)
+	}
+
+	// etcd back
+	atomic.StoreInt32(&down, 0)
+	h.check(now.Add(time.Second * 3))
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("expected ready after recovery, got %d", code)
+	}
+	if recovered != 1 {
+		t.Fatalf("expected recover hook called once, got %d", recovered)
+	}
+}
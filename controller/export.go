@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// exportedRoute is a cidr reachable through the overlay
+// and the edge serving it
+type exportedRoute struct {
+	Cidr       string `json:"cidr"`
+	Edge       string `json:"edge"`
+	ListenAddr string `json:"listen_addr"`
+	Vni        uint32 `json:"vni"`
+	Standby    bool   `json:"standby,omitempty"`
+	// edge, route or static
+	Source string `json:"source"`
+}
+
+// exportRoutes lists cidrs of edges, routes via edges
+// and static routes of edges, sorted by vni and cidr
+func exportRoutes(edges []*codec.Edge, routes []*codec.Route) []*exportedRoute {
+	byAddr := make(map[string]*codec.Edge)
+	byName := make(map[string]*codec.Edge)
+	for _, edge := range edges {
+		byAddr[edge.ListenAddr] = edge
+		byName[edge.Name] = edge
+	}
+
+	out := make([]*exportedRoute, 0, len(edges)+len(routes))
+	for _, edge := range edges {
+		if len(edge.Cidr) > 0 {
+			out = append(out, &exportedRoute{
+				Cidr:       canonicalCidr(edge.Cidr),
+				Edge:       edge.Name,
+				ListenAddr: edge.ListenAddr,
+				Vni:        edge.Vni,
+				Standby:    edge.Standby,
+				Source:     "edge",
+			})
+		}
+		// static routes go via the named peer
+		for _, r := range edge.Routes {
+			e := &exportedRoute{
+				Cidr:   canonicalCidr(r.Cidr),
+				Edge:   r.Peer,
+				Vni:    edge.Vni,
+				Source: "static",
+			}
+			if peer := byName[r.Peer]; peer != nil {
+				e.ListenAddr = peer.ListenAddr
+			}
+			out = append(out, e)
+		}
+	}
+
+	for _, r := range routes {
+		e := &exportedRoute{
+			Cidr:       canonicalCidr(r.CIDR),
+			ListenAddr: r.Nexthop,
+			Vni:        r.Vni,
+			Source:     "route",
+		}
+		if edge := byAddr[r.Nexthop]; edge != nil {
+			e.Edge = edge.Name
+		}
+		out = append(out, e)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Vni != out[j].Vni {
+			return out[i].Vni < out[j].Vni
+		}
+		return out[i].Cidr < out[j].Cidr
+	})
+	return out
+}
+
+// canonicalCidr returns network of cidr, host is taken as /32
+func canonicalCidr(cidr string) string {
+	if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+		return ipnet.String()
+	}
+	if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return cidr
+}
+
+// writeBird writes routes as bird static protocol routes, eg:
+// route 10.0.1.0/24 via 192.168.1.1; # edge1 1.1.1.1:58423
+// via is a gateway ip or an interface name
+func writeBird(w io.Writer, routes []*exportedRoute, via string) {
+	gw := via
+	if net.ParseIP(via) == nil {
+		gw = fmt.Sprintf("%q", via)
+	}
+	for _, r := range routes {
+		fmt.Fprintf(w, "route %s via %s; # %s %s vni %d\n", r.Cidr, gw, r.Edge, r.ListenAddr, r.Vni)
+	}
+}
+
+// writeFRR writes routes as frr static routes, eg:
+// ! edge1 1.1.1.1:58423 vni 0
+// ip route 10.0.1.0/24 192.168.1.1
+func writeFRR(w io.Writer, routes []*exportedRoute, via string) {
+	for _, r := range routes {
+		fmt.Fprintf(w, "! %s %s vni %d\nip route %s %s\n", r.Edge, r.ListenAddr, r.Vni, r.Cidr, via)
+	}
+}
+
+// onExportRoutes lists cidrs reachable through the overlay
+// for routing daemons, eg:
+// GET /api/v1/routes/export?namespace=default
+// GET /api/v1/routes/export?format=bird&via=192.168.1.1
+// GET /api/v1/routes/export?format=frr&via=cframe.0
+func (s *ApiServer) onExportRoutes(w http.ResponseWriter, r *http.Request) {
+	ns := r.URL.Query().Get("namespace")
+	if len(ns) == 0 {
+		ns = "default"
+	}
+	format := r.URL.Query().Get("format")
+	via := r.URL.Query().Get("via")
+	if (format == "bird" || format == "frr") && len(via) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "via required"})
+		return
+	}
+
+	routes := exportRoutes(s.registry.exportEdges(ns), s.registry.exportRouteList(ns))
+	switch format {
+	case "", "json":
+		writeJSON(w, http.StatusOK, routes)
+	case "bird":
+		w.Header().Set("Content-Type", "text/plain")
+		writeBird(w, routes, via)
+	case "frr":
+		w.Header().Set("Content-Type", "text/plain")
+		writeFRR(w, routes, via)
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported format"})
+	}
+}
+
+// exportEdges returns edges of namespace, online edges only
+// if presence is enabled
+func (s *RegistryServer) exportEdges(namespace string) []*codec.Edge {
+	if s.edgeManager == nil {
+		return nil
+	}
+	return s.presentEdges(namespace, s.edgeManager.GetEdges(namespace))
+}
+
+func (s *RegistryServer) exportRouteList(namespace string) []*codec.Route {
+	if s.routeManager == nil {
+		return nil
+	}
+	return s.routeManager.GetRoutes(namespace)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestExportRoutes(t *testing.T) {
+	edges := []*codec.Edge{
+		{Name: "edge2", ListenAddr: "2.2.2.2:58423", Cidr: "10.0.2.1/24"},
+		{Name: "edge1", ListenAddr: "1.1.1.1:58423", Cidr: "10.0.1.0/24",
+			Routes: []*codec.StaticRoute{{Cidr: "172.16.0.0/16", Peer: "edge2"}}},
+		{Name: "edge3", ListenAddr: "3.3.3.3:58423", Cidr: "10.1.0.0/24", Vni: 1},
+	}
+	routes := []*codec.Route{
+		{CIDR: "192.168.10.5", Nexthop: "1.1.1.1:58423"},
+	}
+
+	got := exportRoutes(edges, routes)
+	expected := []exportedRoute{
+		{Cidr: "10.0.1.0/24", Edge: "edge1", ListenAddr: "1.1.1.1:58423", Source: "edge"},
+		{Cidr: "10.0.2.0/24", Edge: "edge2", ListenAddr: "2.2.2.2:58423", Source: "edge"},
+		{Cidr: "172.16.0.0/16", Edge: "edge2", ListenAddr: "2.2.2.2:58423", Source: "static"},
+		{Cidr: "192.168.10.5/32", Edge: "edge1", ListenAddr: "1.1.1.1:58423", Source: "route"},
+		{Cidr: "10.1.0.0/24", Edge: "edge3", ListenAddr: "3.3.3.3:58423", Vni: 1, Source: "edge"},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d routes, got %d", len(expected), len(got))
+	}
+	for i := range expected {
+		if *got[i] != expected[i] {
+			t.Errorf("route %d: expected %+v, got %+v", i, expected[i], *got[i])
+		}
+	}
+
+	// every edge cidr is exported
+	for _, edge := range edges {
+		found := false
+		for _, r := range got {
+			if r.Edge == edge.Name && r.Source == "edge" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("edge %s not exported", edge.Name)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	writeBird(buf, got, "192.168.1.1")
+	if !strings.Contains(buf.String(), "route 10.0.1.0/24 via 192.168.1.1; # edge1") {
+		t.Errorf("unexpected bird output:\n%s", buf)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != len(got) {
+		t.Errorf("expected %d bird routes, got %d", len(got), n)
+	}
+
+	buf.Reset()
+	writeBird(buf, got, "cframe.0")
+	if !strings.Contains(buf.String(), `via "cframe.0";`) {
+		t.Errorf("expected quoted interface, got:\n%s", buf)
+	}
+
+	buf.Reset()
+	writeFRR(buf, got, "cframe.0")
+	if !strings.Contains(buf.String(), "ip route 10.1.0.0/24 cframe.0\n") {
+		t.Errorf("unexpected frr output:\n%s", buf)
+	}
+}
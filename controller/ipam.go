@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/controller/models"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// SetIPAM allocates cidr of edges registered without one,
+// disabled if ipam is nil
+func (s *RegistryServer) SetIPAM(ipam *models.IPAM) {
+	s.ipam = ipam
+}
+
+// allocCidr allocates cidr of curEdge not overlapping cidrs of edges,
+// the edge record is updated so peers learn the new cidr.
+// remote is the address the edge connected from
+func (s *RegistryServer) allocCidr(namespace string, curEdge *codec.Edge, edges []*codec.Edge, remote string) error {
+	taken := make([]string, 0, len(edges))
+	for _, edge := range edges {
+		if edge.Name != curEdge.Name && len(edge.Cidr) > 0 {
+			taken = append(taken, edge.Cidr)
+		}
+	}
+
+	cidr, err := s.ipam.Allocate(namespace, curEdge.Name, taken)
+	if err != nil {
+		log.Error("allocate cidr of edge %s fail: %v", curEdge.Name, err)
+		return err
+	}
+
+	curEdge.Cidr = cidr
+	s.audit.attribute(namespace, curEdge.Name, edgeSource(curEdge.Name, remote))
+	return s.edgeManager.AddEdge(namespace, curEdge)
+}
+
+// releaseCidr reclaims cidr of removed edge
+func (s *RegistryServer) releaseCidr(namespace string, edg *codec.Edge) {
+	if s.ipam != nil {
+		s.ipam.Release(namespace, edg.Name)
+	}
+}
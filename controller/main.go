@@ -3,17 +3,32 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/ICKelin/cframe/codec"
 	"github.com/ICKelin/cframe/controller/models"
 	"github.com/ICKelin/cframe/pkg/etcdstorage"
 	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/version"
 )
 
 func main() {
 	flgConf := flag.String("c", "", "config file path")
+	flgVersion := flag.Bool("version", false, "print version and exit")
+	flgCheck := flag.Bool("check-config", false, "validate config file, print problems and exit non-zero if any")
+	flgCheckEtcd := flag.Bool("check-etcd", false, "with -check-config, also check etcd is reachable")
 	flag.Parse()
 
+	if *flgVersion {
+		fmt.Println(version.Get())
+		return
+	}
+
+	if *flgCheck {
+		os.Exit(checkConfig(os.Stdout, *flgConf, *flgCheckEtcd))
+	}
+
 	conf, err := ParseConfig(*flgConf)
 	if err != nil {
 		fmt.Println(err)
@@ -21,42 +36,158 @@ func main() {
 	}
 
 	log.Init(conf.Log.Path, conf.Log.Level, conf.Log.Days)
+	log.Info("cframe controller %s", version.Get())
 	log.Debug("%v", conf)
 
 	// create etcd storage
-	store := etcdstorage.NewEtcd(conf.Etcd)
+	store := etcdstorage.NewEtcdWithOptions(conf.Etcd, etcdstorage.Options{
+		DialTimeout:      time.Duration(conf.EtcdDialTimeout) * time.Second,
+		KeepAliveTime:    time.Duration(conf.EtcdKeepAliveTime) * time.Second,
+		KeepAliveTimeout: time.Duration(conf.EtcdKeepAliveTimeout) * time.Second,
+	})
+
+	// etcd may start later than controller
+	if conf.EtcdWait > 0 {
+		err = waitEtcd(store.Ping, time.Duration(conf.EtcdWait)*time.Second)
+		if err != nil {
+			log.Error("%v", err)
+			fmt.Println(err)
+			return
+		}
+	}
 
 	// create edge manager
 	edgeManager := models.NewEdgeManager(store)
+	edgeManager.SetWatchBuffer(conf.WatchBuffer)
 
 	// create route manager
 	routeManager := models.NewRouteManager(store)
+	routeManager.SetWatchBuffer(conf.WatchBuffer)
 
 	// create namespace manager
 	namespaceManager := models.NewNamespaceManager(store)
 
 	// registry server for edge
 	r := NewRegistryServer(conf.ListenAddr, edgeManager, routeManager, namespaceManager)
+	r.SetIdleTimeout(time.Duration(conf.IdleTimeout) * time.Second)
+	r.SetEdgeTTL(time.Duration(conf.EdgeTTL) * time.Second)
+	err = r.SetProxyProtocol(conf.ProxyProtocol, conf.ProxyTrusted)
+	if err != nil {
+		log.Error("%v", err)
+		fmt.Println(err)
+		return
+	}
+	// peer changes of a namespace are pushed as one delta
+	r.SetPeerBatch(time.Duration(conf.PeerBatchMs) * time.Millisecond)
+
+	// mutual tls identifies edges by client certificate
+	if len(conf.TLSCert) > 0 {
+		tlsConf, err := LoadTLS(conf.TLSCert, conf.TLSKey, conf.TLSClientCA)
+		if err != nil {
+			log.Error("load tls certificate fail: %v", err)
+			fmt.Println(err)
+			return
+		}
+		r.SetTLS(tlsConf)
+	}
+
+	// read-only replica scales api reads, writes nothing
+	r.SetReadOnly(conf.ReadOnly)
+	if conf.ReadOnly && len(conf.ApiAddr) == 0 {
+		fmt.Println("read_only requires api_addr")
+		return
+	}
+
+	// cidr allocation of edges, eg: 10.100.0.0/16 with prefix 24
+	if len(conf.IpamPool) > 0 && !conf.ReadOnly {
+		ipam, err := models.NewIPAM(store, conf.IpamPool, conf.IpamPrefix)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		r.SetIPAM(ipam)
+	}
+
+	// edge changes are written to a dedicated audit log
+	if len(conf.AuditLog) > 0 {
+		audit, err := openAuditLog(conf.AuditLog)
+		if err != nil {
+			log.Error("open audit log %s fail: %v", conf.AuditLog, err)
+			fmt.Println(err)
+			return
+		}
+		r.SetAuditLog(audit)
+	}
+
+	// edges of topology api, kept updated by edge watch
+	r.LoadTopology()
+
+	// not ready while etcd is lost, topology is reloaded
+	// once it is back as updates may be missed meanwhile
+	etcd := newEtcdHealth(store.Ping, time.Duration(conf.EtcdHealthInterval)*time.Second)
+	etcd.onRecover = r.LoadTopology
+	r.SetEtcdHealth(etcd)
+	go etcd.run()
 
 	// watch for edge delete/put
 	// notify online edge
-	go edgeManager.Watch(
-		func(namespace string, edg *codec.Edge) {
-			r.DelEdge(namespace, edg)
-		},
-		func(namespace string, edg *codec.Edge) {
-			r.ModifyEdge(namespace, edg)
+	go keepWatching("edge", func() {
+		edgeManager.Watch(
+			func(namespace string, edg *codec.Edge) {
+				r.auditEdge(namespace, edg, true)
+				r.DelEdge(namespace, edg)
+			},
+			func(namespace string, edg *codec.Edge) {
+				r.auditEdge(namespace, edg, false)
+				r.ModifyEdge(namespace, edg)
+			})
+	})
+
+	// watch for edge online/expired
+	// notify online edge
+	if conf.EdgeTTL > 0 {
+		go keepWatching("presence", func() {
+			edgeManager.WatchPresence(
+				func(namespace string, edg *codec.Edge) {
+					r.ExpireEdge(namespace, edg)
+				},
+				func(namespace string, edg *codec.Edge) {
+					r.ModifyEdge(namespace, edg)
+				})
 		})
+	}
 
 	// watch for route delete/put
 	// notify online edge
-	go routeManager.Watch(
-		func(namespace string, route *codec.Route) {
-			r.DelRoute(namespace, route)
-		},
-		func(namespace string, route *codec.Route) {
-			r.AddRoute(namespace, route)
-		},
-	)
+	go keepWatching("route", func() {
+		routeManager.Watch(
+			func(namespace string, route *codec.Route) {
+				r.DelRoute(namespace, route)
+			},
+			func(namespace string, route *codec.Route) {
+				r.AddRoute(namespace, route)
+			},
+		)
+	})
+	// http api, disabled if empty
+	if len(conf.ApiAddr) > 0 {
+		api := NewApiServer(conf.ApiAddr, r)
+		api.SetTokens(conf.ApiTokens)
+		if conf.ReadOnly {
+			log.Info("read-only replica")
+			err := api.ListenAndServe()
+			if err != nil {
+				log.Error("api server: %v", err)
+			}
+			return
+		}
+		go func() {
+			err := api.ListenAndServe()
+			if err != nil {
+				log.Error("api server: %v", err)
+			}
+		}()
+	}
+
 	r.ListenAndServe()
 }
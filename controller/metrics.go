@@ -0,0 +1,25 @@
+package main
+
+import "github.com/ICKelin/cframe/pkg/metrics"
+
+// control plane metrics, exported by api server /metrics
+var (
+	registrations = metrics.NewCounter("cframe_controller_registrations_total",
+		"edge registrations accepted")
+	registerFailures = metrics.NewCounter("cframe_controller_register_failures_total",
+		"edge registrations rejected or failed")
+	edgesOnline = metrics.NewGauge("cframe_controller_edges_online",
+		"edges connected to registry")
+	heartbeatsReceived = metrics.NewCounter("cframe_controller_heartbeats_received_total",
+		"heartbeats received from edges")
+	heartbeatsMissed = metrics.NewCounter("cframe_controller_heartbeats_missed_total",
+		"edge connections closed for idle timeout")
+	edgeWatchEvents = metrics.NewCounter("cframe_controller_edge_watch_events_total",
+		"edge put/delete events processed")
+	routeWatchEvents = metrics.NewCounter("cframe_controller_route_watch_events_total",
+		"route put/delete events processed")
+	peerDeltas = metrics.NewCounter("cframe_controller_peer_deltas_total",
+		"batched peer changes pushed to edges")
+	etcdUp = metrics.NewGauge("cframe_controller_etcd_up",
+		"1 if etcd is reachable by health probe, 0 if lost")
+)
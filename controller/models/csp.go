@@ -5,8 +5,8 @@ import (
 	"fmt"
 
 	"github.com/ICKelin/cframe/codec"
-	"github.com/ICKelin/cframe/pkg/etcdstorage"
 	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/storage"
 )
 
 var (
@@ -14,10 +14,10 @@ var (
 )
 
 type CSPManagr struct {
-	storage *etcdstorage.Etcd
+	storage storage.Storage
 }
 
-func NewCSPManager(store *etcdstorage.Etcd) *CSPManagr {
+func NewCSPManager(store storage.Storage) *CSPManagr {
 	return &CSPManagr{
 		storage: store,
 	}
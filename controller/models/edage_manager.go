@@ -1,85 +1,210 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ICKelin/cframe/codec"
-	"github.com/ICKelin/cframe/pkg/etcdstorage"
 	"github.com/ICKelin/cframe/pkg/ip"
 	log "github.com/ICKelin/cframe/pkg/logs"
-	"github.com/coreos/etcd/clientv3"
+	"github.com/ICKelin/cframe/pkg/storage"
 )
 
 var (
 	defaultEdgeManager *EdgeManager
 	edgePrefix         = "/edges/"
+	// online edges, keys expire unless refreshed
+	presencePrefix = "/presence/"
+
+	// resolves host names of listen addresses
+	lookupHost = net.LookupHost
 )
 
 type EdgeManager struct {
-	storage *etcdstorage.Etcd
+	storage     storage.Storage
+	watchBuffer int
+
+	// host names of listen addresses must resolve
+	resolve bool
 }
 
-func NewEdgeManager(store *etcdstorage.Etcd) *EdgeManager {
+func NewEdgeManager(store storage.Storage) *EdgeManager {
 	return &EdgeManager{
 		storage: store,
 	}
 }
 
-func (m *EdgeManager) Watch(delfunc, putfunc func(namespace string, edge *codec.Edge)) {
-	chs := m.storage.Watch(edgePrefix)
-	for c := range chs {
-		for _, evt := range c.Events {
-			log.Info("type: %v", evt.Type)
-			log.Info("new: %v", evt.Kv)
-			log.Info("old: %v", evt.PrevKv)
-			sp := strings.Split(string(evt.Kv.Key), "/")
-
-			if len(sp) < 3 {
-				log.Warn("unsupported key value")
-				continue
-			}
+// SetWatchBuffer sets the number of keys pending between
+// etcd watch and callbacks, updates of one key are coalesced
+func (m *EdgeManager) SetWatchBuffer(size int) {
+	m.watchBuffer = size
+}
 
-			namespace := sp[2]
+// SetResolve rejects edges whose listen address host
+// does not resolve, only the address format is checked by default
+func (m *EdgeManager) SetResolve(resolve bool) {
+	m.resolve = resolve
+}
 
-			switch evt.Type {
-			case clientv3.EventTypeDelete:
-				if delfunc != nil {
-					edge := codec.Edge{}
-					err := json.Unmarshal(evt.PrevKv.Value, &edge)
-					if err != nil {
-						log.Info("json unmarshal fail: %v", err)
-						continue
-					}
+func (m *EdgeManager) Watch(delfunc, putfunc func(namespace string, edge *codec.Edge)) {
+	// store watch is released once the watch ends
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch(m.storage.Watch(ctx, edgePrefix), m.watchBuffer, func(evt *storage.Event) {
+		log.Info("type: %v", evt.Type)
+		log.Info("new: %v", evt.Kv)
+		log.Info("old: %v", evt.PrevKv)
+		sp := strings.Split(string(evt.Kv.Key), "/")
 
-					delfunc(namespace, &edge)
+		if len(sp) < 3 {
+			log.Warn("unsupported key value")
+			return
+		}
+
+		namespace := sp[2]
+		switch evt.Type {
+		case storage.EventTypeDelete:
+			if delfunc != nil {
+				edge := codec.Edge{}
+				err := json.Unmarshal(evt.PrevKv.Value, &edge)
+				if err != nil {
+					log.Info("json unmarshal fail: %v", err)
+					return
 				}
 
-			case clientv3.EventTypePut:
-				if putfunc != nil {
-					edge := codec.Edge{}
-					err := json.Unmarshal(evt.Kv.Value, &edge)
-					if err != nil {
-						log.Info("json unmarshal fail: %v", err)
-						continue
-					}
+				delfunc(namespace, &edge)
+			}
 
-					putfunc(namespace, &edge)
+		case storage.EventTypePut:
+			if putfunc != nil {
+				edge := codec.Edge{}
+				err := json.Unmarshal(evt.Kv.Value, &edge)
+				if err != nil {
+					log.Info("json unmarshal fail: %v", err)
+					return
 				}
+
+				putfunc(namespace, &edge)
 			}
 		}
+	})
+}
+
+// WatchPresence watches online edges, delete event is fired
+// once the edge lease expires without refresh
+func (m *EdgeManager) WatchPresence(delfunc, putfunc func(namespace string, edge *codec.Edge)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch(m.storage.Watch(ctx, presencePrefix), m.watchBuffer, func(evt *storage.Event) {
+		onPresence(evt, delfunc, putfunc)
+	})
+}
+
+func onPresence(evt *storage.Event, delfunc, putfunc func(namespace string, edge *codec.Edge)) {
+	sp := strings.Split(string(evt.Kv.Key), "/")
+	if len(sp) < 4 {
+		log.Warn("unsupported key value")
+		return
+	}
+	namespace := sp[2]
+
+	kv, fn := evt.Kv, putfunc
+	if evt.Type == storage.EventTypeDelete {
+		kv, fn = evt.PrevKv, delfunc
+	} else if evt.PrevKv != nil {
+		// refreshed by reconnect, already online
+		return
+	}
+	if fn == nil || kv == nil {
+		return
+	}
+
+	edge := codec.Edge{}
+	err := json.Unmarshal(kv.Value, &edge)
+	if err != nil {
+		log.Info("json unmarshal fail: %v", err)
+		return
 	}
+	fn(namespace, &edge)
+}
 
+// SetPresence marks edge online for ttl,
+// returns the lease refreshed by KeepPresence
+func (m *EdgeManager) SetPresence(namespace string, edge *codec.Edge, ttl time.Duration) (int64, error) {
+	key := fmt.Sprintf("%s%s/%s", presencePrefix, namespace, edge.Name)
+	return m.storage.SetWithTTL(key, edge, ttl)
 }
 
-func (m *EdgeManager) AddEdge(namespace string, edge *codec.Edge) {
+func (m *EdgeManager) KeepPresence(lease int64) error {
+	return m.storage.KeepAlive(lease)
+}
+
+// PresentEdges returns names of online edges
+func (m *EdgeManager) PresentEdges(namespace string) map[string]bool {
+	key := fmt.Sprintf("%s%s/", presencePrefix, namespace)
+	res, err := m.storage.List(key)
+	if err != nil {
+		log.Error("list %s fail: %v", presencePrefix, err)
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for k := range res {
+		names[k[strings.LastIndex(k, "/")+1:]] = true
+	}
+	return names
+}
+
+func (m *EdgeManager) AddEdge(namespace string, edge *codec.Edge) error {
+	if err := ValidateListenAddr(edge.ListenAddr, m.resolve); err != nil {
+		log.Error("add edge %s fail: %v", edge.Name, err)
+		return err
+	}
+
 	key := fmt.Sprintf("%s%s/%s", edgePrefix, namespace, edge.Name)
 	e := m.storage.Set(key, edge)
 	if e != nil {
 		log.Error("add edge fail: %v", e)
 	}
+	return e
+}
+
+// ValidateListenAddr checks addr is host:port peers are able to dial,
+// host names are resolved if resolve is set
+func ValidateListenAddr(addr string, resolve bool) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen addr %q: %v", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid listen addr %q: invalid port %s", addr, port)
+	}
+	if len(host) == 0 {
+		return fmt.Errorf("invalid listen addr %q: host is required", addr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+			return fmt.Errorf("invalid listen addr %q: %s is not routable", addr, host)
+		}
+		return nil
+	}
+	if !resolve {
+		return nil
+	}
+	ips, err := lookupHost(host)
+	if err != nil {
+		return fmt.Errorf("invalid listen addr %q: %v", addr, err)
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("invalid listen addr %q: %s has no address", addr, host)
+	}
+	return nil
 }
 
 func (m *EdgeManager) DelEdge(namespace, name string) {
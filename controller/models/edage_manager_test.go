@@ -0,0 +1,50 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestValidateListenAddr(t *testing.T) {
+	lookupHost = func(host string) ([]string, error) {
+		if host == "edge1.example.com" {
+			return []string{"1.1.1.1"}, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	defer func() { lookupHost = net.LookupHost }()
+
+	for _, c := range []struct {
+		addr    string
+		resolve bool
+		ok      bool
+	}{
+		{"1.1.1.1:58423", true, true},
+		{"[2001:db8::1]:58423", true, true},
+		{"edge1.example.com:58423", true, true},
+		{"bogus.invalid:58423", false, true},
+		{"bogus.invalid:58423", true, false},
+		{"1.1.1.1", false, false},
+		{":58423", false, false},
+		{"1.1.1.1:0", false, false},
+		{"1.1.1.1:70000", false, false},
+		{"0.0.0.0:58423", false, false},
+		{"224.0.0.1:58423", false, false},
+	} {
+		err := ValidateListenAddr(c.addr, c.resolve)
+		if (err == nil) != c.ok {
+			t.Errorf("validate %s resolve %v: unexpected %v", c.addr, c.resolve, err)
+		}
+	}
+
+	// rejected before storing to etcd
+	m := NewEdgeManager(nil)
+	m.SetResolve(true)
+	err := m.AddEdge("default", &codec.Edge{Name: "edge2", ListenAddr: "bogus.invalid:58423"})
+	if err == nil {
+		t.Fatalf("expected unresolvable edge rejected")
+	}
+}
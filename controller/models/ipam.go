@@ -0,0 +1,133 @@
+package models
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/storage"
+)
+
+// cidrs allocated to edges, key: /ipam/namespace/edge name
+var ipamPrefix = "/ipam/"
+
+// default prefix length of allocated cidr
+const defaultIPAMPrefix = 24
+
+// IPAM allocates cidr of edges from a pool,
+// each edge gets a subnet of prefix length size
+type IPAM struct {
+	storage storage.Storage
+	pool    *net.IPNet
+	size    int
+
+	// allocations of a namespace are serialized
+	mu sync.Mutex
+}
+
+func NewIPAM(store storage.Storage, pool string, size int) (*IPAM, error) {
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil || ipnet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid ipam pool %s", pool)
+	}
+
+	if size == 0 {
+		size = defaultIPAMPrefix
+	}
+	ones, _ := ipnet.Mask.Size()
+	if size < ones || size > 30 {
+		return nil, fmt.Errorf("invalid ipam prefix %d of pool %s", size, pool)
+	}
+
+	return &IPAM{
+		storage: store,
+		pool:    ipnet,
+		size:    size,
+	}, nil
+}
+
+// Allocate returns cidr of edge, allocated once and kept
+// until Release. taken cidrs are never allocated, eg: cidrs of
+// edges configured manually
+func (m *IPAM) Allocate(namespace, name string, taken []string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := fmt.Sprintf("%s%s/", ipamPrefix, namespace)
+	res, err := m.storage.List(key)
+	if err != nil {
+		return "", err
+	}
+
+	used := make([]string, 0, len(res)+len(taken))
+	for k, v := range res {
+		cidr := ""
+		if err := json.Unmarshal([]byte(v), &cidr); err != nil {
+			log.Error("ipam: invalid allocation %s: %v", k, err)
+			continue
+		}
+		if k == key+name {
+			return cidr, nil
+		}
+		used = append(used, cidr)
+	}
+	used = append(used, taken...)
+
+	cidr, err := allocCidr(m.pool, m.size, used)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.storage.Set(key+name, cidr)
+	if err != nil {
+		return "", err
+	}
+	log.Info("ipam: edge %s/%s allocated %s", namespace, name, cidr)
+	return cidr, nil
+}
+
+// Release reclaims cidr of edge
+func (m *IPAM) Release(namespace, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.storage.Del(fmt.Sprintf("%s%s/%s", ipamPrefix, namespace, name))
+	log.Info("ipam: edge %s/%s released", namespace, name)
+}
+
+// allocCidr returns the first subnet of prefix size in pool
+// overlapping none of used
+func allocCidr(pool *net.IPNet, size int, used []string) (string, error) {
+	nets := make([]*net.IPNet, 0, len(used))
+	for _, cidr := range used {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+
+	ones, _ := pool.Mask.Size()
+	base := binary.BigEndian.Uint32(pool.IP.To4())
+	step := uint32(1) << uint(32-size)
+	count := uint64(1) << uint(size-ones)
+	for i := uint64(0); i < count; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+uint32(i)*step)
+		subnet := &net.IPNet{IP: ip, Mask: net.CIDRMask(size, 32)}
+
+		conflict := false
+		for _, n := range nets {
+			if n.Contains(subnet.IP) || subnet.Contains(n.IP) {
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			return subnet.String(), nil
+		}
+	}
+	return "", fmt.Errorf("ipam pool %s exhausted", pool)
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllocCidr(t *testing.T) {
+	_, pool, _ := net.ParseCIDR("10.100.0.0/16")
+
+	// 10.100.0.0/24 configured manually
+	used := []string{"10.100.0.0/24"}
+	a, err := allocCidr(pool, 24, used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used = append(used, a)
+	b, err := allocCidr(pool, 24, used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used = append(used, b)
+
+	if a != "10.100.1.0/24" || b != "10.100.2.0/24" {
+		t.Fatalf("unexpected allocations %s %s", a, b)
+	}
+
+	// range of removed edge a is reclaimed
+	used = []string{"10.100.0.0/24", b}
+	c, err := allocCidr(pool, 24, used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != a {
+		t.Fatalf("expected reclaimed %s, got %s", a, c)
+	}
+
+	// a larger cidr overlapping the pool is skipped
+	c, err = allocCidr(pool, 24, []string{"10.100.0.0/22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != "10.100.4.0/24" {
+		t.Fatalf("expected 10.100.4.0/24, got %s", c)
+	}
+
+	_, small, _ := net.ParseCIDR("10.200.0.0/23")
+	if _, err := allocCidr(small, 24, []string{"10.200.0.0/24", "10.200.1.0/24"}); err == nil {
+		t.Fatal("expected pool exhausted")
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 
-	"github.com/ICKelin/cframe/pkg/etcdstorage"
 	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/storage"
 )
 
 var (
@@ -18,10 +18,10 @@ type Namespace struct {
 }
 
 type NamespaceManager struct {
-	storage *etcdstorage.Etcd
+	storage storage.Storage
 }
 
-func NewNamespaceManager(store *etcdstorage.Etcd) *NamespaceManager {
+func NewNamespaceManager(store storage.Storage) *NamespaceManager {
 	return &NamespaceManager{
 		storage: store,
 	}
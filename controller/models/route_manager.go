@@ -1,14 +1,14 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
 
 	"github.com/ICKelin/cframe/codec"
-	"github.com/ICKelin/cframe/pkg/etcdstorage"
 	log "github.com/ICKelin/cframe/pkg/logs"
-	"github.com/coreos/etcd/clientv3"
+	"github.com/ICKelin/cframe/pkg/storage"
 )
 
 var (
@@ -16,58 +16,64 @@ var (
 )
 
 type RouteManager struct {
-	storage *etcdstorage.Etcd
+	storage     storage.Storage
+	watchBuffer int
 }
 
-func NewRouteManager(store *etcdstorage.Etcd) *RouteManager {
+func NewRouteManager(store storage.Storage) *RouteManager {
 	return &RouteManager{
 		storage: store,
 	}
 }
 
+// SetWatchBuffer sets the number of keys pending between
+// etcd watch and callbacks, updates of one key are coalesced
+func (m *RouteManager) SetWatchBuffer(size int) {
+	m.watchBuffer = size
+}
+
 func (m *RouteManager) Watch(delfunc, putfunc func(namespace string, route *codec.Route)) {
-	chs := m.storage.Watch(routePrefix)
-	for c := range chs {
-		for _, evt := range c.Events {
-			log.Info("type: %v", evt.Type)
-			log.Info("new: %v", evt.Kv)
-			log.Info("old: %v", evt.PrevKv)
-			sp := strings.Split(string(evt.Kv.Key), "/")
-
-			if len(sp) < 3 {
-				log.Warn("unsupported key value")
-				continue
-			}
+	// store watch is released once the watch ends
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch(m.storage.Watch(ctx, routePrefix), m.watchBuffer, func(evt *storage.Event) {
+		log.Info("type: %v", evt.Type)
+		log.Info("new: %v", evt.Kv)
+		log.Info("old: %v", evt.PrevKv)
+		sp := strings.Split(string(evt.Kv.Key), "/")
+
+		if len(sp) < 3 {
+			log.Warn("unsupported key value")
+			return
+		}
 
-			namespace := sp[2]
-			switch evt.Type {
-			case clientv3.EventTypeDelete:
-				if delfunc != nil {
-					route := codec.Route{}
-					err := json.Unmarshal(evt.PrevKv.Value, &route)
-					if err != nil {
-						log.Info("json unmarshal fail: %v", err)
-						continue
-					}
-
-					delfunc(namespace, &route)
+		namespace := sp[2]
+		switch evt.Type {
+		case storage.EventTypeDelete:
+			if delfunc != nil {
+				route := codec.Route{}
+				err := json.Unmarshal(evt.PrevKv.Value, &route)
+				if err != nil {
+					log.Info("json unmarshal fail: %v", err)
+					return
 				}
 
-			case clientv3.EventTypePut:
-				if putfunc != nil {
-					route := codec.Route{}
-					err := json.Unmarshal(evt.Kv.Value, &route)
-					if err != nil {
-						log.Info("json unmarshal fail: %v", err)
-						continue
-					}
+				delfunc(namespace, &route)
+			}
 
-					putfunc(namespace, &route)
+		case storage.EventTypePut:
+			if putfunc != nil {
+				route := codec.Route{}
+				err := json.Unmarshal(evt.Kv.Value, &route)
+				if err != nil {
+					log.Info("json unmarshal fail: %v", err)
+					return
 				}
+
+				putfunc(namespace, &route)
 			}
 		}
-	}
-
+	})
 }
 
 func (m *RouteManager) AddRoute(namespace string, route *codec.Route) error {
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/pkg/storage"
+)
+
+func TestEdgeManagerMemory(t *testing.T) {
+	m := NewEdgeManager(storage.NewMemory())
+
+	events := make(chan string, 16)
+	go m.Watch(
+		func(namespace string, edge *codec.Edge) { events <- "del " + namespace + " " + edge.Name },
+		func(namespace string, edge *codec.Edge) { events <- "put " + namespace + " " + edge.Name },
+	)
+	go m.WatchPresence(
+		func(namespace string, edge *codec.Edge) { events <- "offline " + namespace + " " + edge.Name },
+		func(namespace string, edge *codec.Edge) { events <- "online " + namespace + " " + edge.Name },
+	)
+	// watches registered before writes
+	time.Sleep(time.Millisecond * 50)
+
+	expect := func(evt string) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != evt {
+				t.Fatalf("expected %s, got %s", evt, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not watched", evt)
+		}
+	}
+
+	edge1 := &codec.Edge{Name: "edge1", ListenAddr: "1.1.1.1:58423", Cidr: "10.0.1.0/24"}
+	edge2 := &codec.Edge{Name: "edge2", ListenAddr: "2.2.2.2:58423", Cidr: "10.0.2.0/24"}
+	if err := m.AddEdge("ns", edge1); err != nil {
+		t.Fatal(err)
+	}
+	expect("put ns edge1")
+	m.AddEdge("ns", edge2)
+	expect("put ns edge2")
+	m.AddEdge("other", &codec.Edge{Name: "edge3", ListenAddr: "3.3.3.3:58423"})
+	expect("put other edge3")
+
+	if got := m.GetEdge("ns", "edge1"); got == nil || got.Cidr != edge1.Cidr {
+		t.Fatalf("expected edge1, got %+v", got)
+	}
+	if got := m.GetEdges("ns"); len(got) != 2 {
+		t.Fatalf("expected 2 edges of ns, got %d", len(got))
+	}
+
+	m.DelEdge("ns", "edge1")
+	expect("del ns edge1")
+	if m.GetEdge("ns", "edge1") != nil || len(m.GetEdges("ns")) != 1 {
+		t.Fatalf("deleted edge still listed")
+	}
+
+	// presence refreshed by keepalive, offline once expired
+	lease, err := m.SetPresence("ns", edge2, time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("online ns edge2")
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond * 100)
+		if err := m.KeepPresence(lease); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !m.PresentEdges("ns")["edge2"] {
+		t.Fatalf("edge2 offline while kept alive")
+	}
+	expect("offline ns edge2")
+	if len(m.PresentEdges("ns")) != 0 {
+		t.Fatalf("expired edge still present")
+	}
+	if err := m.KeepPresence(lease); err == nil {
+		t.Fatalf("expected expired lease not renewed")
+	}
+}
+
+func TestRouteManagerMemory(t *testing.T) {
+	store := storage.NewMemory()
+	routes := NewRouteManager(store)
+	namespaces := NewNamespaceManager(store)
+
+	if err := namespaces.AddNamespace(&Namespace{Name: "ns", Secret: "key"}); err != nil {
+		t.Fatal(err)
+	}
+	ns, err := namespaces.GetNamespace("ns")
+	if err != nil || ns.Secret != "key" {
+		t.Fatalf("expected namespace ns, got %+v %v", ns, err)
+	}
+
+	routes.AddRoute("ns", &codec.Route{Name: "r1", CIDR: "192.168.1.0/24", Nexthop: "1.1.1.1:58423"})
+	routes.AddRoute("ns", &codec.Route{Name: "r2", CIDR: "192.168.2.0/24", Nexthop: "1.1.1.1:58423"})
+	if got := routes.GetRoutes("ns"); len(got) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(got))
+	}
+	routes.DelRoute("ns", "r1")
+	if got := routes.GetRoutes("ns"); len(got) != 1 || got[0].Name != "r2" {
+		t.Fatalf("expected route r2 left, got %+v", got)
+	}
+}
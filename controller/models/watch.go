@@ -0,0 +1,128 @@
+package models
+
+import (
+	"sync"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/storage"
+)
+
+// default number of keys pending between etcd watch and callbacks
+const defaultWatchBuffer = 1024
+
+// watchQueue sits between etcd watch and the callbacks,
+// events of the same key are coalesced, see coalesce,
+// and push blocks once size keys are pending
+type watchQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	size    int
+	keys    []string
+	pending map[string][]*storage.Event
+	closed  bool
+}
+
+func newWatchQueue(size int) *watchQueue {
+	if size <= 0 {
+		size = defaultWatchBuffer
+	}
+	q := &watchQueue{
+		size:    size,
+		pending: make(map[string][]*storage.Event),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues evt, coalesced with pending events of the same key
+func (q *watchQueue) push(evt *storage.Event) {
+	key := string(evt.Kv.Key)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if evts, ok := q.pending[key]; ok {
+			q.pending[key] = coalesce(evts, evt)
+			return
+		}
+		if len(q.keys) < q.size {
+			break
+		}
+		q.cond.Wait()
+	}
+
+	q.keys = append(q.keys, key)
+	q.pending[key] = []*storage.Event{evt}
+	q.cond.Broadcast()
+}
+
+// coalesce merges evt into pending events of a key, a pending
+// delete is kept with its PrevKv and followed by the latest put
+// if any, a pending put is replaced by evt
+func coalesce(evts []*storage.Event, evt *storage.Event) []*storage.Event {
+	if evts[0].Type != storage.EventTypeDelete {
+		return []*storage.Event{evt}
+	}
+	if evt.Type == storage.EventTypeDelete {
+		return evts[:1]
+	}
+	return []*storage.Event{evts[0], evt}
+}
+
+// pop returns the oldest pending event,
+// false once the queue is closed and drained
+func (q *watchQueue) pop() (*storage.Event, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.keys) == 0 {
+		if q.closed {
+			return nil, false
+		}
+		q.cond.Wait()
+	}
+
+	// key stays first until its events are delivered
+	key := q.keys[0]
+	evts := q.pending[key]
+	if len(evts) > 1 {
+		q.pending[key] = evts[1:]
+		return evts[0], true
+	}
+	q.keys = q.keys[1:]
+	delete(q.pending, key)
+	q.cond.Broadcast()
+	return evts[0], true
+}
+
+func (q *watchQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// watch reads chs without waiting for handle,
+// so a slow handler never stalls the etcd watch
+func watch(chs <-chan storage.WatchResponse, size int, handle func(evt *storage.Event)) {
+	q := newWatchQueue(size)
+	go func() {
+		defer q.close()
+		for c := range chs {
+			if err := c.Err; err != nil {
+				log.Error("watch fail: %v", err)
+			}
+			for _, evt := range c.Events {
+				q.push(evt)
+			}
+		}
+		log.Warn("watch channel closed")
+	}()
+
+	for {
+		evt, ok := q.pop()
+		if !ok {
+			return
+		}
+		handle(evt)
+	}
+}
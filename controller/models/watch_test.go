@@ -0,0 +1,161 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/pkg/storage"
+)
+
+func putEvent(key, val string) *storage.Event {
+	return &storage.Event{
+		Type: storage.EventTypePut,
+		Kv:   &storage.KeyValue{Key: []byte(key), Value: []byte(val)},
+	}
+}
+
+func TestWatchCoalesce(t *testing.T) {
+	chs := make(chan storage.WatchResponse)
+	done := make(chan struct{})
+	applied := make(map[string]string)
+	handled := 0
+	go func() {
+		defer close(done)
+		watch(chs, 4, func(evt *storage.Event) {
+			// slow consumer
+			time.Sleep(time.Millisecond)
+			applied[string(evt.Kv.Key)] = string(evt.Kv.Value)
+			handled++
+		})
+	}()
+
+	const count = 10000
+	for i := 0; i < count; i++ {
+		resp := storage.WatchResponse{
+			Events: []*storage.Event{putEvent("/edges/ns/a", fmt.Sprint(i))},
+		}
+		select {
+		case chs <- resp:
+		case <-time.After(time.Second):
+			t.Fatalf("watch blocked by slow consumer at %d", i)
+		}
+	}
+	chs <- storage.WatchResponse{Events: []*storage.Event{putEvent("/edges/ns/b", "b")}}
+	close(chs)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("watch not drained")
+	}
+
+	if applied["/edges/ns/a"] != fmt.Sprint(count-1) {
+		t.Fatalf("expected latest %d applied, got %s", count-1, applied["/edges/ns/a"])
+	}
+	if applied["/edges/ns/b"] != "b" {
+		t.Fatalf("update of other key lost")
+	}
+	if handled >= count {
+		t.Fatalf("updates not coalesced, %d handled", handled)
+	}
+}
+
+func TestWatchQueueBackpressure(t *testing.T) {
+	q := newWatchQueue(2)
+	q.push(putEvent("a", "1"))
+	q.push(putEvent("b", "1"))
+	// same key never blocks
+	q.push(putEvent("a", "2"))
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(putEvent("c", "1"))
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatalf("push of new key not blocked on full queue")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	evt, _ := q.pop()
+	if string(evt.Kv.Key) != "a" || string(evt.Kv.Value) != "2" {
+		t.Fatalf("expected latest a, got %s=%s", evt.Kv.Key, evt.Kv.Value)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatalf("push not resumed after pop")
+	}
+}
+
+func TestWatchQueueDelete(t *testing.T) {
+	deleted := func(key, prev string) *storage.Event {
+		return &storage.Event{
+			Type:   storage.EventTypeDelete,
+			Kv:     &storage.KeyValue{Key: []byte(key)},
+			PrevKv: &storage.KeyValue{Key: []byte(key), Value: []byte(prev)},
+		}
+	}
+
+	// delete then put of a pending key are both delivered in order
+	q := newWatchQueue(4)
+	q.push(putEvent("a", "1"))
+	q.push(deleted("a", "1"))
+	q.push(putEvent("a", "2"))
+	q.push(putEvent("a", "3"))
+	q.push(putEvent("b", "1"))
+
+	expect := []string{"a DELETE 1", "a PUT 3", "b PUT 1"}
+	for _, e := range expect {
+		evt, _ := q.pop()
+		got := fmt.Sprintf("%s %s %s", evt.Kv.Key, evt.Type, evt.Kv.Value)
+		if evt.Type == storage.EventTypeDelete {
+			if evt.PrevKv == nil {
+				t.Fatalf("PrevKv of delete dropped")
+			}
+			got = fmt.Sprintf("%s %s %s", evt.Kv.Key, evt.Type, evt.PrevKv.Value)
+		}
+		if got != e {
+			t.Fatalf("expected %s, got %s", e, got)
+		}
+	}
+
+	// put between deletes is dropped, the first delete kept
+	q.push(deleted("a", "3"))
+	q.push(putEvent("a", "4"))
+	q.push(deleted("a", "4"))
+	evt, _ := q.pop()
+	if evt.Type != storage.EventTypeDelete || string(evt.PrevKv.Value) != "3" {
+		t.Fatalf("expected first delete kept, got %s %+v", evt.Type, evt.PrevKv)
+	}
+	if len(q.keys) != 0 {
+		t.Fatalf("unexpected pending keys %v", q.keys)
+	}
+}
+
+func TestPresenceExpired(t *testing.T) {
+	online := &storage.KeyValue{Key: []byte("/presence/ns/edge1"), Value: []byte(`{"name":"edge1","listen_addr":"1.1.1.1:58423"}`)}
+	events := make([]string, 0)
+	// online, refreshed by reconnect, lease expired
+	for _, evt := range []*storage.Event{
+		{Type: storage.EventTypePut, Kv: online},
+		{Type: storage.EventTypePut, Kv: online, PrevKv: online},
+		{Type: storage.EventTypeDelete, Kv: &storage.KeyValue{Key: online.Key}, PrevKv: online},
+	} {
+		onPresence(evt,
+			func(namespace string, edge *codec.Edge) {
+				events = append(events, "del "+namespace+" "+edge.Name)
+			},
+			func(namespace string, edge *codec.Edge) {
+				events = append(events, "put "+namespace+" "+edge.Name)
+			})
+	}
+
+	if len(events) != 2 || events[0] != "put ns edge1" || events[1] != "del ns edge1" {
+		t.Fatalf("unexpected presence events %v", events)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// SetEdgeTTL enables edge presence, registered edge is online
+// for ttl unless refreshed by heartbeat, 0 disables presence
+// and edges are always pushed as peers
+func (s *RegistryServer) SetEdgeTTL(ttl time.Duration) {
+	if ttl > 0 {
+		s.edgeTTL = ttl
+	}
+}
+
+func (s *RegistryServer) presenceEnabled() bool {
+	return s.edgeTTL > 0 && s.edgeManager != nil
+}
+
+// presentEdges filters out edges not online
+func (s *RegistryServer) presentEdges(namespace string, edges []*codec.Edge) []*codec.Edge {
+	if !s.presenceEnabled() {
+		return edges
+	}
+
+	online := s.edgeManager.PresentEdges(namespace)
+	present := make([]*codec.Edge, 0, len(edges))
+	for _, edge := range edges {
+		if online[edge.Name] {
+			present = append(present, edge)
+		}
+	}
+	return present
+}
+
+// present marks edge online with a new lease
+func (s *RegistryServer) present(namespace string, curEdge *codec.Edge) {
+	if !s.presenceEnabled() {
+		return
+	}
+
+	lease, err := s.edgeManager.SetPresence(namespace, curEdge, s.edgeTTL)
+	if err != nil {
+		log.Error("set edge %s presence fail: %v", curEdge.Name, err)
+		return
+	}
+
+	s.mu.Lock()
+	if sess := s.sess[namespace][curEdge.ListenAddr]; sess != nil {
+		sess.lease = lease
+	}
+	s.mu.Unlock()
+}
+
+// keepPresence refreshes edge lease on heartbeat,
+// lease lost is granted again
+func (s *RegistryServer) keepPresence(namespace string, curEdge *codec.Edge) {
+	if !s.presenceEnabled() {
+		return
+	}
+
+	s.mu.Lock()
+	lease := int64(0)
+	if sess := s.sess[namespace][curEdge.ListenAddr]; sess != nil {
+		lease = sess.lease
+	}
+	s.mu.Unlock()
+
+	if lease != 0 {
+		err := s.edgeManager.KeepPresence(lease)
+		if err == nil {
+			return
+		}
+		log.Warn("refresh edge %s presence fail: %v", curEdge.Name, err)
+	}
+	s.present(namespace, curEdge)
+}
+
+// ExpireEdge is called once presence of edge expired,
+// peers remove the edge unless it is still connected
+func (s *RegistryServer) ExpireEdge(namespace string, edg *codec.Edge) {
+	edgeWatchEvents.Inc()
+	s.mu.Lock()
+	sess := s.sess[namespace][edg.ListenAddr]
+	s.mu.Unlock()
+	if sess != nil {
+		log.Warn("edge %s presence expired while connected", edg.Name)
+		s.present(namespace, sess.edge)
+		return
+	}
+
+	log.Info("edge presence expired: %s %v", namespace, edg)
+	s.broadcastOffline(namespace, edg)
+}
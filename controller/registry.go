@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -8,6 +12,7 @@ import (
 	"github.com/ICKelin/cframe/codec"
 	"github.com/ICKelin/cframe/controller/models"
 	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/proxyproto"
 )
 
 // registry server for edges
@@ -34,31 +39,133 @@ type RegistryServer struct {
 
 	// namespace manager
 	namespaceMgr *models.NamespaceManager
+
+	// edge connection without any message
+	// for idleTimeout will be closed
+	idleTimeout time.Duration
+
+	// registered edges are online for edgeTTL unless
+	// refreshed by heartbeat, see presence.go
+	edgeTTL time.Duration
+
+	// allocates cidr of edges without one, see ipam.go
+	ipam *models.IPAM
+
+	// edges and reported hosts, see topology.go
+	topo *topology
+
+	// read-only replica serves queries from the
+	// etcd synced cache, never accepts edges nor writes
+	readOnly bool
+
+	// edge connections from trusted upstreams begin with PROXY
+	// protocol header, edges are known by the client address in
+	// the header
+	proxyProtocol bool
+	proxyTrusted  []*net.IPNet
+
+	// edges connect over tls if set, see certauth.go
+	tls *tls.Config
+
+	// peer changes pushed in batches if set, see batch.go
+	batch *peerBatch
+
+	// etcd connection health, nil if not probed
+	etcd *etcdHealth
+
+	// edge changes are recorded if set, see audit.go
+	audit *auditLog
+
+	// cancelled once server shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+	lis    net.Listener
 }
 
 type Session struct {
-	edge *codec.Edge
-	conn net.Conn
+	edge    *codec.Edge
+	conn    net.Conn
+	version string
+	// lease of edge presence
+	lease int64
+	// compression of large messages to edge, empty if none
+	compress string
+	// client address of edge, the real one behind load balancer
+	remote string
+	// edge applies batched peer changes
+	peerDelta bool
 }
 
 func NewRegistryServer(addr string,
 	edgeMgr *models.EdgeManager,
 	routeMgr *models.RouteManager,
 	namespaceMgr *models.NamespaceManager) *RegistryServer {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &RegistryServer{
 		addr:         addr,
 		sess:         make(map[string]map[string]*Session),
 		edgeManager:  edgeMgr,
 		routeManager: routeMgr,
 		namespaceMgr: namespaceMgr,
+		idleTimeout:  defaultIdleTimeout,
+		topo:         newTopology(),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+var defaultIdleTimeout = time.Second * 30
+
+func (s *RegistryServer) SetIdleTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		s.idleTimeout = timeout
 	}
 }
 
+// errReadOnly is returned by writes to a read-only replica
+var errReadOnly = fmt.Errorf("read-only replica")
+
+// SetReadOnly makes controller a read-only replica
+func (s *RegistryServer) SetReadOnly(readOnly bool) {
+	s.readOnly = readOnly
+}
+
+// SetProxyProtocol reads PROXY protocol v1/v2 header of edges
+// connecting from trusted, eg: the load balancer, headers of
+// other sources are not read
+func (s *RegistryServer) SetProxyProtocol(enabled bool, trusted []string) error {
+	cidrs, err := proxyproto.ParseTrusted(trusted)
+	if err != nil {
+		return err
+	}
+	s.proxyProtocol = enabled
+	s.proxyTrusted = cidrs
+	return nil
+}
+
+// SetEtcdHealth reports readiness by etcd connection health
+func (s *RegistryServer) SetEtcdHealth(h *etcdHealth) {
+	s.etcd = h
+}
+
 func (s *RegistryServer) ListenAndServe() error {
 	lis, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return err
 	}
+	return s.Serve(lis)
+}
+
+func (s *RegistryServer) Serve(lis net.Listener) error {
+	if s.proxyProtocol {
+		lis = proxyproto.NewListener(lis, s.proxyTrusted)
+	}
+	if s.tls != nil {
+		lis = tls.NewListener(lis, s.tls)
+	}
+	s.mu.Lock()
+	s.lis = lis
+	s.mu.Unlock()
 	defer lis.Close()
 
 	go s.state()
@@ -66,6 +173,11 @@ func (s *RegistryServer) ListenAndServe() error {
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			default:
+			}
 			log.Error("accept: ", err)
 			return err
 		}
@@ -74,16 +186,56 @@ func (s *RegistryServer) ListenAndServe() error {
 	}
 }
 
+// Shutdown stops accepting edges and closes all edge connections
+func (s *RegistryServer) Shutdown() {
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lis != nil {
+		s.lis.Close()
+	}
+}
+
 func (s *RegistryServer) onConn(conn net.Conn) {
 	defer conn.Close()
+
+	if s.readOnly {
+		log.Warn("read-only replica rejects edge %s", conn.RemoteAddr())
+		registerFailures.Inc()
+		return
+	}
+
+	// close connection once server shutdown
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	registered := false
+	defer func() {
+		if !registered {
+			registerFailures.Inc()
+		}
+	}()
+
 	reg := codec.RegisterReq{}
+	conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
 	err := codec.ReadJSON(conn, &reg)
+	conn.SetReadDeadline(time.Time{})
 	if err != nil {
 		log.Error("read json fail: %v", err)
 		return
 	}
 
-	log.Info("edge register %+v", reg)
+	log.Info("edge register %+v from %s", reg, conn.RemoteAddr())
+
+	// edge is identified by its client certificate
+	if err := verifyCertIdentity(conn, reg.Name); err != nil {
+		log.Error("verify certificate of %s fail: %v", conn.RemoteAddr(), err)
+		return
+	}
 
 	// verify namespace
 	nsInfo, err := s.namespaceMgr.GetNamespace(reg.Namespace)
@@ -124,6 +276,14 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 		return
 	}
 
+	if len(curEdge.Cidr) == 0 && s.ipam != nil && !reg.Query {
+		err = s.allocCidr(nsInfo.Name, curEdge, edges, conn.RemoteAddr().String())
+		if err != nil {
+			return
+		}
+	}
+
+	otherEdges = s.presentEdges(nsInfo.Name, otherEdges)
 	log.Info("other edge list: %+v", otherEdges)
 
 	// TODO: get csp info
@@ -140,6 +300,26 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 	}
 	log.Info("will dispatch route list: ", otherRoutes)
 
+	// compress peer sets if edge supports it
+	compress := codec.NegotiateCompress(reg.Compress)
+
+	// query leaves the running edge and its presence untouched
+	if reg.Query {
+		registered = true
+		conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+		err = writeEdge(conn, compress, codec.CmdRegister, &codec.RegisterReply{
+			EdgeList:     otherEdges,
+			Routes:       otherRoutes,
+			StaticRoutes: curEdge.Routes,
+			Cidr:         curEdge.Cidr,
+			Compress:     compress,
+		})
+		if err != nil {
+			log.Error("write json fail: %v", err)
+		}
+		return
+	}
+
 	// store session
 	sessKey := nsInfo.Name
 	s.mu.Lock()
@@ -154,10 +334,20 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 
 	s.sess[sessKey][curEdge.ListenAddr] = &Session{
 		edge: &codec.Edge{
+			Name:       curEdge.Name,
 			ListenAddr: curEdge.ListenAddr,
 			Cidr:       curEdge.Cidr,
+			Vni:        curEdge.Vni,
+			Standby:    curEdge.Standby,
+			Weight:     curEdge.Weight,
+			TunAddr:    curEdge.TunAddr,
+			Transport:  curEdge.Transport,
 		},
-		conn: conn,
+		conn:      conn,
+		version:   reg.Version,
+		compress:  compress,
+		remote:    conn.RemoteAddr().String(),
+		peerDelta: reg.PeerDelta,
 	}
 	s.mu.Unlock()
 	defer func() {
@@ -168,9 +358,12 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 
 	// reply to edge
 	conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
-	err = codec.WriteJSON(conn, codec.CmdRegister, &codec.RegisterReply{
-		EdgeList: otherEdges,
-		Routes:   otherRoutes,
+	err = writeEdge(conn, compress, codec.CmdRegister, &codec.RegisterReply{
+		EdgeList:     otherEdges,
+		Routes:       otherRoutes,
+		StaticRoutes: curEdge.Routes,
+		Cidr:         curEdge.Cidr,
+		Compress:     compress,
 	})
 	conn.SetWriteDeadline(time.Time{})
 	if err != nil {
@@ -178,14 +371,65 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 		return
 	}
 
-	// keepalived
+	registered = true
+	registrations.Inc()
+	edgesOnline.Inc()
+	defer edgesOnline.Dec()
+
+	s.setTunAddr(sessKey, curEdge, reg.TunAddr)
+	s.present(sessKey, curEdge)
+	s.keepalive(ctx, sessKey, conn, curEdge)
+}
+
+// setTunAddr updates tun address reported by edge,
+// the edge record is stored only if the address changed
+func (s *RegistryServer) setTunAddr(namespace string, curEdge *codec.Edge, addr string) {
+	if len(addr) == 0 {
+		return
+	}
+
+	remote := ""
+	s.mu.Lock()
+	if sess := s.sess[namespace][curEdge.ListenAddr]; sess != nil {
+		sess.edge.TunAddr = addr
+		remote = sess.remote
+	}
+	s.mu.Unlock()
+
+	if curEdge.TunAddr == addr {
+		return
+	}
+	log.Info("edge %s tun address %s => %s", curEdge.Name, curEdge.TunAddr, addr)
+	curEdge.TunAddr = addr
+	if s.edgeManager != nil {
+		s.audit.attribute(namespace, curEdge.Name, edgeSource(curEdge.Name, remote))
+		s.edgeManager.AddEdge(namespace, curEdge)
+	}
+}
+
+// keepalive serves messages from registered edge until
+// the connection is idle or broken
+func (s *RegistryServer) keepalive(ctx context.Context, namespace string, conn net.Conn, curEdge *codec.Edge) {
 	fail := 0
 	hb := codec.Heartbeat{}
 	for {
-		conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
 		header, body, err := codec.Read(conn)
 		conn.SetReadDeadline(time.Time{})
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Error("edge %s idle for %v, close connection",
+					curEdge.Name, s.idleTimeout)
+				heartbeatsMissed.Inc()
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
 			log.Error("read fail: %v", err)
 			fail += 1
 			if fail >= 3 {
@@ -198,13 +442,22 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 		switch header.Cmd() {
 		case codec.CmdHeartbeat:
 			log.Debug("heartbeat from client: %s", conn.RemoteAddr().String())
+			heartbeatsReceived.Inc()
+			edgeHb := codec.Heartbeat{}
+			if err := json.Unmarshal(body, &edgeHb); err == nil {
+				s.setTunAddr(namespace, curEdge, edgeHb.TunAddr)
+			}
+			s.keepPresence(namespace, curEdge)
+			conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
 			err = codec.WriteJSON(conn, codec.CmdHeartbeat, &hb)
+			conn.SetWriteDeadline(time.Time{})
 			if err != nil {
 				log.Error("write json fail: %v", err)
 			}
 
 		case codec.CmdReport:
 			log.Debug("receive report from edge: %s %s", curEdge.Name, string(body))
+			s.onReport(namespace, curEdge, body)
 
 		case codec.CmdAlarm:
 			log.Info("receive alarm from edge: %s %s", curEdge.Name, string(body))
@@ -218,6 +471,11 @@ func (s *RegistryServer) onConn(conn net.Conn) {
 }
 
 func (s *RegistryServer) broadcastOnline(namespace string, edge *codec.Edge) {
+	if s.batch != nil {
+		s.batchPeer(namespace, edge, false)
+		return
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for addr, host := range s.sess[namespace] {
@@ -236,6 +494,10 @@ func (s *RegistryServer) online(peer net.Conn, edge *codec.Edge) {
 	obj := &codec.BroadcastOnlineMsg{
 		ListenAddr: edge.ListenAddr,
 		Cidr:       edge.Cidr,
+		Vni:        edge.Vni,
+		Standby:    edge.Standby,
+		Weight:     edge.Weight,
+		Transport:  edge.Transport,
 	}
 
 	peer.SetWriteDeadline(time.Now().Add(time.Second * 10))
@@ -247,6 +509,10 @@ func (s *RegistryServer) online(peer net.Conn, edge *codec.Edge) {
 }
 
 func (s *RegistryServer) broadcastOffline(namespace string, edge *codec.Edge) {
+	if s.batch != nil {
+		s.batchPeer(namespace, edge, true)
+	}
+
 	s.mu.Lock()
 	var conn net.Conn
 	for addr, host := range s.sess[namespace] {
@@ -255,7 +521,9 @@ func (s *RegistryServer) broadcastOffline(namespace string, edge *codec.Edge) {
 			continue
 		}
 
-		go s.offline(host.conn, edge)
+		if s.batch == nil {
+			go s.offline(host.conn, edge)
+		}
 	}
 	s.mu.Unlock()
 
@@ -274,6 +542,9 @@ func (s *RegistryServer) offline(peer net.Conn, edge *codec.Edge) {
 	obj := &codec.BroadcastOfflineMsg{
 		ListenAddr: edge.ListenAddr,
 		Cidr:       edge.Cidr,
+		Vni:        edge.Vni,
+		Standby:    edge.Standby,
+		Weight:     edge.Weight,
 	}
 
 	peer.SetWriteDeadline(time.Now().Add(time.Second * 10))
@@ -304,6 +575,7 @@ func (s *RegistryServer) addRoute(peer net.Conn, r *codec.Route) {
 	obj := &codec.AddRouteMsg{
 		Cidr:    r.CIDR,
 		Nexthop: r.Nexthop,
+		Vni:     r.Vni,
 	}
 
 	peer.SetWriteDeadline(time.Now().Add(time.Second * 10))
@@ -334,6 +606,7 @@ func (s *RegistryServer) delRoute(peer net.Conn, r *codec.Route) {
 	obj := &codec.DelRouteMsg{
 		Cidr:    r.CIDR,
 		Nexthop: r.Nexthop,
+		Vni:     r.Vni,
 	}
 
 	peer.SetWriteDeadline(time.Now().Add(time.Second * 10))
@@ -351,8 +624,8 @@ func (s *RegistryServer) state() {
 		s.mu.Lock()
 		for userId, sesses := range s.sess {
 			for _, sess := range sesses {
-				log.Info("namespace %s edge: %s cidr: %s",
-					userId, sess.edge.ListenAddr, sess.edge.Cidr)
+				log.Info("namespace %s edge: %s cidr: %s version: %s",
+					userId, sess.edge.ListenAddr, sess.edge.Cidr, sess.version)
 			}
 		}
 		s.mu.Unlock()
@@ -360,8 +633,11 @@ func (s *RegistryServer) state() {
 }
 
 func (s *RegistryServer) DelEdge(namespace string, edg *codec.Edge) {
+	edgeWatchEvents.Inc()
 	log.Info("delete edge: %s %v", namespace, edg)
+	s.topo.del(namespace, edg)
 	s.broadcastOffline(namespace, edg)
+	s.releaseCidr(namespace, edg)
 	// force edge connection offline
 	edgSess := s.sess[namespace][edg.ListenAddr]
 	if edgSess != nil {
@@ -371,16 +647,87 @@ func (s *RegistryServer) DelEdge(namespace string, edg *codec.Edge) {
 }
 
 func (s *RegistryServer) ModifyEdge(namespace string, edg *codec.Edge) {
+	edgeWatchEvents.Inc()
 	log.Info("modify edge: %s %v", namespace, edg)
+	s.topo.put(namespace, edg)
 	s.broadcastOnline(namespace, edg)
 }
 
 func (s *RegistryServer) DelRoute(namespace string, route *codec.Route) {
+	routeWatchEvents.Inc()
 	log.Info("del route: %s %v", namespace, route)
 	s.broadcastDelRoute(namespace, route)
 }
 
 func (s *RegistryServer) AddRoute(namespace string, route *codec.Route) {
+	routeWatchEvents.Inc()
 	log.Info("add route: %s %v", namespace, route)
 	s.broadcastAddRoute(namespace, route)
 }
+
+// PushPeers pushes the current peer set to the edge named name,
+// bypassing the etcd watch event flow
+func (s *RegistryServer) PushPeers(namespace, name string) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	edges := s.edgeManager.GetEdges(namespace)
+	peers := make([]*codec.Edge, 0, len(edges))
+	find := false
+	var cur *codec.Edge
+	for i, edge := range edges {
+		if edge.Name == name {
+			find, cur = true, edges[i]
+			continue
+		}
+		peers = append(peers, edges[i])
+	}
+	if !find {
+		return fmt.Errorf("edge %s not in %s namespace", name, namespace)
+	}
+	peers = s.presentEdges(namespace, peers)
+
+	for _, route := range s.routeManager.GetRoutes(namespace) {
+		if route.Nexthop == cur.ListenAddr {
+			continue
+		}
+		peers = append(peers, &codec.Edge{
+			ListenAddr: route.Nexthop,
+			Cidr:       route.CIDR,
+			Vni:        route.Vni,
+		})
+	}
+
+	return s.pushPeers(namespace, name, peers)
+}
+
+func (s *RegistryServer) pushPeers(namespace, name string, peers []*codec.Edge) error {
+	s.mu.Lock()
+	var conn net.Conn
+	compress := ""
+	for _, sess := range s.sess[namespace] {
+		if sess.edge.Name == name {
+			conn, compress = sess.conn, sess.compress
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("edge %s of %s namespace is offline", name, namespace)
+	}
+
+	log.Info("push %d peers to edge %s", len(peers), name)
+	conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	err := writeEdge(conn, compress, codec.CmdSetPeers, &codec.SetPeersMsg{Peers: peers})
+	conn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// writeEdge writes obj to edge, compressed if negotiated
+func writeEdge(conn net.Conn, compress string, cmd int, obj interface{}) error {
+	if compress == codec.CompressDeflate {
+		return codec.WriteJSONCompressed(conn, cmd, obj)
+	}
+	return codec.WriteJSON(conn, cmd, obj)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/controller/models"
+	"github.com/ICKelin/cframe/pkg/storage"
+)
+
+func newTestRegistry(t *testing.T, idleTimeout time.Duration) (*RegistryServer, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRegistryServer(lis.Addr().String(), nil, nil, nil)
+	r.SetIdleTimeout(idleTimeout)
+	go r.Serve(lis)
+	return r, lis.Addr().String()
+}
+
+func TestIdleConnClosed(t *testing.T) {
+	r, addr := newTestRegistry(t, time.Millisecond*100)
+	defer r.Shutdown()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// silent client, never register
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected idle connection closed by server, got %v", err)
+	}
+}
+
+func TestShutdownClosesConn(t *testing.T) {
+	r, addr := newTestRegistry(t, time.Minute)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	time.Sleep(time.Millisecond * 50)
+	r.Shutdown()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected connection closed on shutdown, got %v", err)
+	}
+}
+
+func TestPushPeersToSingleEdge(t *testing.T) {
+	r := NewRegistryServer("", nil, nil, nil)
+	target, targetPeer := net.Pipe()
+	other, otherPeer := net.Pipe()
+	defer target.Close()
+	defer other.Close()
+
+	r.sess["default"] = map[string]*Session{
+		"1.1.1.1:58423": {edge: &codec.Edge{Name: "edge1", ListenAddr: "1.1.1.1:58423"}, conn: targetPeer},
+		"2.2.2.2:58423": {edge: &codec.Edge{Name: "edge2", ListenAddr: "2.2.2.2:58423"}, conn: otherPeer},
+	}
+
+	peers := []*codec.Edge{{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"}}
+	done := make(chan error, 1)
+	go func() { done <- r.pushPeers("default", "edge1", peers) }()
+
+	target.SetReadDeadline(time.Now().Add(time.Second))
+	hdr, body, err := codec.Read(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Cmd() != codec.CmdSetPeers {
+		t.Fatalf("expected set peers cmd, got %d", hdr.Cmd())
+	}
+	msg := codec.SetPeersMsg{}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Peers) != 1 || msg.Peers[0].Cidr != "10.0.2.0/24" {
+		t.Fatalf("unexpected peers %+v", msg.Peers)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// other edge receives nothing
+	other.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, _, err := codec.Read(other); err == nil {
+		t.Fatalf("push reached other edge")
+	}
+
+	if err := r.pushPeers("default", "edge3", peers); err == nil {
+		t.Fatalf("expected push to offline edge fail")
+	}
+}
+
+func TestRegistryMetrics(t *testing.T) {
+	fail := registerFailures.Value()
+	r, addr := newTestRegistry(t, time.Millisecond*100)
+	defer r.Shutdown()
+
+	// silent client never registers
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(time.Second * 2)
+	for registerFailures.Value() == fail && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if registerFailures.Value() != fail+1 {
+		t.Fatalf("register failure not counted")
+	}
+
+	// heartbeat then idle
+	edge, peer := net.Pipe()
+	defer edge.Close()
+	received, missed := heartbeatsReceived.Value(), heartbeatsMissed.Value()
+	done := make(chan struct{})
+	go func() {
+		r.keepalive(context.Background(), "default", peer, &codec.Edge{Name: "edge1"})
+		close(done)
+	}()
+
+	if err := codec.WriteJSON(edge, codec.CmdHeartbeat, &codec.Heartbeat{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := codec.Read(edge); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("idle edge not closed")
+	}
+	if heartbeatsReceived.Value() != received+1 {
+		t.Fatalf("received heartbeat not counted")
+	}
+	if heartbeatsMissed.Value() != missed+1 {
+		t.Fatalf("missed heartbeat not counted")
+	}
+
+	edgeEvents, routeEvents := edgeWatchEvents.Value(), routeWatchEvents.Value()
+	r.ModifyEdge("default", &codec.Edge{Name: "edge1"})
+	r.DelEdge("default", &codec.Edge{Name: "edge1"})
+	r.AddRoute("default", &codec.Route{CIDR: "10.0.0.0/24"})
+	if edgeWatchEvents.Value() != edgeEvents+2 || routeWatchEvents.Value() != routeEvents+1 {
+		t.Fatalf("watch events not counted")
+	}
+}
+
+func TestEdgeTunAddr(t *testing.T) {
+	r := NewRegistryServer("", nil, nil, nil)
+	curEdge := &codec.Edge{Name: "edge1", ListenAddr: "1.1.1.1:58423"}
+	edge, peer := net.Pipe()
+	defer edge.Close()
+	r.sess["default"] = map[string]*Session{
+		curEdge.ListenAddr: {edge: &codec.Edge{Name: "edge1", ListenAddr: curEdge.ListenAddr}, conn: peer},
+	}
+
+	// reported on register
+	r.setTunAddr("default", curEdge, "10.0.1.1/24")
+	if got := r.sess["default"][curEdge.ListenAddr].edge.TunAddr; got != "10.0.1.1/24" {
+		t.Fatalf("expected tun address 10.0.1.1/24, got %s", got)
+	}
+
+	// kept updated by heartbeat
+	go r.keepalive(context.Background(), "default", peer, curEdge)
+	if err := codec.WriteJSON(edge, codec.CmdHeartbeat, &codec.Heartbeat{TunAddr: "10.0.2.1/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := codec.Read(edge); err != nil {
+		t.Fatal(err)
+	}
+
+	r.mu.Lock()
+	got := r.sess["default"][curEdge.ListenAddr].edge.TunAddr
+	r.mu.Unlock()
+	if got != "10.0.2.1/24" || curEdge.TunAddr != "10.0.2.1/24" {
+		t.Fatalf("tun address not updated by heartbeat, got %s %s", got, curEdge.TunAddr)
+	}
+}
+
+func TestExpireEdge(t *testing.T) {
+	r := NewRegistryServer("", nil, nil, nil)
+	r.SetEdgeTTL(time.Second)
+	edge2, peer2 := net.Pipe()
+	defer edge2.Close()
+	r.sess["default"] = map[string]*Session{
+		"2.2.2.2:58423": {edge: &codec.Edge{Name: "edge2", ListenAddr: "2.2.2.2:58423"}, conn: peer2},
+	}
+
+	// crashed edge1 is removed from online edges
+	go r.ExpireEdge("default", &codec.Edge{Name: "edge1", ListenAddr: "1.1.1.1:58423", Cidr: "10.0.1.0/24"})
+	edge2.SetReadDeadline(time.Now().Add(time.Second))
+	hdr, body, err := codec.Read(edge2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := codec.BroadcastOfflineMsg{}
+	json.Unmarshal(body, &msg)
+	if hdr.Cmd() != codec.CmdDel || msg.ListenAddr != "1.1.1.1:58423" {
+		t.Fatalf("expected offline of expired edge, got cmd %d %+v", hdr.Cmd(), msg)
+	}
+
+	// connected edge2 is kept, nothing sent to itself
+	r.ExpireEdge("default", &codec.Edge{Name: "edge2", ListenAddr: "2.2.2.2:58423"})
+	edge2.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, _, err := codec.Read(edge2); err == nil {
+		t.Fatalf("connected edge removed on presence expiry")
+	}
+}
+
+// countConn counts bytes read from the connection
+type countConn struct {
+	net.Conn
+	n int
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n += n
+	return n, err
+}
+
+func TestPushPeersCompressed(t *testing.T) {
+	r := NewRegistryServer("", nil, nil, nil)
+	edge, peer := net.Pipe()
+	defer edge.Close()
+	r.sess["default"] = map[string]*Session{
+		"1.1.1.1:58423": {
+			edge:     &codec.Edge{Name: "edge1", ListenAddr: "1.1.1.1:58423"},
+			conn:     peer,
+			compress: codec.NegotiateCompress([]string{"gzip", codec.CompressDeflate}),
+		},
+	}
+
+	peers := make([]*codec.Edge, 0)
+	for i := 0; i < 500; i++ {
+		peers = append(peers, &codec.Edge{
+			Name:       fmt.Sprintf("edge%d", i),
+			Cidr:       fmt.Sprintf("10.%d.%d.0/24", i/256, i%256),
+			ListenAddr: fmt.Sprintf("192.168.%d.%d:58423", i/256, i%256),
+		})
+	}
+	plain, _ := json.Marshal(&codec.SetPeersMsg{Peers: peers})
+
+	done := make(chan error, 1)
+	go func() { done <- r.pushPeers("default", "edge1", peers) }()
+
+	conn := &countConn{Conn: edge}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	hdr, body, err := codec.Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !hdr.Compressed() || conn.n >= len(plain)/2 {
+		t.Fatalf("peer set of %d bytes sent in %d bytes, compressed %v",
+			len(plain), conn.n, hdr.Compressed())
+	}
+
+	msg := codec.SetPeersMsg{}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg.Peers, peers) {
+		t.Fatalf("decoded peer set mismatch")
+	}
+
+	// small messages and edges not negotiated are sent plain
+	r.sess["default"]["1.1.1.1:58423"].compress = ""
+	go func() { done <- r.pushPeers("default", "edge1", peers[:1]) }()
+	hdr, _, err = codec.Read(edge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if hdr.Compressed() {
+		t.Fatalf("compressed without negotiation")
+	}
+}
+
+func TestProxyProtocolRequired(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistryServer(lis.Addr().String(), nil, nil, nil)
+	r.SetProxyProtocol(true, []string{"127.0.0.1"})
+	go r.Serve(lis)
+	defer r.Shutdown()
+
+	// edge connects directly, not through the load balancer
+	fail := registerFailures.Value()
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	codec.WriteJSON(conn, codec.CmdRegister, &codec.RegisterReq{Namespace: "default", Name: "edge1"})
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected edge without proxy header closed, got %v", err)
+	}
+	if registerFailures.Value() != fail+1 {
+		t.Fatalf("register failure not counted")
+	}
+}
+
+func TestRegisterQuery(t *testing.T) {
+	store := storage.NewMemory()
+	edges := models.NewEdgeManager(store)
+	namespaces := models.NewNamespaceManager(store)
+	namespaces.AddNamespace(&models.Namespace{Name: "default", Secret: "key"})
+	edges.AddEdge("default", &codec.Edge{Name: "edge1", ListenAddr: "1.1.1.1:58423", Cidr: "10.0.1.0/24"})
+	edges.AddEdge("default", &codec.Edge{Name: "edge2", ListenAddr: "2.2.2.2:58423", Cidr: "10.0.2.0/24"})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistryServer(lis.Addr().String(), edges, models.NewRouteManager(store), namespaces)
+	go r.Serve(lis)
+	defer r.Shutdown()
+
+	registered := registrations.Value()
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	codec.WriteJSON(conn, codec.CmdRegister, &codec.RegisterReq{
+		Namespace: "default", SecretKey: "key", Name: "edge1", Query: true,
+	})
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	reply := codec.RegisterReply{}
+	if err := codec.ReadJSON(conn, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.EdgeList) != 1 || reply.EdgeList[0].Name != "edge2" {
+		t.Fatalf("unexpected peers %+v", reply.EdgeList)
+	}
+
+	// closed without a session
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected query connection closed, got %v", err)
+	}
+	r.mu.Lock()
+	n := len(r.sess["default"])
+	r.mu.Unlock()
+	if n != 0 || registrations.Value() != registered {
+		t.Fatalf("query registered as edge")
+	}
+}
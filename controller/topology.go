@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// topology keeps edges synced from etcd and hosts
+// reported by edges in memory for the topology api
+type topology struct {
+	mu sync.RWMutex
+	// key: namespace, edge name
+	edges map[string]map[string]*codec.Edge
+	hosts map[string]map[string]*edgeHosts
+}
+
+type edgeHosts struct {
+	hosts []string
+	at    time.Time
+}
+
+func newTopology() *topology {
+	return &topology{
+		edges: make(map[string]map[string]*codec.Edge),
+		hosts: make(map[string]map[string]*edgeHosts),
+	}
+}
+
+func (t *topology) put(namespace string, edge *codec.Edge) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.edges[namespace] == nil {
+		t.edges[namespace] = make(map[string]*codec.Edge)
+	}
+	e := *edge
+	t.edges[namespace][edge.Name] = &e
+}
+
+// get returns a copy of edge name, nil if unknown
+func (t *topology) get(namespace, name string) *codec.Edge {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	edge := t.edges[namespace][name]
+	if edge == nil {
+		return nil
+	}
+	e := *edge
+	return &e
+}
+
+func (t *topology) del(namespace string, edge *codec.Edge) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.edges[namespace], edge.Name)
+	delete(t.hosts[namespace], edge.Name)
+}
+
+// report replaces hosts of edge by the latest report
+func (t *topology) report(namespace, name string, hosts []string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.hosts[namespace] == nil {
+		t.hosts[namespace] = make(map[string]*edgeHosts)
+	}
+	hs := append([]string(nil), hosts...)
+	sort.Strings(hs)
+	t.hosts[namespace][name] = &edgeHosts{hosts: hs, at: at}
+}
+
+// TopologyEdge is an edge in topology api
+type TopologyEdge struct {
+	Name       string               `json:"name"`
+	Cidr       string               `json:"cidr"`
+	ListenAddr string               `json:"listen_addr"`
+	TunAddr    string               `json:"tun_addr,omitempty"`
+	Vni        uint32               `json:"vni"`
+	Standby    bool                 `json:"standby,omitempty"`
+	Weight     int                  `json:"weight,omitempty"`
+	Routes     []*codec.StaticRoute `json:"routes,omitempty"`
+
+	// connected to this controller, or present if presence enabled
+	Online     bool   `json:"online"`
+	Version    string `json:"version,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// local hosts of the last report
+	Hosts      []string   `json:"hosts"`
+	ReportedAt *time.Time `json:"reported_at,omitempty"`
+}
+
+// Topology is the full view of a namespace
+type Topology struct {
+	Namespace string          `json:"namespace"`
+	Edges     []*TopologyEdge `json:"edges"`
+}
+
+// LoadTopology loads edges of all namespaces from etcd,
+// kept updated by edge watch afterwards
+func (s *RegistryServer) LoadTopology() {
+	if s.namespaceMgr == nil || s.edgeManager == nil {
+		return
+	}
+	for _, ns := range s.namespaceMgr.GetNamespaces() {
+		for _, edge := range s.edgeManager.GetEdges(ns.Name) {
+			s.topo.put(ns.Name, edge)
+		}
+	}
+}
+
+// onReport keeps hosts reported by edge
+func (s *RegistryServer) onReport(namespace string, curEdge *codec.Edge, body []byte) {
+	report := codec.ReportMsg{}
+	err := json.Unmarshal(body, &report)
+	if err != nil {
+		log.Error("invalid report from edge %s: %v", curEdge.Name, err)
+		return
+	}
+	s.topo.report(namespace, curEdge.Name, report.Hosts, time.Now())
+}
+
+// Topology returns edges of namespace with their state
+func (s *RegistryServer) Topology(namespace string) *Topology {
+	var present map[string]bool
+	if s.presenceEnabled() {
+		present = s.edgeManager.PresentEdges(namespace)
+	}
+
+	s.mu.Lock()
+	sessions := make(map[string]*Session)
+	for _, sess := range s.sess[namespace] {
+		sessions[sess.edge.Name] = sess
+	}
+	s.mu.Unlock()
+
+	s.topo.mu.RLock()
+	defer s.topo.mu.RUnlock()
+	topo := &Topology{
+		Namespace: namespace,
+		Edges:     make([]*TopologyEdge, 0, len(s.topo.edges[namespace])),
+	}
+	for name, edge := range s.topo.edges[namespace] {
+		te := &TopologyEdge{
+			Name:       edge.Name,
+			Cidr:       edge.Cidr,
+			ListenAddr: edge.ListenAddr,
+			TunAddr:    edge.TunAddr,
+			Vni:        edge.Vni,
+			Standby:    edge.Standby,
+			Weight:     edge.Weight,
+			Routes:     edge.Routes,
+			Online:     present[name],
+			Hosts:      []string{},
+		}
+		if sess := sessions[name]; sess != nil {
+			te.Online, te.Version, te.RemoteAddr = true, sess.version, sess.remote
+			if len(sess.edge.TunAddr) > 0 {
+				te.TunAddr = sess.edge.TunAddr
+			}
+		}
+		if hs := s.topo.hosts[namespace][name]; hs != nil {
+			at := hs.at
+			te.Hosts, te.ReportedAt = hs.hosts, &at
+		}
+		topo.Edges = append(topo.Edges, te)
+	}
+	sort.Slice(topo.Edges, func(i, j int) bool {
+		return topo.Edges[i].Name < topo.Edges[j].Name
+	})
+	return topo
+}
+
+// onTopology returns all edges of namespace in one document,
+// eg: GET /api/v1/topology?namespace=default
+func (s *ApiServer) onTopology(w http.ResponseWriter, r *http.Request) {
+	ns := r.URL.Query().Get("namespace")
+	if len(ns) == 0 {
+		ns = "default"
+	}
+	writeJSON(w, http.StatusOK, s.registry.Topology(ns))
+}
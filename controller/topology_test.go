@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestTopology(t *testing.T) {
+	r := NewRegistryServer("", nil, nil, nil)
+	edges := []*codec.Edge{
+		{Name: "edge1", ListenAddr: "1.1.1.1:58423", Cidr: "10.0.1.0/24"},
+		{Name: "edge2", ListenAddr: "2.2.2.2:58423", Cidr: "10.0.2.0/24", Vni: 1,
+			Routes: []*codec.StaticRoute{{Cidr: "172.16.0.0/16", Peer: "edge1"}}},
+		{Name: "edge3", ListenAddr: "3.3.3.3:58423", Cidr: "10.0.1.0/24", Standby: true},
+		{Name: "edge4", ListenAddr: "4.4.4.4:58423", Cidr: "10.0.4.0/24"},
+	}
+	for _, edge := range edges {
+		r.ModifyEdge("default", edge)
+	}
+	r.ModifyEdge("other", &codec.Edge{Name: "edge9", ListenAddr: "9.9.9.9:58423"})
+	r.DelEdge("default", edges[3])
+
+	// edge1 online and reporting hosts
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	r.sess["default"] = map[string]*Session{
+		edges[0].ListenAddr: {
+			edge:    &codec.Edge{Name: "edge1", ListenAddr: edges[0].ListenAddr, TunAddr: "10.0.1.1/24"},
+			conn:    peer,
+			version: "v1.2.0",
+			remote:  "203.0.113.7:40000",
+		},
+	}
+	go r.keepalive(context.Background(), "default", peer, edges[0])
+	report := &codec.ReportMsg{Hosts: []string{"10.0.1.20", "10.0.1.10"}}
+	if err := codec.WriteJSON(conn, codec.CmdReport, report); err != nil {
+		t.Fatal(err)
+	}
+	// served in order, report is handled once heartbeat replied
+	if err := codec.WriteJSON(conn, codec.CmdHeartbeat, &codec.Heartbeat{}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := codec.Read(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewApiServer("", r)
+	w := httptest.NewRecorder()
+	api.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/topology?namespace=default", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+
+	topo := Topology{}
+	if err := json.Unmarshal(w.Body.Bytes(), &topo); err != nil {
+		t.Fatal(err)
+	}
+	if topo.Namespace != "default" || len(topo.Edges) != 3 {
+		t.Fatalf("expected 3 edges of default namespace, got %+v", topo)
+	}
+
+	for i, te := range topo.Edges {
+		edge := edges[i]
+		if te.Name != edge.Name || te.Cidr != edge.Cidr || te.ListenAddr != edge.ListenAddr ||
+			te.Vni != edge.Vni || te.Standby != edge.Standby ||
+			!reflect.DeepEqual(te.Routes, edge.Routes) {
+			t.Errorf("edge %s mismatch: %+v", edge.Name, te)
+		}
+	}
+
+	e1, e2 := topo.Edges[0], topo.Edges[1]
+	if !e1.Online || e1.Version != "v1.2.0" || e1.TunAddr != "10.0.1.1/24" || e1.RemoteAddr != "203.0.113.7:40000" {
+		t.Errorf("unexpected state of online edge %+v", e1)
+	}
+	if !reflect.DeepEqual(e1.Hosts, []string{"10.0.1.10", "10.0.1.20"}) || e1.ReportedAt == nil {
+		t.Errorf("unexpected hosts of edge1 %v", e1.Hosts)
+	}
+	if e2.Online || len(e2.Hosts) != 0 || e2.ReportedAt != nil {
+		t.Errorf("unexpected state of offline edge %+v", e2)
+	}
+}
+
+func TestReadOnlyReplica(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistryServer(lis.Addr().String(), nil, nil, nil)
+	r.SetReadOnly(true)
+	go r.Serve(lis)
+	defer r.Shutdown()
+
+	// synced from etcd watch
+	r.ModifyEdge("default", &codec.Edge{Name: "edge1", ListenAddr: "1.1.1.1:58423", Cidr: "10.0.1.0/24"})
+	r.ModifyEdge("default", &codec.Edge{Name: "edge2", ListenAddr: "2.2.2.2:58423", Cidr: "10.0.2.0/24"})
+	r.DelEdge("default", &codec.Edge{Name: "edge2", ListenAddr: "2.2.2.2:58423"})
+
+	api := NewApiServer("", r)
+	w := httptest.NewRecorder()
+	api.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/topology", nil))
+	topo := Topology{}
+	if err := json.Unmarshal(w.Body.Bytes(), &topo); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(topo.Edges) != 1 || topo.Edges[0].Name != "edge1" {
+		t.Fatalf("unexpected topology %d %+v", w.Code, topo)
+	}
+
+	w = httptest.NewRecorder()
+	api.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/edges/push?name=edge1", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected push rejected by replica, got %d", w.Code)
+	}
+	if err := r.PushPeers("default", "edge1"); err != errReadOnly {
+		t.Fatalf("expected read-only error, got %v", err)
+	}
+
+	// edges are not accepted
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	codec.WriteJSON(conn, codec.CmdRegister, &codec.RegisterReq{Namespace: "default", Name: "edge1"})
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("replica replied to edge register")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+	"github.com/ICKelin/cframe/pkg/version"
+)
+
+// admin api of edge, listen on local address
+// eg: 127.0.0.1:58424
+type Admin struct {
+	addr   string
+	server *Server
+	config *Config
+	mux    *http.ServeMux
+}
+
+func NewAdmin(addr string, s *Server) *Admin {
+	a := &Admin{
+		addr:   addr,
+		server: s,
+		mux:    http.NewServeMux(),
+	}
+	a.mux.HandleFunc("/version", a.onVersion)
+	a.mux.HandleFunc("/config", a.onConfig)
+	a.mux.HandleFunc("/tap", a.onTap)
+	a.mux.HandleFunc("/tap/start", a.onTapStart)
+	a.mux.HandleFunc("/tap/stop", a.onTapStop)
+	a.mux.HandleFunc("/maintenance", a.onMaintenance)
+	a.mux.HandleFunc("/healthz", a.onHealthz)
+	a.mux.HandleFunc("/readyz", a.onReadyz)
+	a.mux.HandleFunc("/stats", a.onStats)
+	a.mux.HandleFunc("/peers/failed", a.onFailedPeers)
+	a.mux.HandleFunc("/peers/queues", a.onSendQueues)
+	a.mux.HandleFunc("/routes", a.onRoutes)
+	a.mux.HandleFunc("/routes/rebuild", a.onRebuildRoutes)
+	a.mux.HandleFunc("/upgrade", localOnly(a.onUpgrade))
+	a.mux.Handle("/metrics", metrics.Handler())
+	return a
+}
+
+// SetConfig sets the effective config exported by /config
+func (a *Admin) SetConfig(c *Config) {
+	a.config = c
+}
+
+func (a *Admin) ListenAndServe() error {
+	lis, err := a.server.listenInherited("admin", a.addr)
+	if err != nil {
+		return err
+	}
+	if fc, ok := lis.(fileConn); ok {
+		a.server.addHandoff("admin", fc)
+	}
+	log.Info("admin api listen on %s", a.addr)
+	return http.Serve(lis, a.mux)
+}
+
+func (a *Admin) onVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, version.Get())
+}
+
+func (a *Admin) onConfig(w http.ResponseWriter, r *http.Request) {
+	if a.config == nil {
+		writeJSON(w, http.StatusNotFound, nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.config.Redacted())
+}
+
+// onTap downloads captured packets in pcap format
+func (a *Admin) onTap(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	err := a.server.WriteTap(buf)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Write(buf.Bytes())
+}
+
+// onTapStart starts tap, eg: POST /tap/start?dst=10.0.0.2&file=edge.pcap,
+// file is relative to tap_dir
+func (a *Admin) onTapStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	q := r.URL.Query()
+	file, err := a.server.tapPath(q.Get("file"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	ring, _ := strconv.Atoi(q.Get("ring"))
+	cfg := &TapConfig{
+		Src:  q.Get("src"),
+		Dst:  q.Get("dst"),
+		File: file,
+		Ring: ring,
+	}
+	err = a.server.StartTap(cfg)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, cfg)
+}
+
+func (a *Admin) onTapStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	a.server.StopTap()
+	writeJSON(w, http.StatusOK, nil)
+}
+
+// onStats returns smoothed load per second
+// of all traffic and of each peer
+func (a *Admin) onStats(w http.ResponseWriter, r *http.Request) {
+	global, peers := a.server.Load()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"global":  global,
+		"peers":   peers,
+		"latency": a.server.Latency(),
+	})
+}
+
+// onFailedPeers lists peers whose route install failed
+// with the route command output, eg: RTNETLINK answers: File exists
+func (a *Admin) onFailedPeers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.server.FailedStatus())
+}
+
+// onRoutes returns whether route of each peer is installed
+// in os routing table, with peer state and health
+func (a *Admin) onRoutes(w http.ResponseWriter, r *http.Request) {
+	routes, err := a.server.Routes()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, routes)
+}
+
+// onRebuildRoutes flushes os routes of cframe devices and installs
+// routes of current peers again, eg: POST /routes/rebuild
+func (a *Admin) onRebuildRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	result, err := a.server.RebuildRoutes()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// localOnly rejects requests not from loopback, so an admin api
+// listening on other addresses never exposes h
+func localOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "loopback only"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// onUpgrade hands sockets and tun devices over to the binary
+// on disk and drains, eg: POST /upgrade after replacing the binary
+func (a *Admin) onUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	if err := a.server.Upgrade(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, nil)
+}
+
+// onSendQueues returns backlog and drops of each peer send queue
+func (a *Admin) onSendQueues(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.server.SendQueues())
+}
+
+// onMaintenance returns maintenance mode on GET,
+// eg: POST /maintenance?on=true to stop forwarding
+func (a *Admin) onMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid on"})
+			return
+		}
+		a.server.SetMaintenance(on)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"maintenance": a.server.Maintenance()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(obj)
+	if err != nil {
+		log.Error("write json fail: %v", err)
+	}
+}
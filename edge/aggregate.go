@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// routeAggregator installs summary routes of contiguous cidrs
+// pointing to the same peer instead of one route per cidr
+type routeAggregator struct {
+	mu sync.Mutex
+
+	// dev => peer => cidrs of the peer
+	cidrs map[string]map[string]map[string]struct{}
+
+	// dev => peer => summary routes installed for the peer
+	summary map[string]map[string][]string
+
+	// dev => route => number of peers sharing the route
+	refs map[string]map[string]int
+}
+
+func newRouteAggregator() *routeAggregator {
+	return &routeAggregator{
+		cidrs:   make(map[string]map[string]map[string]struct{}),
+		summary: make(map[string]map[string][]string),
+		refs:    make(map[string]map[string]int),
+	}
+}
+
+// SetAggregate merges contiguous peer cidrs to the same peer
+// into summary routes, must be called before peers are added
+func (s *Server) SetAggregate(aggregate bool) {
+	if aggregate {
+		s.aggregator = newRouteAggregator()
+	} else {
+		s.aggregator = nil
+	}
+}
+
+// installRoute installs route of cidr through peer to dev
+func (s *Server) installRoute(peer, cidr, dev string) error {
+	if s.aggregator == nil {
+		return s.installed.AddRoute(cidr, dev)
+	}
+	return s.aggregator.add(s.installed, peer, cidr, dev)
+}
+
+// uninstallRoute removes route of cidr through peer to dev
+func (s *Server) uninstallRoute(peer, cidr, dev string) error {
+	if s.aggregator == nil {
+		return s.installed.DelRoute(cidr, dev)
+	}
+	return s.aggregator.del(s.installed, peer, cidr, dev)
+}
+
+// canonicalCIDR returns network of cidr, host is given its full prefix
+func canonicalCIDR(cidr string) string {
+	_, ipnet, err := net.ParseCIDR(hostCIDR(cidr))
+	if err == nil {
+		return ipnet.String()
+	}
+	return cidr
+}
+
+func (a *routeAggregator) add(routes RouteManager, peer, cidr, dev string) error {
+	cidr = canonicalCIDR(cidr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cidrs[dev] == nil {
+		a.cidrs[dev] = make(map[string]map[string]struct{})
+	}
+	if a.cidrs[dev][peer] == nil {
+		a.cidrs[dev][peer] = make(map[string]struct{})
+	}
+
+	_, exist := a.cidrs[dev][peer][cidr]
+	a.cidrs[dev][peer][cidr] = struct{}{}
+	err := a.sync(routes, peer, dev)
+	if err != nil && !exist {
+		delete(a.cidrs[dev][peer], cidr)
+		if len(a.cidrs[dev][peer]) == 0 {
+			delete(a.cidrs[dev], peer)
+		}
+	}
+	return err
+}
+
+func (a *routeAggregator) del(routes RouteManager, peer, cidr, dev string) error {
+	cidr = canonicalCIDR(cidr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.cidrs[dev][peer][cidr]; !ok {
+		return nil
+	}
+	delete(a.cidrs[dev][peer], cidr)
+	return a.sync(routes, peer, dev)
+}
+
+// move renames peer old to addr keeping its summary routes
+func (a *routeAggregator) move(old, addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for dev, peers := range a.cidrs {
+		if cidrs, ok := peers[old]; ok {
+			peers[addr] = cidrs
+			delete(peers, old)
+		}
+		if summary, ok := a.summary[dev][old]; ok {
+			a.summary[dev][addr] = summary
+			delete(a.summary[dev], old)
+		}
+	}
+}
+
+// releaseAggregate removes cidr of peers no longer serving it
+// from summary routes, eg: peers replaced or moved away
+func (s *Server) releaseAggregate(vni uint32, cidr string, peers []string) {
+	iface := s.ifaces[vni]
+	if s.aggregator == nil || iface == nil {
+		return
+	}
+	for _, peer := range peers {
+		if err := s.aggregator.del(s.installed, peer, cidr, iface.tun.Name()); err != nil {
+			log.Error("release route %s of %s fail: %v", cidr, peer, err)
+		}
+	}
+}
+
+// addrsExcept returns addresses serving pc but not in except
+func (pc *peerConn) addrsExcept(except ...string) []string {
+	all := []string{pc.addr, pc.standby}
+	for _, p := range pc.paths {
+		all = append(all, p.addr)
+	}
+
+	addrs := make([]string, 0, len(all))
+	seen := make(map[string]bool)
+	for _, a := range except {
+		seen[a] = true
+	}
+	for _, a := range all {
+		if len(a) > 0 && !seen[a] {
+			seen[a] = true
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// sync installs summary routes of peer and removes outdated ones,
+// new routes are added before old ones are removed
+func (a *routeAggregator) sync(routes RouteManager, peer, dev string) error {
+	cidrs := make([]string, 0, len(a.cidrs[dev][peer]))
+	for cidr := range a.cidrs[dev][peer] {
+		cidrs = append(cidrs, cidr)
+	}
+	want := aggregateCIDRs(cidrs)
+
+	if a.summary[dev] == nil {
+		a.summary[dev] = make(map[string][]string)
+		a.refs[dev] = make(map[string]int)
+	}
+	old := a.summary[dev][peer]
+	refs := a.refs[dev]
+
+	added := make([]string, 0)
+	for _, r := range diffCIDRs(want, old) {
+		if refs[r] == 0 {
+			if err := routes.AddRoute(r, dev); err != nil {
+				// roll back routes added in this round
+				for _, r := range added {
+					refs[r]--
+					if refs[r] == 0 {
+						routes.DelRoute(r, dev)
+						delete(refs, r)
+					}
+				}
+				return err
+			}
+		}
+		refs[r]++
+		added = append(added, r)
+	}
+
+	var err error
+	for _, r := range diffCIDRs(old, want) {
+		refs[r]--
+		if refs[r] > 0 {
+			continue
+		}
+		delete(refs, r)
+		if e := routes.DelRoute(r, dev); e != nil {
+			err = e
+		}
+	}
+
+	if len(want) == 0 {
+		delete(a.summary[dev], peer)
+		delete(a.cidrs[dev], peer)
+	} else {
+		a.summary[dev][peer] = want
+	}
+	return err
+}
+
+// diffCIDRs returns cidrs in a but not in b
+func diffCIDRs(a, b []string) []string {
+	in := make(map[string]struct{}, len(b))
+	for _, c := range b {
+		in[c] = struct{}{}
+	}
+	diff := make([]string, 0)
+	for _, c := range a {
+		if _, ok := in[c]; !ok {
+			diff = append(diff, c)
+		}
+	}
+	return diff
+}
+
+type ipv4Block struct {
+	start  uint32
+	prefix int
+}
+
+func (b ipv4Block) size() uint64 {
+	return 1 << uint(32-b.prefix)
+}
+
+func (b ipv4Block) contains(o ipv4Block) bool {
+	return b.prefix <= o.prefix &&
+		uint64(o.start) >= uint64(b.start) &&
+		uint64(o.start)+o.size() <= uint64(b.start)+b.size()
+}
+
+func (b ipv4Block) String() string {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, b.start)
+	return fmt.Sprintf("%s/%d", ip, b.prefix)
+}
+
+// aggregateCIDRs removes contained cidrs and merges adjacent
+// sibling cidrs into their parent, non ipv4 cidrs are kept as is
+func aggregateCIDRs(cidrs []string) []string {
+	blocks := make([]ipv4Block, 0, len(cidrs))
+	result := make([]string, 0)
+	for _, cidr := range cidrs {
+		ip, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			ip = net.ParseIP(cidr)
+			if ip == nil || ip.To4() == nil {
+				result = append(result, cidr)
+				continue
+			}
+			ipnet = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		}
+		if ip.To4() == nil {
+			result = append(result, cidr)
+			continue
+		}
+
+		ones, _ := ipnet.Mask.Size()
+		blocks = append(blocks, ipv4Block{
+			start:  binary.BigEndian.Uint32(ipnet.IP.To4()),
+			prefix: ones,
+		})
+	}
+
+	for merged := true; merged; {
+		merged = false
+		sort.Slice(blocks, func(i, j int) bool {
+			if blocks[i].start != blocks[j].start {
+				return blocks[i].start < blocks[j].start
+			}
+			return blocks[i].prefix < blocks[j].prefix
+		})
+
+		out := make([]ipv4Block, 0, len(blocks))
+		for _, b := range blocks {
+			if len(out) == 0 {
+				out = append(out, b)
+				continue
+			}
+
+			last := out[len(out)-1]
+			if last.contains(b) {
+				merged = true
+				continue
+			}
+
+			// siblings of the same parent
+			if last.prefix == b.prefix && last.prefix > 0 &&
+				uint64(last.start)%(last.size()*2) == 0 &&
+				uint64(last.start)+last.size() == uint64(b.start) {
+				out[len(out)-1] = ipv4Block{start: last.start, prefix: last.prefix - 1}
+				merged = true
+				continue
+			}
+			out = append(out, b)
+		}
+		blocks = out
+	}
+
+	for _, b := range blocks {
+		result = append(result, b.String())
+	}
+	return result
+}
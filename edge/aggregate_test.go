@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestAggregateCIDRs(t *testing.T) {
+	cases := []struct {
+		in, expect []string
+	}{
+		{[]string{"10.0.1.0/26", "10.0.1.64/26", "10.0.1.128/26", "10.0.1.192/26"}, []string{"10.0.1.0/24"}},
+		{[]string{"10.0.1.0/24", "10.0.1.128/25", "10.0.1.1"}, []string{"10.0.1.0/24"}},
+		// not aligned to the same parent
+		{[]string{"10.0.1.64/26", "10.0.1.128/26"}, []string{"10.0.1.128/26", "10.0.1.64/26"}},
+		{[]string{"10.0.1.0/25", "10.0.2.0/25"}, []string{"10.0.1.0/25", "10.0.2.0/25"}},
+	}
+
+	for _, c := range cases {
+		got := aggregateCIDRs(c.in)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Fatalf("%v: expected %v, got %v", c.in, c.expect, got)
+		}
+	}
+}
+
+func TestAggregatePeerRoutes(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.SetAggregate(true)
+
+	subnets := []string{"10.0.1.0/26", "10.0.1.64/26", "10.0.1.128/26", "10.0.1.192/26"}
+	for _, cidr := range subnets {
+		s.AddPeer(&codec.Edge{Cidr: cidr, ListenAddr: "1.1.1.1:58423"})
+	}
+	// different peer is never aggregated
+	s.AddPeer(&codec.Edge{Cidr: "10.0.0.0/24", ListenAddr: "2.2.2.2:58423"})
+
+	installed, _ := routes.ListRoutes("cframe.0")
+	sort.Strings(installed)
+	expect := []string{"10.0.0.0/24", "10.0.1.0/24"}
+	if !reflect.DeepEqual(installed, expect) {
+		t.Fatalf("expected routes %v, got %v", expect, installed)
+	}
+
+	// memory routes are kept per cidr
+	if addr, err := s.route(0, "", "10.0.1.130"); err != nil || addr != "1.1.1.1:58423" {
+		t.Fatalf("expected route to 1.1.1.1:58423, got %s %v", addr, err)
+	}
+	if missing, _ := s.Reconcile(); len(missing) != 0 {
+		t.Fatalf("unexpected missing routes %v", missing)
+	}
+
+	// de-aggregate on removal
+	s.DelPeer(&codec.Edge{Cidr: "10.0.1.64/26", ListenAddr: "1.1.1.1:58423"})
+	installed, _ = routes.ListRoutes("cframe.0")
+	sort.Strings(installed)
+	expect = []string{"10.0.0.0/24", "10.0.1.0/26", "10.0.1.128/25"}
+	if !reflect.DeepEqual(installed, expect) {
+		t.Fatalf("expected routes %v, got %v", expect, installed)
+	}
+}
+
+func TestAggregateReleasePeer(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.SetAggregate(true)
+
+	// cidr taken over by another peer
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/25", ListenAddr: "1.1.1.1:58423"})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.128/25", ListenAddr: "1.1.1.1:58423"})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.128/25", ListenAddr: "2.2.2.2:58423"})
+	installed, _ := routes.ListRoutes("cframe.0")
+	sort.Strings(installed)
+	expect := []string{"10.0.1.0/25", "10.0.1.128/25"}
+	if !reflect.DeepEqual(installed, expect) {
+		t.Fatalf("expected routes %v, got %v", expect, installed)
+	}
+
+	// peer moved before removal
+	s.movePeer("2.2.2.2:58423", "3.3.3.3:58423")
+	s.DelPeer(&codec.Edge{Cidr: "10.0.1.128/25", ListenAddr: "2.2.2.2:58423"})
+	s.DelPeer(&codec.Edge{Cidr: "10.0.1.0/25", ListenAddr: "1.1.1.1:58423"})
+	if installed, _ := routes.ListRoutes("cframe.0"); len(installed) != 0 {
+		t.Fatalf("routes left after peers removed: %v", installed)
+	}
+	s.aggregator.mu.Lock()
+	defer s.aggregator.mu.Unlock()
+	for dev, peers := range s.aggregator.cidrs {
+		if len(peers) != 0 || len(s.aggregator.summary[dev]) != 0 || len(s.aggregator.refs[dev]) != 0 {
+			t.Fatalf("aggregator state left for %s: %v %v %v",
+				dev, peers, s.aggregator.summary[dev], s.aggregator.refs[dev])
+		}
+	}
+}
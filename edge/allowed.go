@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+var spoofedDropped = metrics.NewCounter("cframe_edge_spoofed_dropped_total",
+	"packets from peers dropped for source outside cidrs of the peer")
+
+// SetAllowedIPs accepts packets from a peer only if the source
+// falls in cidrs the peer serves, as primary, standby, equal path
+// or static route, so a peer cannot spoof sources of other peers
+func (s *Server) SetAllowedIPs(enabled bool) {
+	s.allowedIPs = enabled
+}
+
+// srcIP returns source address of ipv4 or ipv6 packet
+func srcIP(p Packet) net.IP {
+	switch p.Version() {
+	case 4:
+		if len(p) >= 20 {
+			return net.IP(p[12:16])
+		}
+	case 6:
+		if len(p) >= 40 {
+			return net.IP(p[8:24])
+		}
+	}
+	return nil
+}
+
+// allowedFrom reports whether packet p received from peer addr
+// carries a source within cidrs of vni the peer serves,
+// cidrs are indexed once peers change, see indexPeers
+func (s *Server) allowedFrom(vni uint32, from string, p Packet) bool {
+	src := srcIP(p)
+	if src == nil {
+		return false
+	}
+
+	for _, ipnet := range s.nets.Load().(peerNets)[from][vni] {
+		if ipnet.Contains(src) {
+			return true
+		}
+	}
+	return false
+}
+
+// servedBy reports whether addr is primary, standby or a path of pc
+func (pc *peerConn) servedBy(addr string) bool {
+	if pc.addr == addr || pc.standby == addr {
+		return true
+	}
+	for _, path := range pc.paths {
+		if path.addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// dropSpoofed drops packet from peer whose source is not allowed
+func (s *Server) dropSpoofed(vni uint32, from string, p Packet) bool {
+	if !s.allowedIPs || s.allowedFrom(vni, from, p) {
+		return false
+	}
+	spoofedDropped.Inc()
+	s.tupleLog.Debug("drop packet from %s: source %s not allowed", from, srcIP(p))
+	return true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestAllowedIPs(t *testing.T) {
+	tun := newFakeTun("cframe.0")
+	s := NewServer("", "key", &Interface{tun: tun})
+	s.SetRouteManager(newFakeRoutes())
+	s.SetAllowedIPs(true)
+	s.conn = listenLocal(t)
+
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40002}
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: peer.String()})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: other.String()})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.3.0/24", ListenAddr: other.String(), Standby: true})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.3.0/24", ListenAddr: peer.String()})
+
+	for _, c := range []struct {
+		src     string
+		allowed bool
+	}{
+		{"10.0.1.5", true},
+		// source of the other peer
+		{"10.0.2.5", false},
+		// source of no peer
+		{"192.168.1.5", false},
+		// served as primary with the other peer as standby
+		{"10.0.3.5", true},
+	} {
+		dropped := spoofedDropped.Value()
+		s.onRemote(s.conn, peer, s.encap.EncodeData(0, ipPacket(c.src, "10.0.9.1")))
+
+		select {
+		case pkt := <-tun.out:
+			if !c.allowed {
+				t.Fatalf("spoofed source %s delivered", Packet(pkt).Src())
+			}
+		case <-time.After(time.Millisecond * 100):
+			if c.allowed {
+				t.Fatalf("source %s not delivered", c.src)
+			}
+			if spoofedDropped.Value() != dropped+1 {
+				t.Fatalf("drop of source %s not counted", c.src)
+			}
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// BenchConfig drives synthetic traffic through the forwarding path,
+// rates are offered packets per second of each step
+type BenchConfig struct {
+	Rates      []int
+	Step       time.Duration
+	Size       int
+	SchedQueue int
+}
+
+// default steps of the benchmark
+var defaultBenchRates = []int{10000, 20000, 50000, 100000, 200000, 500000}
+
+// loss rate of a step considered as drop onset
+const benchLossOnset = 0.01
+
+// BenchStep is the result of a rate step
+type BenchStep struct {
+	Rate      int     `json:"rate"`
+	Sent      int64   `json:"sent"`
+	Delivered int64   `json:"delivered"`
+	Loss      float64 `json:"loss"`
+	PPS       float64 `json:"pps"`
+	Mbps      float64 `json:"mbps"`
+}
+
+// BenchResult is throughput of each step,
+// DropOnset is the first rate losing packets, 0 if none
+type BenchResult struct {
+	Steps     []*BenchStep `json:"steps"`
+	MaxPPS    float64      `json:"max_pps"`
+	MaxMbps   float64      `json:"max_mbps"`
+	DropOnset int          `json:"drop_onset"`
+}
+
+// benchTun feeds packets to readLocal and counts packets
+// written by readRemote, in place of a tun device
+type benchTun struct {
+	name      string
+	in        chan []byte
+	delivered int64
+	bytes     int64
+}
+
+func newBenchTun(name string) *benchTun {
+	return &benchTun{name: name, in: make(chan []byte, 4096)}
+}
+
+func (t *benchTun) Read(buf []byte) (int, error) {
+	pkt, ok := <-t.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(buf, pkt), nil
+}
+
+func (t *benchTun) Write(buf []byte) (int, error) {
+	atomic.AddInt64(&t.delivered, 1)
+	atomic.AddInt64(&t.bytes, int64(len(buf)))
+	return len(buf), nil
+}
+
+func (t *benchTun) Close() error {
+	close(t.in)
+	return nil
+}
+
+func (t *benchTun) Name() string { return t.name }
+
+// Bench forwards packets between two edges over loopback,
+// the sender edge reads packets from a tun and the receiver
+// edge writes them to its tun, at increasing offered rates.
+// both edges forward by readLocal and readRemote as served,
+// and are shut down with their sockets and readers once done
+func Bench(encap Encap, cfg *BenchConfig) (*BenchResult, error) {
+	if len(cfg.Rates) == 0 {
+		cfg.Rates = defaultBenchRates
+	}
+	if cfg.Step <= 0 {
+		cfg.Step = time.Second
+	}
+	if cfg.Size < 20 {
+		cfg.Size = 1400
+	}
+
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	aconn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		return nil, err
+	}
+	bconn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		aconn.Close()
+		return nil, err
+	}
+
+	atun, btun := newBenchTun("bench.0"), newBenchTun("bench.1")
+	a := NewServer("", "", &Interface{tun: atun})
+	b := NewServer("", "", &Interface{tun: btun})
+	for _, s := range []*Server{a, b} {
+		s.SetEncap(encap)
+		s.SetRouteManager(noopRoutes{})
+	}
+	a.conn, b.conn = aconn, bconn
+	a.SetScheduler(cfg.SchedQueue)
+	a.AddPeer(&codec.Edge{Cidr: "10.255.0.0/24", ListenAddr: bconn.LocalAddr().String()})
+
+	var readers, sched sync.WaitGroup
+	if a.sched != nil {
+		sched.Add(1)
+		go func() {
+			defer sched.Done()
+			a.sched.run(a.egress)
+		}()
+	}
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		a.readLocal(aconn, 0, a.ifaces[0])
+	}()
+	go func() {
+		defer readers.Done()
+		b.readRemote(bconn)
+	}()
+	defer func() {
+		// readers return once sockets and tun are closed,
+		// the scheduler once readLocal enqueues no more
+		a.Shutdown()
+		b.Shutdown()
+		atun.Close()
+		readers.Wait()
+		if a.sched != nil {
+			a.sched.stop()
+			sched.Wait()
+		}
+	}()
+
+	pkt := make([]byte, cfg.Size)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(cfg.Size))
+	copy(pkt[12:16], net.IPv4(10, 254, 0, 1).To4())
+	copy(pkt[16:20], net.IPv4(10, 255, 0, 1).To4())
+
+	result := &BenchResult{}
+	for _, rate := range cfg.Rates {
+		step := benchStep(atun, btun, pkt, rate, cfg.Step)
+		result.Steps = append(result.Steps, step)
+		if step.PPS > result.MaxPPS {
+			result.MaxPPS, result.MaxMbps = step.PPS, step.Mbps
+		}
+		if result.DropOnset == 0 && step.Loss > benchLossOnset {
+			result.DropOnset = rate
+		}
+	}
+	return result, nil
+}
+
+// benchStep offers rate packets per second for d,
+// packets not accepted by the tun queue count as sent and lost
+func benchStep(atun, btun *benchTun, pkt []byte, rate int, d time.Duration) *BenchStep {
+	delivered := atomic.LoadInt64(&btun.delivered)
+	bytes := atomic.LoadInt64(&btun.bytes)
+
+	const tick = time.Millisecond
+	perTick := float64(rate) * tick.Seconds()
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	sent, credit := int64(0), 0.0
+	beg := time.Now()
+	for now := range ticker.C {
+		if now.Sub(beg) >= d {
+			break
+		}
+		credit += perTick
+		for ; credit >= 1; credit-- {
+			sent++
+			select {
+			case atun.in <- pkt:
+			default:
+			}
+		}
+	}
+	elapsed := time.Since(beg)
+
+	// packets in flight
+	time.Sleep(time.Millisecond * 100)
+
+	step := &BenchStep{
+		Rate:      rate,
+		Sent:      sent,
+		Delivered: atomic.LoadInt64(&btun.delivered) - delivered,
+	}
+	if sent > 0 {
+		step.Loss = 1 - float64(step.Delivered)/float64(sent)
+		if step.Loss < 0 {
+			step.Loss = 0
+		}
+	}
+	step.PPS = float64(step.Delivered) / elapsed.Seconds()
+	step.Mbps = float64(atomic.LoadInt64(&btun.bytes)-bytes) * 8 / elapsed.Seconds() / 1e6
+	return step
+}
+
+func printBench(w io.Writer, result *BenchResult) {
+	fmt.Fprintf(w, "%-10s %-10s %-10s %-8s %-12s %-10s\n", "Rate", "Sent", "Delivered", "Loss", "PPS", "Mbps")
+	for _, s := range result.Steps {
+		fmt.Fprintf(w, "%-10d %-10d %-10d %-8s %-12.0f %-10.1f\n",
+			s.Rate, s.Sent, s.Delivered, fmt.Sprintf("%.1f%%", s.Loss*100), s.PPS, s.Mbps)
+	}
+	fmt.Fprintf(w, "max throughput: %.0f pps, %.1f Mbps\n", result.MaxPPS, result.MaxMbps)
+	if result.DropOnset > 0 {
+		fmt.Fprintf(w, "drop onset: %d pps\n", result.DropOnset)
+	} else {
+		fmt.Fprintln(w, "no drop onset within tested rates")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBench(t *testing.T) {
+	encap, err := NewEncap("", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goroutines := runtime.NumGoroutine()
+	result, err := Bench(encap, &BenchConfig{
+		Rates:      []int{1000, 2000},
+		Step:       time.Millisecond * 200,
+		Size:       200,
+		SchedQueue: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// readers and scheduler of both edges are stopped
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("bench leaked %d goroutines", n-goroutines)
+	}
+
+	if len(result.Steps) != 2 {
+		t.Fatalf("expected 2 steps, got %d", len(result.Steps))
+	}
+	for _, s := range result.Steps {
+		if s.Sent == 0 || s.Delivered == 0 {
+			t.Fatalf("rate %d: sent %d delivered %d", s.Rate, s.Sent, s.Delivered)
+		}
+	}
+	if result.MaxPPS <= 0 || result.MaxMbps <= 0 {
+		t.Fatalf("unexpected max throughput %+v", result)
+	}
+
+	out := &bytes.Buffer{}
+	printBench(out, result)
+	if !strings.Contains(out.String(), "max throughput") {
+		t.Fatalf("unexpected output %s", out)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParsePeerIfaces parses comma separated peer=device pairs,
+// eg: 1.1.1.1:58423=eth1,2.2.2.2:58423=eth2
+func ParsePeerIfaces(s string) (map[string]string, error) {
+	ifaces := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("invalid peer interface %s", pair)
+		}
+		addr, err := net.ResolveUDPAddr("udp", kv[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer interface %s: %v", pair, err)
+		}
+		ifaces[addr.String()] = kv[1]
+	}
+	return ifaces, nil
+}
+
+// SetBindInterface binds peer traffic to device dev,
+// peers in the peer => device map egress their own device.
+// must be called before ListenAndServe
+func (s *Server) SetBindInterface(dev string, peers map[string]string) {
+	s.bindIface = dev
+	s.peerIfaces = peers
+}
+
+// sockOpts are options of a peer socket,
+// device bound to and fwmark set on packets
+type sockOpts struct {
+	dev  string
+	mark int
+}
+
+// listenUDP listens on laddr with opts,
+// reuse allows sockets with other opts on the same port
+func listenUDP(laddr string, opts sockOpts, reuse bool) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: sockControl(opts, reuse)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// defaultOpts are options of s.conn
+func (s *Server) defaultOpts() sockOpts {
+	return sockOpts{dev: s.bindIface, mark: s.fwmark}
+}
+
+// peerOpts returns socket options of peer addr,
+// per peer device and mark override the defaults
+func (s *Server) peerOpts(addr string) sockOpts {
+	opts := s.defaultOpts()
+	if dev, ok := s.peerIfaces[addr]; ok {
+		opts.dev = dev
+	}
+	if mark, ok := s.peerMarks[addr]; ok {
+		opts.mark = mark
+	}
+	return opts
+}
+
+// sharedPort reports whether peers need sockets of their own
+// on the port of s.conn
+func (s *Server) sharedPort() bool {
+	return len(s.peerIfaces) > 0 || len(s.peerMarks) > 0
+}
+
+// listenPeerSocks opens a socket per distinct options of peers
+// on the port of s.conn
+func (s *Server) listenPeerSocks() error {
+	s.peerSocks = make(map[sockOpts]*net.UDPConn)
+	laddr := s.conn.LocalAddr().String()
+	addrs := make([]string, 0, len(s.peerIfaces)+len(s.peerMarks))
+	for addr := range s.peerIfaces {
+		addrs = append(addrs, addr)
+	}
+	for addr := range s.peerMarks {
+		addrs = append(addrs, addr)
+	}
+
+	for _, addr := range addrs {
+		opts := s.peerOpts(addr)
+		if _, ok := s.peerSocks[opts]; ok || opts == s.defaultOpts() {
+			continue
+		}
+
+		conn, err := listenUDP(laddr, opts, true)
+		if err != nil {
+			return fmt.Errorf("peer socket dev %q mark %d fail: %v", opts.dev, opts.mark, err)
+		}
+		s.peerSocks[opts] = conn
+		go s.readRemote(conn)
+	}
+	return nil
+}
+
+// sockFor returns the socket with options of addr,
+// s.conn if addr has no options of its own
+func (s *Server) sockFor(addr string) *net.UDPConn {
+	if conn := s.peerSocks[s.peerOpts(addr)]; conn != nil {
+		return conn
+	}
+	return s.conn
+}
+
+// peerSock returns the socket of peer for udp transport,
+// sock itself for tcp transport
+func (s *Server) peerSock(sock transport, addr string) transport {
+	if _, ok := sock.(*net.UDPConn); !ok {
+		return sock
+	}
+	if conn := s.peerSocks[s.peerOpts(addr)]; conn != nil {
+		return conn
+	}
+	return sock
+}
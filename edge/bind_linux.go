@@ -0,0 +1,41 @@
+package main
+
+import (
+	"syscall"
+)
+
+// SO_REUSEPORT, missing in syscall
+const soReusePort = 0xf
+
+// sockControl binds socket to opts.dev with SO_BINDTODEVICE
+// and marks packets with opts.mark by SO_MARK
+func sockControl(opts sockOpts, reuse bool) func(network, address string, c syscall.RawConn) error {
+	if len(opts.dev) == 0 && opts.mark == 0 && !reuse {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			if reuse {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+				if err != nil {
+					return
+				}
+			}
+			if opts.mark != 0 {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, opts.mark)
+				if err != nil {
+					return
+				}
+			}
+			if len(opts.dev) > 0 {
+				err = syscall.BindToDevice(int(fd), opts.dev)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
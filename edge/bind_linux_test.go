@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// boundDevice reads SO_BINDTODEVICE of conn
+func boundDevice(t *testing.T, conn *net.UDPConn) string {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, syscall.IFNAMSIZ)
+	size := uint32(len(buf))
+	var errno syscall.Errno
+	raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if size > 0 && buf[size-1] == 0 {
+		size--
+	}
+	return string(buf[:size])
+}
+
+func TestBindInterface(t *testing.T) {
+	conn, err := listenUDP("127.0.0.1:0", sockOpts{dev: "lo"}, false)
+	if err != nil {
+		t.Skipf("bind to device: %v", err)
+	}
+	defer conn.Close()
+	if dev := boundDevice(t, conn); dev != "lo" {
+		t.Fatalf("expected socket bound to lo, got %q", dev)
+	}
+
+	unbound, err := listenUDP("127.0.0.1:0", sockOpts{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unbound.Close()
+	if dev := boundDevice(t, unbound); dev != "" {
+		t.Fatalf("expected unbound socket, got %q", dev)
+	}
+}
+
+func TestPeerInterface(t *testing.T) {
+	btun := newFakeTun("b")
+	b := NewServer("", "key", nil)
+	b.AddInterface(0, &Interface{tun: btun})
+	b.conn = listenLocal(t)
+	go b.readRemote(b.conn)
+	baddr := b.conn.LocalAddr().String()
+
+	// peer b egresses lo, others the default socket
+	peers, err := ParsePeerIfaces(baddr + "=lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	atun := newFakeTun("a")
+	a := NewServer("127.0.0.1:0", "key", nil)
+	a.AddInterface(0, &Interface{tun: atun})
+	a.SetBindInterface("", peers)
+	a.conn, err = listenUDP("127.0.0.1:0", sockOpts{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.listenPeerSocks(); err != nil {
+		t.Skipf("bind to device: %v", err)
+	}
+
+	sock := a.sockFor(baddr)
+	if sock == a.conn || boundDevice(t, sock) != "lo" {
+		t.Fatalf("peer socket not bound to lo")
+	}
+	if sock.LocalAddr().String() != a.conn.LocalAddr().String() {
+		t.Fatalf("peer socket on %s, expected %s", sock.LocalAddr(), a.conn.LocalAddr())
+	}
+	if a.sockFor("10.0.0.1:58423") != a.conn {
+		t.Fatalf("peer without interface not on default socket")
+	}
+
+	a.peerConns[0] = map[string]*peerConn{
+		"10.0.0.0/24": newPeerConn(baddr, "10.0.0.0/24"),
+	}
+	go a.readLocal(a.conn, 0, a.ifaces[0])
+	atun.in <- ipPacket("10.0.1.1", "10.0.0.5")
+	select {
+	case pkt := <-btun.out:
+		if Packet(pkt).Dst() != "10.0.0.5" {
+			t.Fatalf("unexpected packet to %s", Packet(pkt).Dst())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("packet not forwarded over bound socket")
+	}
+}
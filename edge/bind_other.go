@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// sockControl fails if dev or mark is set,
+// binding to device and fwmark are linux only
+func sockControl(opts sockOpts, reuse bool) func(network, address string, c syscall.RawConn) error {
+	if len(opts.dev) == 0 && opts.mark == 0 {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("bind to device or fwmark unsupported: %s", runtime.GOOS)
+	}
+}
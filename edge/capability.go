@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// CAP_NET_ADMIN, see linux/capability.h
+const capNetAdmin = 12
+
+// CheckPrivilege returns an actionable error if the process
+// is not allowed to create tun device and install routes
+func CheckPrivilege() error {
+	if runtime.GOOS != "linux" {
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("cframe edge must run as root to create tun device and install routes")
+		}
+		return nil
+	}
+
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		// unknown, leave it to tun creation
+		return nil
+	}
+	return checkCapNetAdmin(string(status), os.Args[0])
+}
+
+// checkCapNetAdmin checks CAP_NET_ADMIN in effective capabilities
+// of /proc/<pid>/status
+func checkCapNetAdmin(status, prog string) error {
+	scanner := bufio.NewScanner(strings.NewReader(status))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return nil
+		}
+
+		if caps&(1<<capNetAdmin) == 0 {
+			return fmt.Errorf("cframe edge requires CAP_NET_ADMIN to create tun device and install routes, "+
+				"run it as root or grant the capability: sudo setcap cap_net_admin+ep %s", prog)
+		}
+		return nil
+	}
+	return nil
+}
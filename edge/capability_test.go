@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckCapNetAdmin(t *testing.T) {
+	status := "Name:\tedge\nCapInh:\t0000000000000000\nCapPrm:\t%s\nCapEff:\t%s\n"
+
+	// root
+	root := strings.Replace(status, "%s", "000001ffffffffff", -1)
+	if err := checkCapNetAdmin(root, "edge"); err != nil {
+		t.Fatal(err)
+	}
+
+	// setcap cap_net_admin+ep
+	netAdmin := strings.Replace(status, "%s", "0000000000001000", -1)
+	if err := checkCapNetAdmin(netAdmin, "edge"); err != nil {
+		t.Fatal(err)
+	}
+
+	// unprivileged user
+	none := strings.Replace(status, "%s", "0000000000000000", -1)
+	err := checkCapNetAdmin(none, "/usr/local/bin/edge")
+	if err == nil {
+		t.Fatalf("expected missing capability error")
+	}
+	if !strings.Contains(err.Error(), "CAP_NET_ADMIN") ||
+		!strings.Contains(err.Error(), "setcap cap_net_admin+ep /usr/local/bin/edge") {
+		t.Fatalf("unfriendly error: %v", err)
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"net"
-	"strings"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ICKelin/cframe/codec"
 	"github.com/ICKelin/cframe/edge/vpc"
@@ -16,14 +19,200 @@ type Server struct {
 	// secret
 	key string
 
+	// name peers know the edge by from controller,
+	// signs tcp hello if set, see tcp.go
+	name string
+
+	// encapsulation of packets between edges
+	encap Encap
+
 	// server listen udp address
 	laddr string
+	conn  *net.UDPConn
+
+	// transport of data packets, udp or tcp,
+	// tcp streams are dialed by dialer
+	transport string
+	dialer    dialer
+
+	// transport announced by peers overriding transport,
+	// key: peer listen addr, see peerTransport
+	peerTransports map[string]string
+
+	// device peer traffic egresses, empty for routing decision
+	// peerIfaces overrides device per peer address and
+	// peerSocks are sockets with options of peers, see bind.go
+	bindIface  string
+	peerIfaces map[string]string
+	peerSocks  map[sockOpts]*net.UDPConn
+
+	// fwmark of peer traffic, 0 for none,
+	// peerMarks overrides mark per peer address, see mark.go
+	fwmark    int
+	peerMarks map[string]int
+
+	// retransmit reliable control packets
+	reliable *reliable
+
+	// ciphers supported by local edge, empty disables encryption
+	// sessions keep the cipher negotiated with each peer
+	ciphers  []string
+	sessions *sessions
+
+	// packets from or to clear cidrs are not encrypted, see clear.go
+	clearCidrs []*net.IPNet
+
+	// cidrs of the outer tunnel peers are trusted in, see nested.go
+	nested []*net.IPNet
+
+	// dscp => peer address or transport, see dscp.go
+	dscpRoutes map[uint8]string
+
+	// mss of tcp syn forwarded is lowered to mssClamp, 0 disables
+	mssClamp int
+
+	// rotate keys of peers every rekeyInterval, 0 disables rotation
+	// old key is accepted for rekeyWindow after rotation
+	rekeyInterval time.Duration
+	rekeyWindow   time.Duration
+
+	// peers connection, scoped by vni
+	// key: vni, val: peers keyed by cidr
+	mu        sync.RWMutex
+	peerConns map[uint32]map[string]*peerConn
+	table     tableSize
+
+	// peers follow the edge across local address changes
+	migration migration
+
+	// peers failed to install, key: vni/cidr
+	failedMu sync.Mutex
+	failed   map[string]*failedPeer
+
+	// installs peer routes to the os, recorded by installed
+	// aggregator merges routes to the same peer if enabled
+	routes     RouteManager
+	installed  *installedRoutes
+	aggregator *routeAggregator
+
+	// serializes flush and rebuild of os routes
+	rebuildMu sync.Mutex
+
+	// held by addRoute, locked while a drained or held down peer
+	// is checked and removed, see expirePeer
+	expireMu sync.RWMutex
+
+	// extra routes via peers, see static.go
+	static *staticRoutes
+
+	// idle eviction of dynamic peers, see idle.go
+	idle *idlePeers
+
+	// peer health check, standby serves traffic once primary is down
+	health         *health
+	healthInterval time.Duration
+	failback       bool
+
+	// cidrs without live peer, see reach.go
+	reach *reachState
+
+	// time for peer set changes to take effect, see converge.go
+	converge *converge
+
+	// flow records of forwarded packets, nil disables, see flows.go
+	flows *flows
+
+	// tcp segments from peers are put in order, nil disables
+	reorder *reorderer
+
+	// drop packets from peers with source outside their cidrs
+	allowedIPs bool
+
+	// packets to peers in this process bypass sockets, see fastpath.go
+	fastPath bool
+
+	// max cidrs installed per peer address and of all peers,
+	// 0 is unlimited, see limits.go
+	peerRouteLimit int
+	routeLimit     int
+
+	// 1 drops data packets but keeps control plane running
+	maintenance int32
+
+	// 1 once Shutdown began, all packets are dropped
+	// tcp streams and listener are closed by Shutdown
+	stopping int32
+	tcp      *tcpTransport
+	tcpLis   net.Listener
+
+	// tcp peers are accepted with PROXY protocol header
+	// when connecting from trusted upstreams
+	proxyProtocol bool
+	proxyTrusted  []*net.IPNet
+
+	// files inherited from the upgraded process and
+	// sockets passed to the new process, see upgrade.go
+	upgradeMu sync.Mutex
+	inherited map[string]*os.File
+	handoffs  map[string]fileConn
+	upgrading int32
+	// closed once handed off, the process exits
+	handedOff chan struct{}
+
+	// cidrs served by each peer address, holds peerNets
+	nets atomic.Value
 
-	// peers connection
-	peerConns map[string]*peerConn
+	// packet capture, holds *tap, nil if stopped
+	tap atomic.Value
+	// directory of capture files started by admin api,
+	// file captures are refused if empty
+	tapDir string
+
+	// path mtu to peers learned from icmp ptb
+	pmtu *pathMTU
+
+	// latest tcp hello accepted of each peer name
+	tcpHellos *tcpHellos
+
+	// failed writes to peers, logged by kind, see transport.go
+	writeErrs *writeErrors
+
+	// smoothed packet and byte rates, see load.go
+	load *load
+
+	// egress priority scheduler, nil writes packets directly
+	sched *scheduler
+
+	// bounded send queue per peer, nil writes packets directly
+	sendq *sendQueues
+
+	// packet drop and delay injection, nil unless chaos build, see chaos.go
+	chaos *chaos
+
+	// grace period a deleted peer keeps forwarding
+	// before its route is torn down, 0 means remove immediately
+	drainGrace time.Duration
+
+	// route of a dead primary deleted is kept for standby
+	// taking over, 0 means remove immediately, see holddown.go
+	deadHoldDown time.Duration
+
+	// delay between peer setups of a batch, see stagger.go
+	stagger   time.Duration
+	staggered *staggeredPeers
+
+	// sampler for per packet tuple logs
+	tupleLog       *log.Sampler
+	nonIPLog       *log.Sampler
+	unknownCtrlLog *log.Sampler
+
+	// local source hosts reported to controller
+	// fed by data path and drained in background
+	srcChan chan string
 
 	// tun device wrap
-	iface *Interface
+	// key: vni bound to the device
+	ifaces map[uint32]*Interface
 
 	vpcInstance vpc.IVPC
 }
@@ -34,21 +223,180 @@ type peerConn struct {
 	// conn *kcp.UDPSession
 	// conn net.Conn
 	cidr string
+	// cidr parsed once installed, nil if invalid
+	ipnet *net.IPNet
+
+	// draining peer is not selected for new flows
+	// and will be removed once drainTimer fires
+	draining   bool
+	drainTimer *time.Timer
+
+	// dead primary deleted is held down until drainTimer fires,
+	// its route is kept for standby taking over, see holddown.go
+	held bool
+
+	// standby peer serves the cidr once the primary is down,
+	// failover is 1 while traffic goes to standby
+	standby  string
+	failover int32
+
+	// peer ids of addr and standby, see peerID
+	id, standbyID string
+
+	// equal peers of the cidr, addr is the first path
+	paths []*path
+}
+
+// newPeerConn returns entry of cidr via addr, cidr is parsed
+// once here as packets are matched against it
+func newPeerConn(addr, cidr string) *peerConn {
+	pc := &peerConn{addr: addr, cidr: cidr}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		log.Error("parse cidr %s fail: %v", cidr, err)
+		return pc
+	}
+	pc.ipnet = ipnet
+	return pc
 }
 
 func NewServer(laddr, key string, iface *Interface) *Server {
-	return &Server{
+	s := &Server{
 		laddr:     laddr,
 		key:       key,
-		peerConns: make(map[string]*peerConn),
-		iface:     iface,
+		encap:     &rawEncap{key: key},
+		peerConns: make(map[uint32]map[string]*peerConn),
+		ifaces:    make(map[uint32]*Interface),
+		failed:    make(map[string]*failedPeer),
+		migration: migration{last: make(map[string]int64)},
+		routes:    &cmdRouteManager{},
+		tupleLog:  log.NewSampler(1, 0),
+		srcChan:   make(chan string, 1024),
+		handedOff: make(chan struct{}),
+		sessions:  &sessions{m: make(map[string]*session)},
+		pmtu:      &pathMTU{m: make(map[string]int)},
+		tcpHellos: &tcpHellos{last: make(map[string]int64)},
+		writeErrs: newWriteErrors(),
+		staggered: &staggeredPeers{pending: make(map[string]*staggerBatch)},
+		load:      newLoad(),
+		static:    &staticRoutes{m: make(map[string]*codec.Edge)},
+		idle:      newIdlePeers(),
+		reach:     newReachState(),
+		converge:  newConverge(),
+
+		peerTransports: make(map[string]string),
+		handoffs:       make(map[string]fileConn),
+		health:         newHealth(defaultHealthFailures),
+		healthInterval: defaultHealthInterval,
+		failback:       true,
+		rekeyWindow:    defaultRekeyWindow,
 	}
+
+	s.installed = &installedRoutes{s: s, routes: make(map[osRoute]struct{})}
+	s.reliable = newReliable(defaultCtrlRTO, defaultCtrlMaxRetry,
+		func(typ byte, payload []byte) []byte {
+			return s.encap.EncodeCtrl(typ, payload)
+		},
+		func(buf []byte, addr *net.UDPAddr) error {
+			_, err := s.sockFor(addr.String()).WriteToUDP(buf, addr)
+			return err
+		})
+
+	s.tap.Store((*tap)(nil))
+	s.nets.Store(peerNets{})
+	if iface != nil {
+		s.ifaces[0] = iface
+	}
+	return s
+}
+
+// AddInterface binds iface to vni,
+// must be called before ListenAndServe
+func (s *Server) AddInterface(vni uint32, iface *Interface) {
+	s.ifaces[vni] = iface
+}
+
+// TunAddr returns ip/cidr of the tun device with the lowest vni
+func (s *Server) TunAddr() string {
+	iface := s.primaryIface()
+	if iface == nil {
+		return ""
+	}
+	return iface.Addr()
+}
+
+// SetTunCidr assigns the first host of cidr
+// to the tun device with the lowest vni
+func (s *Server) SetTunCidr(cidr string) error {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ipnet.IP.To4() == nil {
+		return fmt.Errorf("invalid cidr %s", cidr)
+	}
+	iface := s.primaryIface()
+	if iface == nil {
+		return fmt.Errorf("no interface")
+	}
+
+	ip := make(net.IP, 4)
+	copy(ip, ipnet.IP.To4())
+	ip[3]++
+	addr := &net.IPNet{IP: ip, Mask: ipnet.Mask}
+	if iface.Addr() == addr.String() {
+		return nil
+	}
+	log.Info("tun %s address %s", iface.tun.Name(), addr)
+	return iface.SetAddr(addr)
+}
+
+func (s *Server) primaryIface() *Interface {
+	var iface *Interface
+	vni := uint32(0)
+	for v, i := range s.ifaces {
+		if iface == nil || v < vni {
+			iface, vni = i, v
+		}
+	}
+	return iface
+}
+
+// SetEncap sets encapsulation between edges,
+// must be the same for all edges
+// SetName sets the name peers know the edge by,
+// tcp streams dialed are identified by it
+func (s *Server) SetName(name string) {
+	s.name = name
+}
+
+func (s *Server) SetEncap(encap Encap) {
+	s.encap = encap
+}
+
+// SetCiphers sets ciphers for peer traffic, the strongest
+// cipher supported by both sides is negotiated per peer
+func (s *Server) SetCiphers(ciphers []string) {
+	s.ciphers = ciphers
+}
+
+// SetRouteManager replaces the default route command
+// used to install peer routes
+func (s *Server) SetRouteManager(routes RouteManager) {
+	s.routes = routes
 }
 
 func (s *Server) SetRegistry(r *Registry) {
 	s.registry = r
 }
 
+func (s *Server) SetDrainGrace(grace time.Duration) {
+	s.drainGrace = grace
+}
+
+// SetLogSampling logs 1 in every tuple messages
+// and at most limit tuple messages per second
+func (s *Server) SetLogSampling(every, limit int) {
+	s.tupleLog = log.NewSampler(every, limit)
+}
+
 func (s *Server) SetVPCInstance(vpcInstance vpc.IVPC) {
 	if s.vpcInstance == nil {
 		s.vpcInstance = vpcInstance
@@ -56,146 +404,437 @@ func (s *Server) SetVPCInstance(vpcInstance vpc.IVPC) {
 }
 
 func (s *Server) ListenAndServe() error {
-	laddr, err := net.ResolveUDPAddr("udp", s.laddr)
+	lconn, err := s.listenConn()
 	if err != nil {
 		return err
 	}
-	lconn, err := net.ListenUDP("udp", laddr)
+	defer lconn.Close()
+	s.conn = lconn
+	s.registerFastPath()
+
+	err = s.listenPeerSocks()
 	if err != nil {
 		return err
 	}
-	defer lconn.Close()
 
-	go s.readLocal(lconn)
+	go s.collectSrc()
+	go s.retryFailed()
+	go s.listenICMP()
+	go s.sampleLoad()
+	go s.logTableSize()
+	if s.rekeyInterval > 0 && len(s.ciphers) > 0 {
+		go s.rotateKeys()
+	}
+	if s.healthInterval > 0 {
+		go s.healthCheck()
+	}
+	if s.idle.timeout > 0 {
+		go s.evictIdleLoop()
+	}
+	if s.static.refresh > 0 {
+		go s.refreshStaticLoop()
+	}
+	if s.flows != nil {
+		go s.exportFlows()
+	}
+	if len(s.migration.name) > 0 {
+		go s.watchLocalAddrs()
+	}
+	if s.sched != nil {
+		go func() {
+			defer s.guard()
+			s.sched.run(s.egress)
+		}()
+	}
+	// tcp is always accepted, peers may choose it per peer
+	// even if udp is the default transport
+	var sock transport = lconn
+	d := s.dialer
+	if d == nil {
+		d, _ = NewDialer("")
+	}
+	tcp := newTCPTransport(d, lconn.LocalAddr().(*net.UDPAddr).Port)
+	tcp.key, tcp.name = s.key, s.name
+	lis, err := s.listenInherited("tcp", s.laddr)
+	if err != nil && s.transport == transportTCP {
+		return err
+	}
+	if err != nil {
+		log.Warn("listen tcp %s fail, tcp peers not accepted: %v", s.laddr, err)
+	} else {
+		defer lis.Close()
+		if fc, ok := lis.(fileConn); ok {
+			s.addHandoff("tcp", fc)
+		}
+		go s.serveTCP(lis)
+	}
+	s.setTCP(tcp, lis)
+	if s.transport == transportTCP {
+		sock = tcp
+	}
+
+	for vni, iface := range s.ifaces {
+		go s.readLocal(sock, vni, iface)
+	}
+	s.ready()
 	s.readRemote(lconn)
 	return nil
 }
 
+// max udp datagram read from peers
+const maxDatagram = 1024 * 64
+
+// readRemote reuses one read buffer, packets handed off
+// past an iteration must not alias it, see handoff
 func (s *Server) readRemote(lconn *net.UDPConn) {
-	rawbytes := make([]byte, 1024*64)
-	key := s.key
-	klen := len(key)
+	defer s.guard()
+	rawbytes := make([]byte, maxDatagram)
 	for {
-		nr, _, err := lconn.ReadFromUDP(rawbytes)
+		nr, from, err := lconn.ReadFromUDP(rawbytes)
 		if err != nil {
+			if s.stopped() {
+				return
+			}
 			log.Error("read full fail: %v", err)
 			continue
 		}
 
-		buf := rawbytes[:nr]
+		s.onRemote(lconn, from, rawbytes[:nr])
+	}
+}
 
-		if nr < klen {
-			log.Error("pkt to small")
-			continue
-		}
+// onRemote handles buf received from peer by any transport,
+// buf is reused once onRemote returns
+func (s *Server) onRemote(lconn *net.UDPConn, from *net.UDPAddr, buf []byte) {
+	if s.stopped() {
+		return
+	}
 
-		// decode key
-		rkey := buf[:klen]
-		if string(rkey) != key {
-			log.Error("access forbidden!!")
-			continue
-		}
+	vni, pkt, err := s.encap.Decode(buf)
+	if err != nil {
+		log.Error("decode packet from %s fail: %v", from, err)
+		return
+	}
 
-		pkt := buf[klen:nr]
-		p := Packet(pkt)
-		if p.Invalid() {
-			log.Error("invalid ipv4 packet")
-			continue
-		}
+	if s.chaosDrop(isCtrl(pkt)) {
+		return
+	}
+
+	if isCtrl(pkt) {
+		s.onCtrl(lconn, from, pkt)
+		return
+	}
+
+	if s.dropInMaintenance() {
+		return
+	}
+
+	addr := from.String()
+	sealed := isSealed(pkt)
+	pkt, err = s.decrypt(addr, pkt)
+	if err != nil {
+		log.Error("decrypt packet from %s fail: %v", from, err)
+		return
+	}
+	// peer is alive even if the packet is dropped below
+	s.touchPeer(addr)
+
+	// opened packet is a new slice, plain one aliases buf
+	if !sealed {
+		pkt = handoff(pkt)
+	}
+
+	iface := s.ifaces[vni]
+	if iface == nil {
+		log.Error("no interface for vni %d", vni)
+		return
+	}
+
+	p := Packet(pkt)
+	if p.Invalid() {
+		log.Error("invalid ipv4 packet")
+		return
+	}
+
+	if s.dropForeignVNI(vni, addr) || s.dropSpoofed(vni, addr, p) {
+		return
+	}
+
+	if s.mssClamp > 0 {
+		clampMSS(pkt, s.mssClamp)
+	}
 
-		src := p.Src()
-		dst := p.Dst()
-		log.Debug("tuple %s => %s", src, dst)
+	src := p.Src()
+	dst := p.Dst()
+	s.tupleLog.Debug("tuple %s => %s", src, dst)
 
-		AddTrafficIn(int64(nr))
-		s.iface.Write(pkt)
+	AddTrafficIn(int64(len(buf)))
+	ingressPacketSize.Observe(float64(len(pkt)))
+	s.load.in(addr, len(buf))
+	s.capture(pkt)
+	if s.flows != nil {
+		s.flows.account(vni, true, addr, pkt, time.Now())
+	}
+	if s.reorder != nil {
+		s.reorder.push(vni, iface, pkt)
+		return
 	}
+	iface.Write(pkt)
 }
 
-func (s *Server) readLocal(sock *net.UDPConn) {
+// handoff copies pkt read into a reused buffer, so a consumer
+// retaining it never sees data of the next read
+func handoff(pkt []byte) []byte {
+	cp := make([]byte, len(pkt))
+	copy(cp, pkt)
+	return cp
+}
+
+func (s *Server) readLocal(sock transport, vni uint32, iface *Interface) {
+	defer s.guard()
+	// buffer is reused, packets are copied once encoded
+	// or sealed and tap keeps its own copy
+	buf := make([]byte, 2048)
 	for {
-		pkt, err := s.iface.Read()
+		n, err := iface.ReadPacket(buf)
+		// tun is read by the new process once handed off
+		if s.stopped() {
+			return
+		}
 		if err != nil {
 			log.Error("read iface error: %v", err)
 			continue
 		}
 
-		p := Packet(pkt)
-		if p.Invalid() {
-			log.Error("invalid ipv4 packet")
-			continue
-		}
+		s.forwardLocal(sock, vni, buf[:n])
+	}
+}
 
-		AddTrafficOut(int64(len(pkt)))
-		src := p.Src()
-		dst := p.Dst()
-		log.Debug("tuple %s => %s", src, dst)
+// forwardLocal sends packet read from iface to peer
+func (s *Server) forwardLocal(sock transport, vni uint32, pkt []byte) {
+	if s.stopped() {
+		return
+	}
+	if s.dropNonIP(pkt) {
+		return
+	}
+	p := Packet(pkt)
 
-		peer, err := s.route(dst)
-		if err != nil {
-			log.Error("[E] not route to host: ", dst)
-			continue
-		}
+	if s.dropInMaintenance() {
+		return
+	}
 
-		raddr, err := net.ResolveUDPAddr("udp", peer)
-		if err != nil {
-			log.Error("parse %s fail: %v", peer, err)
-			continue
-		}
+	if s.mssClamp > 0 {
+		clampMSS(pkt, s.mssClamp)
+	}
 
-		// encode key
-		buf := make([]byte, 0, len(pkt)+len(s.key))
-		buf = append(buf, []byte(s.key)...)
-		buf = append(buf, pkt...)
-		_, e := sock.WriteToUDP(buf, raddr)
-		if e != nil {
-			log.Error("%v", e)
-		}
+	AddTrafficOut(int64(len(pkt)))
+	s.capture(pkt)
+	src := p.Src()
+	dst := p.Dst()
+	s.tupleLog.Debug("tuple %s => %s", src, dst)
+	s.reportSrc(src)
+
+	peer, err := s.route(vni, src, dst)
+	if err != nil && s.wakeRoute(vni, dst) {
+		peer, err = s.route(vni, src, dst)
+	}
+	if err == errHeldDown {
+		s.heldUnreachable(vni, pkt)
+		return
+	}
+	if err != nil {
+		log.Error("[E] not route to host: ", dst)
+		return
+	}
+	peer, via := s.dscpRoute(vni, p, dst, peer)
+
+	raddr, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil {
+		log.Error("parse %s fail: %v", peer, err)
+		return
+	}
+
+	s.load.out(raddr.String(), len(pkt))
+	if s.flows != nil {
+		s.flows.account(vni, false, raddr.String(), pkt, time.Now())
+	}
+	egressPacketSize.Observe(float64(len(pkt)))
+	s.touchPeer(raddr.String())
+	data, err := s.encrypt(raddr.String(), pkt)
+	if err != nil {
+		log.Error("encrypt packet to %s fail: %v", raddr, err)
+		return
+	}
+
+	buf := s.encap.EncodeData(vni, data)
+	if s.tooBig(vni, raddr.String(), pkt, buf) {
+		s.tupleLog.Debug("packet %s => %s exceeds path mtu to %s", src, dst, raddr)
+		return
+	}
+
+	if peer := s.fastPathPeer(raddr); peer != nil {
+		s.forwardFast(peer, raddr, buf)
+		return
+	}
+
+	if via == nil {
+		via = s.peerTransport(sock, raddr.String())
 	}
+	psock := s.peerSock(via, raddr.String())
+	if d := s.chaosDelay(); d > 0 {
+		// pkt aliases the read buffer, buf is already a copy
+		pkt = handoff(pkt)
+		time.AfterFunc(d, func() { s.sendPeer(psock, raddr, pkt, buf) })
+		return
+	}
+	s.sendPeer(psock, raddr, pkt, buf)
 }
 
-func (s *Server) route(dst string) (string, error) {
-	for _, p := range s.peerConns {
-		_, ipnet, err := net.ParseCIDR(p.cidr)
-		if err != nil {
-			log.Error("parse cidr fail: %v", err)
-			continue
+// reportSrc hands src host to the collector without blocking
+// the data path, drop it if the collector is busy
+func (s *Server) reportSrc(src string) {
+	select {
+	case s.srcChan <- src:
+	default:
+	}
+}
+
+// collectSrc dedups reported src hosts for the next report
+func (s *Server) collectSrc() {
+	for src := range s.srcChan {
+		AddHost(src)
+	}
+}
+
+// route returns peer address of dst,
+// flows from src to dst stick to the same peer among equal peers.
+// overlapping cidrs are tried in routeOrder so the same
+// peers always give the same decision
+func (s *Server) route(vni uint32, src, dst string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ip := net.ParseIP(dst)
+	if ip == nil {
+		return "", fmt.Errorf("invalid destination %s", dst)
+	}
+
+	matches := make([]*peerConn, 0, 4)
+	for _, p := range s.peerConns[vni] {
+		if p.ipnet != nil && p.ipnet.Contains(ip) {
+			matches = append(matches, p)
+		}
+	}
+	sortRoutes(matches)
+
+	// draining peer is only used if there is no other choice
+	fallback, held := "", false
+	for _, p := range matches {
+		addr := s.activeAddr(p)
+		if len(p.paths) > 1 && addr == p.addr {
+			addr = s.selectPath(p, src+"-"+dst)
 		}
 
-		sp := strings.Split(p.cidr, "/")
-		if len(sp) != 2 {
-			log.Error("parse cidr fail: %v", err)
+		// dead primary held down without standby up yet
+		if p.held && addr == p.addr {
+			held = true
 			continue
 		}
 
-		dstCidr := fmt.Sprintf("%s/%s", dst, sp[1])
-		_, dstNet, err := net.ParseCIDR(dstCidr)
-		if err != nil {
-			log.Error("parse cidr fail: %v", err)
+		// ignore peer ip address
+		ip, _, _ := net.SplitHostPort(addr)
+		if ip == dst {
 			continue
 		}
 
-		if ipnet.String() == dstNet.String() {
-			// ignore peer ip address
-			ip, _, _ := net.SplitHostPort(p.addr)
-			if ip == dst {
-				continue
+		if p.draining {
+			if len(fallback) == 0 {
+				fallback = addr
 			}
-
-			return p.addr, nil
+			continue
 		}
+
+		return addr, nil
+	}
+
+	if len(fallback) > 0 {
+		return fallback, nil
+	}
+	if held {
+		return "", errHeldDown
 	}
 
 	return "", fmt.Errorf("no route")
 }
 
+// routeOrder reports whether a is tried before b,
+// the more specific cidr first and ties are broken by cidr
+func routeOrder(a, b *peerConn) bool {
+	la, lb := a.prefixLen(), b.prefixLen()
+	if la != lb {
+		return la > lb
+	}
+	return a.cidr < b.cidr
+}
+
+func (pc *peerConn) prefixLen() int {
+	if pc.ipnet == nil {
+		return 0
+	}
+	ones, _ := pc.ipnet.Mask.Size()
+	return ones
+}
+
+// sortRoutes sorts the few matched peers in routeOrder
+func sortRoutes(peers []*peerConn) {
+	for i := 1; i < len(peers); i++ {
+		for j := i; j > 0 && routeOrder(peers[j], peers[j-1]); j-- {
+			peers[j], peers[j-1] = peers[j-1], peers[j]
+		}
+	}
+}
+
 func (s *Server) addRoute(peer *codec.Edge) error {
 	log.Info("adding peer: %v", peer)
+	s.expireMu.RLock()
+	defer s.expireMu.RUnlock()
+
+	if peer.Vni > maxVNI {
+		err := permanent(fmt.Errorf("invalid vni %d", peer.Vni))
+		log.Error("add peer %v fail: %v", peer, err)
+		AddErrorLog(err)
+		return err
+	}
+
+	switch peer.Transport {
+	case "", transportUDP, transportTCP:
+	default:
+		err := permanent(fmt.Errorf("unsupported transport %s", peer.Transport))
+		log.Error("add peer %v fail: %v", peer, err)
+		AddErrorLog(err)
+		return err
+	}
+
+	iface := s.ifaces[peer.Vni]
+	if iface == nil {
+		err := permanent(fmt.Errorf("no interface for vni %d", peer.Vni))
+		log.Error("add peer %v fail: %v", peer, err)
+		AddErrorLog(err)
+		return err
+	}
+
+	if err := s.checkNested(peer); err != nil {
+		err = permanent(err)
+		log.Error("add peer %v fail: %v", peer, err)
+		AddErrorLog(err)
+		return err
+	}
 
-	ipmask := strings.Split(peer.Cidr, "/")
-	cidrtype := "-net"
-	if len(ipmask) == 1 || ipmask[1] == "32" {
-		cidrtype = "-host"
+	if err := s.checkRouteLimits(peer); err != nil {
+		log.Error("add peer %v fail: %v", peer, err)
+		AddErrorLog(err)
+		return err
 	}
 
 	// add vpc route
@@ -211,26 +850,72 @@ func (s *Server) addRoute(peer *codec.Edge) error {
 	}
 
 	// add local static route
-	execCmd("route", []string{"del", cidrtype,
-		peer.Cidr, "dev", s.iface.tun.Name()})
-
-	out, err := execCmd("route", []string{"add", cidrtype,
-		peer.Cidr, "dev", s.iface.tun.Name()})
+	err := s.installRoute(peer.ListenAddr, peer.Cidr, iface.tun.Name())
 	if err != nil {
-		log.Error("route add %s %s dev %s, %s %v\n",
-			peer.Cidr, cidrtype, s.iface.tun.Name(), out, err)
+		log.Error("add peer %v fail: %v", peer, err)
 		AddErrorLog(err)
 		return err
 	}
 
 	// add memory route
-	if cidrtype == "-host" {
-		peer.Cidr = fmt.Sprintf("%s/32", ipmask[0])
+	peer.Cidr = hostCIDR(peer.Cidr)
+
+	s.mu.Lock()
+	if len(peer.Transport) > 0 {
+		s.peerTransports[peer.ListenAddr] = peer.Transport
+	} else {
+		delete(s.peerTransports, peer.ListenAddr)
+	}
+	peers := s.peerConns[peer.Vni]
+	if peers == nil {
+		peers = make(map[string]*peerConn)
+		s.peerConns[peer.Vni] = peers
 	}
+	// addresses no longer serving the cidr
+	var released []string
+	old, ok := peers[peer.Cidr]
+	if ok && peer.Standby {
+		if len(old.standby) > 0 && old.standby != peer.ListenAddr {
+			released = []string{old.standby}
+		}
+		old.standby, old.standbyID = peer.ListenAddr, peerID(peer)
+	} else if ok && peer.Weight > 0 && len(old.paths) > 0 && !old.draining {
+		old.addPath(peer.ListenAddr, peerID(peer), peer.Weight)
+	} else {
+		if ok && old.drainTimer != nil {
+			old.drainTimer.Stop()
+		}
+		if ok {
+			released = old.addrsExcept(peer.ListenAddr, old.standby)
+		}
+		pc := newPeerConn(peer.ListenAddr, peer.Cidr)
+		pc.id = peerID(peer)
+		if ok {
+			pc.standby, pc.standbyID = old.standby, old.standbyID
+		}
+		if peer.Standby {
+			pc.addr, pc.standby = "", peer.ListenAddr
+			pc.id, pc.standbyID = "", peerID(peer)
+		}
+		if peer.Weight > 0 && !peer.Standby {
+			pc.addPath(peer.ListenAddr, peerID(peer), peer.Weight)
+		}
+		if !ok {
+			s.peerAdded()
+		}
+		peers[peer.Cidr] = pc
+	}
+	s.indexPeers()
+	s.mu.Unlock()
+	s.releaseAggregate(peer.Vni, peer.Cidr, released)
 
-	s.peerConns[peer.Cidr] = &peerConn{
-		addr: peer.ListenAddr,
-		cidr: peer.Cidr,
+	if len(s.ciphers) > 0 && s.conn != nil && !s.trusted(peer.ListenAddr) {
+		raddr, err := net.ResolveUDPAddr("udp", peer.ListenAddr)
+		if err != nil {
+			log.Error("parse %s fail: %v", peer.ListenAddr, err)
+		} else {
+			s.handshake(raddr)
+		}
 	}
 
 	log.Info("added peer %v OK", peer)
@@ -240,49 +925,152 @@ func (s *Server) addRoute(peer *codec.Edge) error {
 
 func (s *Server) delRoute(peer *codec.Edge) {
 	log.Info("del peer: %v", peer)
-	ipmask := strings.Split(peer.Cidr, "/")
-	cidrtype := "-net"
-	if len(ipmask) == 1 || ipmask[1] == "32" {
-		cidrtype = "-host"
+
+	// other paths still serve the cidr
+	if s.delPath(peer) {
+		if s.aggregator != nil {
+			if iface := s.ifaces[peer.Vni]; iface != nil {
+				s.aggregator.del(s.installed, peer.ListenAddr, peer.Cidr, iface.tun.Name())
+			}
+		}
+		s.forgetQueues([]string{peer.ListenAddr})
+		log.Info("del peer %s OK, route kept", peer)
+		return
 	}
-	out, err := execCmd("route", []string{"del", cidrtype,
-		peer.Cidr, "dev", s.iface.tun.Name()})
-	log.Info("route del %s %s dev %s, %s %v",
-		cidrtype, peer.Cidr, s.iface.tun.Name(), out, err)
 
-	if cidrtype == "-host" {
-		peer.Cidr = fmt.Sprintf("%s/32", ipmask[0])
+	iface := s.ifaces[peer.Vni]
+	if iface != nil {
+		err := s.uninstallRoute(peer.ListenAddr, peer.Cidr, iface.tun.Name())
+		if err != nil {
+			log.Error("del peer %v fail: %v", peer, err)
+		}
 	}
 
-	delete(s.peerConns, peer.Cidr)
+	peer.Cidr = hostCIDR(peer.Cidr)
+
+	// other addresses of the cidr, eg: peer moved since added
+	var released []string
+	s.mu.Lock()
+	if pc, ok := s.peerConns[peer.Vni][peer.Cidr]; ok {
+		released = pc.addrsExcept(peer.ListenAddr)
+		delete(s.peerConns[peer.Vni], peer.Cidr)
+		s.peerRemoved()
+		s.indexPeers()
+	}
+	s.mu.Unlock()
+	s.releaseAggregate(peer.Vni, peer.Cidr, released)
+	s.forgetQueues(append(released, peer.ListenAddr))
 	log.Info("del peer %s OK", peer)
 	log.Info("==========================\n")
 }
 
 func (s *Server) AddPeers(peers []*codec.Edge) {
-	for _, p := range peers {
-		s.addRoute(p)
-	}
+	s.beginConverge(peers, time.Now())
+	s.installPeers(peers)
+	s.checkConverge(time.Now())
 }
 
 func (s *Server) AddPeer(peer *codec.Edge) {
-	s.addRoute(peer)
+	s.beginConverge([]*codec.Edge{peer}, time.Now())
+	s.installPeer(peer)
+	s.checkConverge(time.Now())
 }
 
 func (s *Server) DelPeer(peer *codec.Edge) {
+	s.cancelStaggered(peerKey(peer) + "@" + peer.ListenAddr)
+	s.forgetPeer(peer)
+	s.forgetIdle(peer)
+
+	// never added or already deleted
+	if !s.hasPeer(peer) {
+		log.Debug("del peer %v: peer not found", peer)
+		return
+	}
+
+	if s.holdDown(peer) {
+		return
+	}
+
+	if s.drainGrace <= 0 {
+		s.delRoute(peer)
+		return
+	}
+
+	// standby is not used for new flows unless primary is down
+	// and flows of a path are taken over by other equal peers
+	if peer.Standby || s.multiPath(peer) {
+		s.delRoute(peer)
+		return
+	}
+
+	s.drainPeer(peer)
+}
+
+// hasPeer reports whether cidr of peer is in the routing table
+func (s *Server) hasPeer(peer *codec.Edge) bool {
+	cidr := hostCIDR(peer.Cidr)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.peerConns[peer.Vni][cidr]
+	return ok
+}
+
+// drainPeer marks peer as draining, new flows avoid it
+// but the route is kept for drainGrace before removed
+func (s *Server) drainPeer(peer *codec.Edge) {
+	cidr := hostCIDR(peer.Cidr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pc, ok := s.peerConns[peer.Vni][cidr]
+	if !ok {
+		log.Warn("drain peer %v: peer not found", peer)
+		return
+	}
+
+	if pc.draining {
+		return
+	}
+
+	log.Info("draining peer %v for %v", peer, s.drainGrace)
+	pc.draining = true
+	pc.drainTimer = time.AfterFunc(s.drainGrace, func() {
+		s.expirePeer(peer, cidr, pc)
+	})
+}
+
+// expirePeer removes peer once draining or holddown of pc elapsed,
+// unless the peer is re-added meanwhile and pc is replaced.
+// addRoute waits until removed, so the peer is never re-added
+// between the check and the removal
+func (s *Server) expirePeer(peer *codec.Edge, cidr string, pc *peerConn) {
+	s.expireMu.Lock()
+	defer s.expireMu.Unlock()
+
+	s.mu.RLock()
+	cur := s.peerConns[peer.Vni][cidr]
+	s.mu.RUnlock()
+	if cur != pc {
+		return
+	}
 	s.delRoute(peer)
 }
 
 func (s *Server) AddRoute(msg *codec.AddRouteMsg) {
-	s.addRoute(&codec.Edge{
+	s.installPeer(&codec.Edge{
 		Cidr:       msg.Cidr,
 		ListenAddr: msg.Nexthop,
+		Vni:        msg.Vni,
 	})
 }
 
 func (s *Server) DelRoute(msg *codec.DelRouteMsg) {
-	s.delRoute(&codec.Edge{
+	peer := &codec.Edge{
 		Cidr:       msg.Cidr,
 		ListenAddr: msg.Nexthop,
-	})
+		Vni:        msg.Vni,
+	}
+	s.forgetPeer(peer)
+	s.delRoute(peer)
 }
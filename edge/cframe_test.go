@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// fakeTun feeds packets written to in as local packets
+// and collects packets written by Server to out
+type fakeTun struct {
+	name string
+	in   chan []byte
+	out  chan []byte
+}
+
+func newFakeTun(name string) *fakeTun {
+	return &fakeTun{
+		name: name,
+		in:   make(chan []byte, 16),
+		out:  make(chan []byte, 16),
+	}
+}
+
+func (t *fakeTun) Read(buf []byte) (int, error) {
+	pkt, ok := <-t.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(buf, pkt), nil
+}
+
+func (t *fakeTun) Write(buf []byte) (int, error) {
+	pkt := make([]byte, len(buf))
+	copy(pkt, buf)
+	t.out <- pkt
+	return len(buf), nil
+}
+
+func (t *fakeTun) Close() error { return nil }
+
+func (t *fakeTun) Name() string { return t.name }
+
+// ipPacket builds a minimal ipv4 header from src to dst,
+// ipv6 if src is an ipv6 address
+func ipPacket(src, dst string) []byte {
+	if ip := net.ParseIP(src); ip != nil && ip.To4() == nil {
+		pkt := make([]byte, 40)
+		pkt[0] = 0x60
+		copy(pkt[8:24], ip)
+		copy(pkt[24:40], net.ParseIP(dst))
+		return pkt
+	}
+	pkt := make([]byte, 20)
+	pkt[0] = 0x45
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	return pkt
+}
+
+func listenLocal(t testing.TB) *net.UDPConn {
+	lconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lconn
+}
+
+func TestDrainPeer(t *testing.T) {
+	s := NewServer("", "key", nil)
+	s.SetDrainGrace(time.Hour)
+	s.peerConns[0] = map[string]*peerConn{
+		"10.0.1.0/24": newPeerConn("1.1.1.1:58423", "10.0.1.0/24"),
+		"10.0.0.0/16": newPeerConn("2.2.2.2:58423", "10.0.0.0/16"),
+	}
+
+	s.DelPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"})
+
+	pc, ok := s.peerConns[0]["10.0.1.0/24"]
+	if !ok {
+		t.Fatalf("draining peer removed before grace elapsed")
+	}
+	if !pc.draining {
+		t.Fatalf("peer not marked draining")
+	}
+	defer pc.drainTimer.Stop()
+
+	// new flows avoid the draining peer
+	for i := 0; i < 10; i++ {
+		peer, err := s.route(0, "", "10.0.1.10")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peer != "2.2.2.2:58423" {
+			t.Fatalf("expected route to 2.2.2.2:58423, got %s", peer)
+		}
+	}
+
+	// draining peer still forwards if no other choice
+	delete(s.peerConns[0], "10.0.0.0/16")
+	peer, err := s.route(0, "", "10.0.1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer != "1.1.1.1:58423" {
+		t.Fatalf("expected route to draining peer, got %s", peer)
+	}
+}
+
+func TestDrainPeerReAdded(t *testing.T) {
+	s := NewServer("", "key", nil)
+	s.SetRouteManager(noopRoutes{})
+	s.AddInterface(0, &Interface{tun: newBenchTun("drain.0")})
+	s.SetDrainGrace(time.Millisecond * 50)
+	peer := &codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"}
+
+	// re-added during draining, kept once grace elapsed
+	s.AddPeer(copyEdge(peer))
+	s.DelPeer(copyEdge(peer))
+	s.AddPeer(copyEdge(peer))
+	time.Sleep(time.Millisecond * 150)
+	if p, err := s.route(0, "", "10.0.1.10"); err != nil || p != peer.ListenAddr {
+		t.Fatalf("re-added peer removed by drain: %q %v", p, err)
+	}
+
+	// timer of the replaced peerConn fired late
+	s.mu.RLock()
+	pc := s.peerConns[0]["10.0.1.0/24"]
+	s.mu.RUnlock()
+	s.expirePeer(copyEdge(peer), "10.0.1.0/24", newPeerConn(peer.ListenAddr, peer.Cidr))
+	if !s.hasPeer(peer) {
+		t.Fatalf("re-added peer removed by stale timer")
+	}
+
+	// re-add waits for the peer being removed
+	s.expireMu.Lock()
+	done := make(chan struct{})
+	go func() {
+		s.AddPeer(copyEdge(peer))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("peer re-added while removed")
+	case <-time.After(time.Millisecond * 50):
+	}
+	s.delRoute(copyEdge(peer))
+	s.expireMu.Unlock()
+	<-done
+	s.mu.RLock()
+	cur := s.peerConns[0]["10.0.1.0/24"]
+	s.mu.RUnlock()
+	if cur == nil || cur == pc {
+		t.Fatalf("peer not re-added once removed")
+	}
+}
+
+func BenchmarkReportSrc(b *testing.B) {
+	// no collector running, reportSrc must never block
+	s := NewServer("", "key", nil)
+	for i := 0; i < b.N; i++ {
+		s.reportSrc("192.168.1.1")
+	}
+}
+
+func TestVNIIsolation(t *testing.T) {
+	// edge a and edge b, both serve vni 1 and vni 2
+	// with the same cidr in each vni
+	a1, a2 := newFakeTun("a1"), newFakeTun("a2")
+	b1, b2 := newFakeTun("b1"), newFakeTun("b2")
+
+	a := NewServer("", "key", nil)
+	a.AddInterface(1, &Interface{tun: a1})
+	a.AddInterface(2, &Interface{tun: a2})
+
+	b := NewServer("", "key", nil)
+	b.AddInterface(1, &Interface{tun: b1})
+	b.AddInterface(2, &Interface{tun: b2})
+
+	aconn, bconn := listenLocal(t), listenLocal(t)
+	baddr := bconn.LocalAddr().String()
+	for _, vni := range []uint32{1, 2} {
+		a.peerConns[vni] = map[string]*peerConn{
+			"10.0.0.0/24": newPeerConn(baddr, "10.0.0.0/24"),
+		}
+	}
+
+	go a.readLocal(aconn, 1, a.ifaces[1])
+	go a.readLocal(aconn, 2, a.ifaces[2])
+	go b.readRemote(bconn)
+
+	check := func(in *fakeTun, expect, other *fakeTun, src string) {
+		in.in <- ipPacket(src, "10.0.0.5")
+		select {
+		case pkt := <-expect.out:
+			if got := Packet(pkt).Src(); got != src {
+				t.Fatalf("%s: expected src %s, got %s", expect.name, src, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: packet not delivered", expect.name)
+		}
+
+		select {
+		case <-other.out:
+			t.Fatalf("%s: cross talk packet received", other.name)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	check(a1, b1, b2, "10.0.0.1")
+	check(a2, b2, b1, "10.0.0.2")
+}
+
+func TestDataHeader(t *testing.T) {
+	pkt := ipPacket("10.0.0.1", "10.0.0.2")
+	for _, vni := range []uint32{0, 1, maxVNI} {
+		buf := encodeData("key", vni, pkt)
+		got, ippkt := decodeData(buf[3:])
+		if got != vni {
+			t.Fatalf("expected vni %d, got %d", vni, got)
+		}
+		if string(ippkt) != string(pkt) {
+			t.Fatalf("vni %d: packet mismatch", vni)
+		}
+	}
+}
+
+// retainTun keeps packets written without copying
+// and checks them after the next reads
+type retainTun struct {
+	*fakeTun
+	kept chan []byte
+}
+
+func (t *retainTun) Write(buf []byte) (int, error) {
+	t.kept <- buf
+	return len(buf), nil
+}
+
+func TestReadRemoteHandoff(t *testing.T) {
+	tun := &retainTun{fakeTun: newFakeTun("tun"), kept: make(chan []byte, 64)}
+	b := NewServer("", "key", nil)
+	b.AddInterface(0, &Interface{tun: tun})
+	bconn := listenLocal(t)
+	go b.readRemote(bconn)
+
+	aconn := listenLocal(t)
+	const count = 32
+	for i := 0; i < count; i++ {
+		pkt := ipPacket("10.0.0.1", "10.0.0.2")
+		pkt = append(pkt, bytes.Repeat([]byte{byte(i)}, 100)...)
+		if _, err := aconn.WriteToUDP(b.encap.EncodeData(0, pkt), bconn.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		var pkt []byte
+		select {
+		case pkt = <-tun.kept:
+		case <-time.After(time.Second):
+			t.Fatalf("%d of %d packets delivered", i, count)
+		}
+
+		// retained while later packets are read
+		time.Sleep(time.Millisecond)
+		if !bytes.Equal(pkt[20:], bytes.Repeat([]byte{byte(i)}, 100)) {
+			t.Fatalf("packet %d overwritten by later read", i)
+		}
+	}
+}
+
+func TestRouteDeterministic(t *testing.T) {
+	peers := []*codec.Edge{
+		{Cidr: "10.0.1.9/24", ListenAddr: "9.9.9.9:58423"},
+		{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"},
+		{Cidr: "10.0.1.5/24", ListenAddr: "5.5.5.5:58423"},
+		{Cidr: "10.0.0.0/16", ListenAddr: "2.2.2.2:58423"},
+		{Cidr: "10.0.1.128/25", ListenAddr: "3.3.3.3:58423"},
+	}
+
+	for i := 0; i < 20; i++ {
+		s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+		s.SetRouteManager(newFakeRoutes())
+		// peers added in different order
+		for j := range peers {
+			s.AddPeer(copyEdge(peers[(i+j)%len(peers)]))
+		}
+
+		for k := 0; k < 10; k++ {
+			if addr, _ := s.route(0, "", "10.0.1.1"); addr != "1.1.1.1:58423" {
+				t.Fatalf("round %d: expected 1.1.1.1:58423 among equal cidrs, got %s", i, addr)
+			}
+			if addr, _ := s.route(0, "", "10.0.1.200"); addr != "3.3.3.3:58423" {
+				t.Fatalf("round %d: expected the more specific 3.3.3.3:58423, got %s", i, addr)
+			}
+			if addr, _ := s.route(0, "", "10.0.2.1"); addr != "2.2.2.2:58423" {
+				t.Fatalf("round %d: expected 2.2.2.2:58423, got %s", i, addr)
+			}
+		}
+	}
+}
+
+func BenchmarkRoute(b *testing.B) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+	for i := 0; i < 64; i++ {
+		s.AddPeer(&codec.Edge{
+			Cidr:       fmt.Sprintf("10.0.%d.0/24", i),
+			ListenAddr: fmt.Sprintf("1.1.1.%d:58423", i),
+		})
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.route(0, "10.0.9.1", "10.0.33.1")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// ChaosConfig drops and delays packets to test resilience,
+// only honored by edges built with the chaos tag, see chaos_on.go
+type ChaosConfig struct {
+	// ratio of data and control packets dropped on receive
+	Drop     float64 `json:"drop"`
+	CtrlDrop float64 `json:"ctrl_drop"`
+	// data packets are delayed up to Delay before sent
+	Delay time.Duration `json:"delay"`
+}
+
+// ParseChaos parses comma separated chaos options,
+// eg: drop=0.1,ctrl_drop=0.05,delay=50ms
+func ParseChaos(s string) (*ChaosConfig, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return nil, nil
+	}
+
+	cfg := &ChaosConfig{}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid chaos option %s", pair)
+		}
+
+		var err error
+		switch kv[0] {
+		case "drop":
+			cfg.Drop, err = parseRatio(kv[1])
+		case "ctrl_drop":
+			cfg.CtrlDrop, err = parseRatio(kv[1])
+		case "delay":
+			cfg.Delay, err = time.ParseDuration(kv[1])
+		default:
+			err = fmt.Errorf("unsupported")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid chaos option %s: %v", pair, err)
+		}
+	}
+	return cfg, nil
+}
+
+func parseRatio(s string) (float64, error) {
+	r, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if r < 0 || r > 1 {
+		return 0, fmt.Errorf("ratio out of [0, 1]")
+	}
+	return r, nil
+}
+
+// chaos decides fate of each packet
+type chaos struct {
+	cfg ChaosConfig
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newChaos(cfg *ChaosConfig, seed int64) *chaos {
+	return &chaos{cfg: *cfg, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// drop reports whether a received packet is dropped
+func (c *chaos) drop(ctrl bool) bool {
+	ratio := c.cfg.Drop
+	if ctrl {
+		ratio = c.cfg.CtrlDrop
+	}
+	if ratio <= 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rnd.Float64() < ratio
+}
+
+// delay returns how long a sent data packet is delayed
+func (c *chaos) delay() time.Duration {
+	if c.cfg.Delay <= 0 {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.rnd.Int63n(int64(c.cfg.Delay)))
+}
+
+// SetChaos drops and delays packets as cfg, fails unless
+// the edge is built with the chaos tag so production
+// builds never lose packets on purpose
+func (s *Server) SetChaos(cfg *ChaosConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if !chaosBuild {
+		return fmt.Errorf("chaos requires an edge built with -tags chaos")
+	}
+
+	log.Warn("CHAOS MODE: drop %.2f, ctrl drop %.2f, delay up to %v",
+		cfg.Drop, cfg.CtrlDrop, cfg.Delay)
+	s.chaos = newChaos(cfg, time.Now().UnixNano())
+	return nil
+}
+
+func (s *Server) chaosDrop(ctrl bool) bool {
+	return s.chaos != nil && s.chaos.drop(ctrl)
+}
+
+func (s *Server) chaosDelay() time.Duration {
+	if s.chaos == nil {
+		return 0
+	}
+	return s.chaos.delay()
+}
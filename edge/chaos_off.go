@@ -0,0 +1,7 @@
+//go:build !chaos
+// +build !chaos
+
+package main
+
+// chaos injection is refused by production builds, see chaos.go
+const chaosBuild = false
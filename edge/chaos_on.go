@@ -0,0 +1,7 @@
+//go:build chaos
+// +build chaos
+
+package main
+
+// chaos injection is compiled in, see chaos.go
+const chaosBuild = true
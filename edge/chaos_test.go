@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseChaos(t *testing.T) {
+	cfg, err := ParseChaos("drop=0.1, ctrl_drop=0.05,delay=50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Drop != 0.1 || cfg.CtrlDrop != 0.05 || cfg.Delay != 50*time.Millisecond {
+		t.Fatalf("unexpected %+v", cfg)
+	}
+
+	for _, s := range []string{"drop=1.5", "drop=-0.1", "loss=0.1", "delay=1x", "drop"} {
+		if _, err := ParseChaos(s); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+
+	if cfg, err := ParseChaos(""); cfg != nil || err != nil {
+		t.Fatalf("expected nil for empty, got %v %v", cfg, err)
+	}
+}
+
+func TestChaosDeliveryRatio(t *testing.T) {
+	c := newChaos(&ChaosConfig{Drop: 0.3, CtrlDrop: 0.1}, 1)
+
+	const total = 10000
+	for _, tc := range []struct {
+		ctrl  bool
+		ratio float64
+	}{{false, 0.7}, {true, 0.9}} {
+		delivered := 0
+		for i := 0; i < total; i++ {
+			if !c.drop(tc.ctrl) {
+				delivered++
+			}
+		}
+
+		got := float64(delivered) / total
+		if math.Abs(got-tc.ratio) > 0.03 {
+			t.Errorf("ctrl %v: delivery ratio %.3f, expected %.2f", tc.ctrl, got, tc.ratio)
+		}
+	}
+}
+
+func TestChaosDelay(t *testing.T) {
+	c := newChaos(&ChaosConfig{Delay: 10 * time.Millisecond}, 1)
+	for i := 0; i < 100; i++ {
+		if d := c.delay(); d < 0 || d >= 10*time.Millisecond {
+			t.Fatalf("delay %v out of range", d)
+		}
+	}
+	if c.drop(false) || c.drop(true) {
+		t.Fatal("zero ratio drops packet")
+	}
+}
+
+func TestSetChaosGated(t *testing.T) {
+	s := &Server{}
+	err := s.SetChaos(&ChaosConfig{Drop: 0.1})
+	if chaosBuild != (err == nil) {
+		t.Fatalf("chaos build %v, SetChaos err %v", chaosBuild, err)
+	}
+	if !chaosBuild && s.chaosDrop(false) {
+		t.Fatal("production build drops packet")
+	}
+}
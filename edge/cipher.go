@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// sealed data packet, used as inner packet of any encapsulation
+// | 1byte magic(0x02) | 1byte key epoch | nonce | ciphertext |
+// 0x02 is never the first byte of an ip packet, see rekey.go for epoch
+const sealMagic = 0x02
+
+// magic and epoch
+const sealHeaderSize = 2
+
+const (
+	cipherNone     = "none"
+	cipherAES128   = "aes-128-gcm"
+	cipherChaCha20 = "chacha20-poly1305"
+	cipherAES256   = "aes-256-gcm"
+
+	// integrity only, payload is not encrypted, see hmac.go
+	cipherHMAC = "hmac-sha256"
+)
+
+// cipher suites from the strongest to the weakest,
+// both sides pick the first common one so they always agree
+var cipherSuites = []string{
+	cipherAES256,
+	cipherChaCha20,
+	cipherAES128,
+	cipherHMAC,
+	cipherNone,
+}
+
+// session is the negotiated cipher with a peer,
+// aead is the key of send epoch, nil for none cipher
+// and recv keeps keys of epochs accepted from peer
+type session struct {
+	// nonce counter of the send key, reset with the key
+	seq uint64
+
+	cipher string
+	err    error
+
+	// keys of every epoch and direction are derived from the x25519
+	// shared secret with peer, which never goes on the wire
+	shared []byte
+	local  []byte
+	remote []byte
+
+	mu    sync.RWMutex
+	epoch byte
+	aead  cipher.AEAD
+	recv  map[byte]*epochKey
+}
+
+func newSession(name string, send, recv cipher.AEAD) *session {
+	return &session{
+		cipher: name,
+		aead:   send,
+		recv:   map[byte]*epochKey{0: {aead: recv}},
+	}
+}
+
+func (sess *session) sendKey() (byte, cipher.AEAD) {
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	return sess.epoch, sess.aead
+}
+
+// setSendKey switches to key of epoch, nonces restart from 0
+func (sess *session) setSendKey(epoch byte, aead cipher.AEAD) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.epoch, sess.aead = epoch, aead
+	atomic.StoreUint64(&sess.seq, 0)
+}
+
+// seal seals pkt by the send key with the next nonce
+func (sess *session) seal(pkt []byte) ([]byte, error) {
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	if sess.aead == nil {
+		return pkt, nil
+	}
+	return seal(sess.aead, sess.epoch, atomic.AddUint64(&sess.seq, 1)-1, pkt)
+}
+
+// recvKey returns key of epoch unless it expired
+func (sess *session) recvKey(epoch byte, now time.Time) (cipher.AEAD, error) {
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	k := sess.recv[epoch]
+	if k == nil || k.expired(now) {
+		return nil, fmt.Errorf("key of epoch %d not accepted", epoch)
+	}
+	return k.aead, nil
+}
+
+func isSealed(pkt []byte) bool {
+	return len(pkt) > 0 && pkt[0] == sealMagic
+}
+
+// ParseCiphers parses comma separated cipher suites
+func ParseCiphers(s string) ([]string, error) {
+	ciphers := make([]string, 0)
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if len(c) == 0 {
+			continue
+		}
+
+		if !supportCipher(c) {
+			return nil, fmt.Errorf("unsupported cipher %s", c)
+		}
+		ciphers = append(ciphers, c)
+	}
+	return ciphers, nil
+}
+
+func supportCipher(c string) bool {
+	for _, suite := range cipherSuites {
+		if suite == c {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateCipher returns the strongest cipher supported by both sides
+func negotiateCipher(local, remote []string) (string, error) {
+	has := func(list []string, c string) bool {
+		for _, l := range list {
+			if l == c {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, suite := range cipherSuites {
+		if has(local, suite) && has(remote, suite) {
+			return suite, nil
+		}
+	}
+	return "", fmt.Errorf("no common cipher, local %v remote %v", local, remote)
+}
+
+// newAEAD creates cipher of name with 32 bytes key
+func newAEAD(name string, key []byte) (cipher.AEAD, error) {
+	switch name {
+	case cipherNone:
+		return nil, nil
+
+	case cipherAES128, cipherAES256:
+		klen := 32
+		if name == cipherAES128 {
+			klen = 16
+		}
+		block, err := aes.NewCipher(key[:klen])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+
+	case cipherChaCha20:
+		return chacha20poly1305.New(key)
+
+	case cipherHMAC:
+		return newHMAC(key), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported cipher %s", name)
+	}
+}
+
+// deriveAEAD derives key of packets sent by the side of public
+// key from to the side of public key to, so each direction has
+// its own key. salt is the rekey salt, empty for epoch 0
+func deriveAEAD(name, secret string, shared, from, to, salt []byte) (cipher.AEAD, error) {
+	info := []byte("cframe " + name + " ")
+	info = append(info, from...)
+	info = append(info, to...)
+	info = append(info, salt...)
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, []byte(secret), info), key); err != nil {
+		return nil, err
+	}
+	return newAEAD(name, key)
+}
+
+// seal seals pkt with counter nonce seq, never reused with a key
+func seal(aead cipher.AEAD, epoch byte, seq uint64, pkt []byte) ([]byte, error) {
+	hlen := sealHeaderSize + aead.NonceSize()
+	buf := make([]byte, hlen, hlen+len(pkt)+aead.Overhead())
+	buf[0], buf[1] = sealMagic, epoch
+	nonce := buf[sealHeaderSize:]
+	if len(nonce) >= 8 {
+		binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	}
+	return aead.Seal(buf, nonce, pkt, nil), nil
+}
+
+func open(aead cipher.AEAD, pkt []byte) ([]byte, error) {
+	hlen := sealHeaderSize + aead.NonceSize()
+	if len(pkt) < hlen {
+		return nil, fmt.Errorf("sealed pkt to small")
+	}
+	nonce, ciphertext := pkt[sealHeaderSize:hlen], pkt[hlen:]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// sessions keyed by peer udp address
+type sessions struct {
+	mu sync.RWMutex
+	m  map[string]*session
+
+	// x25519 key pair of each peer, kept for the process
+	// lifetime so hellos of both sides derive the same keys
+	keys map[string]*kexKey
+}
+
+type kexKey struct {
+	priv []byte
+	pub  []byte
+}
+
+// kexKey returns key pair of peer addr, generated once
+func (ss *sessions) kexKey(addr string) (*kexKey, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if k := ss.keys[addr]; k != nil {
+		return k, nil
+	}
+
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	if ss.keys == nil {
+		ss.keys = make(map[string]*kexKey)
+	}
+	k := &kexKey{priv: priv, pub: pub}
+	ss.keys[addr] = k
+	return k, nil
+}
+
+func (ss *sessions) get(addr string) *session {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.m[addr]
+}
+
+func (ss *sessions) addrs() []string {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	addrs := make([]string, 0, len(ss.m))
+	for addr := range ss.m {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (ss *sessions) set(addr string, sess *session) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.m[addr] = sess
+}
+
+// hello advertises local ciphers and the x25519 public key for peer
+// | ciphers, comma separated | ; | hex public key |
+func (s *Server) hello(addr *net.UDPAddr) ([]byte, error) {
+	k, err := s.sessions.kexKey(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(s.advertiseCiphers(), ",") + ";" + hex.EncodeToString(k.pub)), nil
+}
+
+// handshake advertises local ciphers and key share to peer,
+// peer replies with its own and both sides negotiate
+func (s *Server) handshake(addr *net.UDPAddr) <-chan error {
+	payload, err := s.hello(addr)
+	if err != nil {
+		done := make(chan error, 1)
+		done <- err
+		return done
+	}
+	return s.sendCtrl(addr, ctrlHello, payload, true)
+}
+
+// replyHello replies hello of peer with local ciphers and key share
+func (s *Server) replyHello(addr *net.UDPAddr) {
+	payload, err := s.hello(addr)
+	if err != nil {
+		log.Error("reply hello to %s fail: %v", addr, err)
+		return
+	}
+	s.sendCtrl(addr, ctrlHelloReply, payload, true)
+}
+
+// advertiseCiphers returns local ciphers,
+// edge with encryption disabled only accepts plain packets
+func (s *Server) advertiseCiphers() []string {
+	if len(s.ciphers) == 0 {
+		return []string{cipherNone}
+	}
+	return s.ciphers
+}
+
+// onHello negotiates cipher with ciphers advertised by peer
+// and derives keys of both directions from the key shares
+func (s *Server) onHello(from *net.UDPAddr, payload []byte) {
+	fail := func(err error) {
+		log.Error("handshake with %s fail: %v", from, err)
+		AddErrorLog(err)
+		s.sessions.set(from.String(), &session{err: err})
+	}
+
+	parts := strings.SplitN(string(payload), ";", 2)
+	name, err := negotiateCipher(s.advertiseCiphers(), strings.Split(parts[0], ","))
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	var remote []byte
+	if len(parts) == 2 {
+		remote, err = hex.DecodeString(parts[1])
+	}
+	if name != cipherNone && (err != nil || len(remote) != curve25519.PointSize) {
+		fail(fmt.Errorf("invalid key share for cipher %s", name))
+		return
+	}
+
+	// repeated hello of the same keys keeps the session,
+	// so nonces are never reused with a key
+	cur := s.sessions.get(from.String())
+	if cur != nil && cur.err == nil && cur.cipher == name && bytes.Equal(cur.remote, remote) {
+		return
+	}
+
+	sess, err := s.newPeerSession(from.String(), name, remote)
+	if err != nil {
+		fail(err)
+		return
+	}
+	log.Info("negotiated cipher %s with %s", name, from)
+	s.sessions.set(from.String(), sess)
+}
+
+// newPeerSession creates session of cipher name with peer addr,
+// keys are derived from x25519 of local key and remote public key
+func (s *Server) newPeerSession(addr, name string, remote []byte) (*session, error) {
+	if name == cipherNone {
+		return newSession(name, nil, nil), nil
+	}
+
+	k, err := s.sessions.kexKey(addr)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(k.priv, remote)
+	if err != nil {
+		return nil, err
+	}
+	send, err := deriveAEAD(name, s.key, shared, k.pub, remote, nil)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := deriveAEAD(name, s.key, shared, remote, k.pub, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := newSession(name, send, recv)
+	sess.shared, sess.local, sess.remote = shared, k.pub, remote
+	return sess, nil
+}
+
+// PeerCipher returns the cipher negotiated with peer
+func (s *Server) PeerCipher(addr string) (string, error) {
+	sess := s.sessions.get(addr)
+	if sess == nil {
+		return "", fmt.Errorf("no session with %s", addr)
+	}
+	return sess.cipher, sess.err
+}
+
+// encrypt seals pkt sent to addr with the negotiated cipher,
+// returns pkt itself if encryption is disabled or pkt is in the clear
+func (s *Server) encrypt(addr string, pkt []byte) ([]byte, error) {
+	if len(s.ciphers) == 0 || s.inClear(pkt) || s.trusted(addr) {
+		return pkt, nil
+	}
+
+	sess := s.sessions.get(addr)
+	if sess == nil {
+		return nil, fmt.Errorf("cipher with %s not negotiated", addr)
+	}
+	if sess.err != nil {
+		return nil, sess.err
+	}
+	return sess.seal(pkt)
+}
+
+// decrypt opens pkt received from addr,
+// plain packets are accepted only if none cipher is negotiated,
+// the packet is from or to a clear cidr or from a nested peer
+func (s *Server) decrypt(addr string, pkt []byte) ([]byte, error) {
+	if len(s.nested) > 0 {
+		if !s.trusted(addr) {
+			return nil, fmt.Errorf("not from nested cidrs")
+		}
+		if isSealed(pkt) {
+			return nil, fmt.Errorf("unexpected sealed pkt")
+		}
+		return pkt, nil
+	}
+
+	if len(s.ciphers) == 0 {
+		if isSealed(pkt) {
+			return nil, fmt.Errorf("encryption disabled")
+		}
+		return pkt, nil
+	}
+
+	sess := s.sessions.get(addr)
+	if sess == nil {
+		return nil, fmt.Errorf("cipher with %s not negotiated", addr)
+	}
+	if sess.err != nil {
+		return nil, sess.err
+	}
+	if sess.cipher == cipherNone {
+		if isSealed(pkt) {
+			return nil, fmt.Errorf("unexpected sealed pkt")
+		}
+		return pkt, nil
+	}
+
+	if !isSealed(pkt) && s.inClear(pkt) {
+		return pkt, nil
+	}
+	if !isSealed(pkt) || len(pkt) < sealHeaderSize {
+		return nil, fmt.Errorf("unexpected plain pkt")
+	}
+
+	aead, err := sess.recvKey(pkt[1], time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, pkt)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNegotiateCipher(t *testing.T) {
+	cases := []struct {
+		local, remote []string
+		expect        string
+	}{
+		{[]string{cipherAES128, cipherAES256}, []string{cipherAES256, cipherChaCha20}, cipherAES256},
+		{[]string{cipherChaCha20, cipherAES128}, []string{cipherAES128}, cipherAES128},
+		{[]string{cipherAES256, cipherNone}, []string{cipherNone}, cipherNone},
+	}
+
+	for _, c := range cases {
+		got, err := negotiateCipher(c.local, c.remote)
+		if err != nil {
+			t.Fatalf("%v %v: %v", c.local, c.remote, err)
+		}
+		if got != c.expect {
+			t.Fatalf("%v %v: expected %s, got %s", c.local, c.remote, c.expect, got)
+		}
+
+		// both sides agree
+		back, _ := negotiateCipher(c.remote, c.local)
+		if back != got {
+			t.Fatalf("%v %v: asymmetric negotiation %s %s", c.local, c.remote, got, back)
+		}
+	}
+
+	_, err := negotiateCipher([]string{cipherAES256}, []string{cipherChaCha20})
+	if err == nil {
+		t.Fatalf("expected no common cipher")
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	pkt := ipPacket("10.0.0.1", "10.0.0.2")
+	for _, name := range []string{cipherAES128, cipherAES256, cipherChaCha20, cipherHMAC} {
+		aead, err := newAEAD(name, testKey(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err := seal(aead, 0, 0, pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isSealed(buf) {
+			t.Fatalf("%s: sealed pkt without magic", name)
+		}
+
+		plain, err := open(aead, buf)
+		if err != nil {
+			t.Fatalf("%s: open fail: %v", name, err)
+		}
+		if !bytes.Equal(plain, pkt) {
+			t.Fatalf("%s: packet mismatch", name)
+		}
+
+		other, _ := newAEAD(name, testKey(2))
+		if _, err := open(other, buf); err == nil {
+			t.Fatalf("%s: expected open with wrong key fail", name)
+		}
+	}
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestHandshake(t *testing.T) {
+	cases := []struct {
+		a, b   []string
+		expect string
+		fail   bool
+	}{
+		{[]string{cipherAES256, cipherChaCha20}, []string{cipherChaCha20}, cipherChaCha20, false},
+		{[]string{cipherAES256}, []string{cipherChaCha20}, "", true},
+	}
+
+	for _, c := range cases {
+		a := NewServer("", "key", nil)
+		a.SetCiphers(c.a)
+		b := NewServer("", "key", nil)
+		b.SetCiphers(c.b)
+
+		a.conn, b.conn = listenLocal(t), listenLocal(t)
+		go a.readRemote(a.conn)
+		go b.readRemote(b.conn)
+
+		baddr := b.conn.LocalAddr().String()
+		aaddr := a.conn.LocalAddr().String()
+		if err := <-a.handshake(b.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+
+		// wait for the reply from b
+		deadline := time.Now().Add(time.Second)
+		for a.sessions.get(baddr) == nil && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		for _, side := range []struct {
+			s    *Server
+			peer string
+		}{{a, baddr}, {b, aaddr}} {
+			got, err := side.s.PeerCipher(side.peer)
+			if c.fail {
+				if err == nil {
+					t.Fatalf("%v %v: expected negotiation fail, got %s", c.a, c.b, got)
+				}
+				if _, err := side.s.encrypt(side.peer, ipPacket("10.0.0.1", "10.0.0.2")); err == nil {
+					t.Fatalf("%v %v: expected encrypt without cipher fail", c.a, c.b)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("%v %v: %v", c.a, c.b, err)
+			}
+			if got != c.expect {
+				t.Fatalf("%v %v: expected %s, got %s", c.a, c.b, c.expect, got)
+			}
+		}
+	}
+}
+
+func TestCapturedTraffic(t *testing.T) {
+	a := NewServer("", "key", nil)
+	a.SetCiphers([]string{cipherAES256})
+	b := NewServer("", "key", nil)
+	b.SetCiphers([]string{cipherAES256})
+	aaddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:10001")
+	baddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:10002")
+
+	// hellos on the wire
+	helloA, err := a.hello(baddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helloB, err := b.hello(aaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.onHello(aaddr, helloA)
+	a.onHello(baddr, helloB)
+
+	pkt := ipPacket("10.0.1.1", "10.0.2.1")
+	first, err := a.encrypt(baddr.String(), pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := a.encrypt(baddr.String(), pkt)
+	if plain, err := b.decrypt(aaddr.String(), second); err != nil || !bytes.Equal(plain, pkt) {
+		t.Fatalf("peer can not open traffic: %v", err)
+	}
+
+	// nonces are counters of the send key
+	nonce := func(buf []byte) []byte { return buf[sealHeaderSize : sealHeaderSize+12] }
+	if !bytes.Equal(nonce(first), make([]byte, 12)) || nonce(second)[11] != 1 {
+		t.Fatalf("unexpected nonces %x %x", nonce(first), nonce(second))
+	}
+
+	// each direction has its own key
+	reply, _ := b.encrypt(aaddr.String(), pkt)
+	_, sendB := b.sessions.get(aaddr.String()).sendKey()
+	if _, err := open(sendB, first); err == nil {
+		t.Fatalf("directions share a key")
+	}
+	if _, err := a.decrypt(baddr.String(), reply); err != nil {
+		t.Fatalf("reply not opened: %v", err)
+	}
+
+	// observer with the namespace secret and captured hellos
+	c := NewServer("", "key", nil)
+	c.SetCiphers([]string{cipherAES256})
+	c.onHello(baddr, helloB)
+	c.onHello(aaddr, helloA)
+	for _, from := range []string{aaddr.String(), baddr.String()} {
+		if _, err := c.decrypt(from, first); err == nil {
+			t.Fatalf("captured traffic opened by observer as %s", from)
+		}
+	}
+	static := sha256.Sum256([]byte(cipherAES256 + "|key"))
+	aead, _ := newAEAD(cipherAES256, static[:])
+	if _, err := open(aead, first); err == nil {
+		t.Fatalf("captured traffic opened by key of secret")
+	}
+
+	// repeated hello keeps the session and its nonces
+	b.onHello(aaddr, helloA)
+	a.onHello(baddr, helloB)
+	third, _ := a.encrypt(baddr.String(), pkt)
+	if nonce(third)[11] != 2 {
+		t.Fatalf("nonce reset by repeated hello: %x", nonce(third))
+	}
+	if _, err := b.decrypt(aaddr.String(), third); err != nil {
+		t.Fatalf("traffic after repeated hello not opened: %v", err)
+	}
+}
+
+func TestHMACTamper(t *testing.T) {
+	pkt := ipPacket("10.0.0.1", "10.0.0.2")
+	aead, err := newAEAD(cipherHMAC, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := seal(aead, 0, 0, pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// payload is sent in plain
+	if !bytes.Equal(buf[sealHeaderSize:sealHeaderSize+len(pkt)], pkt) {
+		t.Fatalf("hmac payload encrypted")
+	}
+	if _, err := open(aead, buf); err != nil {
+		t.Fatalf("intact pkt rejected: %v", err)
+	}
+
+	for _, off := range []int{sealHeaderSize, sealHeaderSize + 12, len(buf) - 1} {
+		tampered := append([]byte(nil), buf...)
+		tampered[off] ^= 0x01
+		if _, err := open(aead, tampered); err == nil {
+			t.Fatalf("tampered byte %d accepted", off)
+		}
+	}
+	if _, err := open(aead, buf[:len(buf)-1]); err == nil {
+		t.Fatalf("truncated pkt accepted")
+	}
+}
+
+func benchmarkSeal(b *testing.B, name string) {
+	aead, err := newAEAD(name, testKey(1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	pkt := make([]byte, 1400)
+	b.SetBytes(int64(len(pkt)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := seal(aead, 0, uint64(i), pkt)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := open(aead, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSealHMAC(b *testing.B)   { benchmarkSeal(b, cipherHMAC) }
+func BenchmarkSealAES256(b *testing.B) { benchmarkSeal(b, cipherAES256) }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseClearCidrs parses comma separated cidrs sent in the clear,
+// eg: 10.0.1.0/24,10.0.2.0/24
+func ParseClearCidrs(s string) ([]string, error) {
+	cidrs := make([]string, 0)
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if len(c) == 0 {
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clear cidr %s", c)
+		}
+		cidrs = append(cidrs, ipnet.String())
+	}
+	return cidrs, nil
+}
+
+// SetClearCidrs sends packets from or to cidrs unencrypted even if
+// a cipher is negotiated, eg: hosts behind trusted links.
+// plain packets are accepted only for the same cidrs,
+// so peers must be given the same set
+func (s *Server) SetClearCidrs(cidrs []string) error {
+	clear := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("invalid clear cidr %s", c)
+		}
+		clear = append(clear, ipnet)
+	}
+	s.clearCidrs = clear
+	return nil
+}
+
+// inClear reports whether src or dst of pkt is in a clear cidr
+func (s *Server) inClear(pkt []byte) bool {
+	if len(s.clearCidrs) == 0 {
+		return false
+	}
+
+	var src, dst net.IP
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		src, dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+	default:
+		return false
+	}
+
+	for _, c := range s.clearCidrs {
+		if c.Contains(src) || c.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
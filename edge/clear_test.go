@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClearCidrs(t *testing.T) {
+	if _, err := ParseClearCidrs("10.0.2.0/24, 10.0.3.1"); err == nil {
+		t.Fatal("expected error for host without prefix")
+	}
+	clear, err := ParseClearCidrs("10.0.2.1/24")
+	if err != nil || len(clear) != 1 || clear[0] != "10.0.2.0/24" {
+		t.Fatalf("unexpected clear cidrs %v %v", clear, err)
+	}
+
+	a := NewServer("", "key", nil)
+	b := NewServer("", "key", nil)
+	for _, s := range []*Server{a, b} {
+		s.SetCiphers([]string{cipherAES256})
+		s.SetClearCidrs(clear)
+	}
+	a.conn, b.conn = listenLocal(t), listenLocal(t)
+	go a.readRemote(a.conn)
+	go b.readRemote(b.conn)
+
+	baddr := b.conn.LocalAddr().String()
+	aaddr := a.conn.LocalAddr().String()
+	if err := <-a.handshake(b.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for a.sessions.get(baddr) == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// encrypt-marked destination is sealed
+	secret := ipPacket("10.0.1.1", "10.0.1.5")
+	sealed, err := a.encrypt(baddr, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) {
+		t.Fatal("packet to encrypted cidr sent in the clear")
+	}
+	if plain, err := b.decrypt(aaddr, sealed); err != nil || !bytes.Equal(plain, secret) {
+		t.Fatalf("open sealed packet fail: %v", err)
+	}
+
+	// clear-marked destination and source are not
+	for _, pkt := range [][]byte{ipPacket("10.0.1.1", "10.0.2.5"), ipPacket("10.0.2.5", "10.0.1.1")} {
+		out, err := a.encrypt(baddr, pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isSealed(out) || !bytes.Equal(out, pkt) {
+			t.Fatalf("packet %s => %s encrypted", Packet(pkt).Src(), Packet(pkt).Dst())
+		}
+		if _, err := b.decrypt(aaddr, out); err != nil {
+			t.Fatalf("plain packet of clear cidr rejected: %v", err)
+		}
+	}
+
+	// receiver still rejects plain packets outside clear cidrs
+	if _, err := b.decrypt(aaddr, secret); err == nil {
+		t.Fatal("plain packet to encrypted cidr accepted")
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// redacted value of secret config
+const redacted = "***"
+
+// Config is the effective configuration of edge,
+// loaded from env vars and defaults.
+// string fields tagged redact are never exported
+type Config struct {
+	LogLevel   string `json:"log_level"`
+	LogPath    string `json:"log_path"`
+	Listen     string `json:"listen"`
+	Controller string `json:"controller"`
+	Secret     string `json:"secret" redact:"true"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	Encap      string `json:"encap"`
+	Transport  string `json:"transport"`
+	Proxy      string `json:"proxy" redact:"true"`
+	BindIface  string `json:"bind_iface"`
+	Vni        uint32 `json:"vni"`
+
+	DrainGrace     duration `json:"drain_grace"`
+	DeadHoldDown   duration `json:"dead_holddown"`
+	IdleTimeout    duration `json:"idle_timeout"`
+	PeerStagger    duration `json:"peer_stagger"`
+	SchedQueue     int      `json:"sched_queue"`
+	SendQueue      int      `json:"send_queue"`
+	SendQueueDrop  string   `json:"send_queue_drop"`
+	PaceRate       int      `json:"pace_rate"`
+	PaceBurst      int      `json:"pace_burst"`
+	MSSClamp       int      `json:"mss_clamp"`
+	RouteAggregate bool     `json:"route_aggregate"`
+	CtrlCompress   bool     `json:"ctrl_compress"`
+	RouteInstall   bool     `json:"route_install"`
+	Migrate        bool     `json:"migrate"`
+	ProxyProtocol  bool     `json:"proxy_protocol"`
+	ProxyTrusted   []string `json:"proxy_trusted"`
+	AllowedIPs     bool     `json:"allowed_ips"`
+	FastPath       bool     `json:"fast_path"`
+	HealthInterval duration `json:"health_interval"`
+	HealthFailures int      `json:"health_failures"`
+	HealthMin      duration `json:"health_min"`
+	HealthMax      duration `json:"health_max"`
+	FlapHalfLife   duration `json:"flap_half_life"`
+	FlapSuppress   int      `json:"flap_suppress"`
+	FlapReuse      int      `json:"flap_reuse"`
+	Failback       bool     `json:"failback"`
+	Ciphers        []string `json:"ciphers"`
+	ClearCidrs     []string `json:"clear_cidrs"`
+	Nested         []string `json:"nested"`
+	RekeyInterval  duration `json:"rekey_interval"`
+	RekeyWindow    duration `json:"rekey_window"`
+	LogSampleEvery int      `json:"log_sample_every"`
+	LogSampleLimit int      `json:"log_sample_limit"`
+	NonIPLogEvery  int      `json:"nonip_log_every"`
+	UnknownCtrl    int      `json:"unknown_ctrl_log_every"`
+	ReorderTimeout duration `json:"reorder_timeout"`
+	ReorderDepth   int      `json:"reorder_depth"`
+	PeerRouteLimit int      `json:"peer_route_limit"`
+	RouteLimit     int      `json:"route_limit"`
+	Admin          string   `json:"admin"`
+
+	// client certificate identifying edge to controller
+	// and ca verifying controller, plain tcp if both empty
+	CtrlCert string `json:"ctrl_cert"`
+	CtrlKey  string `json:"ctrl_key"`
+	CtrlCA   string `json:"ctrl_ca"`
+
+	// static labels of all metrics exported by admin api
+	MetricLabels map[string]string `json:"metric_labels"`
+	TapFile      string            `json:"tap_file"`
+	TapDir       string            `json:"tap_dir"`
+
+	// flow records to file or udp://host:port, disabled if empty
+	FlowExport string   `json:"flow_export"`
+	FlowMax    int      `json:"flow_max"`
+	FlowIdle   duration `json:"flow_idle"`
+
+	// packet drop and delay injection, only for chaos builds
+	// eg: drop=0.1,ctrl_drop=0.05,delay=50ms
+	Chaos *ChaosConfig `json:"chaos"`
+
+	// json file of peers replacing controller, see peerfile.go
+	PeersFile string `json:"peers_file"`
+
+	// lan discovery, disabled if group is empty
+	Discovery      string   `json:"discovery"`
+	DiscoveryIface string   `json:"discovery_iface"`
+	DiscoveryTTL   duration `json:"discovery_ttl"`
+	Cidr           string   `json:"cidr"`
+
+	// vni => routing table, one tun device per vni, eg: 1=101,2=102
+	// defaults to vni in the main table
+	Vnis map[uint32]int `json:"vnis"`
+
+	// device per peer address, eg: 1.1.1.1:58423=eth1
+	PeerIfaces map[string]string `json:"peer_ifaces"`
+
+	// peer address or transport per dscp of inner packets
+	// eg: 46=2.2.2.2:58423,34=tcp
+	DSCPRoutes map[uint8]string `json:"dscp_routes"`
+
+	// fwmark of peer traffic, overridden per peer address
+	// eg: fwmark=0x100 peer_marks=1.1.1.1:58423=0x200
+	Fwmark    int            `json:"fwmark"`
+	PeerMarks map[string]int `json:"peer_marks"`
+
+	// extra routes via peers, eg: 192.168.100.0/24=edge2
+	// peers are resolved by name again each static_refresh
+	StaticRoutes  []*codec.StaticRoute `json:"static_routes"`
+	StaticRefresh duration             `json:"static_refresh"`
+}
+
+// duration is exported as string, eg: 30s
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig loads config from env vars by getenv,
+// unset env vars take default values
+func LoadConfig(getenv func(string) string) (*Config, error) {
+	c := &Config{
+		LogLevel:       "info",
+		LogPath:        "edge.log",
+		Listen:         ":58423",
+		Controller:     "demo.notr.tech:58422",
+		Namespace:      "default",
+		HealthInterval: duration(defaultHealthInterval),
+		HealthFailures: defaultHealthFailures,
+		Failback:       true,
+		RekeyWindow:    duration(defaultRekeyWindow),
+		DiscoveryIface: "eth0",
+		DiscoveryTTL:   duration(defaultDiscoveryTTL),
+		StaticRefresh:  duration(defaultStaticRefresh),
+	}
+
+	str := func(key string, val *string) {
+		if v := getenv(key); len(v) > 0 {
+			*val = v
+		}
+	}
+	num := func(key string, val *int) error {
+		if v := getenv(key); len(v) > 0 {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %s: %v", key, v, err)
+			}
+			*val = n
+		}
+		return nil
+	}
+	dur := func(key string, val *duration) error {
+		if v := getenv(key); len(v) > 0 {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %s: %v", key, v, err)
+			}
+			*val = duration(d)
+		}
+		return nil
+	}
+
+	str("LOG_LEVEL", &c.LogLevel)
+	str("log_path", &c.LogPath)
+	str("listen", &c.Listen)
+	str("controller", &c.Controller)
+	str("secret", &c.Secret)
+	str("namespace", &c.Namespace)
+	str("name", &c.Name)
+	str("ctrl_cert", &c.CtrlCert)
+	str("ctrl_key", &c.CtrlKey)
+	str("ctrl_ca", &c.CtrlCA)
+	str("encap", &c.Encap)
+	str("transport", &c.Transport)
+	str("proxy", &c.Proxy)
+	str("bind_iface", &c.BindIface)
+	str("admin", &c.Admin)
+	str("tap_file", &c.TapFile)
+	str("tap_dir", &c.TapDir)
+	str("flow_export", &c.FlowExport)
+	str("peers_file", &c.PeersFile)
+	str("discovery", &c.Discovery)
+	str("discovery_iface", &c.DiscoveryIface)
+	str("cidr", &c.Cidr)
+	str("send_queue_drop", &c.SendQueueDrop)
+	c.RouteAggregate = getenv("route_aggregate") == "true"
+	c.CtrlCompress = getenv("ctrl_compress") == "true"
+	c.Failback = getenv("failback") != "false"
+	c.RouteInstall = getenv("route_install") != "false"
+	c.Migrate = getenv("migrate") == "true"
+	c.ProxyProtocol = getenv("proxy_protocol") == "true"
+	c.AllowedIPs = getenv("allowed_ips") == "true"
+	c.FastPath = getenv("fast_path") == "true"
+
+	// vni the tun device bound to, default 0
+	vni := 0
+	for _, err := range []error{
+		num("vni", &vni),
+		num("sched_queue", &c.SchedQueue),
+		num("send_queue", &c.SendQueue),
+		num("pace_rate", &c.PaceRate),
+		num("pace_burst", &c.PaceBurst),
+		num("mss_clamp", &c.MSSClamp),
+		num("health_failures", &c.HealthFailures),
+		num("log_sample_every", &c.LogSampleEvery),
+		num("log_sample_limit", &c.LogSampleLimit),
+		num("nonip_log_every", &c.NonIPLogEvery),
+		num("unknown_ctrl_log_every", &c.UnknownCtrl),
+		num("reorder_depth", &c.ReorderDepth),
+		num("peer_route_limit", &c.PeerRouteLimit),
+		num("route_limit", &c.RouteLimit),
+		num("flow_max", &c.FlowMax),
+		num("flap_suppress", &c.FlapSuppress),
+		num("flap_reuse", &c.FlapReuse),
+		dur("drain_grace", &c.DrainGrace),
+		dur("dead_holddown", &c.DeadHoldDown),
+		dur("idle_timeout", &c.IdleTimeout),
+		dur("peer_stagger", &c.PeerStagger),
+		dur("health_interval", &c.HealthInterval),
+		dur("health_min", &c.HealthMin),
+		dur("health_max", &c.HealthMax),
+		dur("flap_half_life", &c.FlapHalfLife),
+		dur("discovery_ttl", &c.DiscoveryTTL),
+		dur("rekey_interval", &c.RekeyInterval),
+		dur("rekey_window", &c.RekeyWindow),
+		dur("reorder_timeout", &c.ReorderTimeout),
+		dur("flow_idle", &c.FlowIdle),
+		dur("static_refresh", &c.StaticRefresh),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.HealthFailures <= 0 {
+		c.HealthFailures = defaultHealthFailures
+	}
+	if vni < 0 || vni > maxVNI {
+		return nil, fmt.Errorf("invalid vni %d", vni)
+	}
+	c.Vni = uint32(vni)
+
+	vnis, err := ParseVNIs(getenv("vnis"))
+	if err != nil {
+		return nil, err
+	}
+	if len(vnis) == 0 {
+		vnis[c.Vni] = 0
+	}
+	c.Vnis = vnis
+
+	static, err := codec.ParseStaticRoutes(getenv("static_routes"))
+	if err != nil {
+		return nil, err
+	}
+	c.StaticRoutes = static
+
+	chaos, err := ParseChaos(getenv("chaos"))
+	if err != nil {
+		return nil, err
+	}
+	c.Chaos = chaos
+
+	peerIfaces, err := ParsePeerIfaces(getenv("peer_ifaces"))
+	if err != nil {
+		return nil, err
+	}
+	c.PeerIfaces = peerIfaces
+
+	c.Fwmark, err = ParseFwmark(getenv("fwmark"))
+	if err != nil {
+		return nil, err
+	}
+	peerMarks, err := ParsePeerMarks(getenv("peer_marks"))
+	if err != nil {
+		return nil, err
+	}
+	c.PeerMarks = peerMarks
+
+	dscpRoutes, err := ParseDSCPRoutes(getenv("dscp_routes"))
+	if err != nil {
+		return nil, err
+	}
+	c.DSCPRoutes = dscpRoutes
+
+	ciphers, err := ParseCiphers(getenv("ciphers"))
+	if err != nil {
+		return nil, err
+	}
+	c.Ciphers = ciphers
+
+	labels, err := ParseMetricLabels(getenv("metric_labels"))
+	if err != nil {
+		return nil, err
+	}
+	c.MetricLabels = labels
+
+	clear, err := ParseClearCidrs(getenv("clear_cidrs"))
+	if err != nil {
+		return nil, err
+	}
+	c.ClearCidrs = clear
+
+	trusted, err := ParseProxyTrusted(getenv("proxy_trusted"))
+	if err != nil {
+		return nil, err
+	}
+	c.ProxyTrusted = trusted
+
+	nested, err := ParseNested(getenv("nested"))
+	if err != nil {
+		return nil, err
+	}
+	c.Nested = nested
+
+	if len(c.Discovery) > 0 && len(c.Cidr) == 0 {
+		return nil, fmt.Errorf("cidr is required by discovery")
+	}
+	if c.ProxyProtocol && len(c.ProxyTrusted) == 0 {
+		return nil, fmt.Errorf("proxy_trusted is required by proxy_protocol")
+	}
+	if c.Migrate && len(c.Name) == 0 {
+		return nil, fmt.Errorf("name is required by migrate")
+	}
+
+	if len(c.Secret) == 0 {
+		return nil, fmt.Errorf("invalid secret")
+	}
+	return c, nil
+}
+
+// Redacted returns a copy of c with secrets shown as ***
+func (c *Config) Redacted() *Config {
+	r := *c
+	v := reflect.ValueOf(&r).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Tag.Get("redact") != "true" || field.Type.Kind() != reflect.String {
+			continue
+		}
+		if v.Field(i).Len() > 0 {
+			v.Field(i).SetString(redacted)
+		}
+	}
+	return &r
+}
+
+// String returns redacted config in json
+func (c *Config) String() string {
+	b, _ := json.Marshal(c.Redacted())
+	return string(b)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	env := map[string]string{
+		"secret":          "s3cr3t",
+		"listen":          ":50000",
+		"health_interval": "5s",
+		"ciphers":         "aes-256-gcm",
+		"failback":        "false",
+		"metric_labels":   "edge=edge1, region=us-east",
+	}
+	cfg, err := LoadConfig(func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// overrides
+	if cfg.Listen != ":50000" || time.Duration(cfg.HealthInterval) != time.Second*5 ||
+		cfg.Failback || len(cfg.Ciphers) != 1 || cfg.MetricLabels["region"] != "us-east" {
+		t.Fatalf("env not applied: %s", cfg)
+	}
+
+	// defaults
+	if cfg.Namespace != "default" || cfg.HealthFailures != defaultHealthFailures {
+		t.Fatalf("default not applied: %s", cfg)
+	}
+
+	if _, err := ParseMetricLabels("edge=edge1,edge=edge2"); err == nil {
+		t.Fatalf("expected duplicated metric label rejected")
+	}
+
+	env["proxy_protocol"] = "true"
+	if _, err := LoadConfig(func(key string) string { return env[key] }); err == nil {
+		t.Fatalf("expected proxy protocol without trusted upstreams rejected")
+	}
+
+	if _, err := LoadConfig(func(key string) string { return "" }); err == nil {
+		t.Fatalf("expected config without secret rejected")
+	}
+}
+
+func TestAdminConfigRedacted(t *testing.T) {
+	env := map[string]string{
+		"secret":      "s3cr3t",
+		"drain_grace": "30s",
+	}
+	cfg, err := LoadConfig(func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(cfg.String(), "s3cr3t") {
+		t.Fatalf("secret in config log: %s", cfg)
+	}
+
+	admin := NewAdmin("", NewServer("", cfg.Secret, nil))
+	admin.SetConfig(cfg)
+	rec := httptest.NewRecorder()
+	admin.mux.ServeHTTP(rec, httptest.NewRequest("GET", "/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	body := rec.Body.String()
+	if strings.Contains(body, "s3cr3t") {
+		t.Fatalf("secret exported: %s", body)
+	}
+
+	exported := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(body), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported["secret"] != redacted || exported["drain_grace"] != "30s" {
+		t.Fatalf("unexpected config %s", body)
+	}
+
+	// the loaded config is not modified
+	if cfg.Secret != "s3cr3t" {
+		t.Fatalf("config modified by redaction")
+	}
+}
+
+func TestAdminUpgradeLocalOnly(t *testing.T) {
+	admin := NewAdmin("", NewServer("", "key", nil))
+	req := httptest.NewRequest("POST", "/upgrade", nil)
+	req.RemoteAddr = "192.0.2.1:40000"
+	rec := httptest.NewRecorder()
+	admin.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected remote upgrade forbidden, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+var convergeSeconds = metrics.NewHistogram("cframe_edge_converge_seconds",
+	"time from a peer set change to routes installed and peers answering pings",
+	[]float64{0.1, 0.5, 1, 2, 5, 10, 30, 60})
+
+// Convergence is a cycle from receiving peer set changes
+// until all their routes are installed and peers confirmed up
+type Convergence struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Peers    int           `json:"peers"`
+}
+
+// converge tracks the pending cycle, changes received before
+// the cycle converged join it
+type converge struct {
+	mu    sync.Mutex
+	start time.Time
+	peers map[string]*codec.Edge
+	last  *Convergence
+}
+
+func newConverge() *converge {
+	return &converge{peers: make(map[string]*codec.Edge)}
+}
+
+// LastConvergence returns the last converged cycle, nil if none
+func (s *Server) LastConvergence() *Convergence {
+	c := s.converge
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// beginConverge starts a cycle at now for changed peers,
+// or adds them to the pending cycle
+func (s *Server) beginConverge(peers []*codec.Edge, now time.Time) {
+	c := s.converge
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.start.IsZero() {
+		c.start = now
+	}
+	for _, p := range peers {
+		c.peers[peerKey(p)+"@"+p.ListenAddr] = p
+	}
+}
+
+// checkConverge ends the pending cycle once routes of its peers
+// are installed and peers answered pings, peers deleted meanwhile
+// are not waited for
+func (s *Server) checkConverge(now time.Time) {
+	c := s.converge
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.start.IsZero() {
+		return
+	}
+
+	s.failedMu.Lock()
+	for _, p := range c.peers {
+		if fp, ok := s.failed[peerKey(p)]; ok && !fp.permanent {
+			s.failedMu.Unlock()
+			return
+		}
+	}
+	s.failedMu.Unlock()
+
+	for _, p := range c.peers {
+		if !s.hasPeer(p) {
+			continue
+		}
+		if s.healthInterval > 0 && !s.health.confirmed(p.ListenAddr, now) {
+			return
+		}
+	}
+
+	cv := &Convergence{Start: c.start, Duration: now.Sub(c.start), Peers: len(c.peers)}
+	convergeSeconds.Observe(cv.Duration.Seconds())
+	log.Info("converged %d peers in %v", cv.Peers, cv.Duration)
+	c.last = cv
+	c.start = time.Time{}
+	c.peers = make(map[string]*codec.Edge)
+}
+
+// confirmed reports whether addr answered pings and is up at now
+func (h *health) confirmed(addr string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ph, ok := h.peers[addr]
+	return ok && ph.up && !ph.lastPong.IsZero() && !ph.damped(now)
+}
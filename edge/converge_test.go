@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestConvergence(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+	s.SetHealthCheck(time.Hour, 3)
+	s.conn = listenLocal(t)
+	defer s.conn.Close()
+
+	peer := listenLocal(t)
+	defer peer.Close()
+	raddr := peer.LocalAddr().(*net.UDPAddr)
+
+	// push of the controller, peer answers pings after delay
+	delay := time.Millisecond * 200
+	s.SetPeers([]*codec.Edge{{Cidr: "10.0.1.0/24", ListenAddr: raddr.String()}})
+	s.checkPeers(time.Now())
+	if s.LastConvergence() != nil {
+		t.Fatalf("converged before peer confirmed")
+	}
+
+	time.Sleep(delay)
+	now := time.Now()
+	s.health.onPong(raddr.String(), now)
+	s.checkConverge(now)
+
+	cv := s.LastConvergence()
+	if cv == nil {
+		t.Fatalf("convergence not recorded")
+	}
+	if cv.Duration < delay || cv.Duration > delay+time.Millisecond*100 {
+		t.Fatalf("expected convergence about %v, got %v", delay, cv.Duration)
+	}
+	if cv.Peers != 1 {
+		t.Fatalf("expected 1 peer converged, got %d", cv.Peers)
+	}
+
+	// peers deleted before confirmed are not waited for
+	s.SetPeers([]*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: raddr.String()},
+		{Cidr: "10.0.2.0/24", ListenAddr: "127.0.0.1:1"},
+	})
+	if s.LastConvergence() != cv {
+		t.Fatalf("converged before new peer confirmed")
+	}
+	s.SetPeers([]*codec.Edge{{Cidr: "10.0.1.0/24", ListenAddr: raddr.String()}})
+	if s.LastConvergence() == cv {
+		t.Fatalf("deleted peer waited for")
+	}
+}
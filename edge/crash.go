@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"runtime/debug"
+	"sync"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// exit of crashed edge, replaced by tests
+var crashExit = os.Exit
+
+// osRoute is a route installed to the os routing table
+type osRoute struct {
+	cidr string
+	dev  string
+}
+
+// routeOf keys route of cidr to dev, a host is keyed
+// by its full prefix as peers removed may carry either form
+func routeOf(cidr, dev string) osRoute {
+	return osRoute{hostCIDR(cidr), dev}
+}
+
+// installedRoutes installs routes by the route manager of s
+// and records them, so they can be removed even mid-operation.
+// routes never installed are not removed from os
+type installedRoutes struct {
+	s *Server
+
+	mu     sync.Mutex
+	routes map[osRoute]struct{}
+}
+
+func (r *installedRoutes) AddRoute(cidr, dev string) error {
+	err := r.s.routes.AddRoute(cidr, dev)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.routes[routeOf(cidr, dev)] = struct{}{}
+	osRoutesInstalled.Set(int64(len(r.routes)))
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *installedRoutes) DelRoute(cidr, dev string) error {
+	r.mu.Lock()
+	_, ok := r.routes[routeOf(cidr, dev)]
+	r.mu.Unlock()
+	if !ok {
+		log.Debug("route %s dev %s not installed, skip removal", cidr, dev)
+		return nil
+	}
+
+	err := r.s.routes.DelRoute(cidr, dev)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	delete(r.routes, routeOf(cidr, dev))
+	osRoutesInstalled.Set(int64(len(r.routes)))
+	r.mu.Unlock()
+	return nil
+}
+
+// cleanup removes all recorded routes best effort,
+// returns number of routes removed
+func (r *installedRoutes) cleanup() int {
+	r.mu.Lock()
+	routes := make([]osRoute, 0, len(r.routes))
+	for route := range r.routes {
+		routes = append(routes, route)
+	}
+	r.mu.Unlock()
+
+	removed := 0
+	for _, route := range routes {
+		err := r.DelRoute(route.cidr, route.dev)
+		if err != nil {
+			log.Error("remove route %s dev %s fail: %v", route.cidr, route.dev, err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+// guard recovers panic of a long running goroutine, deferred
+// at its top. routes installed are removed before exit so a
+// crashed edge does not blackhole traffic
+func (s *Server) guard() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	log.Error("panic: %v\n%s", r, debug.Stack())
+	removed := s.installed.cleanup()
+	log.Error("removed %d routes of crashed edge", removed)
+	crashExit(2)
+}
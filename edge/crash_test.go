@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestCrashCleanup(t *testing.T) {
+	exited := make(chan int, 1)
+	crashExit = func(code int) { exited <- code }
+	defer func() { crashExit = os.Exit }()
+
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	routes := newFakeRoutes()
+	s.SetRouteManager(routes)
+	s.AddPeers([]*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"},
+		{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"},
+	})
+	s.DelPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"})
+	if len(routes.routes["cframe.0"]) != 1 {
+		t.Fatalf("expected 1 route installed, got %v", routes.routes)
+	}
+
+	// crash in the middle of forwarding
+	go func() {
+		defer s.guard()
+		panic("boom")
+	}()
+
+	select {
+	case code := <-exited:
+		if code != 2 {
+			t.Fatalf("expected exit code 2, got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("crashed edge not exited")
+	}
+
+	if len(routes.routes["cframe.0"]) != 0 {
+		t.Fatalf("routes left after crash: %v", routes.routes)
+	}
+	if len(s.installed.routes) != 0 {
+		t.Fatalf("installed routes not cleared")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+// control packet shares the peer udp socket with data packet
+// | key | 1byte magic(0x00) | 1byte type | payload |
+// 0x00 is never the first byte of an ip packet, so packets of
+// types added by newer edges are ignored instead of taken as data.
+// see encap.go for control packet in other encapsulation
+const ctrlMagic = 0x00
+
+var ctrlUnknown = metrics.NewCounter("cframe_edge_ctrl_unknown_total",
+	"control packets of unknown type or truncated, ignored")
+
+const (
+	_ = iota
+	// health check request, payload is echoed back
+	ctrlPing
+
+	// health check reply
+	ctrlPong
+
+	// ack of reliable control packet, payload is seq
+	ctrlAck
+
+	// cipher negotiation, payload is comma separated ciphers
+	ctrlHello
+	ctrlHelloReply
+
+	// key rotation, payload is epoch and salt, see rekey.go
+	ctrlRekey
+
+	// peer moved to the sender address, see migrate.go
+	ctrlMigrate
+)
+
+func isCtrl(pkt []byte) bool {
+	return len(pkt) >= 1 && pkt[0] == ctrlMagic
+}
+
+// SetUnknownCtrlLog logs 1 in every control packets of unknown
+// type, eg: sent by newer edges, 0 only counts them
+func (s *Server) SetUnknownCtrlLog(every int) {
+	if every > 0 {
+		s.unknownCtrlLog = log.NewSampler(every, 10)
+	}
+}
+
+// ignoreCtrl counts and ignores control packet of unknown type
+func (s *Server) ignoreCtrl(from *net.UDPAddr, pkt []byte) {
+	ctrlUnknown.Inc()
+	if s.unknownCtrlLog == nil || !s.unknownCtrlLog.Allow() {
+		return
+	}
+	if len(pkt) < 2 {
+		log.Warn("ignore truncated ctrl from %s", from)
+		return
+	}
+	log.Warn("ignore unknown ctrl type %d from %s, %d bytes", pkt[1], from, len(pkt))
+}
+
+func encodeCtrl(key string, typ byte, payload []byte) []byte {
+	buf := make([]byte, 0, len(key)+2+len(payload))
+	buf = append(buf, []byte(key)...)
+	buf = append(buf, ctrlMagic, typ)
+	buf = append(buf, payload...)
+	return buf
+}
+
+// sendCtrl sends control packet to peer,
+// reliable packet is retransmitted until acked
+func (s *Server) sendCtrl(addr *net.UDPAddr, typ byte, payload []byte, reliable bool) <-chan error {
+	if reliable {
+		return s.reliable.send(addr, typ, payload)
+	}
+
+	done := make(chan error, 1)
+	_, err := s.sockFor(addr.String()).WriteToUDP(s.encap.EncodeCtrl(typ, payload), addr)
+	done <- err
+	return done
+}
+
+// onCtrl handles control packet received from peer,
+// pkt aliases the read buffer so handlers copy what they keep
+func (s *Server) onCtrl(lconn *net.UDPConn, from *net.UDPAddr, pkt []byte) {
+	// reply from the socket bound for peer
+	if conn := s.peerSocks[s.peerOpts(from.String())]; conn != nil {
+		lconn = conn
+	}
+	if len(pkt) < 2 {
+		s.ignoreCtrl(from, pkt)
+		return
+	}
+	typ, payload := pkt[1], pkt[2:]
+	if typ&ctrlReliable != 0 {
+		if len(payload) < 4 {
+			log.Error("invalid reliable ctrl from %s", from)
+			return
+		}
+
+		_, err := lconn.WriteToUDP(s.encap.EncodeCtrl(ctrlAck, payload[:4]), from)
+		if err != nil {
+			log.Error("reply ack to %s fail: %v", from, err)
+		}
+
+		seq := binary.BigEndian.Uint32(payload)
+		if !s.reliable.accept(from, seq) {
+			log.Debug("duplicate ctrl seq %d from %s", seq, from)
+			return
+		}
+		typ, payload = typ&^ctrlReliable, payload[4:]
+	}
+
+	switch typ {
+	case ctrlPing:
+		_, err := lconn.WriteToUDP(s.encap.EncodeCtrl(ctrlPong, payload), from)
+		if err != nil {
+			log.Error("reply pong to %s fail: %v", from, err)
+		}
+
+	case ctrlPong:
+		log.Debug("pong from %s", from)
+		now := time.Now()
+		s.health.onPong(from.String(), now)
+		s.checkReach(now)
+		s.checkConverge(now)
+
+	case ctrlAck:
+		if len(payload) < 4 {
+			log.Error("invalid ack from %s", from)
+			return
+		}
+		s.reliable.onAck(from, binary.BigEndian.Uint32(payload))
+
+	case ctrlHello:
+		s.onHello(from, payload)
+		s.replyHello(from)
+
+	case ctrlHelloReply:
+		s.onHello(from, payload)
+
+	case ctrlRekey:
+		s.onRekey(from, payload)
+
+	case ctrlMigrate:
+		s.onMigrate(from, payload)
+
+	default:
+		s.ignoreCtrl(from, pkt)
+	}
+}
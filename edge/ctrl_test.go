@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReliableCtrlRetransmit(t *testing.T) {
+	a := NewServer("", "key", nil)
+	a.conn = listenLocal(t)
+	go a.readRemote(a.conn)
+
+	b := NewServer("", "key", nil)
+	b.conn = listenLocal(t)
+	go b.readRemote(b.conn)
+
+	// lose the first transmission
+	var sent int32
+	a.reliable.write = func(buf []byte, addr *net.UDPAddr) error {
+		if atomic.AddInt32(&sent, 1) == 1 {
+			return nil
+		}
+		_, err := a.conn.WriteToUDP(buf, addr)
+		return err
+	}
+
+	done := a.sendCtrl(b.conn.LocalAddr().(*net.UDPAddr), ctrlPong, []byte("hello"), true)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("reliable ctrl not acked")
+	}
+
+	if n := atomic.LoadInt32(&sent); n < 2 {
+		t.Fatalf("expected retransmission, sent %d", n)
+	}
+}
+
+func TestReliableCtrlGiveUp(t *testing.T) {
+	a := NewServer("", "key", nil)
+	a.reliable = newReliable(time.Millisecond*10, 2, a.encap.EncodeCtrl,
+		func(buf []byte, addr *net.UDPAddr) error { return nil })
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	select {
+	case err := <-a.sendCtrl(addr, ctrlPong, nil, true):
+		if err == nil {
+			t.Fatalf("expected error for never acked ctrl")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("reliable ctrl never gave up")
+	}
+}
+
+func TestReliableCtrlDuplicate(t *testing.T) {
+	r := newReliable(time.Second, 3, nil, nil)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	if !r.accept(addr, 1) {
+		t.Fatalf("first seq rejected")
+	}
+	if r.accept(addr, 1) {
+		t.Fatalf("duplicate seq accepted")
+	}
+}
+
+func TestReliableCtrlAckSender(t *testing.T) {
+	r := newReliable(time.Second, 3, func(typ byte, payload []byte) []byte { return payload },
+		func(buf []byte, addr *net.UDPAddr) error { return nil })
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1}
+	done := r.send(peer, ctrlPong, nil)
+
+	// same seq acked by another peer
+	r.onAck(other, 1)
+	select {
+	case err := <-done:
+		t.Fatalf("acked by other peer: %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	r.onAck(peer, 1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ack of peer not applied")
+	}
+}
+
+func TestReliableCtrlSeenExpire(t *testing.T) {
+	r := newReliable(time.Millisecond*10, 1, nil, nil)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	for seq := uint32(1); seq <= 100; seq++ {
+		r.accept(addr, seq)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	// expired seq are dropped once a later one received
+	if !r.accept(addr, 1) {
+		t.Fatalf("expired seq rejected")
+	}
+	if len(r.seen) != 1 || len(r.seenQueue) != 1 {
+		t.Fatalf("expired seq left, %d seen %d queued", len(r.seen), len(r.seenQueue))
+	}
+}
+
+func TestUnknownCtrl(t *testing.T) {
+	tun := newFakeTun("cframe.0")
+	s := NewServer("", "key", &Interface{tun: tun})
+	s.SetUnknownCtrlLog(1)
+	s.conn = listenLocal(t)
+	defer s.conn.Close()
+	peer := listenLocal(t)
+	defer peer.Close()
+	from := peer.LocalAddr().(*net.UDPAddr)
+
+	// type of a newer edge and a truncated ctrl packet
+	unknown := ctrlUnknown.Value()
+	s.onRemote(s.conn, from, encodeCtrl("key", 0x3f, []byte{0x45, 0, 0, 20}))
+	s.onRemote(s.conn, from, []byte("key\x00"))
+	if ctrlUnknown.Value() != unknown+2 {
+		t.Fatalf("unknown ctrl not counted")
+	}
+	select {
+	case pkt := <-tun.out:
+		t.Fatalf("unknown ctrl taken as data: %x", pkt)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// reliable one is still acked, so the sender stops retransmitting
+	s.onRemote(s.conn, from, encodeCtrl("key", 0x3f|ctrlReliable, []byte{0, 0, 0, 7, 1}))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatalf("reliable unknown ctrl not acked: %v", err)
+	}
+	_, ack, err := s.encap.Decode(buf[:n])
+	if err != nil || len(ack) < 2 || ack[1] != ctrlAck {
+		t.Fatalf("unexpected reply %x: %v", buf[:n], err)
+	}
+	if ctrlUnknown.Value() != unknown+3 {
+		t.Fatalf("reliable unknown ctrl not counted")
+	}
+}
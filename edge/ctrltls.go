@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// LoadCtrlTLS loads tls config of controller connection, the
+// client certificate of cert and key identifies edge by its
+// name. controller is verified by ca, or system roots if empty.
+// returns nil if no tls
+func LoadCtrlTLS(cert, key, ca string) (*tls.Config, error) {
+	if len(cert) == 0 && len(ca) == 0 {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(cert) > 0 {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	if len(ca) > 0 {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", ca)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// SetTLS connects to controllers over tls
+func (r *Registry) SetTLS(cfg *tls.Config) {
+	r.tls = cfg
+}
+
+// dial connects to controller srv
+func (r *Registry) dial(srv string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Second * 30}
+	if r.tls == nil {
+		return dialer.Dial("tcp", srv)
+	}
+	return tls.DialWithDialer(dialer, "tcp", srv, r.tls)
+}
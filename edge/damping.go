@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// penalty added by each up/down transition of a peer
+const flapPenalty = 1000
+
+var (
+	defaultFlapSuppress = 2000
+	defaultFlapReuse    = 750
+)
+
+// damping holds down flapping peers as bgp does (RFC2439),
+// each transition adds flapPenalty to the penalty of the peer
+// which halves every halfLife. peer with penalty above suppress
+// is taken as down until the penalty decays below reuse,
+// so traffic stops switching back and forth to it
+type damping struct {
+	halfLife time.Duration
+	suppress float64
+	reuse    float64
+}
+
+func (d *damping) enabled() bool {
+	return d.halfLife > 0
+}
+
+// decay returns penalty decayed from since to now
+func (d *damping) decay(penalty float64, since, now time.Time) float64 {
+	if penalty == 0 || !now.After(since) {
+		return penalty
+	}
+	return penalty * math.Exp2(-float64(now.Sub(since))/float64(d.halfLife))
+}
+
+// flap records a transition of ph at now, the peer is
+// held down until reuseAt once its penalty exceeds suppress
+func (d *damping) flap(addr string, ph *peerHealth, now time.Time) {
+	if !d.enabled() {
+		return
+	}
+
+	// hold down at most 4 half lives
+	max := d.reuse * 16
+	ph.penalty = d.decay(ph.penalty, ph.penaltyAt, now) + flapPenalty
+	if ph.penalty > max {
+		ph.penalty = max
+	}
+	ph.penaltyAt = now
+
+	if ph.penalty <= d.suppress && !now.Before(ph.reuseAt) {
+		return
+	}
+
+	hold := time.Duration(float64(d.halfLife) * math.Log2(ph.penalty/d.reuse))
+	if !now.Before(ph.reuseAt) {
+		log.Warn("peer %s flapping, damped for %v", addr, hold)
+	}
+	ph.reuseAt = now.Add(hold)
+}
+
+// damped reports whether ph is held down at now
+func (ph *peerHealth) damped(now time.Time) bool {
+	return now.Before(ph.reuseAt)
+}
+
+// SetFlapDamping holds down peers flapping between up and down,
+// halfLife 0 disables damping. each flap adds 1000 to the penalty,
+// peer is damped above suppress until it decays below reuse.
+// must be called after SetHealthCheck
+func (s *Server) SetFlapDamping(halfLife time.Duration, suppress, reuse int) {
+	if halfLife <= 0 {
+		return
+	}
+	if suppress <= 0 {
+		suppress = defaultFlapSuppress
+	}
+	if reuse <= 0 || reuse >= suppress {
+		reuse = defaultFlapReuse
+	}
+	s.health.damping = damping{
+		halfLife: halfLife,
+		suppress: float64(suppress),
+		reuse:    float64(reuse),
+	}
+}
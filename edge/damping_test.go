@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// flapPrimary takes primary down and up cycles times,
+// returns how many times the route switched
+func flapPrimary(s *Server, now time.Time, cycles int) int {
+	primary := "1.1.1.1:58423"
+	last, switches := primary, 0
+	check := func() {
+		if addr, _ := s.route(0, "", "10.0.1.1"); addr != last {
+			last = addr
+			switches++
+		}
+	}
+
+	for i := 0; i < cycles; i++ {
+		base := now.Add(time.Duration(i) * time.Second * 2)
+		s.health.onPing(primary, primary, base)
+		s.health.onPing(primary, primary, base.Add(time.Second))
+		check()
+		s.health.onPong(primary, base.Add(time.Second+time.Millisecond*500))
+		check()
+	}
+	return switches
+}
+
+func newFlappingServer() *Server {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+	s.SetHealthCheck(time.Second, 1)
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "2.2.2.2:58423", Standby: true})
+	return s
+}
+
+func TestFlapDamping(t *testing.T) {
+	now := time.Now()
+
+	// every flap switches traffic without damping
+	s := newFlappingServer()
+	if n := flapPrimary(s, now, 5); n != 10 {
+		t.Fatalf("expected 10 switches without damping, got %d", n)
+	}
+
+	s = newFlappingServer()
+	s.SetFlapDamping(time.Minute, 2000, 750)
+	if n := flapPrimary(s, now, 5); n > 3 {
+		t.Fatalf("damped peer kept switching, %d switches", n)
+	}
+	if addr, _ := s.route(0, "", "10.0.1.1"); addr != "2.2.2.2:58423" {
+		t.Fatalf("expected damped primary held down, route to %s", addr)
+	}
+	if !s.health.upAt("2.2.2.2:58423", now) {
+		t.Fatalf("stable standby damped")
+	}
+
+	// penalty decays below reuse, at most 4 half lives
+	if s.health.upAt("1.1.1.1:58423", now.Add(time.Minute)) {
+		t.Fatalf("primary reused before penalty decayed")
+	}
+	if !s.health.upAt("1.1.1.1:58423", now.Add(time.Minute*5)) {
+		t.Fatalf("primary still damped after penalty decayed")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+const defaultDiscoveryTTL = time.Second * 30
+
+// Discovery announces local edge on a multicast group and
+// peers with edges of the same namespace discovered on the lan,
+// without registering through controller
+type Discovery struct {
+	group  *net.UDPAddr
+	ifname string
+	server *Server
+
+	// local edge announced, listen host defaults to the iface address
+	local *codec.Edge
+
+	// announcements are signed by hmac of the secret over
+	// namespace, edge and time, those of other namespace or
+	// secret are ignored, namespace and secret are never sent
+	namespace string
+	secret    []byte
+
+	// discovered peer expires if not announced for ttl,
+	// local edge announces every ttl/3, announcements
+	// timed more than ttl away from local clock are stale
+	ttl time.Duration
+
+	// key: peer listen addr
+	mu    sync.Mutex
+	peers map[string]*discoveredPeer
+
+	done      chan struct{}
+	closeOnce sync.Once
+	conns     []*net.UDPConn
+}
+
+type discoveredPeer struct {
+	edge   *codec.Edge
+	expire time.Time
+	// time of the latest announcement,
+	// earlier or repeated ones are replays
+	announced int64
+}
+
+type announceMsg struct {
+	Name       string `json:"name"`
+	ListenAddr string `json:"listen_addr"`
+	Cidr       string `json:"cidr"`
+	Vni        uint32 `json:"vni"`
+	// unix nano of announcing
+	Time int64  `json:"time"`
+	Sig  string `json:"sig,omitempty"`
+}
+
+// NewDiscovery creates discovery on group of iface ifname,
+// eg: 239.255.58.58:58426 eth0
+func NewDiscovery(group, ifname string, local *codec.Edge, namespace, secret string, s *Server) (*Discovery, error) {
+	gaddr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+	if !gaddr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", group)
+	}
+
+	return &Discovery{
+		group:     gaddr,
+		ifname:    ifname,
+		server:    s,
+		local:     local,
+		namespace: namespace,
+		secret:    []byte(secret),
+		ttl:       defaultDiscoveryTTL,
+		peers:     make(map[string]*discoveredPeer),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+func (d *Discovery) SetTTL(ttl time.Duration) {
+	if ttl > 0 {
+		d.ttl = ttl
+	}
+}
+
+// Run announces local edge and receives announcements until Close
+func (d *Discovery) Run() error {
+	ifi, err := net.InterfaceByName(d.ifname)
+	if err != nil {
+		return err
+	}
+
+	laddr, err := ifaceIPv4(ifi)
+	if err != nil {
+		return err
+	}
+
+	lconn, err := net.ListenMulticastUDP("udp4", ifi, d.group)
+	if err != nil {
+		return err
+	}
+
+	// bind to iface address so announcements go out of ifi
+	sconn, err := net.DialUDP("udp4", &net.UDPAddr{IP: laddr}, d.group)
+	if err != nil {
+		lconn.Close()
+		return err
+	}
+
+	d.mu.Lock()
+	d.conns = append(d.conns, lconn, sconn)
+	d.mu.Unlock()
+
+	msg, err := d.announcement(laddr)
+	if err != nil {
+		d.Close()
+		return err
+	}
+
+	go d.announce(sconn, msg)
+	go d.expireLoop()
+	d.read(lconn)
+	return nil
+}
+
+// Close stops discovery, discovered peers are kept
+func (d *Discovery) Close() {
+	d.closeOnce.Do(func() {
+		close(d.done)
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, conn := range d.conns {
+			conn.Close()
+		}
+	})
+}
+
+func (d *Discovery) announcement(laddr net.IP) (*announceMsg, error) {
+	host, port, err := net.SplitHostPort(d.local.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen addr %s: %v", d.local.ListenAddr, err)
+	}
+	if len(host) == 0 || net.ParseIP(host).IsUnspecified() {
+		host = laddr.String()
+	}
+
+	return &announceMsg{
+		Name:       d.local.Name,
+		ListenAddr: net.JoinHostPort(host, port),
+		Cidr:       d.local.Cidr,
+		Vni:        d.local.Vni,
+	}, nil
+}
+
+// sign returns hmac of msg without signature,
+// prefixed by namespace which is not sent
+func (d *Discovery) sign(msg *announceMsg) string {
+	unsigned := *msg
+	unsigned.Sig = ""
+	b, _ := json.Marshal(&unsigned)
+
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(d.namespace))
+	mac.Write([]byte{0})
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// announce sends msg signed with the current time every ttl/3
+func (d *Discovery) announce(conn *net.UDPConn, msg *announceMsg) {
+	tick := time.NewTicker(d.ttl / 3)
+	defer tick.Stop()
+	for {
+		msg.Time = time.Now().UnixNano()
+		msg.Sig = d.sign(msg)
+		b, _ := json.Marshal(msg)
+		_, err := conn.Write(b)
+		if err != nil {
+			log.Error("announce to %s fail: %v", d.group, err)
+		}
+
+		select {
+		case <-tick.C:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *Discovery) read(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		nr, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.done:
+				return
+			default:
+			}
+			log.Error("read discovery fail: %v", err)
+			continue
+		}
+
+		msg := announceMsg{}
+		err = json.Unmarshal(buf[:nr], &msg)
+		if err != nil {
+			log.Warn("invalid announcement from %s: %v", from, err)
+			continue
+		}
+		d.onAnnounce(&msg, time.Now())
+	}
+}
+
+// onAnnounce peers with the announced edge or refreshes its
+// expiry if known, unsigned, stale and replayed ones are ignored
+func (d *Discovery) onAnnounce(msg *announceMsg, now time.Time) {
+	if !hmac.Equal([]byte(msg.Sig), []byte(d.sign(msg))) || msg.Name == d.local.Name {
+		return
+	}
+	if at := time.Unix(0, msg.Time); now.Sub(at) > d.ttl || at.Sub(now) > d.ttl {
+		log.Debug("stale announcement of %s at %v", msg.Name, at)
+		return
+	}
+
+	edge := &codec.Edge{
+		Name:       msg.Name,
+		ListenAddr: msg.ListenAddr,
+		Cidr:       msg.Cidr,
+		Vni:        msg.Vni,
+	}
+
+	d.mu.Lock()
+	old, ok := d.peers[msg.ListenAddr]
+	if ok && msg.Time <= old.announced {
+		d.mu.Unlock()
+		log.Debug("replayed announcement of %s", msg.Name)
+		return
+	}
+	d.peers[msg.ListenAddr] = &discoveredPeer{edge: edge, expire: now.Add(d.ttl), announced: msg.Time}
+	d.mu.Unlock()
+
+	if ok && old.edge.Cidr == edge.Cidr && old.edge.Vni == edge.Vni {
+		return
+	}
+
+	if ok {
+		log.Info("discovered peer %s changed %v => %v", msg.Name, old.edge, edge)
+		d.server.DelPeer(copyEdge(old.edge))
+	} else {
+		log.Info("discovered peer %s %s %s", msg.Name, msg.ListenAddr, msg.Cidr)
+	}
+	d.server.AddDynamicPeer(copyEdge(edge))
+}
+
+func (d *Discovery) expireLoop() {
+	tick := time.NewTicker(d.ttl / 3)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			d.expire(now)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// expire removes peers not announced for ttl
+func (d *Discovery) expire(now time.Time) {
+	d.mu.Lock()
+	expired := make([]*codec.Edge, 0)
+	for addr, p := range d.peers {
+		if now.After(p.expire) {
+			expired = append(expired, p.edge)
+			delete(d.peers, addr)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, edge := range expired {
+		log.Info("discovered peer %s %s expired", edge.Name, edge.ListenAddr)
+		d.server.DelPeer(copyEdge(edge))
+	}
+}
+
+// copyEdge protects discovered peers from being modified by Server
+func copyEdge(e *codec.Edge) *codec.Edge {
+	c := *e
+	return &c
+}
+
+func ifaceIPv4(ifi *net.Interface) (net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("no ipv4 address on %s", ifi.Name)
+}
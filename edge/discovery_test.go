@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestDiscovery(t *testing.T) {
+	// free port for the group
+	lconn := listenLocal(t)
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 58, 58), Port: lconn.LocalAddr().(*net.UDPAddr).Port}
+	lconn.Close()
+
+	newEdge := func(name, listen, cidr string) (*Server, *Discovery) {
+		s := NewServer("", "key", nil)
+		s.SetRouteManager(newFakeRoutes())
+		s.AddInterface(0, &Interface{tun: newFakeTun(name)})
+		local := &codec.Edge{Name: name, ListenAddr: listen, Cidr: cidr}
+		d, err := NewDiscovery(group.String(), "lo", local, "default", "key", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.SetTTL(time.Millisecond * 300)
+		return s, d
+	}
+
+	a, da := newEdge("a", ":58423", "10.0.1.0/24")
+	b, db := newEdge("b", "127.0.0.1:58424", "10.0.2.0/24")
+	// other namespace is never peered
+	c, dc := newEdge("c", "127.0.0.1:58425", "10.0.3.0/24")
+	dc.namespace = "other"
+
+	for _, d := range []*Discovery{da, db, dc} {
+		go func(d *Discovery) {
+			if err := d.Run(); err != nil {
+				t.Error(err)
+			}
+		}(d)
+		defer d.Close()
+	}
+
+	peerOf := func(s *Server, cidr string) string {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if pc := s.peerConns[0][cidr]; pc != nil {
+			return pc.addr
+		}
+		return ""
+	}
+
+	waitPeer := func(s *Server, cidr, expect string) {
+		deadline := time.Now().Add(time.Second * 3)
+		for peerOf(s, cidr) != expect && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if got := peerOf(s, cidr); got != expect {
+			t.Fatalf("expected peer %s of %s, got %q", expect, cidr, got)
+		}
+	}
+
+	// unspecified listen host takes iface address
+	waitPeer(a, "10.0.2.0/24", "127.0.0.1:58424")
+	waitPeer(b, "10.0.1.0/24", "127.0.0.1:58423")
+	if peerOf(a, "10.0.3.0/24") != "" || peerOf(c, "10.0.1.0/24") != "" {
+		t.Fatalf("edge of other namespace peered")
+	}
+
+	// b stops announcing and expires
+	db.Close()
+	waitPeer(a, "10.0.2.0/24", "")
+}
+
+func TestDiscoveryAnnounce(t *testing.T) {
+	s := NewServer("", "key", nil)
+	s.SetRouteManager(newFakeRoutes())
+	s.AddInterface(0, &Interface{tun: newFakeTun("a")})
+	local := &codec.Edge{Name: "a", ListenAddr: "127.0.0.1:58423", Cidr: "10.0.1.0/24"}
+	d, err := NewDiscovery("239.255.58.58:58426", "lo", local, "default", "key", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	signed := func(at time.Time, cidr string) *announceMsg {
+		msg := &announceMsg{Name: "b", ListenAddr: "127.0.0.1:58424", Cidr: cidr, Time: at.UnixNano()}
+		msg.Sig = d.sign(msg)
+		return msg
+	}
+	discovered := func() string {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if p := d.peers["127.0.0.1:58424"]; p != nil {
+			return p.edge.Cidr
+		}
+		return ""
+	}
+
+	// unsigned, forged and stale announcements are ignored
+	forged := signed(now, "10.0.2.0/24")
+	forged.Cidr = "10.0.9.0/24"
+	for _, msg := range []*announceMsg{
+		{Name: "b", ListenAddr: "127.0.0.1:58424", Cidr: "10.0.2.0/24", Time: now.UnixNano()},
+		forged,
+		signed(now.Add(-d.ttl*2), "10.0.2.0/24"),
+		signed(now.Add(d.ttl*2), "10.0.2.0/24"),
+	} {
+		d.onAnnounce(msg, now)
+		if cidr := discovered(); cidr != "" {
+			t.Fatalf("announcement %+v accepted", msg)
+		}
+	}
+
+	first := signed(now.Add(-time.Second), "10.0.2.0/24")
+	d.onAnnounce(first, now)
+	if discovered() != "10.0.2.0/24" {
+		t.Fatalf("signed announcement not accepted")
+	}
+
+	// replays of earlier announcements do not revert the peer
+	d.onAnnounce(signed(now, "10.0.3.0/24"), now)
+	d.onAnnounce(first, now)
+	if cidr := discovered(); cidr != "10.0.3.0/24" {
+		t.Fatalf("replayed announcement accepted, got %s", cidr)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+var dscpRouted = metrics.NewCounter("cframe_edge_dscp_routed_total",
+	"packets sent over the endpoint or transport of their dscp")
+
+// DSCP returns the differentiated services code point of the
+// traffic class, the upper 6 bits of ipv4 tos or ipv6 class
+func (p Packet) DSCP() uint8 {
+	if p.Version() == 6 {
+		return (p[0]&0x0f)<<2 | p[1]>>6
+	}
+	return p[1] >> 2
+}
+
+// ParseDSCPRoutes parses comma separated dscp=endpoint pairs,
+// endpoint is a peer address or transport udp or tcp,
+// eg: 46=2.2.2.2:58423,34=tcp
+func ParseDSCPRoutes(s string) (map[uint8]string, error) {
+	routes := make(map[uint8]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("invalid dscp route %s", pair)
+		}
+		dscp, err := strconv.ParseUint(kv[0], 0, 8)
+		if err != nil || dscp > 63 {
+			return nil, fmt.Errorf("invalid dscp route %s: dscp is 0-63", pair)
+		}
+		switch kv[1] {
+		case transportUDP, transportTCP:
+			routes[uint8(dscp)] = kv[1]
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid dscp route %s: %v", pair, err)
+		}
+		routes[uint8(dscp)] = addr.String()
+	}
+	return routes, nil
+}
+
+// SetDSCPRoutes sends packets of a dscp over an endpoint of the
+// peer or a transport, eg: latency sensitive classes over the
+// premium link of a peer reachable over several links.
+// the endpoint is used only if it serves the destination as
+// primary, standby or path and is up, otherwise routes apply
+func (s *Server) SetDSCPRoutes(routes map[uint8]string) {
+	s.dscpRoutes = routes
+}
+
+// dscpRoute returns peer address and transport of pkt to dst
+// routed to peer, transport is nil if not overridden
+func (s *Server) dscpRoute(vni uint32, pkt Packet, dst, peer string) (string, transport) {
+	if len(s.dscpRoutes) == 0 {
+		return peer, nil
+	}
+	to, ok := s.dscpRoutes[pkt.DSCP()]
+	if !ok {
+		return peer, nil
+	}
+
+	switch to {
+	case transportTCP, transportUDP:
+		s.mu.RLock()
+		tcp, conn := s.tcp, s.conn
+		s.mu.RUnlock()
+		if to == transportTCP && tcp != nil {
+			dscpRouted.Inc()
+			return peer, tcp
+		}
+		if to == transportUDP && conn != nil {
+			dscpRouted.Inc()
+			return peer, conn
+		}
+		return peer, nil
+	}
+
+	if to != peer && s.serves(vni, to, dst) && s.health.isUp(to) {
+		dscpRouted.Inc()
+		return to, nil
+	}
+	return peer, nil
+}
+
+// serves reports whether addr serves a cidr containing dst
+func (s *Server) serves(vni uint32, addr, dst string) bool {
+	ip := net.ParseIP(dst)
+	if ip == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.peerConns[vni] {
+		if !p.servedBy(addr) {
+			continue
+		}
+		if p.ipnet != nil && p.ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
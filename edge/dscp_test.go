@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestDSCPRoutes(t *testing.T) {
+	if _, err := ParseDSCPRoutes("64=tcp"); err == nil {
+		t.Fatal("expected error for dscp out of range")
+	}
+
+	cheap, premium := listenLocal(t), listenLocal(t)
+	defer cheap.Close()
+	defer premium.Close()
+	routes, err := ParseDSCPRoutes("46=" + premium.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+	s.SetDSCPRoutes(routes)
+	s.conn = listenLocal(t)
+	defer s.conn.Close()
+
+	// the peer is reachable over both links, premium as standby
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: cheap.LocalAddr().String()})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: premium.LocalAddr().String(), Standby: true})
+
+	withDSCP := func(dscp uint8) []byte {
+		pkt := ipPacket("10.0.1.5", "10.0.2.5")
+		pkt[1] = dscp << 2
+		return pkt
+	}
+	received := func(conn *net.UDPConn) bool {
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		_, err := conn.Read(make([]byte, 2048))
+		return err == nil
+	}
+
+	routed := dscpRouted.Value()
+	s.forwardLocal(s.conn, 0, withDSCP(46))
+	if !received(premium) || received(cheap) {
+		t.Fatal("expedited packet not sent over premium endpoint")
+	}
+	if dscpRouted.Value() != routed+1 {
+		t.Fatal("dscp routed packet not counted")
+	}
+
+	s.forwardLocal(s.conn, 0, withDSCP(0))
+	if !received(cheap) || received(premium) {
+		t.Fatal("best effort packet not sent over cheap endpoint")
+	}
+
+	// endpoints not serving the destination are not used
+	other := withDSCP(46)
+	copy(other[16:20], net.ParseIP("10.0.3.5").To4())
+	s.AddPeer(&codec.Edge{Cidr: "10.0.3.0/24", ListenAddr: cheap.LocalAddr().String()})
+	s.forwardLocal(s.conn, 0, other)
+	if !received(cheap) || received(premium) {
+		t.Fatal("packet sent over endpoint not serving its destination")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// | key | [vni header] | ip packet |, see header.go
+	encapRaw = "raw"
+
+	// GRE-in-UDP, rfc8086, data packets end with a tag
+	// authenticating them by the secret
+	// | gre header | key(vni << 8) | ip packet | tag |
+	// control packets use a local experimental protocol type
+	// | gre header | key | 0x00 | type | payload |
+	// and so does sealed ip packet
+	// | gre header | key(vni << 8) | 0x02 | epoch | nonce | ciphertext | tag |
+	encapGRE = "gre"
+)
+
+const (
+	greFlagKey    = 0x2000
+	greProtoIPv4  = 0x0800
+	greProtoIPv6  = 0x86dd
+	greProtoCtrl  = 0x88b5
+	greProtoSeal  = 0x88b6
+	greHeaderSize = 4
+	greKeySize    = 4
+	// truncated hmac-sha256 of gre data packet
+	greTagSize = 16
+)
+
+// Encap encodes packets sent to peers and decodes packets
+// received from peers, edges must use the same encapsulation
+type Encap interface {
+	EncodeData(vni uint32, pkt []byte) []byte
+	EncodeCtrl(typ byte, payload []byte) []byte
+
+	// Decode returns vni and the inner packet, the inner packet
+	// is a control packet, a sealed ip packet or an ip packet
+	Decode(buf []byte) (uint32, []byte, error)
+}
+
+func NewEncap(mode, key string) (Encap, error) {
+	switch mode {
+	case "", encapRaw:
+		return &rawEncap{key: key}, nil
+	case encapGRE:
+		return &greEncap{key: key}, nil
+	default:
+		return nil, fmt.Errorf("unsupported encap mode %s", mode)
+	}
+}
+
+type rawEncap struct {
+	key string
+}
+
+func (e *rawEncap) EncodeData(vni uint32, pkt []byte) []byte {
+	return encodeData(e.key, vni, pkt)
+}
+
+func (e *rawEncap) EncodeCtrl(typ byte, payload []byte) []byte {
+	return encodeCtrl(e.key, typ, payload)
+}
+
+func (e *rawEncap) Decode(buf []byte) (uint32, []byte, error) {
+	klen := len(e.key)
+	if len(buf) < klen {
+		return 0, nil, fmt.Errorf("pkt to small")
+	}
+
+	if string(buf[:klen]) != e.key {
+		return 0, nil, fmt.Errorf("access forbidden")
+	}
+
+	pkt := buf[klen:]
+	if isCtrl(pkt) {
+		return 0, pkt, nil
+	}
+
+	vni, pkt := decodeData(pkt)
+	return vni, pkt, nil
+}
+
+// greEncap carries vni in gre key field like nvgre,
+// data packets do not carry the secret but a tag by it
+type greEncap struct {
+	key string
+}
+
+// tag returns hmac-sha256 of buf by the secret
+func (e *greEncap) tag(buf []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(e.key))
+	mac.Write(buf)
+	return mac.Sum(nil)[:greTagSize]
+}
+
+func (e *greEncap) EncodeData(vni uint32, pkt []byte) []byte {
+	proto := uint16(greProtoIPv4)
+	if isSealed(pkt) {
+		proto = greProtoSeal
+	} else if len(pkt) > 0 && pkt[0]>>4 == 6 {
+		proto = greProtoIPv6
+	}
+
+	buf := make([]byte, greHeaderSize+greKeySize, greHeaderSize+greKeySize+len(pkt)+greTagSize)
+	binary.BigEndian.PutUint16(buf[0:2], greFlagKey)
+	binary.BigEndian.PutUint16(buf[2:4], proto)
+	binary.BigEndian.PutUint32(buf[4:8], vni<<8)
+	buf = append(buf, pkt...)
+	return append(buf, e.tag(buf)...)
+}
+
+func (e *greEncap) EncodeCtrl(typ byte, payload []byte) []byte {
+	ctrl := encodeCtrl(e.key, typ, payload)
+	buf := make([]byte, greHeaderSize, greHeaderSize+len(ctrl))
+	binary.BigEndian.PutUint16(buf[2:4], greProtoCtrl)
+	return append(buf, ctrl...)
+}
+
+func (e *greEncap) Decode(buf []byte) (uint32, []byte, error) {
+	if len(buf) < greHeaderSize {
+		return 0, nil, fmt.Errorf("pkt to small")
+	}
+
+	flags := binary.BigEndian.Uint16(buf[0:2])
+	proto := binary.BigEndian.Uint16(buf[2:4])
+	if flags&0x7 != 0 {
+		return 0, nil, fmt.Errorf("unsupported gre version %d", flags&0x7)
+	}
+
+	// checksum and sequence are not used by cframe but may be set
+	hlen := greHeaderSize
+	if flags&0x8000 != 0 {
+		hlen += 4
+	}
+
+	vni := uint32(0)
+	if flags&greFlagKey != 0 {
+		if len(buf) < hlen+greKeySize {
+			return 0, nil, fmt.Errorf("pkt to small")
+		}
+		vni = binary.BigEndian.Uint32(buf[hlen:hlen+greKeySize]) >> 8
+		hlen += greKeySize
+	}
+
+	if flags&0x1000 != 0 {
+		hlen += 4
+	}
+
+	if len(buf) < hlen {
+		return 0, nil, fmt.Errorf("pkt to small")
+	}
+	pkt := buf[hlen:]
+
+	// data packets without valid tag are injected
+	if proto != greProtoCtrl {
+		if len(pkt) < greTagSize {
+			return 0, nil, fmt.Errorf("pkt to small")
+		}
+		n := len(buf) - greTagSize
+		if !hmac.Equal(buf[n:], e.tag(buf[:n])) {
+			return 0, nil, fmt.Errorf("access forbidden")
+		}
+		pkt = pkt[:len(pkt)-greTagSize]
+	}
+
+	switch proto {
+	case greProtoIPv4, greProtoIPv6:
+		return vni, pkt, nil
+
+	case greProtoSeal:
+		if !isSealed(pkt) {
+			return 0, nil, fmt.Errorf("invalid sealed packet")
+		}
+		return vni, pkt, nil
+
+	case greProtoCtrl:
+		klen := len(e.key)
+		if len(pkt) < klen || string(pkt[:klen]) != e.key {
+			return 0, nil, fmt.Errorf("access forbidden")
+		}
+
+		if !isCtrl(pkt[klen:]) {
+			return 0, nil, fmt.Errorf("invalid ctrl packet")
+		}
+		return 0, pkt[klen:], nil
+
+	default:
+		return 0, nil, fmt.Errorf("unsupported gre protocol 0x%x", proto)
+	}
+}
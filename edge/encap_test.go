@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestEncapRoundTrip(t *testing.T) {
+	pkt := ipPacket("10.0.0.1", "10.0.0.2")
+	for _, mode := range []string{encapRaw, encapGRE} {
+		encap, err := NewEncap(mode, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, vni := range []uint32{0, 1, maxVNI} {
+			vni2, inner, err := encap.Decode(encap.EncodeData(vni, pkt))
+			if err != nil {
+				t.Fatalf("%s: decode data fail: %v", mode, err)
+			}
+			if vni2 != vni || !bytes.Equal(inner, pkt) {
+				t.Fatalf("%s: data mismatch, vni %d => %d", mode, vni, vni2)
+			}
+		}
+
+		_, inner, err := encap.Decode(encap.EncodeCtrl(ctrlPing, []byte("nonce")))
+		if err != nil {
+			t.Fatalf("%s: decode ctrl fail: %v", mode, err)
+		}
+		if !isCtrl(inner) || inner[1] != ctrlPing || string(inner[2:]) != "nonce" {
+			t.Fatalf("%s: ctrl mismatch %v", mode, inner)
+		}
+	}
+}
+
+func TestGREHeader(t *testing.T) {
+	encap, _ := NewEncap(encapGRE, "key")
+	buf := encap.EncodeData(100, ipPacket("10.0.0.1", "10.0.0.2"))
+	if flags := binary.BigEndian.Uint16(buf[0:2]); flags != greFlagKey {
+		t.Fatalf("unexpected gre flags 0x%x", flags)
+	}
+	if proto := binary.BigEndian.Uint16(buf[2:4]); proto != greProtoIPv4 {
+		t.Fatalf("unexpected gre protocol 0x%x", proto)
+	}
+	if key := binary.BigEndian.Uint32(buf[4:8]); key != 100<<8 {
+		t.Fatalf("unexpected gre key 0x%x", key)
+	}
+}
+
+func TestGRECtrlWrongKey(t *testing.T) {
+	a, _ := NewEncap(encapGRE, "key")
+	b, _ := NewEncap(encapGRE, "bad")
+	_, _, err := b.Decode(a.EncodeCtrl(ctrlPing, nil))
+	if err == nil {
+		t.Fatalf("expected ctrl with wrong key rejected")
+	}
+}
+
+func TestGREDataUnauthenticated(t *testing.T) {
+	encap, _ := NewEncap(encapGRE, "key")
+	pkt := ipPacket("10.0.0.1", "10.0.0.2")
+
+	// plain gre packet injected without tag
+	plain := make([]byte, greHeaderSize+greKeySize)
+	binary.BigEndian.PutUint16(plain[0:2], greFlagKey)
+	binary.BigEndian.PutUint16(plain[2:4], greProtoIPv4)
+	if _, _, err := encap.Decode(append(plain, pkt...)); err == nil {
+		t.Fatalf("expected data without tag rejected")
+	}
+
+	// tagged by another secret
+	other, _ := NewEncap(encapGRE, "bad")
+	if _, _, err := encap.Decode(other.EncodeData(0, pkt)); err == nil {
+		t.Fatalf("expected data of wrong key rejected")
+	}
+
+	// tampered
+	buf := encap.EncodeData(1, pkt)
+	buf[greHeaderSize+greKeySize+12] ^= 0x01
+	if _, _, err := encap.Decode(buf); err == nil {
+		t.Fatalf("expected tampered data rejected")
+	}
+}
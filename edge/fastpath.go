@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+var fastPathPackets = metrics.NewCounter("cframe_edge_fast_path_packets_total",
+	"packets handed to a peer in the same process bypassing sockets")
+
+// servers of this process taking packets by the fast path
+// key: udp port of the server
+var fastPathServers = struct {
+	sync.RWMutex
+	m map[int]*fastPathServer
+}{m: make(map[int]*fastPathServer)}
+
+type fastPathServer struct {
+	s *Server
+
+	// addresses the server is reachable at on this host
+	ips []net.IP
+}
+
+// SetFastPath hands packets to peers served by another Server of
+// this process directly instead of through udp sockets, eg: edges
+// of tests or nested setups in one process. both edges enable it
+func (s *Server) SetFastPath(enabled bool) {
+	s.fastPath = enabled
+}
+
+// registerFastPath makes s reachable by the fast path at its port
+func (s *Server) registerFastPath() {
+	if !s.fastPath || s.conn == nil {
+		return
+	}
+	laddr := s.conn.LocalAddr().(*net.UDPAddr)
+	fs := &fastPathServer{s: s}
+	if laddr.IP.IsUnspecified() {
+		fs.ips = append(fs.ips, net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+		addrs, err := localAddrs()
+		if err != nil {
+			log.Warn("fast path: list local addresses fail: %v", err)
+		}
+		for _, addr := range addrs {
+			fs.ips = append(fs.ips, net.ParseIP(addr))
+		}
+	} else {
+		fs.ips = append(fs.ips, laddr.IP)
+	}
+
+	fastPathServers.Lock()
+	defer fastPathServers.Unlock()
+	fastPathServers.m[laddr.Port] = fs
+	log.Info("fast path: serving %s", laddr)
+}
+
+// unregisterFastPath stops the fast path to s
+func (s *Server) unregisterFastPath() {
+	if !s.fastPath || s.conn == nil {
+		return
+	}
+	port := s.conn.LocalAddr().(*net.UDPAddr).Port
+	fastPathServers.Lock()
+	defer fastPathServers.Unlock()
+	if fs := fastPathServers.m[port]; fs != nil && fs.s == s {
+		delete(fastPathServers.m, port)
+	}
+}
+
+// fastPathPeer returns server of this process listening on raddr,
+// nil if the peer is elsewhere
+func (s *Server) fastPathPeer(raddr *net.UDPAddr) *Server {
+	if !s.fastPath || s.conn == nil {
+		return nil
+	}
+	fastPathServers.RLock()
+	fs := fastPathServers.m[raddr.Port]
+	fastPathServers.RUnlock()
+	if fs == nil || fs.s == s || fs.s.stopped() {
+		return nil
+	}
+	for _, ip := range fs.ips {
+		if ip.Equal(raddr.IP) {
+			return fs.s
+		}
+	}
+	return nil
+}
+
+// forwardFast hands encoded buf to peer as if received from s,
+// the source is the address the peer would see over loopback
+func (s *Server) forwardFast(peer *Server, raddr *net.UDPAddr, buf []byte) {
+	from := *s.conn.LocalAddr().(*net.UDPAddr)
+	if from.IP.IsUnspecified() {
+		from.IP = raddr.IP
+	}
+	fastPathPackets.Inc()
+	peer.onRemote(peer.conn, &from, buf)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestFastPath(t *testing.T) {
+	newEdge := func() (*Server, *fakeTun) {
+		tun := newFakeTun("cframe.0")
+		s := NewServer("", "key", &Interface{tun: tun})
+		s.SetRouteManager(newFakeRoutes())
+		s.SetFastPath(true)
+		s.SetAllowedIPs(true)
+		s.conn = listenLocal(t)
+		s.registerFastPath()
+		return s, tun
+	}
+	a, _ := newEdge()
+	b, btun := newEdge()
+	defer a.closeSockets()
+	defer b.closeSockets()
+
+	a.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: b.conn.LocalAddr().String()})
+	b.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: a.conn.LocalAddr().String()})
+
+	// nothing reads b's socket, packets only arrive by the fast path
+	fast := fastPathPackets.Value()
+	a.forwardLocal(a.conn, 0, ipPacket("10.0.1.5", "10.0.2.5"))
+	select {
+	case pkt := <-btun.out:
+		if Packet(pkt).Dst() != "10.0.2.5" {
+			t.Fatalf("unexpected packet to %s", Packet(pkt).Dst())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("packet not delivered by fast path")
+	}
+	if fastPathPackets.Value() != fast+1 {
+		t.Fatalf("fast path not counted")
+	}
+
+	// peers elsewhere and unregistered servers go by sockets
+	if a.fastPathPeer(&net.UDPAddr{IP: net.IPv4(10, 9, 9, 9), Port: b.conn.LocalAddr().(*net.UDPAddr).Port}) != nil {
+		t.Fatalf("remote host taken as local")
+	}
+	b.unregisterFastPath()
+	if a.fastPathPeer(b.conn.LocalAddr().(*net.UDPAddr)) != nil {
+		t.Fatalf("unregistered server still on fast path")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+const (
+	// flows tracked at most if flow max is not set
+	defaultFlowMax = 65536
+
+	// flows without packets for flow idle are exported
+	defaultFlowIdle = time.Second * 30
+)
+
+var (
+	flowsExported = metrics.NewCounter("cframe_edge_flows_exported_total",
+		"flow records exported on expiry")
+	flowsUntracked = metrics.NewCounter("cframe_edge_flows_untracked_total",
+		"new flows not tracked as max active flows reached")
+)
+
+// FlowRecord is a flow exported on expiry, one json per line
+// to file or per datagram to collector
+type FlowRecord struct {
+	Vni     uint32    `json:"vni"`
+	Dir     string    `json:"dir"`
+	Peer    string    `json:"peer"`
+	Proto   uint8     `json:"proto"`
+	Src     string    `json:"src"`
+	Dst     string    `json:"dst"`
+	SrcPort uint16    `json:"src_port"`
+	DstPort uint16    `json:"dst_port"`
+	Packets int64     `json:"packets"`
+	Bytes   int64     `json:"bytes"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+}
+
+// flowKey is vni, direction and 5-tuple of inner packet
+type flowKey struct {
+	vni          uint32
+	in           bool
+	proto        uint8
+	src, dst     [16]byte
+	sport, dport uint16
+}
+
+// flows accounts packets forwarded by flow, a flow is exported
+// once idle, at most max flows are tracked to bound memory
+type flows struct {
+	max  int
+	idle time.Duration
+	w    io.WriteCloser
+
+	mu     sync.Mutex
+	active map[flowKey]*FlowRecord
+}
+
+// SetFlowExport exports flow records to dst, a file path or
+// udp://host:port of a collector. at most max flows are active,
+// flows are exported once idle for idle. empty dst disables
+func (s *Server) SetFlowExport(dst string, max int, idle time.Duration) error {
+	if len(dst) == 0 {
+		s.flows = nil
+		return nil
+	}
+
+	var w io.WriteCloser
+	var err error
+	if strings.HasPrefix(dst, "udp://") {
+		w, err = net.Dial("udp", strings.TrimPrefix(dst, "udp://"))
+	} else {
+		w, err = os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("open flow export %s: %v", dst, err)
+	}
+	s.flows = newFlows(w, max, idle)
+	return nil
+}
+
+func newFlows(w io.WriteCloser, max int, idle time.Duration) *flows {
+	if max <= 0 {
+		max = defaultFlowMax
+	}
+	if idle <= 0 {
+		idle = defaultFlowIdle
+	}
+	return &flows{
+		max:    max,
+		idle:   idle,
+		w:      w,
+		active: make(map[flowKey]*FlowRecord),
+	}
+}
+
+// account counts pkt forwarded to or received from peer
+func (f *flows) account(vni uint32, in bool, peer string, pkt []byte, now time.Time) {
+	p := Packet(pkt)
+	key := flowKey{vni: vni, in: in}
+	if len(p) == 0 {
+		return
+	}
+	// truncated headers come from peers too
+	switch p.Version() {
+	case 4:
+		if len(p) < 20 {
+			return
+		}
+		copy(key.src[:], p[12:16])
+		copy(key.dst[:], p[16:20])
+	case 6:
+		if len(p) < 40 {
+			return
+		}
+		copy(key.src[:], p[8:24])
+		copy(key.dst[:], p[24:40])
+	default:
+		return
+	}
+	key.proto = p.Protocol()
+	key.sport, key.dport = p.ports()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rec := f.active[key]
+	if rec == nil {
+		if len(f.active) >= f.max {
+			flowsUntracked.Inc()
+			return
+		}
+		rec = &FlowRecord{
+			Vni:     vni,
+			Dir:     "out",
+			Peer:    peer,
+			Proto:   key.proto,
+			Src:     p.Src(),
+			Dst:     p.Dst(),
+			SrcPort: key.sport,
+			DstPort: key.dport,
+			Start:   now,
+		}
+		if in {
+			rec.Dir = "in"
+		}
+		f.active[key] = rec
+	}
+	rec.Packets++
+	rec.Bytes += int64(len(pkt))
+	rec.End = now
+}
+
+// expire exports flows idle at now, all flows if now is zero
+func (f *flows) expire(now time.Time) {
+	f.mu.Lock()
+	expired := make([]*FlowRecord, 0)
+	for key, rec := range f.active {
+		if now.IsZero() || now.Sub(rec.End) >= f.idle {
+			expired = append(expired, rec)
+			delete(f.active, key)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, rec := range expired {
+		b, _ := json.Marshal(rec)
+		if _, err := f.w.Write(append(b, '\n')); err != nil {
+			log.Error("export flow record fail: %v", err)
+			continue
+		}
+		flowsExported.Inc()
+	}
+}
+
+func (s *Server) exportFlows() {
+	defer s.guard()
+	tick := time.NewTicker(s.flows.idle / 2)
+	defer tick.Stop()
+	for now := range tick.C {
+		if s.stopped() {
+			return
+		}
+		s.flows.expire(now)
+	}
+}
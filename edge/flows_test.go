@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestFlowExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flows.json")
+
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+	if err := s.SetFlowExport(path, 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	s.conn = listenLocal(t)
+	defer s.conn.Close()
+	peer := listenLocal(t)
+	defer peer.Close()
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: peer.LocalAddr().String()})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		s.forwardLocal(s.conn, 0, tcpSegment(uint32(i*100), 100))
+	}
+
+	// flows beyond max are not tracked
+	untracked := flowsUntracked.Value()
+	s.forwardLocal(s.conn, 0, ipPacket("10.0.1.6", "10.0.2.6"))
+	if flowsUntracked.Value() != untracked+1 {
+		t.Fatal("flow beyond max tracked")
+	}
+
+	// active flows are not exported
+	s.flows.expire(time.Now())
+	if b, _ := ioutil.ReadFile(path); len(b) > 0 {
+		t.Fatalf("active flow exported: %s", b)
+	}
+
+	s.flows.expire(time.Now().Add(time.Minute))
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 flow record, got %d", len(lines))
+	}
+	rec := &FlowRecord{}
+	if err := json.Unmarshal([]byte(lines[0]), rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Dir != "out" || rec.Peer != peer.LocalAddr().String() || rec.Proto != protoTCP ||
+		rec.Src != "10.0.1.5" || rec.Dst != "10.0.2.5" || rec.SrcPort != 40000 || rec.DstPort != 443 {
+		t.Fatalf("unexpected flow tuple %+v", rec)
+	}
+	if rec.Packets != 3 || rec.Bytes != 3*140 {
+		t.Fatalf("expected 3 packets 420 bytes, got %d %d", rec.Packets, rec.Bytes)
+	}
+	if rec.Start.Before(start) || rec.End.Before(rec.Start) {
+		t.Fatalf("unexpected flow time %v - %v", rec.Start, rec.End)
+	}
+}
+
+func TestFlowAccountShort(t *testing.T) {
+	f := newFlows(nil, 16, time.Minute)
+
+	// ipv6 version with an ipv4 sized header
+	short6 := make([]byte, 24)
+	short6[0] = 0x60
+	short4 := []byte{0x45, 0, 0, 10}
+	for _, pkt := range [][]byte{short6, short4, nil} {
+		f.account(0, true, "1.1.1.1:58423", pkt, time.Now())
+	}
+	if len(f.active) != 0 {
+		t.Fatalf("truncated packets tracked %d flows", len(f.active))
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"net"
+)
 
 type Frame []byte
 type Packet []byte
@@ -10,15 +13,20 @@ func (f Frame) Invalid() bool {
 }
 
 func (f Frame) IsIPV4() bool {
+	return f.Ethertype() == 0x0800
+}
+
+// Ethertype returns ethertype of ethernet frame, 0 if invalid
+func (f Frame) Ethertype() uint16 {
 	if f.Invalid() {
-		return false
+		return 0
 	}
-	proto := int(f[12])<<8 + int(f[13])
-	return proto == 0x0800
+	return uint16(f[12])<<8 | uint16(f[13])
 }
 
+// Invalid reports packet shorter than ip header of its version
 func (p Packet) Invalid() bool {
-	return len(p) < 20
+	return len(p) < 20 || p.Version() == 6 && len(p) < 40
 }
 
 func (p Packet) Version() int {
@@ -26,9 +34,112 @@ func (p Packet) Version() int {
 }
 
 func (p Packet) Dst() string {
+	if p.Version() == 6 {
+		return net.IP(p[24:40]).String()
+	}
 	return fmt.Sprintf("%d.%d.%d.%d", p[16], p[17], p[18], p[19])
 }
 
 func (p Packet) Src() string {
+	if p.Version() == 6 {
+		return net.IP(p[8:24]).String()
+	}
 	return fmt.Sprintf("%d.%d.%d.%d", p[12], p[13], p[14], p[15])
 }
+
+// ip protocol numbers
+const (
+	protoICMP  = 1
+	protoTCP   = 6
+	protoUDP   = 17
+	protoICMP6 = 58
+)
+
+// ipv6 extension headers walked to the transport header
+const (
+	ext6HopByHop = 0
+	ext6Routing  = 43
+	ext6Fragment = 44
+	ext6AH       = 51
+	ext6DestOpts = 60
+)
+
+// transport returns protocol and offset of the transport header,
+// offset is -1 if the packet is truncated or a non first fragment
+func (p Packet) transport() (uint8, int) {
+	if len(p) == 0 {
+		return 0, -1
+	}
+
+	switch p.Version() {
+	case 4:
+		if p.Invalid() {
+			return 0, -1
+		}
+		proto := p[9]
+		ihl := int(p[0]&0x0f) * 4
+		// fragment offset
+		if ihl < 20 || uint16(p[6]&0x1f)<<8|uint16(p[7]) != 0 {
+			return proto, -1
+		}
+		return proto, ihl
+
+	case 6:
+		if len(p) < 40 {
+			return 0, -1
+		}
+		next, off := p[6], 40
+		for {
+			switch next {
+			case ext6HopByHop, ext6Routing, ext6DestOpts, ext6AH, ext6Fragment:
+			default:
+				return next, off
+			}
+			if len(p) < off+8 {
+				return next, -1
+			}
+
+			hlen := (int(p[off+1]) + 1) * 8
+			switch next {
+			case ext6AH:
+				hlen = (int(p[off+1]) + 2) * 4
+			case ext6Fragment:
+				hlen = 8
+				if uint16(p[off+2])<<8|uint16(p[off+3]&0xf8) != 0 {
+					return p[off], -1
+				}
+			}
+			next, off = p[off], off+hlen
+		}
+	}
+	return 0, -1
+}
+
+// Protocol returns the transport protocol, eg: 6 for tcp,
+// ipv6 extension headers are skipped
+func (p Packet) Protocol() uint8 {
+	proto, _ := p.transport()
+	return proto
+}
+
+// ports returns ports of tcp or udp packet, 0 for others
+func (p Packet) ports() (uint16, uint16) {
+	proto, off := p.transport()
+	if (proto != protoTCP && proto != protoUDP) || off < 0 || len(p) < off+4 {
+		return 0, 0
+	}
+	return uint16(p[off])<<8 | uint16(p[off+1]),
+		uint16(p[off+2])<<8 | uint16(p[off+3])
+}
+
+// SrcPort returns source port of tcp or udp packet, 0 for others
+func (p Packet) SrcPort() uint16 {
+	sport, _ := p.ports()
+	return sport
+}
+
+// DstPort returns destination port of tcp or udp packet, 0 for others
+func (p Packet) DstPort() uint16 {
+	_, dport := p.ports()
+	return dport
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// l4Packet builds an ipv4 packet with ihl words of header
+// followed by transport header starting with sport and dport
+func l4Packet(proto uint8, ihl int, sport, dport uint16) Packet {
+	hlen := ihl * 4
+	pkt := make([]byte, hlen+20)
+	pkt[0] = 0x40 | byte(ihl)
+	pkt[9] = proto
+	copy(pkt[12:16], net.ParseIP("10.0.0.1").To4())
+	copy(pkt[16:20], net.ParseIP("10.0.1.1").To4())
+	pkt[hlen], pkt[hlen+1] = byte(sport>>8), byte(sport)
+	pkt[hlen+2], pkt[hlen+3] = byte(dport>>8), byte(dport)
+	return pkt
+}
+
+// l6Packet builds an ipv6 packet with extension headers exts,
+// each is next header and the header bytes
+func l6Packet(proto uint8, sport, dport uint16, exts ...[]byte) Packet {
+	pkt := make([]byte, 40)
+	pkt[0] = 0x60
+	next := &pkt[6]
+	for _, ext := range exts {
+		*next = ext[0]
+		off := len(pkt)
+		pkt = append(pkt, ext[1:]...)
+		next = &pkt[off]
+	}
+	*next = proto
+	return append(pkt, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport), 0, 0, 0, 0)
+}
+
+func TestPacketTransport(t *testing.T) {
+	frag := l4Packet(protoUDP, 5, 5353, 53)
+	frag[7] = 0x10
+
+	hopByHop := append([]byte{ext6HopByHop}, make([]byte, 8)...)
+	destOpts := append([]byte{ext6DestOpts, 0, 1}, make([]byte, 14)...)
+	fragment := append([]byte{ext6Fragment}, make([]byte, 8)...)
+	laterFragment := append([]byte{ext6Fragment, 0, 0, 0, 0x08}, make([]byte, 4)...)
+
+	for i, c := range []struct {
+		pkt          Packet
+		proto        uint8
+		sport, dport uint16
+	}{
+		{l4Packet(protoTCP, 5, 40000, 443), protoTCP, 40000, 443},
+		{l4Packet(protoUDP, 5, 5353, 53), protoUDP, 5353, 53},
+		// options of 8 bytes
+		{l4Packet(protoTCP, 7, 22, 50000), protoTCP, 22, 50000},
+		{l4Packet(protoICMP, 5, 0x0800, 0x1234), protoICMP, 0, 0},
+		// non first fragment carries no ports
+		{frag, protoUDP, 0, 0},
+		{l6Packet(protoTCP, 40000, 443), protoTCP, 40000, 443},
+		{l6Packet(protoUDP, 5353, 53, hopByHop, destOpts), protoUDP, 5353, 53},
+		{l6Packet(protoUDP, 5353, 53, fragment), protoUDP, 5353, 53},
+		{l6Packet(protoUDP, 5353, 53, laterFragment), protoUDP, 0, 0},
+		{l6Packet(58, 0x8000, 1), 58, 0, 0},
+		// truncated
+		{l4Packet(protoTCP, 5, 1, 2)[:22], protoTCP, 0, 0},
+		{Packet{0x60, 0, 0}, 0, 0, 0},
+	} {
+		if got := c.pkt.Protocol(); got != c.proto {
+			t.Errorf("case %d: expected protocol %d, got %d", i, c.proto, got)
+		}
+		if sport, dport := c.pkt.SrcPort(), c.pkt.DstPort(); sport != c.sport || dport != c.dport {
+			t.Errorf("case %d: expected ports %d %d, got %d %d", i, c.sport, c.dport, sport, dport)
+		}
+	}
+}
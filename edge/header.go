@@ -0,0 +1,36 @@
+package main
+
+// data packet after key
+// untagged: | ip packet |, vni 0
+// tagged:   | 1byte magic(0x01) | 3bytes vni | ip packet |
+// ip packet never starts with 0x01, see ctrl.go for 0x00
+// and cipher.go for sealed ip packet starting with 0x02
+const vniMagic = 0x01
+
+// vni is 24 bits
+const maxVNI = 1<<24 - 1
+
+func encodeData(key string, vni uint32, pkt []byte) []byte {
+	if vni == 0 {
+		buf := make([]byte, 0, len(key)+len(pkt))
+		buf = append(buf, []byte(key)...)
+		buf = append(buf, pkt...)
+		return buf
+	}
+
+	buf := make([]byte, 0, len(key)+4+len(pkt))
+	buf = append(buf, []byte(key)...)
+	buf = append(buf, vniMagic, byte(vni>>16), byte(vni>>8), byte(vni))
+	buf = append(buf, pkt...)
+	return buf
+}
+
+// decodeData returns vni and ip packet of data packet
+func decodeData(pkt []byte) (uint32, []byte) {
+	if len(pkt) < 4 || pkt[0] != vniMagic {
+		return 0, pkt
+	}
+
+	vni := uint32(pkt[1])<<16 | uint32(pkt[2])<<8 | uint32(pkt[3])
+	return vni, pkt[4:]
+}
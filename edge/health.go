@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+var (
+	defaultHealthInterval = time.Second * 1
+	defaultHealthFailures = 3
+)
+
+// peerHealth is health check state of a peer address
+type peerHealth struct {
+	up       bool
+	lastPing time.Time
+	lastPong time.Time
+	misses   int
+
+	// ping interval of the peer if adaptive
+	interval time.Duration
+
+	// smoothed rtt and jitter of answered pings
+	srtt   time.Duration
+	jitter time.Duration
+	rtt    time.Duration
+
+	// flap penalty at penaltyAt, held down until reuseAt
+	penalty   float64
+	penaltyAt time.Time
+	reuseAt   time.Time
+}
+
+// LatencyStats is smoothed rtt and jitter of a peer in ms
+type LatencyStats struct {
+	RTT    float64 `json:"rtt_ms"`
+	Jitter float64 `json:"jitter_ms"`
+}
+
+var (
+	peerRTT = metrics.NewGaugeVec("cframe_edge_peer_rtt_seconds",
+		"smoothed health check rtt of peer", "peer")
+	peerJitter = metrics.NewGaugeVec("cframe_edge_peer_jitter_seconds",
+		"health check rtt jitter of peer", "peer")
+)
+
+// sample folds rtt of a pong into srtt as tcp does (RFC6298)
+// and jitter as rtp does (RFC3550)
+func (ph *peerHealth) sample(rtt time.Duration) {
+	if ph.rtt == 0 {
+		ph.srtt, ph.rtt = rtt, rtt
+		return
+	}
+
+	d := rtt - ph.rtt
+	if d < 0 {
+		d = -d
+	}
+	ph.jitter += (d - ph.jitter) / 16
+	ph.srtt += (rtt - ph.srtt) / 8
+	ph.rtt = rtt
+}
+
+// health tracks peers by ping/pong over the control channel,
+// peer is marked down after failures pings without pong
+type health struct {
+	mu       sync.Mutex
+	failures int
+	peers    map[string]*peerHealth
+
+	// resolved udp address => peer address
+	addrs map[string]string
+
+	// adaptive probing if max > min, a peer is pinged every min
+	// after a miss and the interval doubles up to max on each pong
+	min, max time.Duration
+
+	// holds down flapping peers, see damping.go
+	damping damping
+}
+
+func newHealth(failures int) *health {
+	return &health{
+		failures: failures,
+		peers:    make(map[string]*peerHealth),
+		addrs:    make(map[string]string),
+	}
+}
+
+// isUp returns false only if addr is marked down or damped,
+// peer never checked is considered up
+func (h *health) isUp(addr string) bool {
+	return h.upAt(addr, time.Now())
+}
+
+func (h *health) upAt(addr string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ph, ok := h.peers[addr]
+	return !ok || (ph.up && !ph.damped(now))
+}
+
+func (h *health) onPing(addr, raddr string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.addrs[raddr] = addr
+	ph, ok := h.peers[addr]
+	if !ok {
+		ph = &peerHealth{up: true, interval: h.min}
+		h.peers[addr] = ph
+	}
+
+	// last ping not answered
+	if !ph.lastPing.IsZero() && ph.lastPong.Before(ph.lastPing) {
+		ph.misses++
+		ph.interval = h.min
+		if ph.up && ph.misses >= h.failures {
+			ph.up = false
+			log.Warn("peer %s down, %d pings lost", addr, ph.misses)
+			h.damping.flap(addr, ph, now)
+		}
+	}
+	ph.lastPing = now
+}
+
+func (h *health) onPong(raddr string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	addr := h.addrs[raddr]
+	ph, ok := h.peers[addr]
+	if !ok {
+		return
+	}
+
+	// pong of the outstanding ping
+	if !ph.lastPing.IsZero() && ph.lastPong.Before(ph.lastPing) {
+		ph.sample(now.Sub(ph.lastPing))
+		peerRTT.Set(addr, ph.srtt.Seconds())
+		peerJitter.Set(addr, ph.jitter.Seconds())
+	}
+
+	ph.lastPong, ph.misses = now, 0
+	if h.adaptive() {
+		ph.interval *= 2
+		if ph.interval > h.max {
+			ph.interval = h.max
+		}
+	}
+	if !ph.up {
+		ph.up = true
+		log.Info("peer %s up", addr)
+		h.damping.flap(addr, ph, now)
+	}
+}
+
+func (h *health) adaptive() bool {
+	return h.min > 0 && h.max > h.min
+}
+
+// due reports whether addr should be pinged at now,
+// every peer is due on each tick unless adaptive
+func (h *health) due(addr string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ph, ok := h.peers[addr]
+	if !h.adaptive() || !ok {
+		return true
+	}
+	// ticks may come a bit early
+	return now.Sub(ph.lastPing) >= ph.interval-h.min/2
+}
+
+// interval returns ping interval of addr, 0 if not adaptive
+func (h *health) interval(addr string) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ph, ok := h.peers[addr]; ok && h.adaptive() {
+		return ph.interval
+	}
+	return 0
+}
+
+// latency returns rtt and jitter of peers answered pings
+func (h *health) latency() map[string]*LatencyStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := make(map[string]*LatencyStats)
+	for addr, ph := range h.peers {
+		if ph.rtt == 0 {
+			continue
+		}
+		stats[addr] = &LatencyStats{
+			RTT:    float64(ph.srtt) / float64(time.Millisecond),
+			Jitter: float64(ph.jitter) / float64(time.Millisecond),
+		}
+	}
+	return stats
+}
+
+// forget stops tracking peers not in addrs
+func (h *health) forget(addrs map[string]struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for addr := range h.peers {
+		if _, ok := addrs[addr]; !ok {
+			delete(h.peers, addr)
+			peerRTT.Delete(addr)
+			peerJitter.Delete(addr)
+		}
+	}
+	for raddr, addr := range h.addrs {
+		if _, ok := addrs[addr]; !ok {
+			delete(h.addrs, raddr)
+		}
+	}
+}
+
+// SetHealthCheck pings peers every interval and marks peer
+// down after failures lost pings, interval 0 disables health check
+func (s *Server) SetHealthCheck(interval time.Duration, failures int) {
+	s.healthInterval = interval
+	s.health = newHealth(failures)
+}
+
+// Latency returns smoothed rtt and jitter of peers by health check
+func (s *Server) Latency() map[string]*LatencyStats {
+	return s.health.latency()
+}
+
+// SetAdaptiveHealth pings healthy peers less often, the interval
+// of a peer drops to min on a lost ping and doubles on each pong up to max.
+// must be called after SetHealthCheck, disabled unless max > min > 0
+func (s *Server) SetAdaptiveHealth(min, max time.Duration) {
+	if min <= 0 || max <= min || s.healthInterval <= 0 {
+		return
+	}
+	s.health.min, s.health.max = min, max
+	s.healthInterval = min
+}
+
+func (s *Server) healthCheck() {
+	defer s.guard()
+	tick := time.NewTicker(s.healthInterval)
+	defer tick.Stop()
+	for now := range tick.C {
+		s.checkPeers(now)
+	}
+}
+
+// checkPeers pings all paths and standby of peers
+func (s *Server) checkPeers(now time.Time) {
+	addrs := make(map[string]struct{})
+	s.mu.RLock()
+	for _, peers := range s.peerConns {
+		for _, p := range peers {
+			for _, addr := range []string{p.addr, p.standby} {
+				if len(addr) > 0 {
+					addrs[addr] = struct{}{}
+				}
+			}
+			for _, path := range p.paths {
+				addrs[path.addr] = struct{}{}
+			}
+		}
+	}
+	s.mu.RUnlock()
+	s.health.forget(addrs)
+
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(now.UnixNano()))
+	for addr := range addrs {
+		if !s.health.due(addr, now) {
+			continue
+		}
+
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			log.Error("parse %s fail: %v", addr, err)
+			continue
+		}
+
+		s.health.onPing(addr, raddr.String(), now)
+		s.sendCtrl(raddr, ctrlPing, payload, false)
+	}
+	s.checkReach(now)
+	s.checkConverge(now)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveHealth(t *testing.T) {
+	s := NewServer("", "key", nil)
+	s.SetHealthCheck(time.Second, 3)
+	s.SetAdaptiveHealth(time.Millisecond*100, time.Millisecond*800)
+	h := s.health
+	addr := "1.1.1.1:58423"
+
+	now := time.Now()
+	ping := func(pong bool) {
+		if !h.due(addr, now) {
+			t.Fatalf("ping not due after %s", h.interval(addr))
+		}
+		h.onPing(addr, addr, now)
+		if pong {
+			h.onPong(addr, now)
+		}
+	}
+
+	// healthy peer relaxes to max
+	for _, expect := range []time.Duration{200, 400, 800, 800} {
+		ping(true)
+		if got := h.interval(addr); got != expect*time.Millisecond {
+			t.Fatalf("expected interval %dms, got %s", expect, got)
+		}
+		if h.due(addr, now.Add(h.interval(addr)/4)) {
+			t.Fatalf("ping due before interval")
+		}
+		now = now.Add(h.interval(addr))
+	}
+
+	// a lost ping tightens the interval
+	ping(false)
+	now = now.Add(h.interval(addr))
+	ping(false)
+	if got := h.interval(addr); got != time.Millisecond*100 {
+		t.Fatalf("expected interval 100ms after miss, got %s", got)
+	}
+
+	// and relaxes again after recovery
+	now = now.Add(h.interval(addr))
+	ping(true)
+	if got := h.interval(addr); got != time.Millisecond*200 {
+		t.Fatalf("expected interval 200ms after recovery, got %s", got)
+	}
+	if !h.isUp(addr) {
+		t.Fatalf("peer down after recovery")
+	}
+}
+
+func TestPeerLatency(t *testing.T) {
+	h := newHealth(3)
+	addr := "1.1.1.1:58423"
+	now := time.Now()
+
+	// rtt alternates 10ms and 30ms
+	for i := 0; i < 200; i++ {
+		rtt := time.Millisecond * 10
+		if i%2 == 1 {
+			rtt = time.Millisecond * 30
+		}
+		h.onPing(addr, addr, now)
+		h.onPong(addr, now.Add(rtt))
+		// late pong of the same ping is ignored
+		h.onPong(addr, now.Add(rtt*10))
+		now = now.Add(time.Second)
+	}
+
+	stats := h.latency()[addr]
+	if stats == nil {
+		t.Fatalf("no latency of %s", addr)
+	}
+	if stats.RTT < 17 || stats.RTT > 23 {
+		t.Fatalf("expected rtt about 20ms, got %.2fms", stats.RTT)
+	}
+	if stats.Jitter < 19 || stats.Jitter > 21 {
+		t.Fatalf("expected jitter about 20ms, got %.2fms", stats.Jitter)
+	}
+
+	if v, ok := peerRTT.Value(addr); !ok || v < 0.017 || v > 0.023 {
+		t.Fatalf("unexpected rtt metric %v", v)
+	}
+
+	h.forget(map[string]struct{}{})
+	if _, ok := peerRTT.Value(addr); ok {
+		t.Fatalf("rtt metric of forgotten peer")
+	}
+}
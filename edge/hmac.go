@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// tag appended by hmac-sha256, truncated to the size of gcm tag
+const hmacTagSize = 16
+
+// hmacAEAD authenticates packets without encrypting them,
+// sealed packet carries the plain payload followed by the tag
+// | 1byte magic(0x02) | 1byte key epoch | payload | 16bytes tag |
+type hmacAEAD struct {
+	key []byte
+}
+
+func newHMAC(key []byte) *hmacAEAD {
+	return &hmacAEAD{key: key}
+}
+
+func (h *hmacAEAD) NonceSize() int { return 0 }
+
+func (h *hmacAEAD) Overhead() int { return hmacTagSize }
+
+func (h *hmacAEAD) tag(plaintext, additionalData []byte) []byte {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(additionalData)
+	mac.Write(plaintext)
+	return mac.Sum(nil)[:hmacTagSize]
+}
+
+func (h *hmacAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	dst = append(dst, plaintext...)
+	return append(dst, h.tag(plaintext, additionalData)...)
+}
+
+func (h *hmacAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < hmacTagSize {
+		return nil, fmt.Errorf("hmac pkt too small")
+	}
+	n := len(ciphertext) - hmacTagSize
+	payload, tag := ciphertext[:n], ciphertext[n:]
+	if !hmac.Equal(tag, h.tag(payload, additionalData)) {
+		return nil, fmt.Errorf("hmac mismatch")
+	}
+	return append(dst, payload...), nil
+}
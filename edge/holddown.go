@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+// route of a dead primary held down without live standby
+var errHeldDown = errors.New("peer held down")
+
+var heldDownDropped = metrics.NewCounter("cframe_edge_held_down_dropped_total",
+	"packets to held down peers without standby, replied icmp unreachable")
+
+// SetDeadHoldDown keeps the route of a dead primary deleted by
+// controller for d, so the standby added next takes over the
+// route instead of the cidr being unrouted meanwhile. packets
+// are sent to the standby once up, or dropped with icmp host
+// unreachable. 0 deletes dead peers at once
+func (s *Server) SetDeadHoldDown(d time.Duration) {
+	s.deadHoldDown = d
+}
+
+// holdDown holds down peer if it is a dead primary serving its
+// cidr alone, returns false if the peer is to be deleted now
+func (s *Server) holdDown(peer *codec.Edge) bool {
+	if s.deadHoldDown <= 0 || peer.Standby || s.health.isUp(peer.ListenAddr) {
+		return false
+	}
+	cidr := hostCIDR(peer.Cidr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pc, ok := s.peerConns[peer.Vni][cidr]
+	if !ok || pc.addr != peer.ListenAddr || len(pc.standby) > 0 || len(pc.paths) > 1 {
+		return false
+	}
+	if pc.held {
+		return true
+	}
+
+	log.Warn("peer %v dead, route held down for %v", peer, s.deadHoldDown)
+	pc.held = true
+	if pc.drainTimer != nil {
+		pc.drainTimer.Stop()
+	}
+	pc.drainTimer = time.AfterFunc(s.deadHoldDown, func() {
+		s.expirePeer(peer, cidr, pc)
+	})
+	return true
+}
+
+// heldUnreachable replies icmp host unreachable, or icmpv6
+// address unreachable, to sender of pkt routed to a held down peer
+func (s *Server) heldUnreachable(vni uint32, pkt []byte) {
+	heldDownDropped.Inc()
+	iface := s.ifaces[vni]
+	if iface == nil {
+		return
+	}
+	if _, err := iface.Write(icmpUnreach(pkt, icmpHostUnreach, 0)); err != nil {
+		log.Error("write host unreachable to %s fail: %v", Packet(pkt).Src(), err)
+	}
+}
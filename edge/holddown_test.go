@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestDeadHoldDown(t *testing.T) {
+	tun := newFakeTun("cframe.0")
+	s := NewServer("", "key", &Interface{tun: tun})
+	routes := newFakeRoutes()
+	s.SetRouteManager(routes)
+	s.SetHealthCheck(time.Hour, 1)
+	s.SetDeadHoldDown(time.Millisecond * 500)
+	s.conn = listenLocal(t)
+	defer s.conn.Close()
+
+	primary, standby := listenLocal(t), listenLocal(t)
+	defer primary.Close()
+	defer standby.Close()
+	paddr, saddr := primary.LocalAddr().String(), standby.LocalAddr().String()
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: paddr})
+
+	// primary misses pings and is deleted by controller
+	now := time.Now()
+	s.health.onPing(paddr, paddr, now)
+	s.health.onPing(paddr, paddr, now.Add(time.Second))
+	s.DelPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: paddr})
+
+	received := func(conn *net.UDPConn) bool {
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		_, err := conn.Read(make([]byte, 2048))
+		return err == nil
+	}
+
+	// held down without standby, sender learns host unreachable
+	dropped := heldDownDropped.Value()
+	s.forwardLocal(s.conn, 0, ipPacket("10.0.1.5", "10.0.2.5"))
+	select {
+	case pkt := <-tun.out:
+		if Packet(pkt).Protocol() != protoICMP || pkt[20] != icmpDstUnreach || pkt[21] != icmpHostUnreach {
+			t.Fatalf("expected icmp host unreachable, got %x", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("held down packet not replied")
+	}
+	if heldDownDropped.Value() != dropped+1 || received(primary) {
+		t.Fatal("packet sent to dead primary")
+	}
+
+	// standby takes over the route kept
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: saddr, Standby: true})
+	s.forwardLocal(s.conn, 0, ipPacket("10.0.1.5", "10.0.2.5"))
+	if !received(standby) {
+		t.Fatal("packet not redirected to standby")
+	}
+
+	// holddown expires, standby keeps serving
+	time.Sleep(time.Millisecond * 500)
+	s.forwardLocal(s.conn, 0, ipPacket("10.0.1.5", "10.0.2.5"))
+	if !received(standby) {
+		t.Fatal("packet not sent to standby after holddown")
+	}
+
+	routes.mu.Lock()
+	defer routes.mu.Unlock()
+	for _, call := range routes.calls {
+		if strings.HasPrefix(call, "del 10.0.2.0/24") {
+			t.Fatalf("route of cidr removed during failover: %v", routes.calls)
+		}
+	}
+}
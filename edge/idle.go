@@ -0,0 +1,228 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// idlePeers evicts dynamic peers, eg: discovered on the lan,
+// once no data is sent to or received from them for timeout.
+// evicted peers are installed again when traffic appears,
+// static routes and peers pushed by controller are never evicted
+type idlePeers struct {
+	// 0 disables eviction
+	timeout time.Duration
+
+	// key: peer addr, val: *peerActivity, loaded per
+	// packet without mu, stored and deleted under mu
+	active sync.Map
+
+	mu sync.Mutex
+	// key: peerKey
+	peers   map[string]*idlePeer
+	evicted int
+}
+
+type idlePeer struct {
+	edge    *codec.Edge
+	evicted bool
+}
+
+// peerActivity is data traffic of a peer addr
+type peerActivity struct {
+	// unix nano of the last data packet to or from addr
+	last int64
+	// evicted peers of addr, woken by its traffic
+	evicted int32
+}
+
+func newIdlePeers() *idlePeers {
+	return &idlePeers{
+		peers: make(map[string]*idlePeer),
+	}
+}
+
+// activity returns activity of peer addr, nil if not tracked
+func (t *idlePeers) activity(addr string) *peerActivity {
+	if v, ok := t.active.Load(addr); ok {
+		return v.(*peerActivity)
+	}
+	return nil
+}
+
+// SetIdleEviction tears down dynamic peers idle for timeout,
+// 0 disables eviction. must be called before ListenAndServe
+func (s *Server) SetIdleEviction(timeout time.Duration) {
+	if timeout > 0 {
+		s.idle.timeout = timeout
+	}
+}
+
+// AddDynamicPeer adds peer which may be evicted once idle
+func (s *Server) AddDynamicPeer(peer *codec.Edge) {
+	if s.idle.timeout > 0 {
+		s.idle.mu.Lock()
+		s.idle.peers[peerKey(peer)] = &idlePeer{edge: copyEdge(peer)}
+		v, _ := s.idle.active.LoadOrStore(peer.ListenAddr, &peerActivity{})
+		atomic.StoreInt64(&v.(*peerActivity).last, time.Now().UnixNano())
+		s.idle.mu.Unlock()
+	}
+	s.installPeer(peer)
+}
+
+// forgetIdle stops tracking peer, called once peer is deleted
+func (s *Server) forgetIdle(peer *codec.Edge) {
+	if s.idle.timeout <= 0 {
+		return
+	}
+
+	s.idle.mu.Lock()
+	defer s.idle.mu.Unlock()
+	key := peerKey(peer)
+	p, ok := s.idle.peers[key]
+	if !ok || p.edge.ListenAddr != peer.ListenAddr {
+		return
+	}
+	if p.evicted {
+		s.idle.evicted--
+		if a := s.idle.activity(peer.ListenAddr); a != nil {
+			atomic.AddInt32(&a.evicted, -1)
+		}
+	}
+	delete(s.idle.peers, key)
+
+	for _, p := range s.idle.peers {
+		if p.edge.ListenAddr == peer.ListenAddr {
+			return
+		}
+	}
+	s.idle.active.Delete(peer.ListenAddr)
+}
+
+// touchPeer records data traffic of peer addr, called per packet
+// and locks only to install evicted peers of addr again
+func (s *Server) touchPeer(addr string) {
+	if s.idle.timeout <= 0 {
+		return
+	}
+
+	a := s.idle.activity(addr)
+	if a == nil {
+		return
+	}
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+	if atomic.LoadInt32(&a.evicted) == 0 {
+		return
+	}
+
+	s.idle.mu.Lock()
+	wake := s.wakeLocked(func(p *idlePeer) bool {
+		return p.edge.ListenAddr == addr
+	})
+	s.idle.mu.Unlock()
+
+	s.reinstall(wake)
+}
+
+// wakeRoute installs evicted peers serving dst again,
+// returns whether any peer is installed
+func (s *Server) wakeRoute(vni uint32, dst string) bool {
+	if s.idle.timeout <= 0 {
+		return false
+	}
+	ip := net.ParseIP(dst)
+	if ip == nil {
+		return false
+	}
+
+	s.idle.mu.Lock()
+	wake := s.wakeLocked(func(p *idlePeer) bool {
+		if p.edge.Vni != vni {
+			return false
+		}
+		_, ipnet, err := net.ParseCIDR(cidrOf(p.edge))
+		return err == nil && ipnet.Contains(ip)
+	})
+	for _, peer := range wake {
+		if a := s.idle.activity(peer.ListenAddr); a != nil {
+			atomic.StoreInt64(&a.last, time.Now().UnixNano())
+		}
+	}
+	s.idle.mu.Unlock()
+
+	s.reinstall(wake)
+	return len(wake) > 0
+}
+
+// wakeLocked marks evicted peers matched as active again
+func (s *Server) wakeLocked(match func(p *idlePeer) bool) []*codec.Edge {
+	if s.idle.evicted == 0 {
+		return nil
+	}
+
+	wake := make([]*codec.Edge, 0)
+	for _, p := range s.idle.peers {
+		if p.evicted && match(p) {
+			p.evicted = false
+			s.idle.evicted--
+			if a := s.idle.activity(p.edge.ListenAddr); a != nil {
+				atomic.AddInt32(&a.evicted, -1)
+			}
+			wake = append(wake, copyEdge(p.edge))
+		}
+	}
+	return wake
+}
+
+func (s *Server) reinstall(peers []*codec.Edge) {
+	for _, peer := range peers {
+		log.Info("idle peer %s %s active again", peer.Cidr, peer.ListenAddr)
+		s.installPeer(peer)
+	}
+}
+
+// evictIdle tears down dynamic peers idle for timeout before now
+func (s *Server) evictIdle(now time.Time) {
+	s.idle.mu.Lock()
+	evict := make([]*codec.Edge, 0)
+	for _, p := range s.idle.peers {
+		a := s.idle.activity(p.edge.ListenAddr)
+		if p.evicted || a != nil && now.Sub(time.Unix(0, atomic.LoadInt64(&a.last))) < s.idle.timeout {
+			continue
+		}
+		p.evicted = true
+		s.idle.evicted++
+		if a != nil {
+			atomic.AddInt32(&a.evicted, 1)
+		}
+		evict = append(evict, copyEdge(p.edge))
+	}
+	s.idle.mu.Unlock()
+
+	for _, peer := range evict {
+		log.Info("evict peer %s %s idle for %v", peer.Cidr, peer.ListenAddr, s.idle.timeout)
+		s.forgetPeer(peer)
+		if s.hasPeer(peer) {
+			s.delRoute(peer)
+		}
+	}
+}
+
+func (s *Server) evictIdleLoop() {
+	tick := time.NewTicker(s.idle.timeout / 4)
+	defer tick.Stop()
+	for now := range tick.C {
+		s.evictIdle(now)
+	}
+}
+
+// cidrOf returns cidr of peer, host is given its full prefix
+func cidrOf(peer *codec.Edge) string {
+	cidr := hostCIDR(peer.Cidr)
+	return cidr
+}
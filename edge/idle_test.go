@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestIdlePeerEvicted(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.SetIdleEviction(time.Minute)
+
+	dynamic := &codec.Edge{Name: "edge2", Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"}
+	pushed := &codec.Edge{Name: "edge3", Cidr: "10.0.3.0/24", ListenAddr: "3.3.3.3:58423"}
+	s.AddDynamicPeer(dynamic)
+	s.AddPeer(pushed)
+	s.AddStaticRoutes([]*codec.StaticRoute{{Cidr: "10.0.4.0/24", Peer: "edge3"}},
+		[]*codec.Edge{pushed})
+
+	// active within timeout
+	s.evictIdle(time.Now().Add(time.Second * 30))
+	if !s.hasPeer(dynamic) {
+		t.Fatalf("peer evicted before idle timeout")
+	}
+
+	s.evictIdle(time.Now().Add(time.Minute * 2))
+	if s.hasPeer(dynamic) {
+		t.Fatalf("idle dynamic peer not evicted")
+	}
+	if _, ok := routes.routes["cframe.0"]["10.0.2.0/24"]; ok {
+		t.Fatalf("route of evicted peer not removed")
+	}
+	if !s.hasPeer(pushed) || !s.hasPeer(&codec.Edge{Cidr: "10.0.4.0/24"}) {
+		t.Fatalf("controller pushed or static peer evicted")
+	}
+
+	// traffic to the evicted cidr installs the peer again
+	if _, err := s.route(0, "10.0.1.1", "10.0.2.5"); err == nil {
+		t.Fatalf("route to evicted peer")
+	}
+	if !s.wakeRoute(0, "10.0.2.5") {
+		t.Fatalf("evicted peer not woken by traffic")
+	}
+	addr, err := s.route(0, "10.0.1.1", "10.0.2.5")
+	if err != nil || addr != dynamic.ListenAddr {
+		t.Fatalf("expected route via %s, got %s %v", dynamic.ListenAddr, addr, err)
+	}
+
+	// traffic from peer installs it again as well
+	s.evictIdle(time.Now().Add(time.Minute * 2))
+	s.touchPeer(dynamic.ListenAddr)
+	if !s.hasPeer(dynamic) {
+		t.Fatalf("evicted peer not woken by peer traffic")
+	}
+
+	// deleted peer is not tracked
+	s.DelPeer(dynamic)
+	s.evictIdle(time.Now().Add(time.Minute * 2))
+	if s.wakeRoute(0, "10.0.2.5") || s.hasPeer(dynamic) {
+		t.Fatalf("deleted peer installed again")
+	}
+}
+
+func TestIdleTouchBeforeDrop(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+	s.SetIdleEviction(time.Minute)
+	s.SetAllowedIPs(true)
+	s.conn = listenLocal(t)
+	defer s.conn.Close()
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}
+	dynamic := &codec.Edge{Name: "edge2", Cidr: "10.0.2.0/24", ListenAddr: from.String()}
+	s.AddDynamicPeer(dynamic)
+	a := s.idle.activity(from.String())
+	atomic.StoreInt64(&a.last, 0)
+
+	// packet of a source not allowed is dropped,
+	// the peer sending it is alive still
+	dropped := spoofedDropped.Value()
+	s.onRemote(s.conn, from, s.encap.EncodeData(0, ipPacket("192.168.1.5", "10.0.1.1")))
+	if spoofedDropped.Value() != dropped+1 {
+		t.Fatalf("spoofed packet not dropped")
+	}
+	if atomic.LoadInt64(&a.last) == 0 {
+		t.Fatalf("peer not touched by dropped packet")
+	}
+
+	// evicted peer is woken by its traffic
+	s.evictIdle(time.Now().Add(time.Minute * 2))
+	if s.hasPeer(dynamic) || atomic.LoadInt32(&a.evicted) != 1 {
+		t.Fatalf("idle peer not evicted")
+	}
+	s.onRemote(s.conn, from, s.encap.EncodeData(0, ipPacket("192.168.1.5", "10.0.1.1")))
+	if !s.hasPeer(dynamic) || atomic.LoadInt32(&a.evicted) != 0 {
+		t.Fatalf("evicted peer not woken by its traffic")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+var routesRejected = metrics.NewCounter("cframe_edge_routes_rejected_total",
+	"peer cidrs rejected by route limits")
+
+// RouteLimitError is a peer cidr rejected as the peer or
+// the edge has limit routes already, retried as failed peers
+// so the cidr is installed once routes are removed
+type RouteLimitError struct {
+	Peer  string
+	Cidr  string
+	Limit int
+	// limit of all peers, otherwise of the peer
+	Total bool
+}
+
+func (e *RouteLimitError) Error() string {
+	if e.Total {
+		return fmt.Sprintf("cidr %s of peer %s rejected: %d routes of all peers reached",
+			e.Cidr, e.Peer, e.Limit)
+	}
+	return fmt.Sprintf("cidr %s of peer %s rejected: %d routes of the peer reached",
+		e.Cidr, e.Peer, e.Limit)
+}
+
+// SetRouteLimits caps cidrs installed per peer address and of
+// all peers, so a misconfigured peer advertising thousands of
+// cidrs never floods the os routing table, 0 is unlimited
+func (s *Server) SetRouteLimits(perPeer, total int) {
+	s.peerRouteLimit = perPeer
+	s.routeLimit = total
+}
+
+// checkRouteLimits returns error if cidr of peer is new
+// and installing it exceeds route limits
+func (s *Server) checkRouteLimits(peer *codec.Edge) error {
+	if s.peerRouteLimit <= 0 && s.routeLimit <= 0 {
+		return nil
+	}
+	cidr := hostCIDR(peer.Cidr)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	existing, ok := s.peerConns[peer.Vni][cidr]
+	if ok && existing.servedBy(peer.ListenAddr) {
+		return nil
+	}
+
+	var err *RouteLimitError
+	if s.routeLimit > 0 && !ok && s.table.size >= s.routeLimit {
+		err = &RouteLimitError{Peer: peer.ListenAddr, Cidr: peer.Cidr, Limit: s.routeLimit, Total: true}
+	} else if s.peerRouteLimit > 0 && s.peerRoutes(peer.ListenAddr) >= s.peerRouteLimit {
+		err = &RouteLimitError{Peer: peer.ListenAddr, Cidr: peer.Cidr, Limit: s.peerRouteLimit}
+	}
+	if err == nil {
+		return nil
+	}
+	routesRejected.Inc()
+	return err
+}
+
+// peerRoutes returns cidrs served by peer addr of all vnis, s.mu held
+func (s *Server) peerRoutes(addr string) int {
+	n := 0
+	for _, peers := range s.peerConns {
+		for _, pc := range peers {
+			if pc.servedBy(addr) {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestRouteLimits(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+	s.SetRouteLimits(2, 3)
+
+	noisy, other := "1.1.1.1:58423", "2.2.2.2:58423"
+	rejected := routesRejected.Value()
+	for i := 1; i <= 4; i++ {
+		s.AddPeer(&codec.Edge{Cidr: fmt.Sprintf("10.0.%d.0/24", i), ListenAddr: noisy})
+	}
+	if size, _, _ := s.TableSize(); size != 2 {
+		t.Fatalf("expected 2 routes of the peer installed, got %d", size)
+	}
+	if routesRejected.Value() != rejected+2 {
+		t.Fatalf("rejected routes not counted")
+	}
+
+	failed := s.FailedStatus()
+	if len(failed) != 2 {
+		t.Fatalf("expected 2 rejected cidrs, got %d", len(failed))
+	}
+	for _, fp := range failed {
+		if fp.ListenAddr != noisy || (fp.Cidr != "10.0.3.0/24" && fp.Cidr != "10.0.4.0/24") {
+			t.Fatalf("unexpected rejected cidr %+v", fp)
+		}
+		want := fmt.Sprintf("cidr %s of peer %s rejected: 2 routes of the peer reached", fp.Cidr, noisy)
+		if fp.Error != want {
+			t.Fatalf("expected error %q, got %q", want, fp.Error)
+		}
+	}
+
+	// re-advertised cidrs of the peer are not counted again
+	err := s.installPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: noisy})
+	if err != nil {
+		t.Fatalf("installed cidr rejected: %v", err)
+	}
+
+	// other peers are limited by the total
+	if err := s.installPeer(&codec.Edge{Cidr: "10.1.1.0/24", ListenAddr: other}); err != nil {
+		t.Fatalf("cidr of other peer rejected: %v", err)
+	}
+	err = s.installPeer(&codec.Edge{Cidr: "10.1.2.0/24", ListenAddr: other})
+	var lerr *RouteLimitError
+	if !errors.As(err, &lerr) || !lerr.Total || lerr.Limit != 3 {
+		t.Fatalf("expected total route limit error, got %v", err)
+	}
+
+	// rejected cidrs are installed once routes are removed
+	s.DelPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: noisy})
+	if err := s.installPeer(&codec.Edge{Cidr: "10.0.3.0/24", ListenAddr: noisy}); err != nil {
+		t.Fatalf("cidr rejected after routes removed: %v", err)
+	}
+}
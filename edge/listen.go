@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// bind of the port held by a process quitting, eg: on restart,
+// is retried bindRetries times starting after bindBackoff,
+// replaced by tests
+var (
+	bindRetries    = 6
+	bindBackoff    = time.Millisecond * 250
+	maxBindBackoff = time.Second * 2
+)
+
+// transientBind reports whether the bind error may go away,
+// the port held by another socket is released on its exit,
+// permission and invalid addresses are permanent
+func transientBind(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+// listenRetry listens by listen, retries with backoff while
+// the address is in use and fails at once on permanent errors
+func listenRetry(laddr string, listen func() (*net.UDPConn, error)) (*net.UDPConn, error) {
+	backoff := bindBackoff
+	for i := 0; ; i++ {
+		conn, err := listen()
+		if err == nil || !transientBind(err) || i >= bindRetries {
+			return conn, err
+		}
+		log.Warn("listen %s fail: %v, retry in %v", laddr, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBindBackoff {
+			backoff = maxBindBackoff
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenRetry(t *testing.T) {
+	backoff, maxb := bindBackoff, maxBindBackoff
+	bindBackoff, maxBindBackoff = time.Millisecond*20, time.Millisecond*50
+	defer func() { bindBackoff, maxBindBackoff = backoff, maxb }()
+
+	// port held by the quitting process, released shortly
+	held := listenLocal(t)
+	laddr := held.LocalAddr().String()
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		held.Close()
+	}()
+
+	s := NewServer(laddr, "key", nil)
+	conn, err := s.listenConn()
+	if err != nil {
+		t.Fatalf("listen on released port fail: %v", err)
+	}
+	conn.Close()
+
+	// permanent errors are not retried
+	calls := 0
+	denied := &net.OpError{Op: "listen", Net: "udp", Err: os.NewSyscallError("bind", syscall.EACCES)}
+	_, err = listenRetry(laddr, func() (*net.UDPConn, error) {
+		calls++
+		return nil, denied
+	})
+	if err != denied || calls != 1 {
+		t.Fatalf("permanent error retried %d times: %v", calls, err)
+	}
+
+	// transient errors are given up after bounded retries
+	calls = 0
+	inUse := &net.OpError{Op: "listen", Net: "udp", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+	_, err = listenRetry(laddr, func() (*net.UDPConn, error) {
+		calls++
+		return nil, inUse
+	})
+	if err != inUse || calls != bindRetries+1 {
+		t.Fatalf("expected %d attempts of held port, got %d: %v", bindRetries+1, calls, err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// load rates are sampled every loadTick and
+// smoothed over about loadWindow
+var (
+	loadTick   = time.Second
+	loadWindow = time.Second * 10
+)
+
+// ewma is an exponentially weighted moving average of a rate,
+// events are counted lock free and folded in on tick
+type ewma struct {
+	count int64
+
+	mu   sync.Mutex
+	rate float64
+	init bool
+}
+
+func (e *ewma) add(n int64) {
+	atomic.AddInt64(&e.count, n)
+}
+
+// tick folds events counted over interval into the average
+func (e *ewma) tick(interval time.Duration, alpha float64) {
+	n := atomic.SwapInt64(&e.count, 0)
+	instant := float64(n) / interval.Seconds()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.init {
+		e.rate, e.init = instant, true
+		return
+	}
+	e.rate += alpha * (instant - e.rate)
+}
+
+// Rate returns events per second
+func (e *ewma) Rate() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rate
+}
+
+// rates of packets and bytes in both directions
+type rates struct {
+	pktsIn, bytesIn   ewma
+	pktsOut, bytesOut ewma
+}
+
+func (r *rates) tick(interval time.Duration, alpha float64) {
+	for _, e := range []*ewma{&r.pktsIn, &r.bytesIn, &r.pktsOut, &r.bytesOut} {
+		e.tick(interval, alpha)
+	}
+}
+
+// idle returns whether all rates decayed to nearly zero
+func (r *rates) idle() bool {
+	for _, e := range []*ewma{&r.pktsIn, &r.pktsOut} {
+		if e.Rate() >= 0.01 || atomic.LoadInt64(&e.count) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadStats is the smoothed load per second
+type LoadStats struct {
+	PktsIn   float64 `json:"pkts_in"`
+	BytesIn  float64 `json:"bytes_in"`
+	PktsOut  float64 `json:"pkts_out"`
+	BytesOut float64 `json:"bytes_out"`
+}
+
+func (r *rates) stats() *LoadStats {
+	return &LoadStats{
+		PktsIn:   r.pktsIn.Rate(),
+		BytesIn:  r.bytesIn.Rate(),
+		PktsOut:  r.pktsOut.Rate(),
+		BytesOut: r.bytesOut.Rate(),
+	}
+}
+
+// load keeps rates of all traffic and of each peer
+type load struct {
+	global rates
+
+	mu    sync.RWMutex
+	peers map[string]*rates
+}
+
+func newLoad() *load {
+	return &load{peers: make(map[string]*rates)}
+}
+
+func (l *load) peer(addr string) *rates {
+	l.mu.RLock()
+	r := l.peers[addr]
+	l.mu.RUnlock()
+	if r != nil {
+		return r
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r = l.peers[addr]
+	if r == nil {
+		r = &rates{}
+		l.peers[addr] = r
+	}
+	return r
+}
+
+// in counts a packet of size received from peer
+func (l *load) in(peer string, size int) {
+	r := l.peer(peer)
+	l.global.pktsIn.add(1)
+	l.global.bytesIn.add(int64(size))
+	r.pktsIn.add(1)
+	r.bytesIn.add(int64(size))
+}
+
+// out counts a packet of size sent to peer
+func (l *load) out(peer string, size int) {
+	r := l.peer(peer)
+	l.global.pktsOut.add(1)
+	l.global.bytesOut.add(int64(size))
+	r.pktsOut.add(1)
+	r.bytesOut.add(int64(size))
+}
+
+// tick updates all rates, idle peers are dropped
+func (l *load) tick(interval, window time.Duration) {
+	alpha := 1 - math.Exp(-interval.Seconds()/window.Seconds())
+	l.global.tick(interval, alpha)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for addr, r := range l.peers {
+		r.tick(interval, alpha)
+		if r.idle() {
+			delete(l.peers, addr)
+		}
+	}
+}
+
+// Load returns smoothed load of all traffic and per peer
+func (s *Server) Load() (*LoadStats, map[string]*LoadStats) {
+	s.load.mu.RLock()
+	defer s.load.mu.RUnlock()
+	peers := make(map[string]*LoadStats, len(s.load.peers))
+	for addr, r := range s.load.peers {
+		peers[addr] = r.stats()
+	}
+	return s.load.global.stats(), peers
+}
+
+func (s *Server) sampleLoad() {
+	tick := time.NewTicker(loadTick)
+	defer tick.Stop()
+	for range tick.C {
+		s.load.tick(loadTick, loadWindow)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoadConverges(t *testing.T) {
+	l := newLoad()
+	near := func(got, expect float64) bool {
+		return math.Abs(got-expect) <= expect*0.05
+	}
+
+	// idle first, then 100 packets of 1000 bytes per second
+	l.tick(time.Second, time.Second*10)
+	for i := 0; i < 60; i++ {
+		for j := 0; j < 100; j++ {
+			l.out("1.1.1.1:58423", 1000)
+			l.in("2.2.2.2:58423", 500)
+		}
+		l.tick(time.Second, time.Second*10)
+	}
+
+	global := l.global.stats()
+	if !near(global.PktsOut, 100) || !near(global.BytesOut, 100000) {
+		t.Fatalf("global out rate not converged: %+v", global)
+	}
+	if !near(global.PktsIn, 100) || !near(global.BytesIn, 50000) {
+		t.Fatalf("global in rate not converged: %+v", global)
+	}
+
+	peer := l.peer("1.1.1.1:58423").stats()
+	if !near(peer.PktsOut, 100) || peer.PktsIn != 0 {
+		t.Fatalf("peer rate not converged: %+v", peer)
+	}
+
+	// idle peers decay and are dropped
+	for i := 0; i < 200; i++ {
+		l.tick(time.Second, time.Second*10)
+	}
+	if len(l.peers) != 0 {
+		t.Fatalf("idle peers not dropped: %d", len(l.peers))
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	s := NewServer("", "key", nil)
+	s.load.out("1.1.1.1:58423", 100)
+	s.load.tick(time.Second, time.Second*10)
+
+	w := httptest.NewRecorder()
+	NewAdmin("", s).mux.ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	stats := struct {
+		Global *LoadStats            `json:"global"`
+		Peers  map[string]*LoadStats `json:"peers"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Global.PktsOut != 1 || stats.Peers["1.1.1.1:58423"].BytesOut != 100 {
+		t.Fatalf("unexpected stats %s", w.Body.String())
+	}
+}
+
+func BenchmarkLoadOut(b *testing.B) {
+	l := newLoad()
+	for i := 0; i < b.N; i++ {
+		l.out("1.1.1.1:58423", 1400)
+	}
+}
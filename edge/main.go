@@ -1,77 +1,434 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/ICKelin/cframe/codec"
 	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+	"github.com/ICKelin/cframe/pkg/version"
 )
 
 func main() {
-	logLevel := os.Getenv("LOG_LEVEL")
-	if len(logLevel) == 0 {
-		logLevel = "info"
+	flgSelfTest := flag.Bool("selftest", false, "ping each peer, print reachability and exit")
+	flgVersion := flag.Bool("version", false, "print version and exit")
+	flgReplay := flag.String("replay", "", "print peer of each packet in pcap file read from tun, and exit")
+	flgReplayPeers := flag.String("replay-peers", "", "json file of peers for -replay, fetched from controller if empty")
+	flgBench := flag.Bool("bench", false, "forward synthetic traffic over loopback at increasing rates, print throughput and exit")
+	flgBenchSize := flag.Int("bench-size", 1400, "packet size of -bench")
+	flgBenchStep := flag.Duration("bench-step", time.Second, "duration of each rate of -bench")
+	flag.Parse()
+
+	if *flgVersion {
+		fmt.Println(version.Get())
+		return
+	}
+
+	cfg, err := LoadConfig(os.Getenv)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// log file, or syslog url eg: syslog+udp://10.0.0.1:514
+	log.Init(cfg.LogPath, cfg.LogLevel, 3)
+	log.Info("cframe edge %s", version.Get())
+	log.Info("effective config: %s", cfg)
+
+	// encapsulation between edges, raw or gre
+	encap, err := NewEncap(cfg.Encap, cfg.Secret)
+	if err != nil {
+		log.Error("%v", err)
+		return
+	}
+
+	// ctrl_cert/ctrl_key identify edge to controller over tls
+	// eg: ctrl_cert=edge1.pem ctrl_key=edge1.key ctrl_ca=ca.pem
+	ctrlTLS, err := LoadCtrlTLS(cfg.CtrlCert, cfg.CtrlKey, cfg.CtrlCA)
+	if err != nil {
+		log.Error("load controller tls fail: %v", err)
+		return
+	}
+
+	// peers of peers_file, or queried from controller
+	// without taking over session of the running edge
+	if *flgSelfTest {
+		peers, err := selfTestPeers(cfg, ctrlTLS)
+		if err != nil {
+			fmt.Println("fetch peers fail:", err)
+			os.Exit(1)
+		}
+
+		result := SelfTest(encap, peers, time.Second*3)
+		printReachability(os.Stdout, result)
+		if n := unreachable(result); n > 0 {
+			fmt.Printf("%d of %d peers unreachable\n", n, len(result))
+			os.Exit(1)
+		}
+		return
+	}
+
+	// routing decisions of captured packets, eg: by tap_file
+	if len(*flgReplay) > 0 {
+		err := replay(cfg, *flgReplay, *flgReplayPeers)
+		if err != nil {
+			fmt.Println("replay fail:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// diagnostic only, sched_queue and encap of config apply
+	if *flgBench {
+		result, err := Bench(encap, &BenchConfig{
+			Size:       *flgBenchSize,
+			Step:       *flgBenchStep,
+			SchedQueue: cfg.SchedQueue,
+		})
+		if err != nil {
+			fmt.Println("bench fail:", err)
+			os.Exit(1)
+		}
+		printBench(os.Stdout, result)
+		return
+	}
+
+	// fail early instead of deep inside tun creation
+	err = CheckPrivilege()
+	if err != nil {
+		fmt.Println(err)
+		log.Error("%v", err)
+		os.Exit(1)
+	}
+
+	s := NewServer(cfg.Listen, cfg.Secret, nil)
+	// remove installed routes if crashed
+	defer s.guard()
+
+	// sockets and tun devices passed by the process upgraded from
+	s.SetInherited(ParseInherited(os.Getenv(inheritEnv)))
+
+	// one tun device per vni, routes of a vni with table
+	// go to that table, eg: vnis=1=101,2=102
+	for vni, table := range cfg.Vnis {
+		iface := s.InheritedInterface(vni)
+		if iface == nil {
+			iface, err = NewInterface()
+		}
+		if err != nil {
+			log.Error("new interface for vni %d fail: %v", vni, err)
+			return
+		}
+
+		defer iface.Close()
+		err = iface.Up()
+		if err != nil {
+			log.Error("up interface fail: %v", err)
+			return
+		}
+
+		err = iface.SetMTU(1400)
+		if err != nil {
+			log.Error("set mtu fail: %v", err)
+		}
+
+		s.AddInterface(vni, iface)
+		if table > 0 {
+			err = s.SetRouteTable(vni, table)
+			if err != nil {
+				log.Error("%v", err)
+				return
+			}
+		}
+		log.Info("vni %d on %s table %d", vni, iface.tun.Name(), table)
+	}
+
+	s.SetEncap(encap)
+
+	// data transport to peers, udp or tcp
+	// tcp may go through proxy, eg: socks5://127.0.0.1:1080
+	err = s.SetTransport(cfg.Transport, cfg.Proxy)
+	if err != nil {
+		log.Error("%v", err)
+		return
 	}
-	log.Init("edge.log", logLevel, 3)
 
-	iface, err := NewInterface()
+	// tcp peers connect through load balancers of
+	// proxy_trusted sending PROXY protocol headers
+	err = s.SetProxyProtocol(cfg.ProxyProtocol, cfg.ProxyTrusted)
 	if err != nil {
-		log.Error("[E] new interface fail: ", err)
+		log.Error("%v", err)
+		return
+	}
+
+	// egress device of peer traffic, eg: eth1
+	// overridden per peer by peer_ifaces
+	s.SetBindInterface(cfg.BindIface, cfg.PeerIfaces)
+
+	// fwmark of peer traffic for firewall and policy routing,
+	// eg: 0x100, overridden per peer by peer_marks
+	s.SetFwmark(cfg.Fwmark, cfg.PeerMarks)
+
+	// chaos testing only, refused unless built with -tags chaos
+	if err := s.SetChaos(cfg.Chaos); err != nil {
+		log.Error("%v", err)
 		return
 	}
 
-	defer iface.Close()
-	err = iface.Up()
+	// grace period for deleted peer, eg: 30s
+	s.SetDrainGrace(time.Duration(cfg.DrainGrace))
+
+	// dead primary keeps its route for dead_holddown, eg: 10s,
+	// so the standby takes over without the cidr unrouted
+	s.SetDeadHoldDown(time.Duration(cfg.DeadHoldDown))
+
+	// discovered peers idle for idle_timeout are removed
+	// until traffic to or from them appears, eg: 10m, 0 disables
+	s.SetIdleEviction(time.Duration(cfg.IdleTimeout))
+
+	// delay between peer setups of a batch, eg: 20ms, 0 disables
+	s.SetPeerStagger(time.Duration(cfg.PeerStagger))
+
+	// egress priority queue length per band, disabled if 0
+	s.SetScheduler(cfg.SchedQueue)
+
+	// packets queued per peer, disabled if 0, full queue drops
+	// by send_queue_drop, drop-tail (default) or drop-head
+	err = s.SetSendQueue(cfg.SendQueue, cfg.SendQueueDrop)
 	if err != nil {
-		log.Error("up interface fail: %v", err)
+		log.Error("%v", err)
 		return
 	}
 
-	err = iface.SetMTU(1400)
+	// pace packets to each peer at pace_rate bytes per second,
+	// pace_burst bytes go back to back, eg: 12500000 and 30000
+	// packets wait in send_queue, 256 deep if not set
+	err = s.SetPacing(cfg.PaceRate, cfg.PaceBurst)
 	if err != nil {
-		log.Error("set mtu fail: %v", err)
+		log.Error("%v", err)
+		return
 	}
 
-	// create cframe udp server
-	// just hard code listen address once without env var
-	lisAddr := ":58423"
-	lis := os.Getenv("listen")
-	if len(lis) > 0 {
-		lisAddr = lis
+	// route_install=false leaves os routes to a routing daemon
+	s.SetRouteInstall(cfg.RouteInstall)
+
+	// merge contiguous cidrs to the same peer into summary routes
+	s.SetAggregate(cfg.RouteAggregate)
+
+	// peer health check, eg: 1s, 0 disables health check
+	// peer is down after health_failures lost pings
+	s.SetHealthCheck(time.Duration(cfg.HealthInterval), cfg.HealthFailures)
+
+	// adaptive health check, eg: health_min=200ms health_max=5s
+	// healthy peers are pinged every health_max, every health_min after a loss
+	s.SetAdaptiveHealth(time.Duration(cfg.HealthMin), time.Duration(cfg.HealthMax))
+
+	// hold down peers flapping between up and down, eg: flap_half_life=5m
+	// each flap adds 1000, damped above flap_suppress until below flap_reuse
+	s.SetFlapDamping(time.Duration(cfg.FlapHalfLife), cfg.FlapSuppress, cfg.FlapReuse)
+
+	// lower mss of tcp syn to fit the tun mtu 1400, eg: 1360
+	// for ipv4, 0 disables
+	s.SetMSSClamp(cfg.MSSClamp)
+
+	// tcp peers identify streams by name behind nat or proxy
+	s.SetName(cfg.Name)
+
+	// migrate=true moves peers to the new address once a local
+	// address changes, eg: laptop switching wifi, requires name
+	if cfg.Migrate {
+		s.SetMigration(cfg.Name)
 	}
 
-	// create registry to get connect to controller
-	// just hard code controller address once without env var
-	ctrlAddr := "demo.notr.tech:58422"
-	ctrl := os.Getenv("controller")
-	if len(ctrl) > 0 {
-		ctrlAddr = ctrl
+	// stay on standby after primary recovers if failback=false
+	s.SetFailback(cfg.Failback)
+
+	// ciphers for peer traffic, disabled if empty
+	// eg: aes-256-gcm,chacha20-poly1305,none
+	// hmac-sha256 authenticates packets without encrypting them
+	s.SetCiphers(cfg.Ciphers)
+
+	// traffic from or to clear_cidrs skips encryption,
+	// eg: 10.0.1.0/24 behind a trusted link, same set on all peers
+	err = s.SetClearCidrs(cfg.ClearCidrs)
+	if err != nil {
+		log.Error("%v", err)
+		return
 	}
 
-	// it is our secret
-	// read from env firstly
-	// if empty, use configuration
-	secret := os.Getenv("secret")
-	if len(secret) <= 0 {
-		log.Error("invalid secret")
+	// inside an outer tunnel, eg: nested=10.8.0.0/24 of wireguard,
+	// peers in the outer tunnel are not encrypted by cframe
+	err = s.SetNested(cfg.Nested)
+	if err != nil {
+		log.Error("%v", err)
 		return
 	}
 
-	ns := os.Getenv("namespace")
-	if len(ns) <= 0 {
-		log.Info("use default namespace")
-		ns = "default"
+	// rotate peer keys, eg: 1h, old key accepted for rekey_window
+	s.SetKeyRotation(time.Duration(cfg.RekeyInterval), time.Duration(cfg.RekeyWindow))
+
+	// per packet log sampling
+	// log 1 in every N tuple messages, at most M per second
+	s.SetLogSampling(cfg.LogSampleEvery, cfg.LogSampleLimit)
+
+	// tcp segments from peers after a gap wait up to reorder_timeout
+	// for the gap, at most reorder_depth per flow, eg: 5ms and 16
+	// 0 disables, for readers or paths scrambling order
+	s.SetReorder(time.Duration(cfg.ReorderTimeout), cfg.ReorderDepth)
+
+	// allowed_ips=true drops packets from a peer whose source
+	// is outside cidrs the peer serves, against spoofing
+	s.SetAllowedIPs(cfg.AllowedIPs)
+
+	// fast_path=true hands packets to peers served in this process
+	// without sockets, for nested setups embedding several edges
+	s.SetFastPath(cfg.FastPath)
+
+	// cidrs beyond peer_route_limit of a peer or route_limit
+	// of all peers are rejected and retried, 0 is unlimited
+	s.SetRouteLimits(cfg.PeerRouteLimit, cfg.RouteLimit)
+
+	// latency sensitive dscp classes over the premium endpoint
+	// of a peer, eg: dscp_routes=46=2.2.2.2:58423
+	s.SetDSCPRoutes(cfg.DSCPRoutes)
+
+	// flow records on expiry, eg: flow_export=udp://10.0.0.9:2055
+	// at most flow_max flows, exported once idle for flow_idle
+	err = s.SetFlowExport(cfg.FlowExport, cfg.FlowMax, time.Duration(cfg.FlowIdle))
+	if err != nil {
+		log.Error("%v", err)
+		return
 	}
 
-	s := NewServer(lisAddr, secret, iface)
+	// non ip frames from tun are counted and dropped,
+	// log 1 in every N of them, 0 disables
+	s.SetNonIPLog(cfg.NonIPLogEvery)
+
+	// control packets of types unknown to this version, eg: from
+	// newer edges, are counted and ignored, log 1 in every N of them
+	s.SetUnknownCtrlLog(cfg.UnknownCtrl)
+
+	// captures started by admin api write files only under tap_dir
+	s.SetTapDir(cfg.TapDir)
 
-	reg := NewRegistry(ctrlAddr, ns, secret, os.Getenv("name"), s)
+	// SIGUSR1 toggles packet capture, written to tap_file if set
+	// SIGUSR2 toggles maintenance mode
+	// SIGHUP flushes and rebuilds os routes of peers
 	go func() {
-		err := reg.Run()
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+		for v := range sig {
+			if v == syscall.SIGUSR2 {
+				s.ToggleMaintenance()
+				continue
+			}
+			if v == syscall.SIGHUP {
+				if _, err := s.RebuildRoutes(); err != nil {
+					log.Error("rebuild routes: %v", err)
+				}
+				continue
+			}
+
+			err := s.ToggleTap(&TapConfig{File: cfg.TapFile})
+			if err != nil {
+				log.Error("%v", err)
+			}
+		}
+	}()
+
+	// peers come from a static file, lan discovery or controller
+	// peers_file=/etc/cframe/peers.json is reloaded on change
+	// discovery=239.255.58.58:58426 discovery_iface=eth0 finds lan edges
+	if len(cfg.PeersFile) > 0 {
+		pf := NewPeersFile(cfg.PeersFile, s)
+		go func() {
+			defer s.guard()
+			err := pf.Run()
+			if err != nil {
+				log.Error("peers file: %v", err)
+			}
+		}()
+	} else if len(cfg.Discovery) > 0 {
+		local := &codec.Edge{
+			Name:       cfg.Name,
+			ListenAddr: cfg.Listen,
+			Cidr:       cfg.Cidr,
+			Vni:        cfg.Vni,
+		}
+		disc, err := NewDiscovery(cfg.Discovery, cfg.DiscoveryIface, local, cfg.Namespace, cfg.Secret, s)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(0)
+			log.Error("%v", err)
+			return
 		}
+		disc.SetTTL(time.Duration(cfg.DiscoveryTTL))
+		go func() {
+			defer s.guard()
+			err := disc.Run()
+			if err != nil {
+				log.Error("discovery: %v", err)
+			}
+		}()
+	} else {
+		// controllers are failed over in order once connection is lost
+		// eg: controller=10.0.0.1:58422,10.0.0.2:58422
+		reg := NewRegistry(cfg.Controller, cfg.Namespace, cfg.Secret, cfg.Name, s)
+		reg.SetStaticRoutes(cfg.StaticRoutes)
+		// static_refresh=30s follows peers of static routes moved
+		// or joined after register, 0 resolves them once
+		s.SetStaticRefresh(time.Duration(cfg.StaticRefresh))
+		reg.SetTLS(ctrlTLS)
+		// ctrl_compress=true compresses peer sets from controller
+		reg.SetCompress(cfg.CtrlCompress)
+		s.SetRegistry(reg)
+		go func() {
+			defer s.guard()
+			err := reg.Run()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(0)
+			}
+		}()
+	}
+
+	// labels of every metric telling edges apart,
+	// eg: metric_labels=edge=edge1,region=us-east,env=prod
+	if err := metrics.SetLabels(cfg.MetricLabels); err != nil {
+		log.Error("%v", err)
+		return
+	}
+
+	// admin api, disabled if empty
+	if len(cfg.Admin) > 0 {
+		admin := NewAdmin(cfg.Admin, s)
+		admin.SetConfig(cfg)
+		go func() {
+			err := admin.ListenAndServe()
+			if err != nil {
+				log.Error("admin api: %v", err)
+			}
+		}()
+	}
+
+	// the new process serves once upgraded, see upgrade.go
+	go func() {
+		<-s.HandedOff()
+		log.Info("upgrade: exit")
+		os.Exit(0)
+	}()
+
+	// remove routes before closing sockets on shutdown
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Info("shutting down")
+		s.Shutdown()
+		os.Exit(0)
 	}()
 
 	s.ListenAndServe()
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync/atomic"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+var maintenanceDropped = metrics.NewCounter("cframe_edge_maintenance_dropped_total",
+	"data packets dropped in maintenance mode")
+
+// SetMaintenance stops or resumes forwarding data packets,
+// registration, heartbeats and health checks keep running
+func (s *Server) SetMaintenance(on bool) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&s.maintenance, v) != v {
+		log.Warn("maintenance mode: %v", on)
+	}
+}
+
+func (s *Server) Maintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+// ToggleMaintenance switches maintenance mode, returns the new mode
+func (s *Server) ToggleMaintenance() bool {
+	on := !s.Maintenance()
+	s.SetMaintenance(on)
+	return on
+}
+
+// dropInMaintenance counts and drops data packets in maintenance mode
+func (s *Server) dropInMaintenance() bool {
+	if !s.Maintenance() {
+		return false
+	}
+	maintenanceDropped.Inc()
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceDropsData(t *testing.T) {
+	tun := newFakeTun("tun")
+	a := NewServer("", "key", nil)
+	a.AddInterface(0, &Interface{tun: tun})
+	a.conn = listenLocal(t)
+	go a.readRemote(a.conn)
+
+	peer := listenLocal(t)
+	a.peerConns[0] = map[string]*peerConn{
+		"10.0.0.0/24": newPeerConn(peer.LocalAddr().String(), "10.0.0.0/24"),
+	}
+	go a.readLocal(a.conn, 0, a.ifaces[0])
+
+	a.SetMaintenance(true)
+	dropped := maintenanceDropped.Value()
+
+	// local data
+	tun.in <- ipPacket("10.0.1.1", "10.0.0.5")
+	peer.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	if _, _, err := peer.ReadFromUDP(make([]byte, 2048)); err == nil {
+		t.Fatalf("local data forwarded in maintenance mode")
+	}
+
+	// remote data
+	send := func(buf []byte) {
+		if _, err := peer.WriteToUDP(buf, a.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(a.encap.EncodeData(0, ipPacket("10.0.0.5", "10.0.1.1")))
+	select {
+	case <-tun.out:
+		t.Fatalf("remote data forwarded in maintenance mode")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	if n := maintenanceDropped.Value() - dropped; n != 2 {
+		t.Fatalf("expected 2 packets dropped, got %d", n)
+	}
+
+	// control traffic goes on
+	send(a.encap.EncodeCtrl(ctrlPing, []byte("nonce")))
+	buf := make([]byte, 2048)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	nr, _, err := peer.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("ping not answered in maintenance mode: %v", err)
+	}
+	_, inner, err := a.encap.Decode(buf[:nr])
+	if err != nil || !isCtrl(inner) || inner[1] != ctrlPong {
+		t.Fatalf("expected pong, got %v %v", inner, err)
+	}
+
+	a.SetMaintenance(false)
+	send(a.encap.EncodeData(0, ipPacket("10.0.0.5", "10.0.1.1")))
+	select {
+	case <-tun.out:
+	case <-time.After(time.Second):
+		t.Fatalf("remote data not forwarded after maintenance")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseFwmark parses fwmark in decimal or hex, eg: 0x100
+func ParseFwmark(s string) (int, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	mark, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid fwmark %s", s)
+	}
+	return int(mark), nil
+}
+
+// ParsePeerMarks parses fwmark per peer address,
+// eg: 1.1.1.1:58423=0x100,2.2.2.2:58423=0x200
+func ParsePeerMarks(s string) (map[string]int, error) {
+	marks := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid peer fwmark %s", pair)
+		}
+		addr, err := net.ResolveUDPAddr("udp", kv[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer fwmark %s: %v", pair, err)
+		}
+		mark, err := ParseFwmark(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		marks[addr.String()] = mark
+	}
+	return marks, nil
+}
+
+// SetFwmark marks peer traffic with SO_MARK for firewall and
+// policy routing rules, peers in the peer => mark map use
+// their own mark. must be called before ListenAndServe
+func (s *Server) SetFwmark(mark int, peers map[string]int) {
+	s.fwmark = mark
+	s.peerMarks = peers
+}
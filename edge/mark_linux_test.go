@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func socketMark(t *testing.T, conn *net.UDPConn) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mark := 0
+	raw.Control(func(fd uintptr) {
+		mark, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mark
+}
+
+func TestParsePeerMarks(t *testing.T) {
+	marks, err := ParsePeerMarks("1.1.1.1:58423=0x100, 2.2.2.2:58423=512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]int{"1.1.1.1:58423": 0x100, "2.2.2.2:58423": 512}
+	if !reflect.DeepEqual(marks, expect) {
+		t.Fatalf("expected %v, got %v", expect, marks)
+	}
+
+	for _, s := range []string{"1.1.1.1:58423", "1.1.1.1:58423=x"} {
+		if _, err := ParsePeerMarks(s); err == nil {
+			t.Fatalf("%s: expected error", s)
+		}
+	}
+}
+
+func TestPeerFwmark(t *testing.T) {
+	s := NewServer("127.0.0.1:0", "key", nil)
+	s.SetFwmark(0x10, map[string]int{"1.1.1.1:58423": 0x20})
+
+	var err error
+	s.conn, err = listenUDP("127.0.0.1:0", s.defaultOpts(), s.sharedPort())
+	if err != nil {
+		t.Skipf("fwmark: %v", err)
+	}
+	defer s.conn.Close()
+	if err := s.listenPeerSocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mark := socketMark(t, s.conn); mark != 0x10 {
+		t.Fatalf("expected default mark 0x10, got %#x", mark)
+	}
+
+	sock := s.sockFor("1.1.1.1:58423")
+	if sock == s.conn {
+		t.Fatalf("peer with its own mark on default socket")
+	}
+	if mark := socketMark(t, sock); mark != 0x20 {
+		t.Fatalf("expected peer mark 0x20, got %#x", mark)
+	}
+	if sock.LocalAddr().String() != s.conn.LocalAddr().String() {
+		t.Fatalf("peer socket on %s, expected %s", sock.LocalAddr(), s.conn.LocalAddr())
+	}
+	if s.sockFor("2.2.2.2:58423") != s.conn {
+		t.Fatalf("peer without mark not on default socket")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+// control plane metrics, exported by admin api /metrics
+var (
+	registrations = metrics.NewCounter("cframe_edge_registrations_total",
+		"registrations accepted by controller")
+	registerFailures = metrics.NewCounter("cframe_edge_register_failures_total",
+		"registrations failed")
+	reconnects = metrics.NewCounter("cframe_edge_reconnects_total",
+		"connections to controller after the first one")
+	heartbeatsSent = metrics.NewCounter("cframe_edge_heartbeats_sent_total",
+		"heartbeats sent to controller")
+	heartbeatsMissed = metrics.NewCounter("cframe_edge_heartbeats_missed_total",
+		"heartbeats not sent, controller disconnected or write failed")
+	controllerConnected = metrics.NewGauge("cframe_edge_controller_connected",
+		"1 if connected to controller")
+)
+
+// size of inner packets forwarded, 32 to 2048 bytes in powers
+// of 2. ingress is received from peers, egress is sent to peers
+var (
+	ingressPacketSize = metrics.NewHistogram("cframe_edge_ingress_packet_bytes",
+		"size of inner packets received from peers", metrics.ExponentialBuckets(32, 2, 7))
+	egressPacketSize = metrics.NewHistogram("cframe_edge_egress_packet_bytes",
+		"size of inner packets sent to peers", metrics.ExponentialBuckets(32, 2, 7))
+)
+
+// ParseMetricLabels parses static labels of all metrics,
+// eg: edge=edge1,region=us-east,env=prod
+func ParseMetricLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, fmt.Errorf("invalid metric label %s", item)
+		}
+		if _, ok := labels[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate metric label %s", item)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
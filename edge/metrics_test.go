@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestPacketSizeHistogram(t *testing.T) {
+	tun := newFakeTun("cframe.0")
+	s := NewServer("", "key", &Interface{tun: tun})
+	s.SetRouteManager(newFakeRoutes())
+	s.conn = listenLocal(t)
+	peer := listenLocal(t)
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: peer.LocalAddr().String()})
+
+	sized := func(n int) []byte {
+		pkt := make([]byte, n)
+		copy(pkt, ipPacket("10.0.9.1", "10.0.1.5"))
+		return pkt
+	}
+	sizes := []int{20, 40, 64, 100, 576, 1400, 1500, 4000}
+	// cumulative count per bound 32, 64 ... 2048
+	expect := []int64{1, 3, 4, 4, 4, 5, 7}
+
+	in, inTotal := ingressPacketSize.Buckets()
+	out, outTotal := egressPacketSize.Buckets()
+	for _, n := range sizes {
+		s.forwardLocal(s.conn, 0, sized(n))
+		s.onRemote(s.conn, peer.LocalAddr().(*net.UDPAddr), s.encap.EncodeData(0, sized(n)))
+		select {
+		case <-tun.out:
+		case <-time.After(time.Second):
+			t.Fatalf("packet of %d bytes not delivered", n)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		before []int64
+		total  int64
+		h      interface {
+			Buckets() ([]int64, int64)
+		}
+	}{
+		{"ingress", in, inTotal, ingressPacketSize},
+		{"egress", out, outTotal, egressPacketSize},
+	} {
+		got, total := c.h.Buckets()
+		if total-c.total != int64(len(sizes)) {
+			t.Fatalf("%s: expected %d packets, got %d", c.name, len(sizes), total-c.total)
+		}
+		for i := range expect {
+			if got[i]-c.before[i] != expect[i] {
+				t.Fatalf("%s: bucket %d expected %d, got %d", c.name, i, expect[i], got[i]-c.before[i])
+			}
+		}
+	}
+}
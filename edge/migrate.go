@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// connection migration keeps peers once the local address changes,
+// eg: a laptop switching wifi. the edge announces itself by name
+// to every peer from the new address
+// | 8bytes unix nano | 32bytes hmac | name |
+// the peer verifies hmac by the shared key and moves address, session
+// keys and health of the named peer to the sender address, without
+// handshake nor route change
+var (
+	localAddrCheck = time.Second * 2
+	migrateMaxSkew = time.Second * 30
+
+	// local unicast addresses, replaced by tests
+	localAddrs = func() ([]string, error) {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]string, 0, len(addrs))
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				ips = append(ips, ipnet.IP.String())
+			}
+		}
+		sort.Strings(ips)
+		return ips, nil
+	}
+)
+
+const migrateMACSize = sha256.Size
+
+type migration struct {
+	// name announced by local edge, empty disables migration
+	name string
+
+	// last announcement accepted of each peer name
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+// SetMigration announces the edge by name to peers once a local
+// address changes, name must be the one peers know from controller
+func (s *Server) SetMigration(name string) {
+	s.migration.name = name
+}
+
+func migrateMAC(key, name string, ts []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("migrate|"))
+	mac.Write(ts)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+// watchLocalAddrs migrates peers each time local addresses change
+func (s *Server) watchLocalAddrs() {
+	defer s.guard()
+	prev, _ := localAddrs()
+	tick := time.NewTicker(localAddrCheck)
+	defer tick.Stop()
+	for range tick.C {
+		cur, err := localAddrs()
+		if err != nil || strings.Join(cur, ",") == strings.Join(prev, ",") {
+			continue
+		}
+
+		log.Info("local address changed %v => %v", prev, cur)
+		prev = cur
+		s.migrate()
+	}
+}
+
+// migrate redials tcp streams and announces the local edge
+// to every peer from the current address
+func (s *Server) migrate() {
+	s.mu.RLock()
+	tcp := s.tcp
+	s.mu.RUnlock()
+	if tcp != nil {
+		tcp.close()
+	}
+
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixNano()))
+	payload := append(ts, migrateMAC(s.key, s.migration.name, ts)...)
+	payload = append(payload, s.migration.name...)
+
+	addrs := make(map[string]struct{})
+	for _, p := range s.Peers() {
+		addrs[p.ListenAddr] = struct{}{}
+	}
+	for _, addr := range s.sessions.addrs() {
+		addrs[addr] = struct{}{}
+	}
+
+	for addr := range addrs {
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			continue
+		}
+		go func() {
+			if err := <-s.sendCtrl(raddr, ctrlMigrate, payload, true); err != nil {
+				log.Error("announce migration to %s fail: %v", raddr, err)
+			}
+		}()
+	}
+}
+
+// onMigrate moves the named peer to the address it announced from
+func (s *Server) onMigrate(from *net.UDPAddr, payload []byte) {
+	if len(payload) <= 8+migrateMACSize {
+		log.Error("invalid migrate from %s", from)
+		return
+	}
+	ts, mac, name := payload[:8], payload[8:8+migrateMACSize], string(payload[8+migrateMACSize:])
+	if !hmac.Equal(mac, migrateMAC(s.key, name, ts)) {
+		log.Error("migrate of %s from %s: invalid mac", name, from)
+		return
+	}
+
+	at := int64(binary.BigEndian.Uint64(ts))
+	skew := time.Since(time.Unix(0, at))
+	if skew < -migrateMaxSkew || skew > migrateMaxSkew {
+		log.Error("migrate of %s from %s: clock skew %v", name, from, skew)
+		return
+	}
+
+	s.migration.mu.Lock()
+	if at <= s.migration.last[name] {
+		s.migration.mu.Unlock()
+		log.Debug("stale migrate of %s from %s", name, from)
+		return
+	}
+	s.migration.last[name] = at
+	s.migration.mu.Unlock()
+
+	old := s.peerAddr(name)
+	if len(old) == 0 || old == from.String() {
+		return
+	}
+	log.Info("peer %s migrated %s => %s", name, old, from)
+	s.movePeer(old, from.String())
+}
+
+// movePeer rewrites peer address old to addr, keeping
+// routes, session keys and health state of the peer
+func (s *Server) movePeer(old, addr string) {
+	s.mu.Lock()
+	for _, peers := range s.peerConns {
+		for _, pc := range peers {
+			if pc.addr == old {
+				pc.addr = addr
+			}
+			if pc.standby == old {
+				pc.standby = addr
+			}
+			for _, p := range pc.paths {
+				if p.addr == old {
+					p.addr = addr
+				}
+			}
+		}
+	}
+	s.indexPeers()
+	s.mu.Unlock()
+	if s.aggregator != nil {
+		s.aggregator.move(old, addr)
+	}
+
+	s.sessions.move(old, addr)
+	s.health.move(old, addr)
+	s.idle.move(old, addr)
+}
+
+func (ss *sessions) move(old, addr string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if sess, ok := ss.m[old]; ok {
+		ss.m[addr] = sess
+		delete(ss.m, old)
+	}
+}
+
+func (h *health) move(old, addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ph, ok := h.peers[old]; ok {
+		h.peers[addr] = ph
+		delete(h.peers, old)
+	}
+	for raddr, a := range h.addrs {
+		if a == old {
+			delete(h.addrs, raddr)
+			h.addrs[addr] = addr
+		}
+	}
+}
+
+func (i *idlePeers) move(old, addr string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if a := i.activity(old); a != nil {
+		i.active.Store(addr, a)
+		i.active.Delete(old)
+	}
+	for _, p := range i.peers {
+		if p.edge.ListenAddr == old {
+			p.edge.ListenAddr = addr
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestMigrate(t *testing.T) {
+	atun := newFakeTun("cframe.0")
+	a := NewServer("", "key", &Interface{tun: atun})
+	a.SetCiphers([]string{cipherAES256})
+	a.SetMigration("edge-a")
+	b := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	b.SetCiphers([]string{cipherAES256})
+	b.SetRouteManager(newFakeRoutes())
+
+	// only a handshakes, the session of b is negotiated once
+	a.conn = listenLocal(t)
+	old := a.conn.LocalAddr().String()
+	b.AddPeer(&codec.Edge{Name: "edge-a", Cidr: "10.0.1.0/24", ListenAddr: old})
+	b.conn = listenLocal(t)
+	go a.readRemote(a.conn)
+	go b.readRemote(b.conn)
+
+	baddr := b.conn.LocalAddr().(*net.UDPAddr)
+	if err := <-a.handshake(baddr); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for b.sessions.get(old) == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	sess := b.sessions.get(old)
+	if sess == nil {
+		t.Fatalf("no session of %s", old)
+	}
+
+	// local address changes, a binds the new address
+	a.conn = listenLocal(t)
+	go a.readRemote(a.conn)
+	addr := a.conn.LocalAddr().String()
+	a.migrate()
+
+	deadline = time.Now().Add(time.Second)
+	for b.sessions.get(addr) == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if got := b.sessions.get(addr); got != sess {
+		t.Fatalf("expected session kept on %s, got %v", addr, got)
+	}
+	if b.sessions.get(old) != nil {
+		t.Fatalf("session still on old address %s", old)
+	}
+	if got := b.peerAddr("edge-a"); got != addr {
+		t.Fatalf("expected peer moved to %s, got %s", addr, got)
+	}
+	b.mu.RLock()
+	pc := b.peerConns[0]["10.0.1.0/24"]
+	b.mu.RUnlock()
+	if pc.addr != addr {
+		t.Fatalf("expected route via %s, got %s", addr, pc.addr)
+	}
+
+	// traffic resumes on the new address without handshake
+	b.forwardLocal(b.conn, 0, ipPacket("10.0.9.1", "10.0.1.5"))
+	select {
+	case pkt := <-atun.out:
+		if Packet(pkt).Dst() != "10.0.1.5" {
+			t.Fatalf("unexpected packet %x", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("packet not delivered after migration")
+	}
+}
+
+func TestMigrateReject(t *testing.T) {
+	s := NewServer("", "key", nil)
+	pc := newPeerConn("1.1.1.1:58423", "10.0.1.0/24")
+	pc.id = "edge-a"
+	s.peerConns[0] = map[string]*peerConn{"10.0.1.0/24": pc}
+	from := &net.UDPAddr{IP: net.ParseIP("2.2.2.2"), Port: 58423}
+
+	announce := func(key string, at time.Time) []byte {
+		ts := make([]byte, 8)
+		binary.BigEndian.PutUint64(ts, uint64(at.UnixNano()))
+		payload := append(ts, migrateMAC(key, "edge-a", ts)...)
+		return append(payload, "edge-a"...)
+	}
+
+	for _, payload := range [][]byte{
+		announce("other", time.Now()),
+		announce("key", time.Now().Add(-time.Hour)),
+		[]byte("short"),
+	} {
+		s.onMigrate(from, payload)
+		if got := s.peerAddr("edge-a"); got != "1.1.1.1:58423" {
+			t.Fatalf("expected migration rejected, moved to %s", got)
+		}
+	}
+
+	// replayed announcement is ignored
+	payload := announce("key", time.Now())
+	s.onMigrate(from, payload)
+	if got := s.peerAddr("edge-a"); got != from.String() {
+		t.Fatalf("expected peer moved to %s, got %s", from, got)
+	}
+	s.onMigrate(&net.UDPAddr{IP: net.ParseIP("3.3.3.3"), Port: 58423}, payload)
+	if got := s.peerAddr("edge-a"); got != from.String() {
+		t.Fatalf("expected replay ignored, moved to %s", got)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpOptEnd  = 0
+	tcpOptNOP  = 1
+	tcpOptMSS  = 2
+)
+
+var mssClamped = metrics.NewCounter("cframe_edge_mss_clamped_total",
+	"tcp syn packets with mss lowered to mss_clamp")
+
+// SetMSSClamp lowers mss option of tcp syn packets forwarded
+// in both directions to mss, so tcp segments fit the tunnel
+// without fragmentation, eg: 1360 for tun mtu 1400. 0 disables
+func (s *Server) SetMSSClamp(mss int) {
+	s.mssClamp = mss
+}
+
+// clampMSS lowers mss option of tcp syn pkt to mss in place,
+// the tcp checksum is recomputed. returns whether pkt changed
+func clampMSS(pkt []byte, mss int) bool {
+	p := Packet(pkt)
+	proto, off := p.transport()
+	if proto != protoTCP || off < 0 || len(p) < off+20 {
+		return false
+	}
+	tcp := p[off:]
+	if tcp[13]&tcpFlagSYN == 0 {
+		return false
+	}
+
+	// options between fixed header and data offset
+	hlen := int(tcp[12]>>4) * 4
+	if hlen < 20 || len(tcp) < hlen {
+		return false
+	}
+	for i := 20; i < hlen; {
+		kind := tcp[i]
+		if kind == tcpOptEnd {
+			return false
+		}
+		if kind == tcpOptNOP {
+			i++
+			continue
+		}
+		if i+1 >= hlen || tcp[i+1] < 2 || i+int(tcp[i+1]) > hlen {
+			return false
+		}
+		if kind == tcpOptMSS && tcp[i+1] == 4 {
+			if int(binary.BigEndian.Uint16(tcp[i+2:])) <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(tcp[i+2:], uint16(mss))
+			tcpChecksum(p, off)
+			mssClamped.Inc()
+			return true
+		}
+		i += int(tcp[i+1])
+	}
+	return false
+}
+
+// tcpChecksum recomputes checksum of tcp segment at off of p
+// over the pseudo header of ipv4 or ipv6
+func tcpChecksum(p Packet, off int) {
+	end := len(p)
+	var pseudo []byte
+	if p.Version() == 4 {
+		if total := int(binary.BigEndian.Uint16(p[2:4])); total >= off && total < end {
+			end = total
+		}
+		pseudo = make([]byte, 12)
+		copy(pseudo, p[12:20])
+		pseudo[9] = protoTCP
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(end-off))
+	} else {
+		if total := 40 + int(binary.BigEndian.Uint16(p[4:6])); total >= off && total < end {
+			end = total
+		}
+		pseudo = make([]byte, 40)
+		copy(pseudo, p[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(end-off))
+		pseudo[39] = protoTCP
+	}
+
+	tcp := p[off:end]
+	tcp[16], tcp[17] = 0, 0
+	binary.BigEndian.PutUint16(tcp[16:], checksum(append(pseudo, tcp...)))
+}
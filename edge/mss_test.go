@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// tcpSyn builds ipv4 tcp syn with options: nop, nop, mss
+func tcpSyn(src, dst string, mss uint16) []byte {
+	pkt := make([]byte, 20+28)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8], pkt[9] = 64, protoTCP
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+
+	tcp := pkt[20:]
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	tcp[12] = 7 << 4
+	tcp[13] = tcpFlagSYN
+	copy(tcp[20:], []byte{tcpOptNOP, tcpOptNOP, tcpOptMSS, 4, byte(mss >> 8), byte(mss), tcpOptEnd, 0})
+	tcpChecksum(pkt, 20)
+	return pkt
+}
+
+// validTCPChecksum verifies ipv4 tcp checksum including pseudo header
+func validTCPChecksum(pkt []byte) bool {
+	pseudo := make([]byte, 12)
+	copy(pseudo, pkt[12:20])
+	pseudo[9] = protoTCP
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(pkt)-20))
+	return checksum(append(pseudo, pkt[20:]...)) == 0
+}
+
+func TestClampMSS(t *testing.T) {
+	pkt := tcpSyn("10.0.0.1", "10.0.1.1", 1460)
+	if !validTCPChecksum(pkt) {
+		t.Fatal("invalid checksum of syn built")
+	}
+
+	if !clampMSS(pkt, 1360) {
+		t.Fatal("large mss not clamped")
+	}
+	if mss := binary.BigEndian.Uint16(pkt[20+24:]); mss != 1360 {
+		t.Fatalf("expected mss 1360, got %d", mss)
+	}
+	if !validTCPChecksum(pkt) {
+		t.Fatal("checksum not corrected")
+	}
+
+	// small mss and non syn are untouched
+	small := tcpSyn("10.0.0.1", "10.0.1.1", 1200)
+	if clampMSS(small, 1360) {
+		t.Fatal("small mss changed")
+	}
+	ack := tcpSyn("10.0.0.1", "10.0.1.1", 1460)
+	ack[20+13] = 0x10
+	if clampMSS(ack, 1360) {
+		t.Fatal("non syn packet changed")
+	}
+	if clampMSS(ipPacket("10.0.0.1", "10.0.1.1"), 1360) {
+		t.Fatal("non tcp packet changed")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// path is one of equal peers serving the same cidr,
+// new flows are distributed proportionally to weight
+type path struct {
+	addr   string
+	weight int
+	// peer id of the path, see peerID
+	id string
+}
+
+// addPath adds or updates weighted path of pc
+func (pc *peerConn) addPath(addr, id string, weight int) {
+	for _, p := range pc.paths {
+		if p.addr == addr {
+			p.weight, p.id = weight, id
+			return
+		}
+	}
+	pc.paths = append(pc.paths, &path{addr: addr, weight: weight, id: id})
+}
+
+// delPath removes weighted path of pc, returns false if not found
+func (pc *peerConn) delPath(addr string) bool {
+	for i, p := range pc.paths {
+		if p.addr == addr {
+			pc.paths = append(pc.paths[:i], pc.paths[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// selectPath selects path of the flow by weighted rendezvous hashing,
+// the same flow always goes to the same path while the path is up
+func (s *Server) selectPath(pc *peerConn, flow string) string {
+	best, bestScore := "", math.Inf(-1)
+	down, downScore := "", math.Inf(-1)
+	for _, p := range pc.paths {
+		score := pathScore(flow, p)
+		if !s.health.isUp(p.addr) {
+			if score > downScore {
+				down, downScore = p.addr, score
+			}
+			continue
+		}
+
+		if score > bestScore {
+			best, bestScore = p.addr, score
+		}
+	}
+
+	// all paths down
+	if len(best) == 0 {
+		return down
+	}
+	return best
+}
+
+// pathScore is -weight/ln(h) where h is hash of flow and path in (0, 1)
+func pathScore(flow string, p *path) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(flow))
+	h.Write([]byte{0})
+	h.Write([]byte(p.addr))
+	u := (float64(h.Sum64()>>11) + 0.5) / float64(1<<53)
+	return -float64(p.weight) / math.Log(u)
+}
+
+// multiPath returns true if other equal peers serve the cidr of peer
+func (s *Server) multiPath(peer *codec.Edge) bool {
+	cidr := hostCIDR(peer.Cidr)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pc, ok := s.peerConns[peer.Vni][cidr]
+	return ok && len(pc.paths) > 1
+}
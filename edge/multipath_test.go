@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestWeightedPaths(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423", Weight: 3})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "2.2.2.2:58423", Weight: 1})
+
+	flows := 10000
+	count := make(map[string]int)
+	for i := 0; i < flows; i++ {
+		src := fmt.Sprintf("10.0.%d.%d", i/250, i%250)
+		addr, err := s.route(0, src, "10.0.1.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		count[addr]++
+
+		// sticky per flow
+		again, _ := s.route(0, src, "10.0.1.1")
+		if again != addr {
+			t.Fatalf("flow %s moved from %s to %s", src, addr, again)
+		}
+	}
+
+	ratio := float64(count["1.1.1.1:58423"]) / float64(flows)
+	if math.Abs(ratio-0.75) > 0.03 {
+		t.Fatalf("expected 75%% flows to weight 3 path, got %v", count)
+	}
+}
+
+func TestWeightedPathDown(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	a := &codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423", Weight: 1}
+	b := &codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "2.2.2.2:58423", Weight: 1}
+	s.AddPeer(a)
+	s.AddPeer(b)
+
+	// path a lost pings, all flows go to b
+	now := time.Now()
+	for i := 0; i < defaultHealthFailures+1; i++ {
+		s.health.onPing(a.ListenAddr, a.ListenAddr, now.Add(time.Duration(i)*time.Second))
+	}
+	for i := 0; i < 100; i++ {
+		addr, _ := s.route(0, fmt.Sprintf("10.0.0.%d", i), "10.0.1.1")
+		if addr != b.ListenAddr {
+			t.Fatalf("flow routed to down path %s", addr)
+		}
+	}
+
+	// route is kept until the last path removed
+	s.DelPeer(b)
+	if addr, _ := s.route(0, "10.0.0.1", "10.0.1.1"); addr != a.ListenAddr {
+		t.Fatalf("expected route to remaining path, got %s", addr)
+	}
+	if n := len(routes.Calls()); n != 2 {
+		t.Fatalf("route removed while other path serves the cidr: %v", routes.Calls())
+	}
+
+	s.DelPeer(a)
+	if _, err := s.route(0, "10.0.0.1", "10.0.1.1"); err == nil {
+		t.Fatalf("expected no route after all paths removed")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// ParseNested parses comma separated cidrs of the outer tunnel,
+// eg: 10.8.0.0/24 of wireguard
+func ParseNested(s string) ([]string, error) {
+	cidrs := make([]string, 0)
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if len(c) == 0 {
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nested cidr %s", c)
+		}
+		cidrs = append(cidrs, ipnet.String())
+	}
+	return cidrs, nil
+}
+
+// SetNested runs the edge inside an outer tunnel encrypting
+// traffic between edges, eg: wireguard. peers must listen on
+// addresses in cidrs of the outer tunnel and are trusted,
+// packets to them are not encrypted by cframe and packets
+// from addresses outside the outer tunnel are dropped
+func (s *Server) SetNested(cidrs []string) error {
+	nested := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("invalid nested cidr %s", c)
+		}
+		nested = append(nested, ipnet)
+	}
+	s.nested = nested
+	return nil
+}
+
+// trusted reports whether peer addr is reached over the outer tunnel
+func (s *Server) trusted(addr string) bool {
+	if len(s.nested) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, c := range s.nested {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNested rejects peers not reachable over the outer tunnel
+func (s *Server) checkNested(peer *codec.Edge) error {
+	if len(s.nested) == 0 || s.trusted(peer.ListenAddr) {
+		return nil
+	}
+	return fmt.Errorf("peer %s is outside nested cidrs", peer.ListenAddr)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestNested(t *testing.T) {
+	if _, err := ParseNested("10.8.0.1"); err == nil {
+		t.Fatal("expected error for host without prefix")
+	}
+	nested, err := ParseNested("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newEdge := func() (*Server, *fakeTun) {
+		tun := newFakeTun("cframe.0")
+		s := NewServer("", "key", &Interface{tun: tun})
+		s.SetRouteManager(newFakeRoutes())
+		s.SetCiphers([]string{cipherAES256})
+		if err := s.SetNested(nested); err != nil {
+			t.Fatal(err)
+		}
+		s.conn = listenLocal(t)
+		go s.readRemote(s.conn)
+		return s, tun
+	}
+	a, _ := newEdge()
+	b, btun := newEdge()
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	// peers outside the outer tunnel are rejected
+	if err := a.installPeer(&codec.Edge{Cidr: "10.0.9.0/24", ListenAddr: "192.168.1.1:58423"}); err == nil {
+		t.Fatal("peer outside nested cidrs installed")
+	}
+
+	// a plain socket in the outer tunnel sees packets unsealed
+	wire := listenLocal(t)
+	defer wire.Close()
+	a.AddPeer(&codec.Edge{Cidr: "10.0.3.0/24", ListenAddr: wire.LocalAddr().String()})
+	pkt := ipPacket("10.0.1.5", "10.0.3.5")
+	a.forwardLocal(a.conn, 0, pkt)
+	wire.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := wire.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, inner, err := a.encap.Decode(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isSealed(inner) || !bytes.Equal(inner, pkt) {
+		t.Fatal("packet to nested peer encrypted by cframe")
+	}
+	if a.sessions.get(wire.LocalAddr().String()) != nil {
+		t.Fatal("cipher negotiated with nested peer")
+	}
+
+	// forwarded between edges without cframe encryption
+	baddr := b.conn.LocalAddr().String()
+	a.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: baddr})
+	b.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: a.conn.LocalAddr().String()})
+	a.forwardLocal(a.conn, 0, ipPacket("10.0.1.5", "10.0.2.5"))
+	select {
+	case got := <-btun.out:
+		if Packet(got).Dst() != "10.0.2.5" {
+			t.Fatalf("unexpected packet to %s", Packet(got).Dst())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet not forwarded to nested peer")
+	}
+
+	// health check still works
+	a.checkPeers(time.Now())
+	deadline := time.Now().Add(time.Second)
+	for !a.health.confirmed(baddr, time.Now()) {
+		if time.Now().After(deadline) {
+			t.Fatal("nested peer not confirmed by health check")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// sources outside the outer tunnel are dropped
+	if _, err := b.decrypt("192.168.1.1:58423", pkt); err == nil {
+		t.Fatal("packet from outside nested cidrs accepted")
+	}
+}
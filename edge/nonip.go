@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/hex"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+// frameClass is the kind of frame read from the tun device
+type frameClass int
+
+const (
+	frameIP frameClass = iota
+	// shorter than an ipv4 header
+	frameShort
+	// ethernet frame, the device is likely a tap instead of a tun
+	// or a tun with packet information header
+	frameEthernet
+	// neither ip nor ethernet
+	frameUnknown
+)
+
+var frameClassNames = map[frameClass]string{
+	frameIP:       "ip",
+	frameShort:    "short",
+	frameEthernet: "ethernet",
+	frameUnknown:  "unknown",
+}
+
+func (c frameClass) String() string {
+	return frameClassNames[c]
+}
+
+// ethertypes seen at offset 12 of ethernet frames
+var ethertypes = map[uint16]string{
+	0x0800: "ipv4",
+	0x0806: "arp",
+	0x86dd: "ipv6",
+	0x8100: "vlan",
+	0x88cc: "lldp",
+}
+
+var (
+	framesShort = metrics.NewCounter("cframe_edge_frames_short_total",
+		"frames from tun shorter than an ip header, dropped")
+	framesEthernet = metrics.NewCounter("cframe_edge_frames_ethernet_total",
+		"ethernet frames from tun, dropped")
+	framesUnknown = metrics.NewCounter("cframe_edge_frames_unknown_total",
+		"non ip frames from tun, dropped")
+)
+
+// classifyFrame tells ip packets from frames the edge never forwards
+func classifyFrame(p Packet) frameClass {
+	if p.Invalid() {
+		return frameShort
+	}
+
+	switch p.Version() {
+	case 4, 6:
+		return frameIP
+	}
+
+	if _, ok := ethertypes[Frame(p).Ethertype()]; ok {
+		return frameEthernet
+	}
+	return frameUnknown
+}
+
+// SetNonIPLog logs 1 in every non ip frames from tun
+// with the header in hex, 0 only counts them
+func (s *Server) SetNonIPLog(every int) {
+	if every > 0 {
+		s.nonIPLog = log.NewSampler(every, 10)
+	}
+}
+
+// dropNonIP counts and drops frames from tun which are not ip packets
+func (s *Server) dropNonIP(pkt []byte) bool {
+	class := classifyFrame(Packet(pkt))
+	switch class {
+	case frameIP:
+		return false
+	case frameShort:
+		framesShort.Inc()
+	case frameEthernet:
+		framesEthernet.Inc()
+	default:
+		framesUnknown.Inc()
+	}
+
+	if s.nonIPLog != nil && s.nonIPLog.Allow() {
+		head := pkt
+		if len(head) > 32 {
+			head = head[:32]
+		}
+		if class == frameEthernet {
+			log.Warn("drop %s frame from tun, ethertype %s, check tun/tap mode: %s",
+				class, ethertypes[Frame(pkt).Ethertype()], hex.EncodeToString(head))
+		} else {
+			log.Warn("drop %s frame from tun, %d bytes: %s", class, len(pkt), hex.EncodeToString(head))
+		}
+	}
+	return true
+}
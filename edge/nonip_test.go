@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestClassifyFrame(t *testing.T) {
+	arp := make([]byte, 42)
+	copy(arp[6:12], []byte{0x02, 0, 0, 0, 0, 1})
+	arp[12], arp[13] = 0x08, 0x06
+
+	for _, c := range []struct {
+		pkt    []byte
+		expect frameClass
+	}{
+		{ipPacket("10.0.0.1", "10.0.0.2"), frameIP},
+		{[]byte{0x45, 0, 0}, frameShort},
+		{arp, frameEthernet},
+		{make([]byte, 32), frameUnknown},
+	} {
+		if got := classifyFrame(c.pkt); got != c.expect {
+			t.Fatalf("%x: expected %s, got %s", c.pkt, c.expect, got)
+		}
+	}
+}
+
+func TestDropNonIP(t *testing.T) {
+	s := NewServer("", "key", nil)
+	s.SetNonIPLog(1)
+
+	// arp request from a tap device
+	arp := make([]byte, 42)
+	for i := 0; i < 6; i++ {
+		arp[i] = 0xff
+	}
+	arp[12], arp[13] = 0x08, 0x06
+
+	ethernet, unknown := framesEthernet.Value(), framesUnknown.Value()
+	s.forwardLocal(listenLocal(t), 0, arp)
+	if got := framesEthernet.Value() - ethernet; got != 1 {
+		t.Fatalf("expected 1 ethernet frame, got %d", got)
+	}
+	if framesUnknown.Value() != unknown {
+		t.Fatalf("arp counted as unknown")
+	}
+
+	if s.dropNonIP(ipPacket("10.0.0.1", "10.0.0.2")) {
+		t.Fatalf("ip packet dropped")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import "time"
+
+const (
+	// queue depth per peer when pacing without send_queue
+	defaultPaceQueue = 256
+	// bytes sent back to back if burst not set, a few packets
+	defaultPaceBurst = 4 * 1500
+)
+
+// pacer spaces packets to a peer at rate bytes per second,
+// up to burst bytes go out back to back. packets over rate
+// are delayed, never dropped by the pacer
+type pacer struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newPacer(rate, burst int) *pacer {
+	return &pacer{rate: float64(rate), burst: float64(burst), tokens: float64(burst)}
+}
+
+// reserve takes size bytes at now, returns how long
+// the packet waits to keep the pace
+func (p *pacer) reserve(size int, now time.Time) time.Duration {
+	if !p.last.IsZero() {
+		p.tokens += now.Sub(p.last).Seconds() * p.rate
+		if p.tokens > p.burst {
+			p.tokens = p.burst
+		}
+	}
+	p.last = now
+
+	p.tokens -= float64(size)
+	if p.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-p.tokens / p.rate * float64(time.Second))
+}
+
+// SetPacing spaces packets to each peer at rate bytes per second
+// with burst bytes sent back to back, rate 0 disables pacing
+// and burst 0 defaults to defaultPaceBurst.
+// packets wait in the peer send queue, enabled with
+// defaultPaceQueue packets if not set by SetSendQueue
+func (s *Server) SetPacing(rate, burst int) error {
+	if rate <= 0 {
+		if s.sendq != nil {
+			s.sendq.paceRate = 0
+		}
+		return nil
+	}
+	if burst <= 0 {
+		burst = defaultPaceBurst
+	}
+
+	if s.sendq == nil {
+		if err := s.SetSendQueue(defaultPaceQueue, dropTail); err != nil {
+			return err
+		}
+	}
+	s.sendq.paceRate, s.sendq.paceBurst = rate, burst
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacerReserve(t *testing.T) {
+	p := newPacer(1000, 500)
+	now := time.Now()
+
+	// burst goes out back to back, then 1 byte per ms
+	if d := p.reserve(500, now); d != 0 {
+		t.Fatalf("burst delayed %v", d)
+	}
+	if d := p.reserve(100, now); d != 100*time.Millisecond {
+		t.Fatalf("expected 100ms, got %v", d)
+	}
+
+	// idle refills no more than burst
+	if d := p.reserve(500, now.Add(time.Hour)); d != 0 {
+		t.Fatalf("refilled burst delayed %v", d)
+	}
+	if d := p.reserve(1, now.Add(time.Hour)); d <= 0 {
+		t.Fatal("tokens over burst")
+	}
+}
+
+func TestPacingSpacing(t *testing.T) {
+	const size, count = 1000, 20
+	sent := make(chan time.Time, count)
+	sq, _ := newSendQueues(count, "", func(p *egressPkt) { sent <- time.Now() })
+	// 100KB/s paces 1000 byte packets 10ms apart after a 2 packet burst
+	sq.paceRate, sq.paceBurst = 100000, 2*size
+
+	peer := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 58423}
+	for i := 0; i < count; i++ {
+		sq.push(&egressPkt{addr: peer, buf: make([]byte, size)})
+	}
+
+	times := make([]time.Time, 0, count)
+	for len(times) < count {
+		select {
+		case at := <-sent:
+			times = append(times, at)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %d packets sent", len(times))
+		}
+	}
+
+	if gap := times[1].Sub(times[0]); gap > 5*time.Millisecond {
+		t.Fatalf("burst paced, gap %v", gap)
+	}
+	spacing := times[count-1].Sub(times[2]) / (count - 3)
+	if spacing < 8*time.Millisecond || spacing > 15*time.Millisecond {
+		t.Fatalf("expected about 10ms spacing, got %v", spacing)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// peers file is checked for changes every peersFilePoll
+var peersFilePoll = time.Second * 2
+
+// PeersFile feeds the peer set from a local json file
+// without controller nor etcd, eg:
+// [{"name":"edge2","cidr":"10.0.2.0/24","listen_addr":"1.1.1.2:58423"}]
+type PeersFile struct {
+	path   string
+	server *Server
+	last   []byte
+	done   chan struct{}
+}
+
+// NewPeersFile creates peers file of path applied to s
+func NewPeersFile(path string, s *Server) *PeersFile {
+	return &PeersFile{
+		path:   path,
+		server: s,
+		done:   make(chan struct{}),
+	}
+}
+
+// ParsePeers parses peers of a peers file
+func ParsePeers(content []byte) ([]*codec.Edge, error) {
+	peers := make([]*codec.Edge, 0)
+	if err := json.Unmarshal(content, &peers); err != nil {
+		return nil, err
+	}
+
+	for _, p := range peers {
+		if _, _, err := net.ParseCIDR(p.Cidr); err != nil && net.ParseIP(p.Cidr) == nil {
+			return nil, fmt.Errorf("invalid cidr %s of peer %s", p.Cidr, p.Name)
+		}
+		if _, err := net.ResolveUDPAddr("udp", p.ListenAddr); err != nil {
+			return nil, fmt.Errorf("invalid listen_addr %s of peer %s", p.ListenAddr, p.Name)
+		}
+	}
+	return peers, nil
+}
+
+// Load applies peers of the file if it changed since last load,
+// a broken file keeps the current peers
+func (f *PeersFile) Load() error {
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	if f.last != nil && bytes.Equal(content, f.last) {
+		return nil
+	}
+
+	peers, err := ParsePeers(content)
+	if err != nil {
+		return fmt.Errorf("peers file %s: %v", f.path, err)
+	}
+
+	f.last = content
+	log.Info("peers file %s changed, %d peers", f.path, len(peers))
+	f.server.SetPeers(peers)
+	return nil
+}
+
+// Run loads the file and reloads it on change until closed
+func (f *PeersFile) Run() error {
+	if err := f.Load(); err != nil {
+		return err
+	}
+
+	tick := time.NewTicker(peersFilePoll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-f.done:
+			return nil
+		case <-tick.C:
+			if err := f.Load(); err != nil {
+				log.Error("%v", err)
+				AddErrorLog(err)
+			}
+		}
+	}
+}
+
+func (f *PeersFile) Close() {
+	close(f.done)
+}
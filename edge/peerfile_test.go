@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeersFile(t *testing.T) {
+	old := peersFilePoll
+	peersFilePoll = time.Millisecond * 10
+	defer func() { peersFilePoll = old }()
+
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+
+	path := filepath.Join(t.TempDir(), "peers.json")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitRoutes := func(expect ...string) {
+		waitRoutes(t, routes, "cframe.0", expect)
+	}
+
+	write(`[{"cidr":"10.0.1.0/24","listen_addr":"1.1.1.1:58423"},
+		{"cidr":"10.0.2.0/24","listen_addr":"2.2.2.2:58423"}]`)
+	pf := NewPeersFile(path, s)
+	defer pf.Close()
+	go pf.Run()
+	waitRoutes("10.0.1.0/24", "10.0.2.0/24")
+
+	// edit removes one peer and adds another
+	write(`[{"cidr":"10.0.2.0/24","listen_addr":"2.2.2.2:58423"},
+		{"cidr":"10.0.3.1","listen_addr":"3.3.3.3:58423"}]`)
+	waitRoutes("10.0.2.0/24", "10.0.3.1/32")
+
+	// broken file keeps current peers
+	write(`[{"cidr":"10.0.4.0/33","listen_addr":"4.4.4.4:58423"}]`)
+	time.Sleep(peersFilePoll * 5)
+	waitRoutes("10.0.2.0/24", "10.0.3.1/32")
+
+	write(`[]`)
+	waitRoutes()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// peerID is the stable identity of peer, empty if unnamed.
+// ids are kept on entries of peerConns, so a peer changing cidr
+// or listen address replaces its old entry instead of leaving
+// it behind. peers without name, eg: routes via nexthop, have no id
+func peerID(peer *codec.Edge) string {
+	return peer.Name
+}
+
+// namedPeers returns entries of named peers in peerConns
+func (s *Server) namedPeers() []*codec.Edge {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	peers := make([]*codec.Edge, 0)
+	for vni, pcs := range s.peerConns {
+		for _, pc := range pcs {
+			entry := func(id, addr string) *codec.Edge {
+				return &codec.Edge{Name: id, Cidr: pc.cidr, Vni: vni, ListenAddr: addr}
+			}
+			if len(pc.paths) > 0 {
+				for _, p := range pc.paths {
+					if len(p.id) > 0 {
+						peer := entry(p.id, p.addr)
+						peer.Weight = p.weight
+						peers = append(peers, peer)
+					}
+				}
+			} else if len(pc.id) > 0 {
+				peers = append(peers, entry(pc.id, pc.addr))
+			}
+			if len(pc.standbyID) > 0 {
+				peer := entry(pc.standbyID, pc.standby)
+				peer.Standby = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+	return peers
+}
+
+// peerByID returns the entry of the named peer, nil if not installed
+func (s *Server) peerByID(id string) *codec.Edge {
+	for _, peer := range s.namedPeers() {
+		if peer.Name == id {
+			return peer
+		}
+	}
+	return nil
+}
+
+// peerAddr returns listen address of the named peer
+func (s *Server) peerAddr(id string) string {
+	if peer := s.peerByID(id); peer != nil {
+		return peer.ListenAddr
+	}
+	return ""
+}
+
+func samePeerEntry(a, b *codec.Edge) bool {
+	return canonicalCIDR(a.Cidr) == canonicalCIDR(b.Cidr) &&
+		a.Vni == b.Vni &&
+		a.ListenAddr == b.ListenAddr &&
+		a.Standby == b.Standby
+}
+
+// replacePeer removes the old entry of peer before the
+// new one is installed, without draining as it is the same edge,
+// retries of an old entry failed to install are dropped
+func (s *Server) replacePeer(peer *codec.Edge) {
+	id := peerID(peer)
+	if len(id) == 0 {
+		return
+	}
+
+	s.failedMu.Lock()
+	for key, fp := range s.failed {
+		if peerID(fp.peer) == id && !samePeerEntry(fp.peer, peer) {
+			delete(s.failed, key)
+		}
+	}
+	s.failedMu.Unlock()
+
+	old := s.peerByID(id)
+	if old == nil || samePeerEntry(old, peer) {
+		return
+	}
+
+	log.Info("peer %s changed %s %s => %s %s",
+		id, old.Cidr, old.ListenAddr, peer.Cidr, peer.ListenAddr)
+	s.delRoute(old)
+}
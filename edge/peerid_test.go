@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestPeerChangeCidr(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.SetDrainGrace(time.Hour)
+
+	s.AddPeer(&codec.Edge{Name: "b", Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"})
+	s.AddPeer(&codec.Edge{Name: "c", Cidr: "10.0.3.0/24", ListenAddr: "3.3.3.3:58423"})
+
+	// b moves to another cidr, old route removed without draining
+	moved := &codec.Edge{Name: "b", Cidr: "10.0.2.0/24", ListenAddr: "1.1.1.1:58423"}
+	s.AddPeer(moved)
+	expect := []string{
+		"add 10.0.1.0/24 cframe.0",
+		"add 10.0.3.0/24 cframe.0",
+		"del 10.0.1.0/24 cframe.0",
+		"add 10.0.2.0/24 cframe.0",
+	}
+	if got := routes.Calls(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected calls %v, got %v", expect, got)
+	}
+
+	s.mu.RLock()
+	_, leaked := s.peerConns[0]["10.0.1.0/24"]
+	n := len(s.peerConns[0])
+	s.mu.RUnlock()
+	if leaked || n != 2 {
+		t.Fatalf("old cidr of peer leaked, %d peers", n)
+	}
+	if addr, err := s.route(0, "", "10.0.2.1"); err != nil || addr != moved.ListenAddr {
+		t.Fatalf("expected route to %s, got %s %v", moved.ListenAddr, addr, err)
+	}
+
+	// re-adding the same entry changes nothing
+	s.AddPeer(moved)
+	if n := len(routes.Calls()); n != len(expect)+1 {
+		t.Fatalf("unexpected calls %v", routes.Calls())
+	}
+
+	s.SetDrainGrace(0)
+	s.DelPeer(moved)
+	if len(s.peerAddr("b")) > 0 {
+		t.Fatalf("deleted peer still tracked")
+	}
+}
+
+func TestPeerIDStandbyRemoved(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+
+	s.AddPeer(&codec.Edge{Name: "a", Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"})
+	standby := &codec.Edge{Name: "b", Cidr: "10.0.1.0/24", ListenAddr: "2.2.2.2:58423", Standby: true}
+	s.AddPeer(standby)
+	if got := s.peerAddr("b"); got != standby.ListenAddr {
+		t.Fatalf("expected standby %s, got %s", standby.ListenAddr, got)
+	}
+
+	s.DelPeer(standby)
+	if peers := s.namedPeers(); len(peers) != 1 || peers[0].Name != "a" {
+		t.Fatalf("removed standby still identified: %v", peers)
+	}
+	if got := s.peerAddr("a"); got != "1.1.1.1:58423" {
+		t.Fatalf("primary lost with standby, got %s", got)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// Peers returns installed peers and peers waiting for retry
+func (s *Server) Peers() []*codec.Edge {
+	peers := make([]*codec.Edge, 0)
+	s.mu.RLock()
+	for vni, pcs := range s.peerConns {
+		for _, pc := range pcs {
+			if len(pc.paths) > 0 {
+				for _, p := range pc.paths {
+					peers = append(peers, &codec.Edge{
+						ListenAddr: p.addr,
+						Cidr:       pc.cidr,
+						Vni:        vni,
+						Weight:     p.weight,
+					})
+				}
+			} else if len(pc.addr) > 0 {
+				peers = append(peers, &codec.Edge{
+					ListenAddr: pc.addr,
+					Cidr:       pc.cidr,
+					Vni:        vni,
+				})
+			}
+
+			if len(pc.standby) > 0 {
+				peers = append(peers, &codec.Edge{
+					ListenAddr: pc.standby,
+					Cidr:       pc.cidr,
+					Vni:        vni,
+					Standby:    true,
+				})
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, fp := range s.FailedPeers() {
+		peers = append(peers, fp.peer)
+	}
+	return peers
+}
+
+// SetPeers replaces all peers with peers,
+// peers not in the set are deleted and new peers are added
+func (s *Server) SetPeers(peers []*codec.Edge) {
+	s.beginConverge(peers, time.Now())
+	defer func() { s.checkConverge(time.Now()) }()
+
+	// pending installs of the previous set are rescheduled below
+	// if still wanted
+	s.cancelAllStaggered()
+	want := make(map[string]*codec.Edge)
+	for _, p := range peers {
+		want[peerKey(p)+"@"+p.ListenAddr] = p
+	}
+
+	have := make(map[string]struct{})
+	for _, p := range s.Peers() {
+		if s.isStatic(p) {
+			continue
+		}
+		key := peerKey(p) + "@" + p.ListenAddr
+		if _, ok := want[key]; !ok {
+			s.DelPeer(p)
+			continue
+		}
+		have[key] = struct{}{}
+	}
+
+	missing := make([]*codec.Edge, 0)
+	for key, p := range want {
+		if _, ok := have[key]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	s.installPeers(missing)
+}
+
+// ApplyPeerDelta applies a batch of peer changes in one SetPeers,
+// so peers never see the intermediate sets. peers of add already
+// installed are updated in place
+func (s *Server) ApplyPeerDelta(add, del []*codec.Edge) {
+	want := make(map[string]*codec.Edge)
+	for _, p := range s.Peers() {
+		if !s.isStatic(p) {
+			want[peerKey(p)+"@"+p.ListenAddr] = p
+		}
+	}
+	for _, p := range del {
+		delete(want, peerKey(p)+"@"+p.ListenAddr)
+	}
+	updated := make([]*codec.Edge, 0)
+	for _, p := range add {
+		key := peerKey(p) + "@" + p.ListenAddr
+		if _, ok := want[key]; ok {
+			updated = append(updated, p)
+		}
+		want[key] = p
+	}
+
+	peers := make([]*codec.Edge, 0, len(want))
+	for _, p := range want {
+		peers = append(peers, p)
+	}
+	s.SetPeers(peers)
+	for _, p := range updated {
+		s.installPeer(p)
+	}
+}
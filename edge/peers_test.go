@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestSetPeers(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.AddPeers([]*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"},
+		{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"},
+	})
+
+	s.SetPeers([]*codec.Edge{
+		{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"},
+		{Cidr: "10.0.3.1", ListenAddr: "3.3.3.3:58423"},
+	})
+
+	installed, _ := routes.ListRoutes("cframe.0")
+	sort.Strings(installed)
+	expect := []string{"10.0.2.0/24", "10.0.3.1/32"}
+	if !reflect.DeepEqual(installed, expect) {
+		t.Fatalf("expected routes %v, got %v", expect, installed)
+	}
+
+	// unchanged peer is not reinstalled
+	adds := 0
+	for _, call := range routes.Calls() {
+		if call == "add 10.0.2.0/24 cframe.0" {
+			adds++
+		}
+	}
+	if adds != 1 {
+		t.Fatalf("unchanged peer reinstalled %d times", adds)
+	}
+
+	if _, err := s.route(0, "", "10.0.1.1"); err == nil {
+		t.Fatalf("removed peer still routable")
+	}
+	if addr, _ := s.route(0, "", "10.0.3.1"); addr != "3.3.3.3:58423" {
+		t.Fatalf("expected route to 3.3.3.3:58423, got %s", addr)
+	}
+}
+
+func TestPeerDelta(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.AddPeers([]*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"},
+		{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"},
+		{Cidr: "10.0.3.0/24", ListenAddr: "3.3.3.3:58423"},
+	})
+	before := len(routes.Calls())
+
+	r := NewRegistry("", "default", "secret", "edge1", s)
+	if !r.registerReq().PeerDelta {
+		t.Fatalf("peer delta not offered")
+	}
+	ctrl, edge := net.Pipe()
+	defer ctrl.Close()
+	go r.read(edge)
+
+	err := codec.WriteJSON(ctrl, codec.CmdPeerDelta, &codec.PeerDeltaMsg{
+		Add: []*codec.Edge{
+			{Cidr: "10.0.4.0/24", ListenAddr: "4.4.4.4:58423"},
+			{Cidr: "10.0.5.0/24", ListenAddr: "5.5.5.5:58423"},
+		},
+		Del: []*codec.Edge{
+			{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"},
+			{Cidr: "10.0.3.0/24", ListenAddr: "3.3.3.3:58423"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"10.0.2.0/24", "10.0.4.0/24", "10.0.5.0/24"}
+	var installed []string
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		installed, _ = routes.ListRoutes("cframe.0")
+		sort.Strings(installed)
+		if reflect.DeepEqual(installed, expect) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !reflect.DeepEqual(installed, expect) {
+		t.Fatalf("expected routes %v, got %v", expect, installed)
+	}
+
+	// only changed peers are touched, unchanged one is kept
+	calls := routes.Calls()[before:]
+	sort.Strings(calls)
+	expectCalls := []string{
+		"add 10.0.4.0/24 cframe.0",
+		"add 10.0.5.0/24 cframe.0",
+		"del 10.0.1.0/24 cframe.0",
+		"del 10.0.3.0/24 cframe.0",
+	}
+	if !reflect.DeepEqual(calls, expectCalls) {
+		t.Fatalf("expected route changes %v, got %v", expectCalls, calls)
+	}
+	if addr, _ := s.route(0, "", "10.0.2.1"); addr != "2.2.2.2:58423" {
+		t.Fatalf("unchanged peer lost, route to %s", addr)
+	}
+}
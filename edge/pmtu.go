@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+const (
+	// outer ipv4 and udp header of packets sent to peers
+	udpOverhead = 28
+
+	// path mtu below this is ignored,
+	// forged ptb must not shrink peer mtu to nothing
+	minPathMTU = 576
+
+	icmpDstUnreach  = 3
+	icmpHostUnreach = 1
+	icmpFragNeeded  = 4
+
+	icmp6DstUnreach   = 1
+	icmp6AddrUnreach  = 3
+	icmp6PacketTooBig = 2
+	// icmpv6 errors carry as much of the packet
+	// as fits the minimum ipv6 mtu 1280
+	icmp6MaxOrig = 1280 - 40 - 8
+)
+
+// pathMTU keeps path mtu to peers learned from icmp ptb,
+// key: peer udp address, val: outer ip mtu
+type pathMTU struct {
+	mu sync.RWMutex
+	m  map[string]int
+}
+
+func (p *pathMTU) get(addr string) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.m[addr]
+}
+
+// lower stores mtu only if it is lower than the known one
+func (p *pathMTU) lower(addr string, mtu int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old, ok := p.m[addr]; ok && old <= mtu {
+		return false
+	}
+	p.m[addr] = mtu
+	return true
+}
+
+// PeerMTU returns path mtu to peer, 0 if unknown
+func (s *Server) PeerMTU(addr string) int {
+	return s.pmtu.get(addr)
+}
+
+// listenICMP receives icmp ptb for packets sent to peers,
+// requires raw socket privilege
+func (s *Server) listenICMP() {
+	defer s.guard()
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		log.Error("listen icmp fail, path mtu discovery disabled: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1500)
+	for {
+		nr, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Error("read icmp fail: %v", err)
+			return
+		}
+		s.onICMP(buf[:nr])
+	}
+}
+
+// onICMP lowers peer mtu if msg is a ptb for our outer datagram
+// | type(3) | code(4) | checksum | unused | mtu | orig ip header | orig udp header |
+func (s *Server) onICMP(msg []byte) {
+	if len(msg) < 8 || msg[0] != icmpDstUnreach || msg[1] != icmpFragNeeded {
+		return
+	}
+
+	mtu := int(binary.BigEndian.Uint16(msg[6:8]))
+	orig := msg[8:]
+	if len(orig) < 20 || orig[0]>>4 != 4 || orig[9] != protoUDP {
+		return
+	}
+
+	ihl := int(orig[0]&0x0f) * 4
+	if len(orig) < ihl+8 {
+		return
+	}
+
+	sport := int(binary.BigEndian.Uint16(orig[ihl : ihl+2]))
+	if s.conn != nil && sport != s.conn.LocalAddr().(*net.UDPAddr).Port {
+		return
+	}
+
+	if mtu < minPathMTU {
+		log.Warn("ignore ptb with mtu %d", mtu)
+		return
+	}
+
+	dport := int(binary.BigEndian.Uint16(orig[ihl+2 : ihl+4]))
+	peer := fmt.Sprintf("%s:%d", Packet(orig).Dst(), dport)
+	if s.pmtu.lower(peer, mtu) {
+		log.Info("path mtu to %s lowered to %d", peer, mtu)
+	}
+}
+
+// tooBig reports whether buf carrying pkt exceeds path mtu to peer,
+// sender of pkt with DF set is told the mtu left for inner packets
+func (s *Server) tooBig(vni uint32, peer string, pkt, buf []byte) bool {
+	mtu := s.pmtu.get(peer)
+	if mtu == 0 || len(buf)+udpOverhead <= mtu {
+		return false
+	}
+
+	// ipv4 packets without DF are fragmented by the kernel,
+	// ipv6 packets are never fragmented on path
+	if Packet(pkt).Version() == 4 && pkt[6]&0x40 == 0 {
+		return false
+	}
+
+	inner := mtu - udpOverhead - (len(buf) - len(pkt))
+	iface := s.ifaces[vni]
+	if iface == nil {
+		return true
+	}
+
+	if _, err := iface.Write(icmpTooBig(pkt, inner)); err != nil {
+		log.Error("write ptb to %s fail: %v", Packet(pkt).Src(), err)
+	}
+	return true
+}
+
+// icmpTooBig builds the icmp frag needed, or icmpv6
+// packet too big, replied to sender of pkt
+func icmpTooBig(pkt []byte, mtu int) []byte {
+	return icmpUnreach(pkt, icmpFragNeeded, mtu)
+}
+
+// icmpUnreach builds the icmp destination unreachable of code
+// replied to sender of pkt, mtu is set for frag needed only,
+// ipv6 senders get the icmpv6 error of the same meaning
+func icmpUnreach(pkt []byte, code byte, mtu int) []byte {
+	if Packet(pkt).Version() == 6 {
+		if code == icmpFragNeeded {
+			return icmp6Error(pkt, icmp6PacketTooBig, 0, uint32(mtu))
+		}
+		return icmp6Error(pkt, icmp6DstUnreach, icmp6AddrUnreach, 0)
+	}
+
+	ihl := int(pkt[0]&0x0f) * 4
+	orig := pkt
+	if len(orig) > ihl+8 {
+		orig = orig[:ihl+8]
+	}
+
+	icmp := make([]byte, 8, 8+len(orig))
+	icmp[0] = icmpDstUnreach
+	icmp[1] = code
+	if code == icmpFragNeeded {
+		binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+	}
+	icmp = append(icmp, orig...)
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp))
+
+	ip := make([]byte, 20, 20+len(icmp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(icmp)))
+	ip[8] = 64
+	ip[9] = protoICMP
+	copy(ip[12:16], pkt[16:20])
+	copy(ip[16:20], pkt[12:16])
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+	return append(ip, icmp...)
+}
+
+// icmp6Error builds the icmpv6 error of typ and code replied
+// to sender of pkt, param is the mtu of packet too big
+func icmp6Error(pkt []byte, typ, code byte, param uint32) []byte {
+	orig := pkt
+	if len(orig) > icmp6MaxOrig {
+		orig = orig[:icmp6MaxOrig]
+	}
+
+	icmp := make([]byte, 8, 8+len(orig))
+	icmp[0] = typ
+	icmp[1] = code
+	binary.BigEndian.PutUint32(icmp[4:8], param)
+	icmp = append(icmp, orig...)
+
+	ip := make([]byte, 40, 40+len(icmp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], uint16(len(icmp)))
+	ip[6] = protoICMP6
+	ip[7] = 64
+	copy(ip[8:24], pkt[24:40])
+	copy(ip[24:40], pkt[8:24])
+	binary.BigEndian.PutUint16(icmp[2:4], icmp6Checksum(ip, icmp))
+	return append(ip, icmp...)
+}
+
+// icmp6Checksum is checksum of icmpv6 msg
+// with the pseudo header of ipv6 header ip
+func icmp6Checksum(ip, msg []byte) uint16 {
+	pseudo := make([]byte, 40, 40+len(msg))
+	copy(pseudo[0:32], ip[8:40])
+	binary.BigEndian.PutUint32(pseudo[32:36], uint32(len(msg)))
+	pseudo[39] = protoICMP6
+	return checksum(append(pseudo, msg...))
+}
+
+// checksum is the internet checksum, rfc1071
+func checksum(buf []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(buf); i += 2 {
+		sum += uint32(buf[i])<<8 | uint32(buf[i+1])
+	}
+	if len(buf)%2 == 1 {
+		sum += uint32(buf[len(buf)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// ptb builds an icmp frag needed for udp datagram sport => dst
+func ptb(sport int, dst string, dport, mtu int) []byte {
+	orig := ipPacket("192.168.0.1", dst)
+	orig[9] = protoUDP
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], uint16(sport))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dport))
+
+	msg := make([]byte, 8)
+	msg[0] = icmpDstUnreach
+	msg[1] = icmpFragNeeded
+	binary.BigEndian.PutUint16(msg[6:8], uint16(mtu))
+	msg = append(msg, orig...)
+	return append(msg, udp...)
+}
+
+func TestPTBLowersPeerMTU(t *testing.T) {
+	s := NewServer("", "key", nil)
+	s.conn = listenLocal(t)
+	defer s.conn.Close()
+	port := s.conn.LocalAddr().(*net.UDPAddr).Port
+	peer := "1.1.1.1:58423"
+
+	if mtu := s.PeerMTU(peer); mtu != 0 {
+		t.Fatalf("expected unknown mtu, got %d", mtu)
+	}
+
+	s.onICMP(ptb(port, "1.1.1.1", 58423, 1300))
+	if mtu := s.PeerMTU(peer); mtu != 1300 {
+		t.Fatalf("expected mtu 1300, got %d", mtu)
+	}
+
+	// ptb never raises mtu
+	s.onICMP(ptb(port, "1.1.1.1", 58423, 1400))
+	// mtu too low
+	s.onICMP(ptb(port, "1.1.1.1", 58423, 100))
+	// not our socket
+	s.onICMP(ptb(port+1, "1.1.1.1", 58423, 1000))
+	if mtu := s.PeerMTU(peer); mtu != 1300 {
+		t.Fatalf("expected mtu 1300, got %d", mtu)
+	}
+
+	if mtu := s.PeerMTU("2.2.2.2:58423"); mtu != 0 {
+		t.Fatalf("other peer affected, mtu %d", mtu)
+	}
+}
+
+func TestPTBToSender(t *testing.T) {
+	tun := newFakeTun("tun")
+	s := NewServer("", "key", nil)
+	s.AddInterface(0, &Interface{tun: tun})
+	s.peerConns[0] = map[string]*peerConn{
+		"10.0.0.0/24": newPeerConn("127.0.0.1:58423", "10.0.0.0/24"),
+	}
+	s.pmtu.lower("127.0.0.1:58423", 1300)
+
+	pkt := make([]byte, 1400)
+	copy(pkt, ipPacket("10.0.1.1", "10.0.0.5"))
+	pkt[6] = 0x40
+	tr := &shortTransport{max: 1 << 16}
+	s.forwardLocal(tr, 0, pkt)
+	if len(tr.written) != 0 {
+		t.Fatalf("packet exceeds path mtu sent")
+	}
+
+	select {
+	case reply := <-tun.out:
+		p := Packet(reply)
+		if p.Src() != "10.0.0.5" || p.Dst() != "10.0.1.1" || reply[9] != protoICMP {
+			t.Fatalf("unexpected reply %s => %s proto %d", p.Src(), p.Dst(), reply[9])
+		}
+		if checksum(reply[:20]) != 0 || checksum(reply[20:]) != 0 {
+			t.Fatalf("bad checksum")
+		}
+		// raw encap carries the secret
+		expect := 1300 - udpOverhead - len("key")
+		if mtu := int(binary.BigEndian.Uint16(reply[26:28])); mtu != expect {
+			t.Fatalf("expected inner mtu %d, got %d", expect, mtu)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ptb not replied")
+	}
+
+	// packets without DF are left to fragmentation
+	pkt[6] = 0
+	s.forwardLocal(tr, 0, pkt)
+	if len(tr.written) == 0 {
+		t.Fatalf("packet without DF not sent")
+	}
+}
+
+func TestPTBToSenderV6(t *testing.T) {
+	tun := newFakeTun("tun")
+	s := NewServer("", "key", nil)
+	s.AddInterface(0, &Interface{tun: tun})
+	s.peerConns[0] = map[string]*peerConn{
+		"fd00:0:0:1::/64": newPeerConn("127.0.0.1:58423", "fd00:0:0:1::/64"),
+	}
+
+	// routed by the ipv6 destination
+	small := ipPacket("fd00::5", "fd00:0:0:1::5")
+	tr := &shortTransport{max: 1 << 16}
+	s.forwardLocal(tr, 0, small)
+	if len(tr.written) == 0 {
+		t.Fatalf("ipv6 packet not routed to peer")
+	}
+
+	// ipv6 has no DF, any packet over path mtu gets a ptb
+	s.pmtu.lower("127.0.0.1:58423", 1300)
+	pkt := make([]byte, 1400)
+	copy(pkt, small)
+	tr.written = nil
+	s.forwardLocal(tr, 0, pkt)
+	if len(tr.written) != 0 {
+		t.Fatalf("packet exceeds path mtu sent")
+	}
+
+	select {
+	case reply := <-tun.out:
+		p := Packet(reply)
+		if p.Version() != 6 || p.Src() != "fd00:0:0:1::5" || p.Dst() != "fd00::5" || reply[6] != protoICMP6 {
+			t.Fatalf("unexpected reply %s => %s next header %d", p.Src(), p.Dst(), reply[6])
+		}
+		icmp := reply[40:]
+		if icmp[0] != icmp6PacketTooBig || icmp6Checksum(reply[:40], icmp) != 0 {
+			t.Fatalf("bad packet too big type %d", icmp[0])
+		}
+		if len(icmp) != 8+icmp6MaxOrig {
+			t.Fatalf("expected original packet truncated, got %d", len(icmp))
+		}
+		expect := 1300 - udpOverhead - len("key")
+		if mtu := int(binary.BigEndian.Uint32(icmp[4:8])); mtu != expect {
+			t.Fatalf("expected inner mtu %d, got %d", expect, mtu)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ptb not replied")
+	}
+
+	// host unreachable of a held down peer
+	reply := Packet(icmpUnreach(small, icmpHostUnreach, 0))
+	if reply[6] != protoICMP6 || reply[40] != icmp6DstUnreach || reply[41] != icmp6AddrUnreach {
+		t.Fatalf("unexpected unreachable %v", reply[:42])
+	}
+}
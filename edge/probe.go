@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// IsUp returns whether the tun device is up
+func (iface *Interface) IsUp() bool {
+	ifi, err := net.InterfaceByName(iface.tun.Name())
+	if err != nil {
+		return false
+	}
+	return ifi.Flags&net.FlagUp != 0
+}
+
+// Live returns nil if every tun device is up
+func (s *Server) Live() error {
+	for vni, iface := range s.ifaces {
+		if !iface.IsUp() {
+			return fmt.Errorf("interface %s of vni %d is down", iface.tun.Name(), vni)
+		}
+	}
+	return nil
+}
+
+// Ready returns nil if edge is connected to controller
+// and every peer received is installed
+func (s *Server) Ready() error {
+	if s.registry != nil && !s.registry.Connected() {
+		return fmt.Errorf("controller disconnected")
+	}
+
+	if n := len(s.FailedPeers()); n > 0 {
+		return fmt.Errorf("%d peers not installed", n)
+	}
+	return nil
+}
+
+// onHealthz is the liveness probe
+func (a *Admin) onHealthz(w http.ResponseWriter, r *http.Request) {
+	probe(w, a.server.Live())
+}
+
+// onReadyz is the readiness probe
+func (a *Admin) onReadyz(w http.ResponseWriter, r *http.Request) {
+	probe(w, a.server.Ready())
+}
+
+func probe(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
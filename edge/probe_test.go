@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestReadinessFollowsController(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	// controller accepts registration then hangs up on demand
+	hangup := make(chan struct{})
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req := codec.RegisterReq{}
+		if err := codec.ReadJSON(conn, &req); err != nil {
+			return
+		}
+		codec.WriteJSON(conn, codec.CmdRegister, &codec.RegisterReply{})
+		<-hangup
+	}()
+
+	s := NewServer("", "key", nil)
+	s.SetRouteManager(newFakeRoutes())
+	r := NewRegistry(lis.Addr().String(), "default", "key", "edge1", s)
+	s.SetRegistry(r)
+	admin := NewAdmin("", s)
+
+	readyz := func() int {
+		w := httptest.NewRecorder()
+		admin.mux.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code
+	}
+
+	waitReady := func(expect int) {
+		deadline := time.Now().Add(time.Second * 2)
+		for readyz() != expect && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if code := readyz(); code != expect {
+			t.Fatalf("expected readyz %d, got %d", expect, code)
+		}
+	}
+
+	waitReady(http.StatusServiceUnavailable)
+	go r.run(lis.Addr().String())
+	waitReady(http.StatusOK)
+
+	// peer waiting for retry is not ready
+	s.failedMu.Lock()
+	s.failed["0/10.0.0.0/24"] = &failedPeer{peer: &codec.Edge{Cidr: "10.0.0.0/24"}}
+	s.failedMu.Unlock()
+	waitReady(http.StatusServiceUnavailable)
+	s.forgetPeer(&codec.Edge{Cidr: "10.0.0.0/24"})
+	waitReady(http.StatusOK)
+
+	close(hangup)
+	waitReady(http.StatusServiceUnavailable)
+}
+
+func TestLivenessIfaceDown(t *testing.T) {
+	s := NewServer("", "key", nil)
+	admin := NewAdmin("", s)
+	healthz := func() int {
+		w := httptest.NewRecorder()
+		admin.mux.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		return w.Code
+	}
+
+	if code := healthz(); code != http.StatusOK {
+		t.Fatalf("expected healthz 200 without iface, got %d", code)
+	}
+
+	// loopback is always up, fake device does not exist
+	s.AddInterface(0, &Interface{tun: newFakeTun("lo")})
+	if code := healthz(); code != http.StatusOK {
+		t.Fatalf("expected healthz 200 with lo, got %d", code)
+	}
+	s.AddInterface(1, &Interface{tun: newFakeTun("cframe.none")})
+	if code := healthz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected healthz 503 with missing iface, got %d", code)
+	}
+}
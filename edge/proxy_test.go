@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// mockSocks5 accepts no auth CONNECT to ipv4 targets,
+// connected targets are sent to targets
+func mockSocks5(t *testing.T, targets chan<- string) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				greet := make([]byte, 3)
+				if _, err := io.ReadFull(conn, greet); err != nil {
+					return
+				}
+				conn.Write([]byte{0x05, 0x00})
+
+				req := make([]byte, 10)
+				if _, err := io.ReadFull(conn, req); err != nil || req[3] != 0x01 {
+					return
+				}
+				target := net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(req[8:10]))))
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				targets <- target
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+				relay(conn, upstream)
+			}(conn)
+		}
+	}()
+	return lis
+}
+
+// mockHTTPProxy accepts CONNECT
+func mockHTTPProxy(t *testing.T, targets chan<- string) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer upstream.Close()
+				targets <- req.Host
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				relay(conn, upstream)
+			}(conn)
+		}
+	}()
+	return lis
+}
+
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(a, b); done <- struct{}{} }()
+	go func() { io.Copy(b, a); done <- struct{}{} }()
+	<-done
+}
+
+func TestTCPTransportOverProxy(t *testing.T) {
+	for _, scheme := range []string{"socks5", "http"} {
+		targets := make(chan string, 1)
+		var proxy net.Listener
+		if scheme == "socks5" {
+			proxy = mockSocks5(t, targets)
+		} else {
+			proxy = mockHTTPProxy(t, targets)
+		}
+
+		// b receives over tcp
+		btun := newFakeTun("b")
+		b := NewServer("", "key", nil)
+		b.AddInterface(0, &Interface{tun: btun})
+		b.conn = listenLocal(t)
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go b.serveTCP(lis)
+
+		// a sends over tcp through proxy
+		atun := newFakeTun("a")
+		a := NewServer("", "key", nil)
+		a.AddInterface(0, &Interface{tun: atun})
+		if err := a.SetTransport(transportTCP, scheme+"://"+proxy.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		a.peerConns[0] = map[string]*peerConn{
+			"10.0.0.0/24": newPeerConn(lis.Addr().String(), "10.0.0.0/24"),
+		}
+		go a.readLocal(newTCPTransport(a.dialer, 58423), 0, a.ifaces[0])
+
+		atun.in <- ipPacket("10.0.1.1", "10.0.0.5")
+		select {
+		case pkt := <-btun.out:
+			if Packet(pkt).Dst() != "10.0.0.5" {
+				t.Fatalf("%s: unexpected packet to %s", scheme, Packet(pkt).Dst())
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("%s: packet not forwarded over proxy", scheme)
+		}
+
+		if target := <-targets; target != lis.Addr().String() {
+			t.Fatalf("%s: proxy connected to %s", scheme, target)
+		}
+		lis.Close()
+		proxy.Close()
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+// events pending for the consumer, newer events are dropped once full
+const reachEventQueue = 64
+
+// ReachEvent is a cidr becoming unreachable once no live peer
+// covers it, or reachable again once one of its peers is back
+type ReachEvent struct {
+	Vni       uint32    `json:"vni"`
+	Cidr      string    `json:"cidr"`
+	Reachable bool      `json:"reachable"`
+	Time      time.Time `json:"time"`
+}
+
+var (
+	cidrReachable = metrics.NewGaugeVec("cframe_edge_cidr_reachable",
+		"1 if a live peer covers the cidr, 0 if none", "cidr")
+	cidrUnreachable = metrics.NewCounter("cframe_edge_cidr_unreachable_total",
+		"times a cidr lost its last live peer")
+)
+
+// reachability of cidrs of peers by health check,
+// key: cidr, prefixed by vni if not 0
+type reachState struct {
+	mu     sync.Mutex
+	state  map[string]bool
+	events chan *ReachEvent
+}
+
+func newReachState() *reachState {
+	return &reachState{
+		state:  make(map[string]bool),
+		events: make(chan *ReachEvent, reachEventQueue),
+	}
+}
+
+func reachKey(vni uint32, cidr string) string {
+	if vni == 0 {
+		return cidr
+	}
+	return fmt.Sprintf("%d:%s", vni, cidr)
+}
+
+// ReachEvents returns changes of cidr reachability, events
+// are dropped if not consumed
+func (s *Server) ReachEvents() <-chan *ReachEvent {
+	return s.reach.events
+}
+
+// checkReach emits events of cidrs whose reachability changed,
+// a cidr is reachable if primary, standby or any path is up
+func (s *Server) checkReach(now time.Time) {
+	type cidrPeers struct {
+		vni   uint32
+		cidr  string
+		addrs []string
+	}
+	cidrs := make([]cidrPeers, 0)
+	s.mu.RLock()
+	for vni, peers := range s.peerConns {
+		for cidr, p := range peers {
+			c := cidrPeers{vni: vni, cidr: cidr}
+			for _, addr := range []string{p.addr, p.standby} {
+				if len(addr) > 0 {
+					c.addrs = append(c.addrs, addr)
+				}
+			}
+			for _, path := range p.paths {
+				c.addrs = append(c.addrs, path.addr)
+			}
+			cidrs = append(cidrs, c)
+		}
+	}
+	s.mu.RUnlock()
+
+	r := s.reach
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := make(map[string]struct{})
+	for _, c := range cidrs {
+		live := false
+		for _, addr := range c.addrs {
+			if s.health.upAt(addr, now) {
+				live = true
+				break
+			}
+		}
+
+		key := reachKey(c.vni, c.cidr)
+		seen[key] = struct{}{}
+		prev, ok := r.state[key]
+		r.state[key] = live
+		if live {
+			cidrReachable.Set(key, 1)
+		} else {
+			cidrReachable.Set(key, 0)
+		}
+		// new cidrs are reachable until their peers are down
+		if (ok && prev == live) || (!ok && live) {
+			continue
+		}
+
+		if live {
+			log.Info("cidr %s reachable", key)
+		} else {
+			log.Warn("cidr %s unreachable, no live peer of %v", key, c.addrs)
+			cidrUnreachable.Inc()
+		}
+		select {
+		case r.events <- &ReachEvent{Vni: c.vni, Cidr: c.cidr, Reachable: live, Time: now}:
+		default:
+			log.Warn("reachability event of %s dropped", key)
+		}
+	}
+
+	for key := range r.state {
+		if _, ok := seen[key]; !ok {
+			delete(r.state, key)
+			cidrReachable.Delete(key)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestReachEvents(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+	s.SetHealthCheck(time.Second, 1)
+	s.conn = listenLocal(t)
+	only, primary, standby := "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: only})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: primary})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: standby, Standby: true})
+
+	// standby of 10.0.2.0/24 answers, the only peer of 10.0.1.0/24 does not
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		s.checkPeers(now)
+		s.health.onPong(standby, now)
+		now = now.Add(time.Second)
+	}
+	s.checkPeers(now)
+
+	select {
+	case evt := <-s.ReachEvents():
+		if evt.Cidr != "10.0.1.0/24" || evt.Reachable {
+			t.Fatalf("unexpected event %+v", evt)
+		}
+	default:
+		t.Fatalf("no unreachable event")
+	}
+	select {
+	case evt := <-s.ReachEvents():
+		t.Fatalf("unexpected event %+v", evt)
+	default:
+	}
+	if v, _ := cidrReachable.Value("10.0.1.0/24"); v != 0 {
+		t.Fatalf("expected 10.0.1.0/24 unreachable in metrics")
+	}
+	if v, _ := cidrReachable.Value("10.0.2.0/24"); v != 1 {
+		t.Fatalf("expected 10.0.2.0/24 reachable in metrics")
+	}
+
+	// the peer comes back
+	s.health.onPong(only, now)
+	s.checkReach(now)
+	select {
+	case evt := <-s.ReachEvents():
+		if evt.Cidr != "10.0.1.0/24" || !evt.Reachable {
+			t.Fatalf("unexpected event %+v", evt)
+		}
+	default:
+		t.Fatalf("no reachable event")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// RebuildResult is the routes a flush and rebuild removed and added,
+// formatted as cidr dev
+type RebuildResult struct {
+	Removed []string `json:"removed"`
+	Added   []string `json:"added"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// RebuildRoutes flushes routes of cframe devices from os routing table
+// and installs routes of current peers again, so drift between memory
+// and os is fixed. the connected route of a device is kept.
+// without route listing only routes recorded as installed are removed
+func (s *Server) RebuildRoutes() (*RebuildResult, error) {
+	if !s.routeInstall() {
+		return nil, fmt.Errorf("route install disabled")
+	}
+	s.rebuildMu.Lock()
+	defer s.rebuildMu.Unlock()
+
+	result := &RebuildResult{Removed: make([]string, 0), Added: make([]string, 0)}
+	fail := func(format string, args ...interface{}) {
+		err := fmt.Errorf(format, args...)
+		log.Error("rebuild routes: %v", err)
+		AddErrorLog(err)
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	// flush
+	flush := make([]osRoute, 0)
+	lister, ok := s.routes.(RouteLister)
+	for _, iface := range s.ifaces {
+		if !ok {
+			break
+		}
+		dev := iface.tun.Name()
+		routes, err := lister.ListRoutes(dev)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range routes {
+			if !connectedRoute(r, iface.Addr()) {
+				flush = append(flush, routeOf(r, dev))
+			}
+		}
+	}
+
+	s.installed.mu.Lock()
+	for r := range s.installed.routes {
+		if !ok {
+			flush = append(flush, r)
+		}
+		delete(s.installed.routes, r)
+	}
+	osRoutesInstalled.Set(0)
+	s.installed.mu.Unlock()
+	if s.aggregator != nil {
+		s.aggregator.reset()
+	}
+
+	for _, r := range flush {
+		if err := s.routes.DelRoute(r.cidr, r.dev); err != nil {
+			fail("remove %s dev %s: %v", r.cidr, r.dev, err)
+			continue
+		}
+		log.Info("rebuild routes: removed %s dev %s", r.cidr, r.dev)
+		result.Removed = append(result.Removed, fmt.Sprintf("%s dev %s", r.cidr, r.dev))
+	}
+
+	// rebuild from peers
+	type want struct{ peer, cidr, dev string }
+	wants := make([]want, 0)
+	s.mu.RLock()
+	for vni, peers := range s.peerConns {
+		iface := s.ifaces[vni]
+		if iface == nil {
+			continue
+		}
+		for cidr, pc := range peers {
+			peer := pc.addr
+			if len(peer) == 0 {
+				peer = pc.standby
+			}
+			wants = append(wants, want{peer, cidr, iface.tun.Name()})
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, w := range wants {
+		if err := s.installRoute(w.peer, w.cidr, w.dev); err != nil {
+			fail("install %s dev %s: %v", w.cidr, w.dev, err)
+			continue
+		}
+		log.Info("rebuild routes: added %s dev %s", w.cidr, w.dev)
+		result.Added = append(result.Added, fmt.Sprintf("%s dev %s", w.cidr, w.dev))
+	}
+
+	log.Info("rebuild routes done, %d removed, %d added, %d errors",
+		len(result.Removed), len(result.Added), len(result.Errors))
+	return result, nil
+}
+
+// connectedRoute reports whether route is the network of the device
+// address or an ipv6 link local route, which the kernel owns
+func connectedRoute(route, addr string) bool {
+	_, ipnet, err := net.ParseCIDR(route)
+	if err != nil {
+		return false
+	}
+	if ipnet.IP.IsLinkLocalUnicast() {
+		return true
+	}
+	_, local, err := net.ParseCIDR(addr)
+	return err == nil && local.String() == ipnet.String()
+}
+
+// reset forgets summary routes, they are flushed from os
+func (a *routeAggregator) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cidrs = make(map[string]map[string]map[string]struct{})
+	a.summary = make(map[string]map[string][]string)
+	a.refs = make(map[string]map[string]int)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestRebuildRoutes(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"})
+
+	// drift: a stale route left in os and a peer route lost
+	routes.mu.Lock()
+	routes.routes["cframe.0"]["10.0.9.0/24"] = struct{}{}
+	delete(routes.routes["cframe.0"], "10.0.2.0/24")
+	routes.mu.Unlock()
+
+	result, err := s.RebuildRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors) != 0 {
+		t.Fatalf("unexpected errors %v", result.Errors)
+	}
+	sort.Strings(result.Added)
+	if expect := []string{"10.0.1.0/24 dev cframe.0", "10.0.2.0/24 dev cframe.0"}; !reflect.DeepEqual(result.Added, expect) {
+		t.Fatalf("expected added %v, got %v", expect, result.Added)
+	}
+	sort.Strings(result.Removed)
+	if expect := []string{"10.0.1.0/24 dev cframe.0", "10.0.9.0/24 dev cframe.0"}; !reflect.DeepEqual(result.Removed, expect) {
+		t.Fatalf("expected removed %v, got %v", expect, result.Removed)
+	}
+
+	got, _ := routes.ListRoutes("cframe.0")
+	sort.Strings(got)
+	if expect := []string{"10.0.1.0/24", "10.0.2.0/24"}; !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected os routes %v, got %v", expect, got)
+	}
+	if missing, err := s.Reconcile(); err != nil || len(missing) != 0 {
+		t.Fatalf("unexpected reconcile %v %v", missing, err)
+	}
+
+	// rebuilt routes are recorded and removed with their peers
+	s.DelPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"})
+	got, _ = routes.ListRoutes("cframe.0")
+	if expect := []string{"10.0.1.0/24"}; !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected os routes %v, got %v", expect, got)
+	}
+}
+
+func TestRebuildRoutesAggregate(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.SetAggregate(true)
+	s.AddPeer(&codec.Edge{Cidr: "10.0.0.0/24", ListenAddr: "1.1.1.1:58423"})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"})
+
+	routes.mu.Lock()
+	routes.routes["cframe.0"] = map[string]struct{}{"10.0.9.0/24": {}}
+	routes.mu.Unlock()
+
+	if _, err := s.RebuildRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := routes.ListRoutes("cframe.0")
+	if expect := []string{"10.0.0.0/23"}; !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected os routes %v, got %v", expect, got)
+	}
+}
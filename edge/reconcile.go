@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// RouteLister lists routes installed to dev,
+// route manager implementing it supports reconciliation
+type RouteLister interface {
+	ListRoutes(dev string) ([]string, error)
+}
+
+// missingRoute is a peer route not found in os routing table
+type missingRoute struct {
+	Vni  uint32
+	Cidr string
+	Dev  string
+}
+
+func (r *missingRoute) String() string {
+	return fmt.Sprintf("vni %d route %s dev %s not installed", r.Vni, r.Cidr, r.Dev)
+}
+
+// Reconcile compares peer routes with routes in os routing table
+// and reports routes missing in os
+func (s *Server) Reconcile() ([]*missingRoute, error) {
+	if !s.routeInstall() {
+		return nil, nil
+	}
+	lister, ok := s.routes.(RouteLister)
+	if !ok {
+		return nil, fmt.Errorf("route manager does not support listing routes")
+	}
+
+	missing := make([]*missingRoute, 0)
+	for vni, iface := range s.ifaces {
+		dev := iface.tun.Name()
+		routes, err := lister.ListRoutes(dev)
+		if err != nil {
+			return nil, err
+		}
+
+		installed := make([]*net.IPNet, 0, len(routes))
+		for _, r := range routes {
+			if _, ipnet, err := net.ParseCIDR(hostCIDR(r)); err == nil {
+				installed = append(installed, ipnet)
+			}
+		}
+
+		// peer route may be covered by an aggregated route
+		s.mu.RLock()
+		for cidr := range s.peerConns[vni] {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				continue
+			}
+
+			if !coveredBy(ipnet, installed) {
+				missing = append(missing, &missingRoute{Vni: vni, Cidr: ipnet.String(), Dev: dev})
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	for _, m := range missing {
+		log.Warn("reconcile: %s", m)
+		AddErrorLog(fmt.Errorf("reconcile: %s", m))
+	}
+	log.Info("reconcile routes done, %d missing", len(missing))
+	return missing, nil
+}
+
+func coveredBy(ipnet *net.IPNet, routes []*net.IPNet) bool {
+	ones, _ := ipnet.Mask.Size()
+	for _, r := range routes {
+		rones, _ := r.Mask.Size()
+		if rones <= ones && r.Contains(ipnet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *cmdRouteManager) ListRoutes(dev string) ([]string, error) {
+	routes, err := m.listRoutes(dev)
+	if err != nil || !m.hasInet6(dev) {
+		return routes, err
+	}
+
+	routes6, err := m.listRoutes6(dev)
+	if err != nil {
+		return nil, err
+	}
+	return append(routes, routes6...), nil
+}
+
+func (m *cmdRouteManager) listRoutes(dev string) ([]string, error) {
+	if table, ok := m.tables[dev]; ok {
+		out, err := execCmd("ip", []string{"-4", "route", "show", "table", strconv.Itoa(table), "dev", dev})
+		if err != nil {
+			return nil, fmt.Errorf("ip route show table %d dev %s, %s %v", table, dev, out, err)
+		}
+		return parseIPRoute(strings.NewReader(out))
+	}
+
+	fp, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return parseProcRoute(fp, dev)
+}
+
+func (m *cmdRouteManager) listRoutes6(dev string) ([]string, error) {
+	if table, ok := m.tables[dev]; ok {
+		out, err := execCmd("ip", []string{"-6", "route", "show", "table", strconv.Itoa(table), "dev", dev})
+		if err != nil {
+			return nil, fmt.Errorf("ip -6 route show table %d dev %s, %s %v", table, dev, out, err)
+		}
+		return parseIPRoute(strings.NewReader(out))
+	}
+
+	fp, err := os.Open("/proc/net/ipv6_route")
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return parseProcRoute6(fp, dev)
+}
+
+// parseProcRoute parses ipv4 routes of dev in /proc/net/route format
+// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+// destination and mask are hex of network order bytes
+func parseProcRoute(r io.Reader, dev string) ([]string, error) {
+	routes := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[0] != dev {
+			continue
+		}
+
+		dst, err := strconv.ParseUint(fields[1], 16, 32)
+		if err != nil {
+			continue
+		}
+		mask, err := strconv.ParseUint(fields[7], 16, 32)
+		if err != nil {
+			continue
+		}
+
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(dst))
+		routes = append(routes, fmt.Sprintf("%s/%d", ip, bits.OnesCount32(uint32(mask))))
+	}
+	return routes, scanner.Err()
+}
+
+// parseProcRoute6 parses inet6 routes of dev in /proc/net/ipv6_route format
+// Destination PrefixLen Source SrcPrefixLen NextHop Metric RefCnt Use Flags Iface
+// destination is 32 hex digits, prefix length is hex
+func parseProcRoute6(r io.Reader, dev string) ([]string, error) {
+	routes := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[9] != dev {
+			continue
+		}
+
+		dst, err := hex.DecodeString(fields[0])
+		if err != nil || len(dst) != net.IPv6len {
+			continue
+		}
+		ones, err := strconv.ParseUint(fields[1], 16, 8)
+		if err != nil || ones > 128 {
+			continue
+		}
+		routes = append(routes, fmt.Sprintf("%s/%d", net.IP(dst), ones))
+	}
+	return routes, scanner.Err()
+}
+
+// parseIPRoute parses output of ip route show dev, eg:
+// 10.0.0.0/24 scope link
+// 10.0.1.1 scope link
+// fd00:1::/64 metric 1024 pref medium
+func parseIPRoute(r io.Reader) ([]string, error) {
+	routes := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(hostCIDR(fields[0]))
+		if err != nil {
+			continue
+		}
+		routes = append(routes, ipnet.String())
+	}
+	return routes, scanner.Err()
+}
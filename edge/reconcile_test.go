@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestReconcileMissingRoute(t *testing.T) {
+	routes := newFakeRoutes()
+	routes.omit["10.0.2.0/24"] = true
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.AddPeers([]*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"},
+		{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"},
+		{Cidr: "10.0.3.1", ListenAddr: "3.3.3.3:58423"},
+	})
+
+	missing, err := s.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 {
+		t.Fatalf("expected 1 missing route, got %v", missing)
+	}
+	if m := missing[0]; m.Cidr != "10.0.2.0/24" || m.Dev != "cframe.0" || m.Vni != 0 {
+		t.Fatalf("unexpected missing route %s", m)
+	}
+}
+
+func TestParseProcRoute(t *testing.T) {
+	table := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0100A8C0	0003	0	0	0	00000000	0	0	0
+cframe.0	0001000A	00000000	0001	0	0	0	00FFFFFF	0	0	0
+cframe.0	0103000A	00000000	0005	0	0	0	FFFFFFFF	0	0	0
+`
+	routes, err := parseProcRoute(strings.NewReader(table), "cframe.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(routes)
+	expect := []string{"10.0.1.0/24", "10.0.3.1/32"}
+	if !reflect.DeepEqual(routes, expect) {
+		t.Fatalf("expected %v, got %v", expect, routes)
+	}
+}
+
+func TestParseProcRoute6(t *testing.T) {
+	table := `fd000000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+fd000001000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000400 00000001 00000000 00000001 cframe.0
+fd000002000000000000000000000001 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000400 00000001 00000000 00000001 cframe.0
+`
+	routes, err := parseProcRoute6(strings.NewReader(table), "cframe.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"fd00:1::/64", "fd00:2::1/128"}
+	if !reflect.DeepEqual(routes, expect) {
+		t.Fatalf("expected %v, got %v", expect, routes)
+	}
+
+	routes, err = parseIPRoute(strings.NewReader("fd00:1::/64 metric 1024 pref medium\nfd00:2::1 metric 1024 pref medium\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(routes, expect) {
+		t.Fatalf("expected %v, got %v", expect, routes)
+	}
+}
+
+func TestRoutesStatus(t *testing.T) {
+	routes := newFakeRoutes()
+	routes.fail["10.0.2.0/24"] = fmt.Errorf("SIOCADDRT: Network is unreachable")
+	routes.omit["10.0.3.1"] = true
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.SetHealthCheck(time.Second, 1)
+	s.AddPeers([]*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"},
+		{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"},
+		{Cidr: "10.0.3.1", ListenAddr: "3.3.3.3:58423"},
+	})
+
+	// 1.1.1.1 answers pings, 3.3.3.3 lost one
+	now := time.Now()
+	s.health.onPing("1.1.1.1:58423", "1.1.1.1:58423", now)
+	s.health.onPong("1.1.1.1:58423", now)
+	s.health.onPing("3.3.3.3:58423", "3.3.3.3:58423", now)
+	s.health.onPing("3.3.3.3:58423", "3.3.3.3:58423", now.Add(time.Second))
+
+	status, err := s.Routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 3 {
+		t.Fatalf("expected 3 routes, got %d", len(status))
+	}
+
+	expect := []struct {
+		cidr      string
+		installed bool
+		state     string
+		health    string
+	}{
+		{"10.0.1.0/24", true, "active", "up"},
+		{"10.0.2.0/24", false, "failed", "unknown"},
+		{"10.0.3.1/32", false, "active", "down"},
+	}
+	for i, e := range expect {
+		st := status[i]
+		if st.Cidr != e.cidr || st.Installed != e.installed || st.State != e.state || st.Health != e.health {
+			t.Fatalf("route %d: expected %+v, got %+v", i, e, st)
+		}
+	}
+	if status[1].Error == "" || status[0].Dev != "cframe.0" {
+		t.Fatalf("unexpected status %+v %+v", status[0], status[1])
+	}
+}
+
+func TestReconcileHost6(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.AddPeer(&codec.Edge{Cidr: "fd00::1", ListenAddr: "1.1.1.1:58423"})
+
+	s.mu.RLock()
+	_, ok := s.peerConns[0]["fd00::1/128"]
+	s.mu.RUnlock()
+	if !ok {
+		t.Fatalf("ipv6 host not keyed by /128: %v", s.Peers())
+	}
+	if addr, _ := s.route(0, "", "fd00::1"); addr != "1.1.1.1:58423" {
+		t.Fatalf("expected route to 1.1.1.1:58423, got %s", addr)
+	}
+	// neighbours of the host are not routed to peer
+	if _, err := s.route(0, "", "fd00::2"); err == nil {
+		t.Fatalf("route of ipv6 host wider than the host")
+	}
+
+	missing, err := s.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("unexpected missing routes %v", missing)
+	}
+
+	s.DelPeer(&codec.Edge{Cidr: "fd00::1", ListenAddr: "1.1.1.1:58423"})
+	if s.hasPeer(&codec.Edge{Cidr: "fd00::1/128"}) {
+		t.Fatalf("ipv6 host not deleted")
+	}
+	if installed, _ := routes.ListRoutes("cframe.0"); len(installed) != 0 {
+		t.Fatalf("route of ipv6 host left %v", installed)
+	}
+}
@@ -1,19 +1,34 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ICKelin/cframe/codec"
 	"github.com/ICKelin/cframe/edge/vpc"
+	"github.com/ICKelin/cframe/pkg/version"
 
 	log "github.com/ICKelin/cframe/pkg/logs"
 )
 
+// reconnect backoff, doubled on each failed attempt
+// and reset once registered
+var (
+	reconnectMin = time.Second
+	reconnectMax = time.Second * 30
+)
+
 type Registry struct {
-	srv       string
+	// controllers tried in order, the next one is
+	// used once connection to current one is lost
+	srvs      []string
 	namespace string
 	secret    string
 	name      string
@@ -24,31 +39,185 @@ type Registry struct {
 
 	// report channel
 	reportchan chan struct{}
+
+	// 1 if connected to controller
+	connected int32
+
+	// extra routes configured locally, installed
+	// with routes of the edge record on controller
+	static []*codec.StaticRoute
+
+	// ask controller to compress large messages
+	compress bool
+
+	// controllers are connected over tls if set, see ctrltls.go
+	tls *tls.Config
+
+	// registered once, peers are resynced on later registrations
+	registered bool
+
+	// closed by Close, stops reconnecting
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
+// NewRegistry creates registry of controllers srv,
+// eg: 10.0.0.1:58422,10.0.0.2:58422
 func NewRegistry(srv, ns, secret string, name string, s *Server) *Registry {
+	srvs := make([]string, 0)
+	for _, addr := range strings.Split(srv, ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			srvs = append(srvs, addr)
+		}
+	}
 	return &Registry{
-		srv:        srv,
+		srvs:       srvs,
 		namespace:  ns,
 		secret:     secret,
 		name:       name,
 		server:     s,
 		hbchan:     make(chan struct{}),
 		reportchan: make(chan struct{}),
+		stop:       make(chan struct{}),
 	}
 }
 
+// Close disconnects from controller and stops reconnecting
+func (r *Registry) Close() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
 func (r *Registry) Run() error {
+	if len(r.srvs) == 0 {
+		return fmt.Errorf("no controller")
+	}
+
 	go r.heartbeat()
 	go r.report()
-	for {
-		r.run()
-		time.Sleep(time.Second * 3)
+	backoff := reconnectMin
+	for i := 0; ; i++ {
+		if i > 0 {
+			reconnects.Inc()
+		}
+		select {
+		case <-r.stop:
+			return nil
+		default:
+		}
+		srv := r.srvs[i%len(r.srvs)]
+		err := r.run(srv)
+		if err == nil {
+			backoff = reconnectMin
+		}
+
+		if len(r.srvs) > 1 {
+			log.Warn("controller %s lost, fail over to %s in %v",
+				srv, r.srvs[(i+1)%len(r.srvs)], backoff)
+		}
+		select {
+		case <-r.stop:
+			return nil
+		case <-time.After(backoff):
+		}
+
+		if err != nil {
+			if backoff *= 2; backoff > reconnectMax {
+				backoff = reconnectMax
+			}
+		}
+	}
+}
+
+func (r *Registry) registerReq() *codec.RegisterReq {
+	req := &codec.RegisterReq{
+		Namespace: r.namespace,
+		SecretKey: r.secret,
+		Name:      r.name,
+		Version:   version.Get().String(),
+		TunAddr:   r.tunAddr(),
+		PeerDelta: true,
 	}
+	if r.compress {
+		req.Compress = []string{codec.CompressDeflate}
+	}
+	return req
+}
+
+// SetCompress asks controller to compress peer sets,
+// used only if controller supports it
+func (r *Registry) SetCompress(enabled bool) {
+	r.compress = enabled
 }
 
-func (r *Registry) run() error {
-	conn, err := net.DialTimeout("tcp", r.srv, time.Second*30)
+func (r *Registry) register(conn net.Conn) (*codec.RegisterReply, error) {
+	return r.request(conn, r.registerReq())
+}
+
+func (r *Registry) request(conn net.Conn, req *codec.RegisterReq) (*codec.RegisterReply, error) {
+	err := codec.WriteJSON(conn, codec.CmdRegister, req)
+	if err != nil {
+		registerFailures.Inc()
+		return nil, err
+	}
+
+	reply := &codec.RegisterReply{}
+	err = codec.ReadJSON(conn, reply)
+	if err != nil {
+		registerFailures.Inc()
+		return nil, err
+	}
+	if !req.Query {
+		registrations.Inc()
+	}
+	if len(reply.Compress) > 0 {
+		log.Info("control messages compressed by %s", reply.Compress)
+	}
+	log.Debug("%v", reply)
+	return reply, nil
+}
+
+// FetchPeers queries the first controller available for peers
+// and routes of current edge, the edge is not registered so a
+// running one keeps its session
+func (r *Registry) FetchPeers() ([]*codec.Edge, error) {
+	req := r.registerReq()
+	req.Query = true
+	err := fmt.Errorf("no controller")
+	for _, srv := range r.srvs {
+		var conn net.Conn
+		conn, err = r.dial(srv)
+		if err != nil {
+			continue
+		}
+
+		var reply *codec.RegisterReply
+		reply, err = r.request(conn, req)
+		conn.Close()
+		if err == nil {
+			return replyPeers(reply), nil
+		}
+	}
+	return nil, err
+}
+
+// replyPeers returns peer edges and routes of register reply as peers
+func replyPeers(reply *codec.RegisterReply) []*codec.Edge {
+	peers := make([]*codec.Edge, 0, len(reply.EdgeList)+len(reply.Routes))
+	peers = append(peers, reply.EdgeList...)
+	for _, route := range reply.Routes {
+		peers = append(peers, &codec.Edge{
+			ListenAddr: route.Nexthop,
+			Cidr:       route.CIDR,
+			Vni:        route.Vni,
+		})
+	}
+	return peers
+}
+
+// run registers to controller srv and serves the connection,
+// returns nil once a registered connection is lost
+func (r *Registry) run(srv string) error {
+	conn, err := r.dial(srv)
 	if err != nil {
 		log.Error("%v", err)
 		return err
@@ -56,20 +225,11 @@ func (r *Registry) run() error {
 
 	defer conn.Close()
 
-	reg := codec.RegisterReq{
-		Namespace: r.namespace,
-		SecretKey: r.secret,
-		Name:      r.name,
-	}
-	err = codec.WriteJSON(conn, codec.CmdRegister, &reg)
+	reply, err := r.register(conn)
 	if err != nil {
-		log.Error("write json: %v", err)
+		log.Error("register fail: %v", err)
 		return err
 	}
-
-	reply := &codec.RegisterReply{}
-	codec.ReadJSON(conn, reply)
-	log.Debug("%v", reply)
 	if reply.CSPInfo != nil {
 		instance, err := vpc.GetVPCInstance(reply.CSPInfo.CspType, reply.CSPInfo.AccessKey, reply.CSPInfo.AccessSecret)
 		if err != nil {
@@ -80,26 +240,105 @@ func (r *Registry) run() error {
 		}
 	}
 
-	// add peers route
-	for _, route := range reply.Routes {
-		r.server.AddPeer(&codec.Edge{
-			ListenAddr: route.Nexthop,
-			Cidr:       route.CIDR,
-		})
+	// cidr allocated by controller
+	if len(reply.Cidr) > 0 {
+		err = r.server.SetTunCidr(reply.Cidr)
+		if err != nil {
+			log.Error("set tun address of %s fail: %v", reply.Cidr, err)
+			AddErrorLog(err)
+		}
+	}
+
+	// peers changed while disconnected or known by another
+	// controller are resynced by replacing the peer set
+	if r.registered {
+		log.Info("registered to %s again, resync peers", srv)
+		r.server.SetPeers(replyPeers(reply))
+	} else {
+		// add peers route
+		for _, route := range reply.Routes {
+			r.server.AddPeer(&codec.Edge{
+				ListenAddr: route.Nexthop,
+				Cidr:       route.CIDR,
+				Vni:        route.Vni,
+			})
+		}
+
+		// add peer edge
+		r.server.AddPeers(reply.EdgeList)
 	}
+	r.registered = true
 
-	// add peer edge
-	r.server.AddPeers(reply.EdgeList)
+	// static routes via peers
+	static := make([]*codec.StaticRoute, 0, len(r.static)+len(reply.StaticRoutes))
+	static = append(static, r.static...)
+	static = append(static, reply.StaticRoutes...)
+	r.server.AddStaticRoutes(static, reply.EdgeList)
 
-	go r.read(conn)
-	r.write(conn)
+	// make sure routes are in os routing table
+	_, err = r.server.Reconcile()
+	if err != nil {
+		log.Warn("reconcile routes fail: %v", err)
+	}
+
+	r.setConnected(true)
+	defer r.setConnected(false)
+
+	// writer stops once reader lost the connection,
+	// which is closed once registry is closed
+	done := make(chan struct{})
+	go func() {
+		r.read(conn)
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-r.stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	r.write(conn, done)
 	return nil
 }
 
+// tunAddr reports ip/cidr of the tun device to controller
+func (r *Registry) tunAddr() string {
+	if r.server == nil {
+		return ""
+	}
+	return r.server.TunAddr()
+}
+
+// SetStaticRoutes sets extra routes via peers,
+// peer is resolved by name once registered
+func (r *Registry) SetStaticRoutes(routes []*codec.StaticRoute) {
+	r.static = routes
+}
+
+// Connected returns whether edge is connected to controller
+func (r *Registry) Connected() bool {
+	return atomic.LoadInt32(&r.connected) == 1
+}
+
+func (r *Registry) setConnected(connected bool) {
+	v := int32(0)
+	if connected {
+		v = 1
+	}
+	atomic.StoreInt32(&r.connected, v)
+	controllerConnected.Set(int64(v))
+}
+
 func (r *Registry) report() {
 	tick := time.NewTicker(time.Second * 30)
 	defer tick.Stop()
-	for range tick.C {
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-tick.C:
+		}
 		select {
 		case r.reportchan <- struct{}{}:
 		default:
@@ -111,27 +350,43 @@ func (r *Registry) heartbeat() {
 	tick := time.NewTicker(time.Second * 10)
 	defer tick.Stop()
 
-	for range tick.C {
+	for {
 		select {
-		case r.hbchan <- struct{}{}:
-		default:
+		case <-r.stop:
+			return
+		case <-tick.C:
+			r.tickHeartbeat()
 		}
 	}
 }
 
-func (r *Registry) write(conn net.Conn) {
+// tickHeartbeat asks writer to send heartbeat,
+// heartbeat is missed if writer is not connected
+func (r *Registry) tickHeartbeat() {
+	select {
+	case r.hbchan <- struct{}{}:
+	default:
+		heartbeatsMissed.Inc()
+	}
+}
+
+func (r *Registry) write(conn net.Conn, done <-chan struct{}) {
 	for {
 		select {
+		case <-done:
+			return
 		case <-r.hbchan:
 			log.Debug("send heartbeat to server")
-			hb := &codec.Heartbeat{}
+			hb := &codec.Heartbeat{TunAddr: r.tunAddr()}
 			conn.SetWriteDeadline(time.Now().Add(time.Second * 30))
 			err := codec.WriteJSON(conn, codec.CmdHeartbeat, hb)
 			conn.SetWriteDeadline(time.Time{})
 			if err != nil {
+				heartbeatsMissed.Inc()
 				log.Error("invalid hb msg: %v", err)
 				return
 			}
+			heartbeatsSent.Inc()
 		case <-r.reportchan:
 			report := ResetStat()
 			conn.SetWriteDeadline(time.Now().Add(time.Second * 30))
@@ -145,10 +400,15 @@ func (r *Registry) write(conn net.Conn) {
 }
 
 func (r *Registry) read(conn net.Conn) {
+	if r.server != nil {
+		defer r.server.guard()
+	}
 	for {
 		hdr, body, err := codec.Read(conn)
 		if err != nil {
 			log.Error("read fail: %v", err)
+			r.setConnected(false)
+			conn.Close()
 			return
 		}
 
@@ -167,6 +427,10 @@ func (r *Registry) read(conn net.Conn) {
 			r.server.AddPeer(&codec.Edge{
 				ListenAddr: online.ListenAddr,
 				Cidr:       online.Cidr,
+				Vni:        online.Vni,
+				Standby:    online.Standby,
+				Weight:     online.Weight,
+				Transport:  online.Transport,
 			})
 
 		case codec.CmdDel:
@@ -180,6 +444,9 @@ func (r *Registry) read(conn net.Conn) {
 			r.server.DelPeer(&codec.Edge{
 				ListenAddr: offline.ListenAddr,
 				Cidr:       offline.Cidr,
+				Vni:        offline.Vni,
+				Standby:    offline.Standby,
+				Weight:     offline.Weight,
 			})
 
 		case codec.CmdAddRoute:
@@ -202,6 +469,26 @@ func (r *Registry) read(conn net.Conn) {
 			}
 			r.server.DelRoute(&delRoute)
 
+		case codec.CmdSetPeers:
+			log.Info("set peers cmd: %s", string(body))
+			setPeers := codec.SetPeersMsg{}
+			err := json.Unmarshal(body, &setPeers)
+			if err != nil {
+				log.Error("invalid set peers msg: %v", err)
+				continue
+			}
+			r.server.SetPeers(setPeers.Peers)
+
+		case codec.CmdPeerDelta:
+			log.Info("peer delta cmd: %s", string(body))
+			delta := codec.PeerDeltaMsg{}
+			err := json.Unmarshal(body, &delta)
+			if err != nil {
+				log.Error("invalid peer delta msg: %v", err)
+				continue
+			}
+			r.server.ApplyPeerDelta(delta.Add, delta.Del)
+
 		case codec.CmdExit:
 			log.Warn("receive exit signal")
 			os.Exit(0)
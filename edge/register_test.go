@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	"github.com/ICKelin/cframe/pkg/version"
+)
+
+func TestRegisterReqVersion(t *testing.T) {
+	r := NewRegistry("", "default", "secret", "edge1", nil)
+	req := r.registerReq()
+	if len(req.Version) == 0 || req.Version != version.Get().String() {
+		t.Fatalf("unexpected version in register req: %s", req.Version)
+	}
+}
+
+func TestRegisterReqTunAddr(t *testing.T) {
+	// lo stands in for the tun device
+	s := NewServer("", "key", &Interface{tun: newFakeTun("lo")})
+	r := NewRegistry("", "default", "secret", "edge1", s)
+	if addr := r.registerReq().TunAddr; addr != "127.0.0.1/8" {
+		t.Fatalf("expected tun address 127.0.0.1/8, got %s", addr)
+	}
+}
+
+func TestRegisterReqCompress(t *testing.T) {
+	r := NewRegistry("", "default", "secret", "edge1", nil)
+	if c := r.registerReq().Compress; len(c) != 0 {
+		t.Fatalf("compression offered by default: %v", c)
+	}
+	r.SetCompress(true)
+	if c := r.registerReq().Compress; len(c) != 1 || c[0] != codec.CompressDeflate {
+		t.Fatalf("expected deflate offered, got %v", c)
+	}
+}
+
+func TestRegistryMetrics(t *testing.T) {
+	r := NewRegistry("", "default", "secret", "edge1", nil)
+	edge, ctrl := net.Pipe()
+	defer edge.Close()
+	defer ctrl.Close()
+
+	go func() {
+		req := codec.RegisterReq{}
+		if err := codec.ReadJSON(ctrl, &req); err != nil {
+			return
+		}
+		codec.WriteJSON(ctrl, codec.CmdRegister, &codec.RegisterReply{})
+	}()
+
+	ok, fail := registrations.Value(), registerFailures.Value()
+	if _, err := r.register(edge); err != nil {
+		t.Fatal(err)
+	}
+	if registrations.Value() != ok+1 {
+		t.Fatalf("registration not counted")
+	}
+
+	closed, _ := net.Pipe()
+	closed.Close()
+	if _, err := r.register(closed); err == nil {
+		t.Fatalf("expected register on closed conn fail")
+	}
+	if registerFailures.Value() != fail+1 {
+		t.Fatalf("register failure not counted")
+	}
+
+	// no writer running
+	missed := heartbeatsMissed.Value()
+	r.tickHeartbeat()
+	if heartbeatsMissed.Value() != missed+1 {
+		t.Fatalf("missed heartbeat not counted")
+	}
+
+	sent := heartbeatsSent.Value()
+	go r.write(edge, nil)
+	r.hbchan <- struct{}{}
+	hdr, _, err := codec.Read(ctrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Cmd() != codec.CmdHeartbeat {
+		t.Fatalf("expected heartbeat, got cmd %d", hdr.Cmd())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for heartbeatsSent.Value() != sent+1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if heartbeatsSent.Value() != sent+1 {
+		t.Fatalf("sent heartbeat not counted")
+	}
+}
+
+// mockController replies peers to registrations until closed
+type mockController struct {
+	lis   net.Listener
+	peers []*codec.Edge
+
+	mu    sync.Mutex
+	conns []net.Conn
+	reqs  []*codec.RegisterReq
+}
+
+func newMockController(t *testing.T, peers []*codec.Edge) *mockController {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockController{lis: lis, peers: peers}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			m.mu.Lock()
+			m.conns = append(m.conns, conn)
+			m.mu.Unlock()
+			go func() {
+				req := codec.RegisterReq{}
+				if codec.ReadJSON(conn, &req) != nil {
+					return
+				}
+				m.mu.Lock()
+				m.reqs = append(m.reqs, &req)
+				m.mu.Unlock()
+				codec.WriteJSON(conn, codec.CmdRegister, &codec.RegisterReply{EdgeList: m.peers})
+				// heartbeats are read until closed
+				for {
+					if _, _, err := codec.Read(conn); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return m
+}
+
+func (m *mockController) close() {
+	m.lis.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, conn := range m.conns {
+		conn.Close()
+	}
+}
+
+func TestRegistryFailover(t *testing.T) {
+	oldMin := reconnectMin
+	reconnectMin = time.Millisecond * 10
+	defer func() { reconnectMin = oldMin }()
+
+	c1 := newMockController(t, []*codec.Edge{
+		{Name: "edge2", Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"},
+		{Name: "edge3", Cidr: "10.0.3.0/24", ListenAddr: "3.3.3.3:58423"},
+	})
+	c2 := newMockController(t, []*codec.Edge{
+		{Name: "edge2", Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"},
+		{Name: "edge4", Cidr: "10.0.4.0/24", ListenAddr: "4.4.4.4:58423"},
+	})
+	defer c2.close()
+
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	r := NewRegistry(c1.lis.Addr().String()+","+c2.lis.Addr().String(), "default", "secret", "edge1", s)
+	done := make(chan struct{})
+	go func() {
+		r.Run()
+		close(done)
+	}()
+	defer func() {
+		r.Close()
+		<-done
+	}()
+
+	waitRoutes(t, routes, "cframe.0", []string{"10.0.2.0/24", "10.0.3.0/24"})
+	if !r.Connected() {
+		t.Fatalf("expected connected to first controller")
+	}
+
+	// first controller goes away, peers are resynced from the second
+	c1.close()
+	waitRoutes(t, routes, "cframe.0", []string{"10.0.2.0/24", "10.0.4.0/24"})
+	deadline := time.Now().Add(time.Second)
+	for !r.Connected() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !r.Connected() {
+		t.Fatalf("expected connected to second controller")
+	}
+}
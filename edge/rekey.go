@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// each side rotates the key of packets it sends independently
+//  1. sender picks the next epoch and a random salt, sends reliable
+//     rekey | 1byte epoch | 16bytes salt |
+//  2. receiver derives the key of epoch, accepts both keys
+//     and expires keys of older epochs after the window
+//  3. sender switches to the new epoch once rekey is acked
+const rekeySaltSize = 16
+
+const defaultRekeyWindow = time.Second * 10
+
+type epochKey struct {
+	aead cipher.AEAD
+	// zero means never expire
+	expire time.Time
+}
+
+func (k *epochKey) expired(now time.Time) bool {
+	return !k.expire.IsZero() && now.After(k.expire)
+}
+
+// SetKeyRotation rotates keys of every peer each interval,
+// old key is accepted for window after the new one, 0 disables rotation
+func (s *Server) SetKeyRotation(interval, window time.Duration) {
+	s.rekeyInterval = interval
+	if window > 0 {
+		s.rekeyWindow = window
+	}
+}
+
+func (s *Server) rotateKeys() {
+	defer s.guard()
+	tick := time.NewTicker(s.rekeyInterval)
+	defer tick.Stop()
+	for range tick.C {
+		for _, addr := range s.sessions.addrs() {
+			s.rekey(addr)
+		}
+	}
+}
+
+// epochAEAD derives the send or recv key of epoch of sess from
+// the shared secret and salt, the salt alone reveals nothing
+func (s *Server) epochAEAD(sess *session, salt []byte, send bool) (cipher.AEAD, error) {
+	if send {
+		return deriveAEAD(sess.cipher, s.key, sess.shared, sess.local, sess.remote, salt)
+	}
+	return deriveAEAD(sess.cipher, s.key, sess.shared, sess.remote, sess.local, salt)
+}
+
+// rekey rotates the key of packets sent to addr,
+// done once peer accepts the new key
+func (s *Server) rekey(addr string) <-chan error {
+	done := make(chan error, 1)
+	sess := s.sessions.get(addr)
+	if sess == nil || sess.err != nil || sess.cipher == cipherNone {
+		done <- fmt.Errorf("no encrypted session with %s", addr)
+		return done
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		done <- err
+		return done
+	}
+
+	salt := make([]byte, rekeySaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		done <- err
+		return done
+	}
+
+	aead, err := s.epochAEAD(sess, salt, true)
+	if err != nil {
+		done <- err
+		return done
+	}
+
+	cur, _ := sess.sendKey()
+	epoch := cur + 1
+	payload := append([]byte{epoch}, salt...)
+	go func() {
+		err := <-s.sendCtrl(raddr, ctrlRekey, payload, true)
+		if err != nil {
+			log.Error("rotate key with %s fail: %v", addr, err)
+			AddErrorLog(err)
+			done <- err
+			return
+		}
+
+		sess.setSendKey(epoch, aead)
+		log.Info("rotated key with %s to epoch %d", addr, epoch)
+		done <- nil
+	}()
+	return done
+}
+
+// onRekey accepts key of the new epoch from peer
+func (s *Server) onRekey(from *net.UDPAddr, payload []byte) {
+	if len(payload) != 1+rekeySaltSize {
+		log.Error("invalid rekey from %s", from)
+		return
+	}
+
+	sess := s.sessions.get(from.String())
+	if sess == nil || sess.err != nil || sess.cipher == cipherNone {
+		log.Error("rekey from %s without encrypted session", from)
+		return
+	}
+
+	aead, err := s.epochAEAD(sess, payload[1:], false)
+	if err != nil {
+		log.Error("rekey from %s fail: %v", from, err)
+		AddErrorLog(err)
+		return
+	}
+
+	epoch, now := payload[0], time.Now()
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for e, k := range sess.recv {
+		if k.expired(now) {
+			delete(sess.recv, e)
+			continue
+		}
+		if k.expire.IsZero() {
+			k.expire = now.Add(s.rekeyWindow)
+		}
+	}
+	sess.recv[epoch] = &epochKey{aead: aead}
+	log.Info("accepted key of epoch %d from %s", epoch, from)
+}
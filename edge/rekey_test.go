@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeyRotation(t *testing.T) {
+	tun := newFakeTun("b")
+	a := NewServer("", "key", nil)
+	a.SetCiphers([]string{cipherAES256})
+	b := NewServer("", "key", nil)
+	b.SetCiphers([]string{cipherAES256})
+	b.SetKeyRotation(0, time.Millisecond*300)
+	b.AddInterface(0, &Interface{tun: tun})
+
+	a.conn, b.conn = listenLocal(t), listenLocal(t)
+	go a.readRemote(a.conn)
+	go b.readRemote(b.conn)
+
+	baddr := b.conn.LocalAddr().(*net.UDPAddr)
+	aaddr := a.conn.LocalAddr().String()
+	if err := <-a.handshake(baddr); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for a.sessions.get(baddr.String()) == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	send := func() []byte {
+		data, err := a.encrypt(baddr.String(), ipPacket("10.0.1.1", "10.0.0.5"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.conn.WriteToUDP(a.encap.EncodeData(0, data), baddr); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// count delivered packets
+	delivered := make(chan int)
+	stop := make(chan struct{})
+	go func() {
+		n := 0
+		for {
+			select {
+			case <-tun.out:
+				n++
+			case <-stop:
+				delivered <- n
+				return
+			}
+		}
+	}()
+
+	// keep sending across the rotation
+	old := send()
+	rotated := a.rekey(baddr.String())
+	sent := 1
+	for done := false; !done; sent++ {
+		select {
+		case err := <-rotated:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		default:
+		}
+		send()
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	close(stop)
+	if n := <-delivered; n != sent {
+		t.Fatalf("%d of %d packets delivered across rotation", n, sent)
+	}
+
+	epoch, _ := a.sessions.get(baddr.String()).sendKey()
+	if epoch != 1 || old[1] != 0 {
+		t.Fatalf("expected send epoch 1 after rotation, got %d", epoch)
+	}
+
+	// old key accepted within window only
+	if _, err := b.decrypt(aaddr, old); err != nil {
+		t.Fatalf("old key rejected within window: %v", err)
+	}
+	time.Sleep(time.Millisecond * 400)
+	if _, err := b.decrypt(aaddr, old); err == nil {
+		t.Fatalf("old key accepted after window")
+	}
+	if _, err := b.decrypt(aaddr, send()); err != nil {
+		t.Fatalf("new key rejected: %v", err)
+	}
+}
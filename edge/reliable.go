@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// reliable delivery for control packets only,
+// data packets are never retransmitted
+// | key | 0x00 | 1byte type|0x80 | 4bytes seq | payload |
+// receiver replies ctrlAck carrying seq and drops duplicates
+const ctrlReliable = 0x80
+
+var (
+	defaultCtrlRTO      = time.Millisecond * 200
+	defaultCtrlMaxRetry = 5
+)
+
+type pendingCtrl struct {
+	buf   []byte
+	addr  *net.UDPAddr
+	retry int
+	timer *time.Timer
+	done  chan error
+}
+
+// ctrlKey identifies a reliable control packet by
+// the peer address and seq
+type ctrlKey struct {
+	addr string
+	seq  uint32
+}
+
+type seenCtrl struct {
+	key ctrlKey
+	at  time.Time
+}
+
+type reliable struct {
+	rto      time.Duration
+	maxRetry int
+	encode   func(typ byte, payload []byte) []byte
+	write    func(buf []byte, addr *net.UDPAddr) error
+
+	mu      sync.Mutex
+	seq     uint32
+	pending map[ctrlKey]*pendingCtrl
+
+	// recently received seq and the same in receiving
+	// order, expired from the front
+	seen      map[ctrlKey]bool
+	seenQueue []seenCtrl
+}
+
+func newReliable(rto time.Duration, maxRetry int,
+	encode func(typ byte, payload []byte) []byte,
+	write func(buf []byte, addr *net.UDPAddr) error) *reliable {
+	return &reliable{
+		rto:      rto,
+		maxRetry: maxRetry,
+		encode:   encode,
+		write:    write,
+		pending:  make(map[ctrlKey]*pendingCtrl),
+		seen:     make(map[ctrlKey]bool),
+	}
+}
+
+// send sends control packet and retransmits it until acked,
+// the returned channel receives nil once acked or error after maxRetry
+func (r *reliable) send(addr *net.UDPAddr, typ byte, payload []byte) <-chan error {
+	r.mu.Lock()
+	r.seq++
+	seq := r.seq
+
+	body := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(body, seq)
+	body = append(body, payload...)
+
+	p := &pendingCtrl{
+		buf:  r.encode(typ|ctrlReliable, body),
+		addr: addr,
+		done: make(chan error, 1),
+	}
+	key := ctrlKey{addr.String(), seq}
+	r.pending[key] = p
+	p.timer = time.AfterFunc(r.rto, func() { r.retransmit(key) })
+	r.mu.Unlock()
+
+	err := r.write(p.buf, addr)
+	if err != nil {
+		log.Error("send ctrl %d to %s fail: %v", typ, addr, err)
+	}
+	return p.done
+}
+
+func (r *reliable) retransmit(key ctrlKey) {
+	r.mu.Lock()
+	p, ok := r.pending[key]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+
+	if p.retry >= r.maxRetry {
+		delete(r.pending, key)
+		r.mu.Unlock()
+		p.done <- fmt.Errorf("ctrl seq %d to %s not acked after %d retries",
+			key.seq, p.addr, p.retry)
+		return
+	}
+
+	p.retry++
+	p.timer = time.AfterFunc(r.rto, func() { r.retransmit(key) })
+	r.mu.Unlock()
+
+	log.Debug("retransmit ctrl seq %d to %s", key.seq, p.addr)
+	err := r.write(p.buf, p.addr)
+	if err != nil {
+		log.Error("retransmit ctrl seq %d to %s fail: %v", key.seq, p.addr, err)
+	}
+}
+
+// onAck completes seq sent to addr, acks from
+// other peers than the receiver are ignored
+func (r *reliable) onAck(addr *net.UDPAddr, seq uint32) {
+	key := ctrlKey{addr.String(), seq}
+	r.mu.Lock()
+	p, ok := r.pending[key]
+	if ok {
+		delete(r.pending, key)
+		p.timer.Stop()
+	}
+	r.mu.Unlock()
+
+	if ok {
+		p.done <- nil
+	} else {
+		log.Debug("ack of unknown ctrl seq %d from %s", seq, addr)
+	}
+}
+
+// accept reports whether seq from addr is received at the first time,
+// seq is remembered until the sender stops retransmitting
+func (r *reliable) accept(addr *net.UDPAddr, seq uint32) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	expire := r.rto * time.Duration(r.maxRetry+1)
+	n := 0
+	for ; n < len(r.seenQueue) && now.Sub(r.seenQueue[n].at) > expire; n++ {
+		delete(r.seen, r.seenQueue[n].key)
+	}
+	r.seenQueue = r.seenQueue[n:]
+
+	key := ctrlKey{addr.String(), seq}
+	if r.seen[key] {
+		return false
+	}
+	r.seen[key] = true
+	r.seenQueue = append(r.seenQueue, seenCtrl{key, now})
+	return true
+}
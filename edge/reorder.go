@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+// segments held per flow if reorder depth is not set
+const defaultReorderDepth = 16
+
+// flows without segments held are forgotten once idle for reorderIdle,
+// segments of flows beyond reorderMaxFlows pass through untracked
+var (
+	reorderIdle     = time.Minute
+	reorderMaxFlows = 4096
+)
+
+var (
+	reorderHeld = metrics.NewCounter("cframe_edge_reorder_held_total",
+		"tcp segments held for the missing segments before them")
+	reorderFlushed = metrics.NewCounter("cframe_edge_reorder_flushed_total",
+		"times segments held were delivered with a gap on timeout or full buffer")
+	reorderUntracked = metrics.NewCounter("cframe_edge_reorder_untracked_total",
+		"tcp segments passed through as reorder flows are full")
+)
+
+// reorderer delivers tcp segments from peers to tun in sequence order,
+// a segment after a gap is held until the gap is filled, timeout
+// passes or depth segments of the flow are held.
+// packets other than tcp carry no sequence and pass through
+type reorderer struct {
+	timeout time.Duration
+	depth   int
+
+	// key: vni and tcp 4-tuple
+	mu    sync.Mutex
+	flows map[string]*reorderFlow
+	swept time.Time
+}
+
+type reorderFlow struct {
+	// sequence expected next
+	next uint32
+
+	// held segments sorted by seq, flushed by timer
+	pending []*reorderSeg
+	timer   *time.Timer
+	timerID int
+	seen    time.Time
+}
+
+type reorderSeg struct {
+	seq, end uint32
+	iface    *Interface
+	pkt      []byte
+}
+
+func newReorderer(timeout time.Duration, depth int) *reorderer {
+	if depth <= 0 {
+		depth = defaultReorderDepth
+	}
+	return &reorderer{
+		timeout: timeout,
+		depth:   depth,
+		flows:   make(map[string]*reorderFlow),
+		swept:   time.Now(),
+	}
+}
+
+// SetReorder holds tcp segments received after a gap for up to
+// timeout and at most depth segments per flow, so they reach tun
+// in order, timeout 0 disables reordering
+func (s *Server) SetReorder(timeout time.Duration, depth int) {
+	if timeout <= 0 {
+		s.reorder = nil
+		return
+	}
+	s.reorder = newReorderer(timeout, depth)
+}
+
+// seqBefore compares tcp sequence numbers across wrap around
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// reorderKey returns key of the tcp flow of p and its segment,
+// ok is false if p is not a tcp segment
+func reorderKey(vni uint32, p Packet) (key string, tcp []byte, ok bool) {
+	proto, off := p.transport()
+	if proto != protoTCP || off < 0 || len(p) < off+20 {
+		return "", nil, false
+	}
+	tcp = p[off:]
+	if hlen := int(tcp[12]>>4) * 4; hlen < 20 || len(tcp) < hlen {
+		return "", nil, false
+	}
+
+	var addrs []byte
+	switch p.Version() {
+	case 4:
+		addrs = p[12:20]
+	case 6:
+		addrs = p[8:40]
+	default:
+		return "", nil, false
+	}
+	k := make([]byte, 4, 4+len(addrs)+4)
+	binary.BigEndian.PutUint32(k, vni)
+	k = append(k, addrs...)
+	k = append(k, tcp[:4]...)
+	return string(k), tcp, true
+}
+
+// push delivers pkt to iface, or holds a copy of it until
+// segments before it are delivered, pkt may alias a read buffer
+func (r *reorderer) push(vni uint32, iface *Interface, pkt []byte) {
+	key, tcp, ok := reorderKey(vni, Packet(pkt))
+	if !ok {
+		iface.Write(pkt)
+		return
+	}
+
+	flags := tcp[13]
+	seq := binary.BigEndian.Uint32(tcp[4:8])
+	end := seq + uint32(len(tcp)-int(tcp[12]>>4)*4)
+	if flags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+		end++
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweep(now)
+
+	f := r.flows[key]
+	if f == nil && len(r.flows) >= reorderMaxFlows {
+		// idle flows may be swept early to make room
+		r.swept = time.Time{}
+		r.sweep(now)
+		if len(r.flows) >= reorderMaxFlows {
+			reorderUntracked.Inc()
+			iface.Write(pkt)
+			return
+		}
+	}
+	if f == nil || flags&tcpFlagSYN != 0 {
+		if f != nil {
+			f.flush()
+		}
+		f = &reorderFlow{next: seq}
+		r.flows[key] = f
+	}
+	f.seen = now
+
+	// in order, retransmitted or pure ack
+	if seq == end || !seqBefore(f.next, seq) {
+		iface.Write(pkt)
+		f.advance(end)
+		f.drain()
+		if flags&tcpFlagRST != 0 {
+			f.flush()
+			delete(r.flows, key)
+		}
+		return
+	}
+
+	if len(f.pending) >= r.depth {
+		f.flush()
+		iface.Write(pkt)
+		f.advance(end)
+		return
+	}
+
+	reorderHeld.Inc()
+	f.hold(&reorderSeg{seq: seq, end: end, iface: iface, pkt: handoff(pkt)})
+	if f.timer == nil {
+		f.timerID++
+		id := f.timerID
+		f.timer = time.AfterFunc(r.timeout, func() { r.expire(f, id) })
+	}
+}
+
+// expire delivers segments of f held beyond timeout,
+// timer id tells a stopped timer from the running one
+func (r *reorderer) expire(f *reorderFlow, id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f.timer == nil || f.timerID != id {
+		return
+	}
+	f.timer = nil
+	f.flush()
+}
+
+// sweep forgets idle flows without segments held
+func (r *reorderer) sweep(now time.Time) {
+	if now.Sub(r.swept) < reorderIdle {
+		return
+	}
+	r.swept = now
+	for key, f := range r.flows {
+		if len(f.pending) == 0 && now.Sub(f.seen) > reorderIdle {
+			delete(r.flows, key)
+		}
+	}
+}
+
+func (f *reorderFlow) advance(end uint32) {
+	if seqBefore(f.next, end) {
+		f.next = end
+	}
+}
+
+// hold inserts seg by seq
+func (f *reorderFlow) hold(seg *reorderSeg) {
+	i := len(f.pending)
+	for i > 0 && seqBefore(seg.seq, f.pending[i-1].seq) {
+		i--
+	}
+	f.pending = append(f.pending, nil)
+	copy(f.pending[i+1:], f.pending[i:])
+	f.pending[i] = seg
+}
+
+// drain delivers held segments no longer after a gap
+func (f *reorderFlow) drain() {
+	for len(f.pending) > 0 && !seqBefore(f.next, f.pending[0].seq) {
+		seg := f.pending[0]
+		f.pending = f.pending[1:]
+		seg.iface.Write(seg.pkt)
+		f.advance(seg.end)
+	}
+	if len(f.pending) == 0 {
+		f.stop()
+	}
+}
+
+// flush delivers all held segments in order, skipping the gaps
+func (f *reorderFlow) flush() {
+	if len(f.pending) > 0 {
+		reorderFlushed.Inc()
+	}
+	for _, seg := range f.pending {
+		seg.iface.Write(seg.pkt)
+		f.advance(seg.end)
+	}
+	f.pending = nil
+	f.stop()
+}
+
+func (f *reorderFlow) stop() {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpSegment builds ipv4 tcp segment of n payload bytes at seq
+func tcpSegment(seq uint32, n int) []byte {
+	pkt := make([]byte, 40+n)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8], pkt[9] = 64, protoTCP
+	copy(pkt[12:16], net.ParseIP("10.0.1.5").To4())
+	copy(pkt[16:20], net.ParseIP("10.0.2.5").To4())
+
+	tcp := pkt[20:]
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x10
+	return pkt
+}
+
+func segSeq(pkt []byte) uint32 {
+	return binary.BigEndian.Uint32(pkt[24:28])
+}
+
+func TestReorder(t *testing.T) {
+	tun := newFakeTun("cframe.0")
+	iface := &Interface{tun: tun}
+	r := newReorderer(time.Millisecond*50, 4)
+
+	expect := func(seqs ...uint32) {
+		t.Helper()
+		for _, seq := range seqs {
+			select {
+			case pkt := <-tun.out:
+				if got := segSeq(pkt); got != seq {
+					t.Fatalf("expected seq %d, got %d", seq, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("seq %d not delivered", seq)
+			}
+		}
+		select {
+		case pkt := <-tun.out:
+			t.Fatalf("unexpected seq %d", segSeq(pkt))
+		default:
+		}
+	}
+
+	// 1000 opens the flow, 1300 and 1200 are held for 1100
+	r.push(0, iface, tcpSegment(1000, 100))
+	expect(1000)
+	r.push(0, iface, tcpSegment(1300, 100))
+	r.push(0, iface, tcpSegment(1200, 100))
+	expect()
+	r.push(0, iface, tcpSegment(1100, 100))
+	expect(1100, 1200, 1300)
+
+	// non tcp passes through
+	r.push(0, iface, ipPacket("10.0.1.5", "10.0.2.5"))
+	if pkt := <-tun.out; len(pkt) != 20 {
+		t.Fatalf("unexpected packet %x", pkt)
+	}
+
+	// the gap of 1400 is never filled, held segments are
+	// delivered in order after timeout
+	r.push(0, iface, tcpSegment(1600, 100))
+	r.push(0, iface, tcpSegment(1500, 100))
+	expect()
+	time.Sleep(time.Millisecond * 100)
+	expect(1500, 1600)
+
+	// a retransmit before the expected seq is not held
+	r.push(0, iface, tcpSegment(1400, 100))
+	expect(1400)
+
+	// full buffer is flushed
+	for _, seq := range []uint32{2200, 2100, 2000, 1900} {
+		r.push(0, iface, tcpSegment(seq, 100))
+	}
+	expect()
+	r.push(0, iface, tcpSegment(2300, 100))
+	expect(1900, 2000, 2100, 2200, 2300)
+}
+
+func TestReorderHeldCopy(t *testing.T) {
+	tun := newFakeTun("cframe.0")
+	iface := &Interface{tun: tun}
+	r := newReorderer(time.Second, 4)
+
+	r.push(0, iface, tcpSegment(1000, 100))
+	<-tun.out
+
+	// 1200 is held while the read buffer is reused by 1300
+	buf := tcpSegment(1200, 100)
+	r.push(0, iface, buf)
+	copy(buf, tcpSegment(1300, 100))
+	r.push(0, iface, tcpSegment(1100, 100))
+	for _, seq := range []uint32{1100, 1200} {
+		select {
+		case pkt := <-tun.out:
+			if got := segSeq(pkt); got != seq {
+				t.Fatalf("expected seq %d, got %d", seq, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("seq %d not delivered", seq)
+		}
+	}
+}
+
+func TestReorderMaxFlows(t *testing.T) {
+	old := reorderMaxFlows
+	reorderMaxFlows = 2
+	defer func() { reorderMaxFlows = old }()
+
+	tun := newFakeTun("cframe.0")
+	iface := &Interface{tun: tun}
+	r := newReorderer(time.Second, 4)
+
+	untracked := reorderUntracked.Value()
+	for port := uint16(1); port <= 3; port++ {
+		pkt := tcpSegment(1000, 100)
+		binary.BigEndian.PutUint16(pkt[20:], port)
+		r.push(0, iface, pkt)
+		<-tun.out
+	}
+	r.mu.Lock()
+	n := len(r.flows)
+	r.mu.Unlock()
+	if n != 2 || reorderUntracked.Value() != untracked+1 {
+		t.Fatalf("expected 2 flows tracked, got %d", n)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+const linkTypeEthernet = 1
+
+// replayDecision is the routing decision of a replayed packet,
+// peer is empty if the packet is dropped for reason
+type replayDecision struct {
+	Index  int    `json:"index"`
+	Src    string `json:"src"`
+	Dst    string `json:"dst"`
+	Peer   string `json:"peer"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// readPcap reads packets of pcap file with raw ip or ethernet link type,
+// as written by tap or tcpdump
+func readPcap(r io.Reader) ([]tapPacket, error) {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("read pcap header: %v", err)
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(hdr[0:4]) == pcapMagic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagic:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("unsupported pcap magic %x", hdr[0:4])
+	}
+
+	linkType := order.Uint32(hdr[20:24])
+	if linkType != linkTypeRaw && linkType != linkTypeEthernet {
+		return nil, fmt.Errorf("unsupported pcap link type %d", linkType)
+	}
+
+	pkts := make([]tapPacket, 0)
+	rec := make([]byte, 16)
+	for {
+		_, err := io.ReadFull(r, rec)
+		if err == io.EOF {
+			return pkts, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read pcap record: %v", err)
+		}
+
+		size := order.Uint32(rec[8:12])
+		if size > pcapSnapLen {
+			return nil, fmt.Errorf("invalid pcap record size %d", size)
+		}
+		pkt := make([]byte, size)
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			return nil, fmt.Errorf("read pcap record: %v", err)
+		}
+
+		if linkType == linkTypeEthernet {
+			if !Frame(pkt).IsIPV4() {
+				continue
+			}
+			pkt = pkt[14:]
+		}
+		ts := time.Unix(int64(order.Uint32(rec[0:4])), int64(order.Uint32(rec[4:8]))*1000)
+		pkts = append(pkts, tapPacket{ts: ts, pkt: pkt})
+	}
+}
+
+// loadPeers reads peers from a json file of edges,
+// eg: [{"cidr":"10.0.1.0/24","listen_addr":"1.1.1.1:58423"}]
+func loadPeers(path string) ([]*codec.Edge, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]*codec.Edge, 0)
+	err = json.Unmarshal(b, &peers)
+	return peers, err
+}
+
+// replayTransport records peers written to instead of sending
+type replayTransport struct {
+	sent []net.Addr
+}
+
+func (t *replayTransport) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	t.sent = append(t.sent, addr)
+	return len(buf), nil
+}
+
+// Replay runs packets read from tun of vni through forwardLocal
+// of an edge with peers, packets are written to a transport
+// recording peers so nothing is sent or installed
+func Replay(peers []*codec.Edge, vni uint32, pkts []tapPacket) []*replayDecision {
+	s := NewServer("", "", nil)
+	s.SetRouteManager(noopRoutes{})
+	vnis := map[uint32]struct{}{vni: {}}
+	for _, p := range peers {
+		vnis[p.Vni] = struct{}{}
+	}
+	for v := range vnis {
+		s.AddInterface(v, &Interface{tun: newBenchTun(fmt.Sprintf("replay.%d", v))})
+	}
+	s.AddPeers(peers)
+
+	sock := &replayTransport{}
+	decisions := make([]*replayDecision, 0, len(pkts))
+	for i, p := range pkts {
+		d := &replayDecision{Index: i + 1}
+		decisions = append(decisions, d)
+
+		class := classifyFrame(p.pkt)
+		if class == frameIP {
+			pkt := Packet(p.pkt)
+			d.Src, d.Dst = pkt.Src(), pkt.Dst()
+		}
+
+		// forwardLocal may rewrite the packet, eg: mss clamp
+		sock.sent = sock.sent[:0]
+		s.forwardLocal(sock, vni, handoff(p.pkt))
+		if len(sock.sent) > 0 {
+			d.Peer = sock.sent[0].String()
+			continue
+		}
+
+		// not sent, tell why
+		switch {
+		case class != frameIP:
+			d.Reason = fmt.Sprintf("drop %s frame", class)
+		default:
+			d.Reason = "dropped"
+			if _, err := s.route(vni, d.Src, d.Dst); err != nil {
+				d.Reason = err.Error()
+			}
+		}
+	}
+	return decisions
+}
+
+func printReplay(w io.Writer, decisions []*replayDecision) {
+	fmt.Fprintf(w, "%-6s %-16s %-16s %-25s %s\n", "No.", "Src", "Dst", "Peer", "Note")
+	for _, d := range decisions {
+		peer := d.Peer
+		if len(peer) == 0 {
+			peer = "-"
+		}
+		fmt.Fprintf(w, "%-6d %-16s %-16s %-25s %s\n", d.Index, d.Src, d.Dst, peer, d.Reason)
+	}
+}
+
+// replay prints routing decisions of packets in pcap file,
+// peers are read from peersFile or fetched from controller
+func replay(cfg *Config, pcapFile, peersFile string) error {
+	fp, err := os.Open(pcapFile)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	pkts, err := readPcap(fp)
+	if err != nil {
+		return err
+	}
+
+	var peers []*codec.Edge
+	if len(peersFile) > 0 {
+		peers, err = loadPeers(peersFile)
+	} else {
+		peers, err = NewRegistry(cfg.Controller, cfg.Namespace, cfg.Secret, cfg.Name, nil).FetchPeers()
+	}
+	if err != nil {
+		return fmt.Errorf("load peers: %v", err)
+	}
+
+	printReplay(os.Stdout, Replay(peers, cfg.Vni, pkts))
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestReplay(t *testing.T) {
+	now := time.Now()
+	arp := make([]byte, 42)
+	arp[12], arp[13] = 0x08, 0x06
+	buf := &bytes.Buffer{}
+	err := writePcap(buf, []tapPacket{
+		{ts: now, pkt: ipPacket("10.0.0.1", "10.0.1.5")},
+		{ts: now, pkt: ipPacket("10.0.0.1", "10.0.2.5")},
+		{ts: now, pkt: ipPacket("10.0.0.1", "10.0.3.7")},
+		{ts: now, pkt: ipPacket("10.0.0.1", "10.0.9.5")},
+		{ts: now, pkt: arp},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkts, err := readPcap(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 5 {
+		t.Fatalf("expected 5 packets, got %d", len(pkts))
+	}
+
+	peers := []*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"},
+		{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"},
+		// host route
+		{Cidr: "10.0.3.7", ListenAddr: "3.3.3.3:58423"},
+	}
+	decisions := Replay(peers, 0, pkts)
+
+	expect := []struct {
+		peer, reason string
+	}{
+		{"1.1.1.1:58423", ""},
+		{"2.2.2.2:58423", ""},
+		{"3.3.3.3:58423", ""},
+		{"", "no route"},
+		{"", "drop ethernet frame"},
+	}
+	for i, d := range decisions {
+		if d.Peer != expect[i].peer || d.Reason != expect[i].reason {
+			t.Fatalf("packet %d: expected %q %q, got %q %q",
+				i+1, expect[i].peer, expect[i].reason, d.Peer, d.Reason)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	printReplay(out, decisions)
+	if !strings.Contains(out.String(), "10.0.9.5") {
+		t.Fatalf("unexpected output %s", out)
+	}
+}
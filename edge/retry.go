@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+var (
+	minRetryBackoff = time.Second * 1
+	maxRetryBackoff = time.Minute * 1
+)
+
+var peersAbandoned = metrics.NewCounter("cframe_edge_peer_installs_abandoned_total",
+	"peer installs given up for errors retrying cannot fix")
+
+// failedPeer is a peer whose install failed,
+// retried with backoff until success or deleted by controller.
+// permanent failures are not retried but kept for status
+// until the peer is deleted or changed
+type failedPeer struct {
+	peer      *codec.Edge
+	err       error
+	backoff   time.Duration
+	next      time.Time
+	permanent bool
+}
+
+// permanentError is an install failure retrying cannot fix,
+// eg: vni without interface or unsupported transport
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// route command outputs of arguments the os never accepts
+var permanentRouteOutputs = []string{
+	"Invalid argument",
+	"invalid prefix",
+	"any valid prefix is expected",
+}
+
+// isPermanent reports whether install of peer failed with err
+// must be given up, other errors are retried with backoff
+func isPermanent(err error) bool {
+	var perr *permanentError
+	if errors.As(err, &perr) {
+		return true
+	}
+	var rerr *RouteError
+	if errors.As(err, &rerr) {
+		for _, out := range permanentRouteOutputs {
+			if strings.Contains(rerr.Output, out) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// failed records err of fp, must be called with failedMu held
+func (fp *failedPeer) failed(err error, now time.Time) {
+	fp.err = err
+	if !isPermanent(err) {
+		fp.next = now.Add(fp.backoff)
+		log.Warn("peer %v install fail: %v, retry in %v", fp.peer, err, fp.backoff)
+		return
+	}
+	if !fp.permanent {
+		peersAbandoned.Inc()
+	}
+	fp.permanent, fp.next = true, time.Time{}
+	log.Error("peer %v install fail: %v, not retried", fp.peer, err)
+}
+
+func peerKey(peer *codec.Edge) string {
+	cidr := hostCIDR(peer.Cidr)
+	if peer.Standby {
+		return fmt.Sprintf("%d/%s/standby", peer.Vni, cidr)
+	}
+	if peer.Weight > 0 {
+		return fmt.Sprintf("%d/%s/%s", peer.Vni, cidr, peer.ListenAddr)
+	}
+	return fmt.Sprintf("%d/%s", peer.Vni, cidr)
+}
+
+// installPeer adds peer route and queues it for retry on failure
+func (s *Server) installPeer(peer *codec.Edge) error {
+	s.replacePeer(peer)
+	key := peerKey(peer)
+	err := s.addRoute(peer)
+
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	if err == nil {
+		delete(s.failed, key)
+		return nil
+	}
+
+	fp, ok := s.failed[key]
+	if !ok || fp.permanent {
+		// a permanent failure of the same key is of an older entry
+		fp = &failedPeer{backoff: minRetryBackoff}
+		s.failed[key] = fp
+	}
+	fp.peer = peer
+	fp.failed(err, time.Now())
+	return err
+}
+
+// forgetPeer stops retrying the peer
+func (s *Server) forgetPeer(peer *codec.Edge) {
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	delete(s.failed, peerKey(peer))
+}
+
+// FailedPeers returns peers waiting for retry
+func (s *Server) FailedPeers() []*failedPeer {
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	peers := make([]*failedPeer, 0, len(s.failed))
+	for _, fp := range s.failed {
+		peers = append(peers, fp)
+	}
+	return peers
+}
+
+// FailedPeerStatus is a failed peer exported by admin api,
+// output and exit code are of the failed route command
+type FailedPeerStatus struct {
+	Cidr       string    `json:"cidr"`
+	ListenAddr string    `json:"listen_addr"`
+	Vni        uint32    `json:"vni"`
+	Error      string    `json:"error"`
+	Output     string    `json:"output,omitempty"`
+	ExitCode   int       `json:"exit_code,omitempty"`
+	NextRetry  time.Time `json:"next_retry"`
+	// not retried, install fails until the peer changes
+	Permanent bool `json:"permanent,omitempty"`
+}
+
+// FailedStatus returns status of peers waiting for retry
+func (s *Server) FailedStatus() []*FailedPeerStatus {
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	status := make([]*FailedPeerStatus, 0, len(s.failed))
+	for _, fp := range s.failed {
+		st := &FailedPeerStatus{
+			Cidr:       fp.peer.Cidr,
+			ListenAddr: fp.peer.ListenAddr,
+			Vni:        fp.peer.Vni,
+			NextRetry:  fp.next,
+			Permanent:  fp.permanent,
+		}
+		if fp.err != nil {
+			st.Error = fp.err.Error()
+		}
+		var rerr *RouteError
+		if errors.As(fp.err, &rerr) {
+			st.Output, st.ExitCode = rerr.Output, rerr.ExitCode
+		}
+		status = append(status, st)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Cidr < status[j].Cidr
+	})
+	return status
+}
+
+func (s *Server) retryFailed() {
+	defer s.guard()
+	tick := time.NewTicker(minRetryBackoff)
+	defer tick.Stop()
+	for now := range tick.C {
+		s.retry(now)
+	}
+}
+
+// retry re-installs failed peers due at now
+func (s *Server) retry(now time.Time) {
+	s.failedMu.Lock()
+	due := make([]*failedPeer, 0)
+	for _, fp := range s.failed {
+		if !fp.permanent && !now.Before(fp.next) {
+			due = append(due, fp)
+		}
+	}
+	s.failedMu.Unlock()
+
+	for _, fp := range due {
+		log.Info("retry install peer %v", fp.peer)
+		err := s.addRoute(fp.peer)
+
+		s.failedMu.Lock()
+		key := peerKey(fp.peer)
+		// deleted by controller during retry
+		if s.failed[key] != fp {
+			s.failedMu.Unlock()
+			continue
+		}
+
+		if err == nil {
+			delete(s.failed, key)
+			s.failedMu.Unlock()
+			log.Info("retry install peer %v OK", fp.peer)
+			continue
+		}
+
+		fp.backoff *= 2
+		if fp.backoff > maxRetryBackoff {
+			fp.backoff = maxRetryBackoff
+		}
+		fp.failed(err, now)
+		s.failedMu.Unlock()
+	}
+	s.checkConverge(now)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestRetryFailedPeer(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+
+	// the first route add fails
+	routes := newFakeRoutes()
+	routes.fail["10.0.1.0/24"] = fmt.Errorf("SIOCADDRT: Network is unreachable")
+	s.SetRouteManager(routes)
+	adds := func() int { return len(routes.Calls()) }
+
+	peer := &codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"}
+	s.AddPeer(peer)
+	if len(s.FailedPeers()) != 1 {
+		t.Fatalf("expected 1 failed peer, got %d", len(s.FailedPeers()))
+	}
+	if _, err := s.route(0, "", "10.0.1.1"); err == nil {
+		t.Fatalf("failed peer should not be routable")
+	}
+
+	// not due yet
+	s.retry(time.Now())
+	if adds() != 1 {
+		t.Fatalf("retry before backoff elapsed")
+	}
+
+	delete(routes.fail, "10.0.1.0/24")
+	s.retry(time.Now().Add(minRetryBackoff))
+	if adds() != 2 {
+		t.Fatalf("expected retry, route add called %d times", adds())
+	}
+	if len(s.FailedPeers()) != 0 {
+		t.Fatalf("peer still in failed state after retry succeed")
+	}
+
+	addr, err := s.route(0, "", "10.0.1.1")
+	if err != nil || addr != "1.1.1.1:58423" {
+		t.Fatalf("expected route to 1.1.1.1:58423, got %s %v", addr, err)
+	}
+}
+
+func TestRetryForgetDeletedPeer(t *testing.T) {
+	s := NewServer("", "key", nil)
+
+	// no interface for vni 0, install fails
+	peer := &codec.Edge{Cidr: "10.0.1.1", ListenAddr: "1.1.1.1:58423"}
+	s.AddPeer(peer)
+	if len(s.FailedPeers()) != 1 {
+		t.Fatalf("expected 1 failed peer")
+	}
+
+	s.DelPeer(&codec.Edge{Cidr: "10.0.1.1/32", ListenAddr: "1.1.1.1:58423"})
+	if len(s.FailedPeers()) != 0 {
+		t.Fatalf("deleted peer still retried")
+	}
+}
+
+func TestRetryPermanentFailure(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	routes := newFakeRoutes()
+	routes.fail["10.0.1.0/24"] = &RouteError{
+		Cmd:      "ip",
+		Output:   "Error: Invalid argument",
+		ExitCode: 2,
+	}
+	s.SetRouteManager(routes)
+
+	abandoned := peersAbandoned.Value()
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"})
+	// vni without interface
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423", Vni: 7})
+	if got := peersAbandoned.Value(); got != abandoned+2 {
+		t.Fatalf("expected 2 installs abandoned, got %v", got-abandoned)
+	}
+	for _, st := range s.FailedStatus() {
+		if !st.Permanent || !st.NextRetry.IsZero() {
+			t.Fatalf("expected %s failed permanently, got %+v", st.Cidr, st)
+		}
+	}
+
+	// given up, not retried
+	calls := len(routes.Calls())
+	s.retry(time.Now().Add(maxRetryBackoff))
+	if n := len(routes.Calls()); n != calls {
+		t.Fatalf("permanent failure retried, %d route calls", n-calls)
+	}
+
+	// transient failure of the changed peer is retried again
+	routes.fail["10.0.1.0/24"] = fmt.Errorf("SIOCADDRT: Network is unreachable")
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "3.3.3.3:58423"})
+	delete(routes.fail, "10.0.1.0/24")
+	s.retry(time.Now().Add(minRetryBackoff))
+	if _, err := s.route(0, "", "10.0.1.1"); err != nil {
+		t.Fatalf("changed peer not retried: %v", err)
+	}
+}
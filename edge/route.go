@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RouteManager installs routes of peer cidrs to the tun device
+type RouteManager interface {
+	AddRoute(cidr, dev string) error
+	DelRoute(cidr, dev string) error
+}
+
+// noopRoutes never touches os routing table
+type noopRoutes struct{}
+
+func (noopRoutes) AddRoute(cidr, dev string) error { return nil }
+func (noopRoutes) DelRoute(cidr, dev string) error { return nil }
+
+// SetRouteInstall disables installing peer routes to os routing table,
+// eg: routes are managed by a routing daemon. peers are still forwarded
+func (s *Server) SetRouteInstall(enabled bool) {
+	if !enabled {
+		s.routes = noopRoutes{}
+	}
+}
+
+func (s *Server) routeInstall() bool {
+	_, ok := s.routes.(noopRoutes)
+	return !ok
+}
+
+// cmdRouteManager manages routes by linux route command,
+// routes of devices with a table go to that table by ip command
+type cmdRouteManager struct {
+	tables map[string]int
+
+	// devices ever given an inet6 route, listed by ListRoutes
+	inet6Mu sync.Mutex
+	inet6   map[string]bool
+}
+
+func (m *cmdRouteManager) markInet6(dev string) {
+	m.inet6Mu.Lock()
+	defer m.inet6Mu.Unlock()
+	if m.inet6 == nil {
+		m.inet6 = make(map[string]bool)
+	}
+	m.inet6[dev] = true
+}
+
+func (m *cmdRouteManager) hasInet6(dev string) bool {
+	m.inet6Mu.Lock()
+	defer m.inet6Mu.Unlock()
+	return m.inet6[dev]
+}
+
+// SetTable installs routes of dev into routing table,
+// 0 means the main table. must be called before routes added
+func (m *cmdRouteManager) SetTable(dev string, table int) {
+	if m.tables == nil {
+		m.tables = make(map[string]int)
+	}
+	if table == 0 {
+		delete(m.tables, dev)
+		return
+	}
+	m.tables[dev] = table
+}
+
+// hostCIDR returns cidr, a bare host is given its full
+// prefix, /32 for ipv4 and /128 for ipv6
+func hostCIDR(cidr string) string {
+	if strings.Contains(cidr, "/") {
+		return cidr
+	}
+	if isIPv6(cidr) {
+		return cidr + "/128"
+	}
+	return cidr + "/32"
+}
+
+func routeType(cidr string) string {
+	ipmask := strings.Split(cidr, "/")
+	if len(ipmask) == 1 || ipmask[1] == "32" {
+		return "-host"
+	}
+	return "-net"
+}
+
+// isIPv6 reports whether cidr or host is of inet6 family
+func isIPv6(cidr string) bool {
+	return strings.Contains(cidr, ":")
+}
+
+// ipRouteArgs builds ip route command args of op in table,
+// inet6 routes are given -6, eg:
+// ip -6 route replace fd00:1::/64 dev cframe.0 table 101
+func ipRouteArgs(op, cidr, dev string, table int) []string {
+	args := []string{"route", op, cidr, "dev", dev, "table", strconv.Itoa(table)}
+	if isIPv6(cidr) {
+		args = append([]string{"-6"}, args...)
+	}
+	return args
+}
+
+// routeArgs builds route command args of op,
+// inet6 routes take no -net or -host, eg:
+// route add -net 10.0.1.0/24 dev cframe.0
+// route -A inet6 add fd00:1::/64 dev cframe.0
+func routeArgs(op, cidr, dev string) []string {
+	if isIPv6(cidr) {
+		return []string{"-A", "inet6", op, cidr, "dev", dev}
+	}
+	return []string{op, routeType(cidr), cidr, "dev", dev}
+}
+
+func (m *cmdRouteManager) AddRoute(cidr, dev string) error {
+	if isIPv6(cidr) {
+		m.markInet6(dev)
+	}
+
+	if table, ok := m.tables[dev]; ok {
+		return routeCmd("ip", ipRouteArgs("replace", cidr, dev, table)...)
+	}
+
+	// remove stale route first
+	execCmd("route", routeArgs("del", cidr, dev))
+
+	return routeCmd("route", routeArgs("add", cidr, dev)...)
+}
+
+func (m *cmdRouteManager) DelRoute(cidr, dev string) error {
+	var err error
+	if table, ok := m.tables[dev]; ok {
+		err = routeCmd("ip", ipRouteArgs("del", cidr, dev, table)...)
+	} else {
+		err = routeCmd("route", routeArgs("del", cidr, dev)...)
+	}
+
+	if rerr, ok := err.(*RouteError); ok && noSuchRoute(rerr.Output) {
+		return nil
+	}
+	return err
+}
+
+// RouteError is a failed route command with its output,
+// eg: RTNETLINK answers: File exists
+type RouteError struct {
+	Cmd      string
+	Args     []string
+	Output   string
+	ExitCode int
+	Err      error
+}
+
+func (e *RouteError) Error() string {
+	return fmt.Sprintf("%s %s: %s (exit %d)",
+		e.Cmd, strings.Join(e.Args, " "), e.Output, e.ExitCode)
+}
+
+func (e *RouteError) Unwrap() error {
+	return e.Err
+}
+
+// routeCmd runs route command, failure is returned as *RouteError
+func routeCmd(cmd string, args ...string) error {
+	out, err := execCmd(cmd, args)
+	if err == nil {
+		return nil
+	}
+
+	code := -1
+	if exit, ok := err.(*exec.ExitError); ok {
+		code = exit.ExitCode()
+	}
+	return &RouteError{
+		Cmd:      cmd,
+		Args:     args,
+		Output:   strings.TrimSpace(out),
+		ExitCode: code,
+		Err:      err,
+	}
+}
+
+// noSuchRoute reports whether route del failed for the route
+// being already gone, eg: SIOCDELRT: No such process
+func noSuchRoute(out string) bool {
+	return strings.Contains(out, "No such process") ||
+		strings.Contains(out, "No such route")
+}
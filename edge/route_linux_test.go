@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestInstallRouteInet6(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("installing routes requires root")
+	}
+	if _, err := os.Stat("/proc/net/ipv6_route"); err != nil {
+		t.Skipf("ipv6 disabled: %v", err)
+	}
+
+	// documentation prefix on loopback never carries traffic
+	const cidr, dev = "2001:db8:cf::/64", "lo"
+	m := &cmdRouteManager{}
+	if err := m.AddRoute(cidr, dev); err != nil {
+		t.Skipf("route -A inet6: %v", err)
+	}
+	defer m.DelRoute(cidr, dev)
+
+	installed := func() bool {
+		routes, err := m.ListRoutes(dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range routes {
+			if r == cidr {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !installed() {
+		t.Fatalf("%s not found in inet6 table of %s", cidr, dev)
+	}
+	if err := m.DelRoute(cidr, dev); err != nil {
+		t.Fatal(err)
+	}
+	if installed() {
+		t.Fatalf("%s left in inet6 table of %s", cidr, dev)
+	}
+}
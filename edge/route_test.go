@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// fakeRoutes records route calls,
+// fail makes AddRoute of the cidr fail
+// and omit silently drops the route added
+type fakeRoutes struct {
+	mu     sync.Mutex
+	calls  []string
+	fail   map[string]error
+	omit   map[string]bool
+	routes map[string]map[string]struct{}
+}
+
+func newFakeRoutes() *fakeRoutes {
+	return &fakeRoutes{
+		fail:   make(map[string]error),
+		omit:   make(map[string]bool),
+		routes: make(map[string]map[string]struct{}),
+	}
+}
+
+func (m *fakeRoutes) AddRoute(cidr, dev string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, fmt.Sprintf("add %s %s", cidr, dev))
+	if err := m.fail[cidr]; err != nil {
+		return err
+	}
+
+	if !m.omit[cidr] {
+		if m.routes[dev] == nil {
+			m.routes[dev] = make(map[string]struct{})
+		}
+		if _, ipnet, err := net.ParseCIDR(hostCIDR(cidr)); err == nil {
+			m.routes[dev][ipnet.String()] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (m *fakeRoutes) DelRoute(cidr, dev string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, fmt.Sprintf("del %s %s", cidr, dev))
+	_, ipnet, _ := net.ParseCIDR(hostCIDR(cidr))
+	if ipnet != nil {
+		delete(m.routes[dev], ipnet.String())
+	}
+	return nil
+}
+
+func (m *fakeRoutes) ListRoutes(dev string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	routes := make([]string, 0)
+	for r := range m.routes[dev] {
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// waitRoutes waits until routes of dev are expect
+func waitRoutes(t *testing.T, routes *fakeRoutes, dev string, expect []string) {
+	t.Helper()
+	if expect == nil {
+		expect = []string{}
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		installed, _ := routes.ListRoutes(dev)
+		sort.Strings(installed)
+		if reflect.DeepEqual(installed, expect) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected routes %v, got %v", expect, installed)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func (m *fakeRoutes) Calls() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.calls...)
+}
+
+func TestRouteManager(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.1", ListenAddr: "2.2.2.2:58423"})
+	s.DelPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"})
+
+	expect := []string{
+		"add 10.0.1.0/24 cframe.0",
+		"add 10.0.2.1 cframe.0",
+		"del 10.0.1.0/24 cframe.0",
+	}
+	if got := routes.Calls(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected calls %v, got %v", expect, got)
+	}
+
+	if _, err := s.route(0, "", "10.0.1.1"); err == nil {
+		t.Fatalf("deleted peer still routable")
+	}
+	if addr, err := s.route(0, "", "10.0.2.1"); err != nil || addr != "2.2.2.2:58423" {
+		t.Fatalf("expected route to 2.2.2.2:58423, got %s %v", addr, err)
+	}
+}
+
+func TestDrainPeerRouteRemoved(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.SetDrainGrace(time.Millisecond * 50)
+
+	peer := &codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"}
+	s.AddPeer(peer)
+	s.DelPeer(peer)
+	if n := len(routes.Calls()); n != 1 {
+		t.Fatalf("route removed before grace elapsed")
+	}
+
+	time.Sleep(time.Millisecond * 200)
+	expect := []string{
+		"add 10.0.1.0/24 cframe.0",
+		"del 10.0.1.0/24 cframe.0",
+	}
+	if got := routes.Calls(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected calls %v, got %v", expect, got)
+	}
+}
+
+func TestRouteInstallDisabled(t *testing.T) {
+	var calls []string
+	old := execCmd
+	execCmd = func(cmd string, args []string) (string, error) {
+		calls = append(calls, cmd+" "+strings.Join(args, " "))
+		return "", nil
+	}
+	defer func() { execCmd = old }()
+
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteInstall(false)
+
+	peer := listenLocal(t)
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: peer.LocalAddr().String()})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"})
+	s.DelPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"})
+	if missing, err := s.Reconcile(); err != nil || len(missing) != 0 {
+		t.Fatalf("unexpected reconcile %v %v", missing, err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("os route commands invoked: %v", calls)
+	}
+
+	// forwarding still follows the peer routes
+	s.forwardLocal(listenLocal(t), 0, ipPacket("10.0.9.1", "10.0.1.5"))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatalf("packet not forwarded: %v", err)
+	}
+	if _, pkt := decodeData(buf[3:n]); Packet(pkt).Dst() != "10.0.1.5" {
+		t.Fatalf("unexpected packet %x", buf[:n])
+	}
+}
+
+func TestDelPeerNeverAdded(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	s.SetDrainGrace(time.Hour)
+
+	// route add failed, peer waits for retry
+	peer := &codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"}
+	routes.fail[peer.Cidr] = fmt.Errorf("SIOCADDRT: Network is unreachable")
+	s.AddPeer(peer)
+	ResetStat()
+
+	s.DelPeer(peer)
+	// unknown peer
+	s.DelPeer(&codec.Edge{Cidr: "10.0.2.1", ListenAddr: "2.2.2.2:58423"})
+
+	expect := []string{"add 10.0.1.0/24 cframe.0"}
+	if got := routes.Calls(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected calls %v, got %v", expect, got)
+	}
+	if errs := ResetStat().Error; len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if s.hasPeer(peer) || len(s.FailedPeers()) != 0 {
+		t.Fatalf("deleted peer left in routing table or retry list")
+	}
+
+	// a route gone from os is removed without error
+	m := &cmdRouteManager{}
+	old := execCmd
+	execCmd = func(cmd string, args []string) (string, error) {
+		return "SIOCDELRT: No such process\n", fmt.Errorf("exit status 7")
+	}
+	defer func() { execCmd = old }()
+	if err := m.DelRoute("10.0.1.0/24", "cframe.0"); err != nil {
+		t.Fatalf("missing route not treated as removed: %v", err)
+	}
+}
+
+func TestRouteErrorOutput(t *testing.T) {
+	old := execCmd
+	execCmd = func(cmd string, args []string) (string, error) {
+		if args[0] == "add" {
+			return "RTNETLINK answers: File exists\n", fmt.Errorf("exit status 2")
+		}
+		return "", nil
+	}
+	defer func() { execCmd = old }()
+
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	err := s.installPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"})
+	rerr, ok := err.(*RouteError)
+	if !ok {
+		t.Fatalf("expected *RouteError, got %T %v", err, err)
+	}
+	if rerr.Cmd != "route" || rerr.Output != "RTNETLINK answers: File exists" {
+		t.Fatalf("unexpected route error %+v", rerr)
+	}
+	if !strings.Contains(err.Error(), "route add -net 10.0.1.0/24 dev cframe.0: RTNETLINK answers: File exists") {
+		t.Fatalf("output missing in error: %v", err)
+	}
+
+	// failed peer exports the command output
+	status := s.FailedStatus()
+	if len(status) != 1 || status[0].Output != "RTNETLINK answers: File exists" {
+		t.Fatalf("unexpected failed status %+v", status)
+	}
+}
+
+func TestRouteCommandsInet6(t *testing.T) {
+	var calls []string
+	old := execCmd
+	execCmd = func(cmd string, args []string) (string, error) {
+		calls = append(calls, cmd+" "+strings.Join(args, " "))
+		return "", nil
+	}
+	defer func() { execCmd = old }()
+
+	m := &cmdRouteManager{}
+	m.SetTable("cframe.1", 101)
+	m.AddRoute("fd00:1::/64", "cframe.0")
+	m.AddRoute("fd00:2::1", "cframe.0")
+	m.DelRoute("fd00:1::/64", "cframe.0")
+	m.AddRoute("fd00:3::/64", "cframe.1")
+	m.DelRoute("fd00:3::/64", "cframe.1")
+
+	expect := []string{
+		"route -A inet6 del fd00:1::/64 dev cframe.0",
+		"route -A inet6 add fd00:1::/64 dev cframe.0",
+		"route -A inet6 del fd00:2::1 dev cframe.0",
+		"route -A inet6 add fd00:2::1 dev cframe.0",
+		"route -A inet6 del fd00:1::/64 dev cframe.0",
+		"ip -6 route replace fd00:3::/64 dev cframe.1 table 101",
+		"ip -6 route del fd00:3::/64 dev cframe.1 table 101",
+	}
+	if !reflect.DeepEqual(calls, expect) {
+		t.Fatalf("expected %v, got %v", expect, calls)
+	}
+	if !m.hasInet6("cframe.0") || !m.hasInet6("cframe.1") || m.hasInet6("cframe.2") {
+		t.Fatalf("inet6 devices not recorded: %v", m.inet6)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// RouteStatus tells whether a desired peer route is wired,
+// exported by admin api /routes
+type RouteStatus struct {
+	Vni        uint32 `json:"vni"`
+	Cidr       string `json:"cidr"`
+	ListenAddr string `json:"listen_addr"`
+	Dev        string `json:"dev"`
+
+	// route found in os routing table, or recorded as
+	// installed if the route manager can not list routes
+	Installed bool `json:"installed"`
+
+	// active, standby, draining or failed
+	State string `json:"state"`
+
+	// up, down, unknown before the first check or disabled
+	Health   string    `json:"health"`
+	LastPong time.Time `json:"last_pong,omitempty"`
+
+	// route install error of failed peer
+	Error string `json:"error,omitempty"`
+}
+
+// status returns health and last pong of addr
+func (h *health) status(addr string, now time.Time) (string, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ph, ok := h.peers[addr]
+	switch {
+	case !ok:
+		return "unknown", time.Time{}
+	case ph.up && !ph.damped(now):
+		return "up", ph.lastPong
+	default:
+		return "down", ph.lastPong
+	}
+}
+
+// Routes returns status of the route of each peer,
+// backed by os routing table and peer health check
+func (s *Server) Routes() ([]*RouteStatus, error) {
+	now := time.Now()
+	status := make([]*RouteStatus, 0)
+	add := func(vni uint32, cidr, addr, state string) *RouteStatus {
+		st := &RouteStatus{Vni: vni, Cidr: cidr, ListenAddr: addr, State: state, Health: "disabled"}
+		if iface := s.ifaces[vni]; iface != nil {
+			st.Dev = iface.tun.Name()
+		}
+		if s.healthInterval > 0 {
+			st.Health, st.LastPong = s.health.status(addr, now)
+		}
+		status = append(status, st)
+		return st
+	}
+
+	s.mu.RLock()
+	for vni, peers := range s.peerConns {
+		for _, p := range peers {
+			state := "active"
+			if p.draining {
+				state = "draining"
+			}
+			if len(p.paths) > 0 {
+				for _, path := range p.paths {
+					add(vni, p.cidr, path.addr, state)
+				}
+			} else if len(p.addr) > 0 {
+				add(vni, p.cidr, p.addr, state)
+			}
+			if len(p.standby) > 0 {
+				add(vni, p.cidr, p.standby, "standby")
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	installed, err := s.routesInstalled(status)
+	if err != nil {
+		return nil, err
+	}
+	for i, st := range status {
+		st.Installed = installed[i]
+	}
+
+	// failed peer is usually absent from the peer table
+	listed := make(map[string]*RouteStatus, len(status))
+	for _, st := range status {
+		listed[fmt.Sprintf("%d/%s@%s", st.Vni, st.Cidr, st.ListenAddr)] = st
+	}
+	for _, fp := range s.FailedStatus() {
+		cidr := routeOf(fp.Cidr, "").cidr
+		st := listed[fmt.Sprintf("%d/%s@%s", fp.Vni, cidr, fp.ListenAddr)]
+		if st == nil {
+			st = add(fp.Vni, cidr, fp.ListenAddr, "failed")
+		}
+		st.State, st.Error = "failed", fp.Error
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		if status[i].Vni != status[j].Vni {
+			return status[i].Vni < status[j].Vni
+		}
+		if status[i].Cidr != status[j].Cidr {
+			return status[i].Cidr < status[j].Cidr
+		}
+		return status[i].ListenAddr < status[j].ListenAddr
+	})
+	return status, nil
+}
+
+// routesInstalled checks routes of status against os routing table
+// as Reconcile does, falls back to routes recorded as installed
+func (s *Server) routesInstalled(status []*RouteStatus) ([]bool, error) {
+	installed := make([]bool, len(status))
+	if !s.routeInstall() {
+		return installed, nil
+	}
+
+	lister, ok := s.routes.(RouteLister)
+	osRoutes := make(map[string][]*net.IPNet)
+	for i, st := range status {
+		if !ok {
+			s.installed.mu.Lock()
+			_, installed[i] = s.installed.routes[routeOf(st.Cidr, st.Dev)]
+			s.installed.mu.Unlock()
+			continue
+		}
+
+		routes, listed := osRoutes[st.Dev]
+		if !listed {
+			list, err := lister.ListRoutes(st.Dev)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range list {
+				if _, ipnet, err := net.ParseCIDR(r); err == nil {
+					routes = append(routes, ipnet)
+				}
+			}
+			osRoutes[st.Dev] = routes
+		}
+
+		_, ipnet, err := net.ParseCIDR(st.Cidr)
+		installed[i] = err == nil && coveredBy(ipnet, routes)
+	}
+	return installed, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+var schedDropped = metrics.NewCounter("cframe_edge_sched_dropped_total",
+	"egress packets dropped for a full scheduler band")
+
+// priority bands of egress packets
+const (
+	bandHigh = iota
+	bandNormal
+	bandLow
+	numBands
+)
+
+var (
+	// packets drained from each band per round,
+	// lower bands still get a share under backlog
+	bandWeights = [numBands]int{8, 4, 1}
+
+	// packet size classifying interactive and bulk traffic
+	smallPacket = 128
+	largePacket = 1000
+)
+
+// dscp classes
+const (
+	dscpCS1  = 8
+	dscpAF41 = 34
+	dscpEF   = 46
+)
+
+type egressPkt struct {
+	sock transport
+	addr *net.UDPAddr
+	buf  []byte
+}
+
+// scheduler queues egress packets in priority bands
+// and drains higher bands first with weighting
+type scheduler struct {
+	bands  [numBands]chan *egressPkt
+	notify chan struct{}
+}
+
+func newScheduler(queueLen int) *scheduler {
+	s := &scheduler{notify: make(chan struct{}, 1)}
+	for i := range s.bands {
+		s.bands[i] = make(chan *egressPkt, queueLen)
+	}
+	return s
+}
+
+// classify returns band of ip packet by dscp then by size
+func classify(pkt []byte) int {
+	if len(pkt) > 1 && pkt[0]>>4 == 4 {
+		dscp := pkt[1] >> 2
+		switch {
+		case dscp >= dscpAF41:
+			return bandHigh
+		case dscp == dscpCS1:
+			return bandLow
+		}
+	}
+
+	switch {
+	case len(pkt) <= smallPacket:
+		return bandHigh
+	case len(pkt) >= largePacket:
+		return bandLow
+	default:
+		return bandNormal
+	}
+}
+
+// stop ends run once nothing is enqueued any more
+func (s *scheduler) stop() {
+	close(s.notify)
+}
+
+// enqueue queues p to band, p is dropped if the band is full
+func (s *scheduler) enqueue(p *egressPkt, band int) bool {
+	select {
+	case s.bands[band] <- p:
+	default:
+		schedDropped.Inc()
+		return false
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// run drains bands by weight until all bands are empty
+func (s *scheduler) run(write func(p *egressPkt)) {
+	for range s.notify {
+		for s.drain(write) {
+		}
+	}
+}
+
+// drain runs one weighted round, returns false if nothing drained
+func (s *scheduler) drain(write func(p *egressPkt)) bool {
+	drained := false
+	for band, weight := range bandWeights {
+	loop:
+		for i := 0; i < weight; i++ {
+			select {
+			case p := <-s.bands[band]:
+				write(p)
+				drained = true
+			default:
+				break loop
+			}
+		}
+	}
+	return drained
+}
+
+// SetScheduler queues egress packets in priority bands of
+// queueLen packets, queueLen 0 writes packets to peer directly
+func (s *Server) SetScheduler(queueLen int) {
+	if queueLen <= 0 {
+		s.sched = nil
+		return
+	}
+	s.sched = newScheduler(queueLen)
+}
+
+// sendPeer writes buf to peer through scheduler if enabled
+func (s *Server) sendPeer(sock transport, addr *net.UDPAddr, pkt, buf []byte) {
+	if s.sched != nil {
+		band := classify(pkt)
+		if !s.sched.enqueue(&egressPkt{sock: sock, addr: addr, buf: buf}, band) {
+			log.Debug("egress band %d full, drop packet to %s", band, addr)
+		}
+		return
+	}
+	s.egress(&egressPkt{sock: sock, addr: addr, buf: buf})
+}
+
+func (s *Server) writeEgress(p *egressPkt) {
+	err := writePeer(p.sock, p.buf, p.addr)
+	if err != nil {
+		s.writeErrs.add(err, time.Now())
+	}
+}
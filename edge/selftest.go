@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// reachability of a peer probed by self test
+type reachability struct {
+	cidr      string
+	addr      string
+	rtt       time.Duration
+	reachable bool
+	err       error
+}
+
+// SelfTest pings each peer via the health check channel
+// it does not require forwarding running
+func SelfTest(encap Encap, peers []*codec.Edge, timeout time.Duration) []*reachability {
+	result := make([]*reachability, 0, len(peers))
+	for _, peer := range peers {
+		rtt, err := ping(encap, peer.ListenAddr, timeout)
+		result = append(result, &reachability{
+			cidr:      peer.Cidr,
+			addr:      peer.ListenAddr,
+			rtt:       rtt,
+			reachable: err == nil,
+			err:       err,
+		})
+	}
+	return result
+}
+
+// unreachable returns the number of peers not reachable
+func unreachable(result []*reachability) int {
+	n := 0
+	for _, r := range result {
+		if !r.reachable {
+			n++
+		}
+	}
+	return n
+}
+
+// selfTestPeers returns peers of peers_file if set, otherwise
+// queried from controller, the edge is not registered
+func selfTestPeers(cfg *Config, ctrlTLS *tls.Config) ([]*codec.Edge, error) {
+	if len(cfg.PeersFile) > 0 {
+		content, err := ioutil.ReadFile(cfg.PeersFile)
+		if err != nil {
+			return nil, err
+		}
+		return ParsePeers(content)
+	}
+
+	reg := NewRegistry(cfg.Controller, cfg.Namespace, cfg.Secret, cfg.Name, nil)
+	reg.SetTLS(ctrlTLS)
+	return reg.FetchPeers()
+}
+
+func ping(encap Encap, addr string, timeout time.Duration) (time.Duration, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	nonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonce, uint64(time.Now().UnixNano()))
+
+	beg := time.Now()
+	_, err = conn.Write(encap.EncodeCtrl(ctrlPing, nonce))
+	if err != nil {
+		return 0, err
+	}
+
+	conn.SetReadDeadline(beg.Add(timeout))
+	buf := make([]byte, 128)
+	for {
+		nr, err := conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		_, reply, err := encap.Decode(buf[:nr])
+		if err != nil {
+			continue
+		}
+
+		if isCtrl(reply) && len(reply) >= 2 && reply[1] == ctrlPong && bytes.Equal(reply[2:], nonce) {
+			return time.Since(beg), nil
+		}
+	}
+}
+
+func printReachability(w io.Writer, result []*reachability) {
+	fmt.Fprintln(w, "peer reachability:")
+	fmt.Fprintf(w, "      %-20s %-25s %-12s %-12s\n", "CIDR", "Listener", "RTT", "Status")
+	fmt.Fprintln(w, "---------------------------------------------------------------------------")
+	for i, r := range result {
+		rtt, status := "-", "unreachable"
+		if r.reachable {
+			rtt, status = r.rtt.String(), "reachable"
+		}
+		fmt.Fprintf(w, "%-5d %-20s %-25s %-12s %-12s\n", i+1, r.cidr, r.addr, rtt, status)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestSelfTest(t *testing.T) {
+	// mock peer answers ping
+	lconn := listenLocal(t)
+	peer := NewServer("", "key", nil)
+	go peer.readRemote(lconn)
+
+	// nobody listens on this address
+	dead := listenLocal(t)
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	peers := []*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: lconn.LocalAddr().String()},
+		{Cidr: "10.0.2.0/24", ListenAddr: deadAddr},
+	}
+
+	result := SelfTest(&rawEncap{key: "key"}, peers, time.Millisecond*500)
+	if len(result) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(result))
+	}
+
+	if !result[0].reachable || result[0].rtt <= 0 {
+		t.Fatalf("expected %s reachable: %v", result[0].addr, result[0].err)
+	}
+
+	if result[1].reachable {
+		t.Fatalf("expected %s unreachable", result[1].addr)
+	}
+
+	if n := unreachable(result); n != 1 {
+		t.Fatalf("expected 1 unreachable, got %d", n)
+	}
+
+	out := &bytes.Buffer{}
+	printReachability(out, result)
+	lines := strings.Split(out.String(), "\n")
+	if !strings.Contains(lines[3], "10.0.1.0/24") || !strings.Contains(lines[3], " reachable") {
+		t.Fatalf("unexpected matrix line: %s", lines[3])
+	}
+	if !strings.Contains(lines[4], "10.0.2.0/24") || !strings.Contains(lines[4], "unreachable") {
+		t.Fatalf("unexpected matrix line: %s", lines[4])
+	}
+}
+
+func TestSelfTestWrongKey(t *testing.T) {
+	lconn := listenLocal(t)
+	peer := NewServer("", "key", nil)
+	go peer.readRemote(lconn)
+
+	peers := []*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: lconn.LocalAddr().String()},
+	}
+
+	result := SelfTest(&rawEncap{key: "bad"}, peers, time.Millisecond*200)
+	if result[0].reachable {
+		t.Fatalf("expected unreachable with wrong key")
+	}
+}
+
+func TestSelfTestPeers(t *testing.T) {
+	// queried from controller, never registered
+	c := newMockController(t, []*codec.Edge{{Name: "edge2", Cidr: "10.0.2.0/24", ListenAddr: "2.2.2.2:58423"}})
+	defer c.close()
+	registered := registrations.Value()
+	peers, err := selfTestPeers(&Config{Controller: c.lis.Addr().String(), Namespace: "default", Name: "edge1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Cidr != "10.0.2.0/24" {
+		t.Fatalf("unexpected peers %+v", peers)
+	}
+	c.mu.Lock()
+	query := len(c.reqs) == 1 && c.reqs[0].Query
+	c.mu.Unlock()
+	if !query || registrations.Value() != registered {
+		t.Fatalf("selftest registered as the edge")
+	}
+
+	// peers file takes precedence
+	path := filepath.Join(t.TempDir(), "peers.json")
+	ioutil.WriteFile(path, []byte(`[{"cidr":"10.0.3.0/24","listen_addr":"3.3.3.3:58423"}]`), 0644)
+	peers, err = selfTestPeers(&Config{Controller: c.lis.Addr().String(), PeersFile: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Cidr != "10.0.3.0/24" {
+		t.Fatalf("unexpected peers of file %+v", peers)
+	}
+}
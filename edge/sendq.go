@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+// drop policies of a full peer send queue
+const (
+	// packet being sent is dropped
+	dropTail = "drop-tail"
+	// oldest queued packet is dropped for the new one
+	dropHead = "drop-head"
+)
+
+var queueDrops = metrics.NewCounterVec("cframe_edge_peer_queue_drops_total",
+	"packets dropped by full send queue of peer", "peer")
+
+// sendQueue holds packets to one peer, drained by
+// a writer running only while packets are queued
+type sendQueue struct {
+	mu      sync.Mutex
+	pkts    []*egressPkt
+	running bool
+	dropped int64
+
+	// used by the writer only, nil if not paced
+	pacer *pacer
+}
+
+// sendQueues bounds backlog to each peer to depth packets,
+// so a slow peer never blocks others or grows memory
+type sendQueues struct {
+	depth    int
+	dropHead bool
+	write    func(p *egressPkt)
+
+	// pacing of each peer, see pacing.go
+	paceRate  int
+	paceBurst int
+
+	mu    sync.RWMutex
+	peers map[string]*sendQueue
+}
+
+func newSendQueues(depth int, policy string, write func(p *egressPkt)) (*sendQueues, error) {
+	switch policy {
+	case "", dropTail, dropHead:
+	default:
+		return nil, fmt.Errorf("unsupported drop policy %s", policy)
+	}
+
+	return &sendQueues{
+		depth:    depth,
+		dropHead: policy == dropHead,
+		write:    write,
+		peers:    make(map[string]*sendQueue),
+	}, nil
+}
+
+func (sq *sendQueues) queue(peer string) *sendQueue {
+	sq.mu.RLock()
+	q := sq.peers[peer]
+	sq.mu.RUnlock()
+	if q != nil {
+		return q
+	}
+
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	q = sq.peers[peer]
+	if q == nil {
+		q = &sendQueue{}
+		if sq.paceRate > 0 {
+			q.pacer = newPacer(sq.paceRate, sq.paceBurst)
+		}
+		sq.peers[peer] = q
+	}
+	return q
+}
+
+// forget removes queue and drops of peer, packets queued
+// are still written by the running writer
+func (sq *sendQueues) forget(peer string) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	delete(sq.peers, peer)
+	queueDrops.Delete(peer)
+}
+
+// push queues p to its peer, full queue drops by policy
+func (sq *sendQueues) push(p *egressPkt) {
+	peer := p.addr.String()
+	q := sq.queue(peer)
+
+	q.mu.Lock()
+	if len(q.pkts) >= sq.depth {
+		q.dropped++
+		queueDrops.Inc(peer)
+		log.Debug("send queue of %s full, drop packet", peer)
+		if !sq.dropHead {
+			q.mu.Unlock()
+			return
+		}
+		q.pkts[0] = nil
+		q.pkts = q.pkts[1:]
+	}
+	q.pkts = append(q.pkts, p)
+
+	start := !q.running
+	q.running = true
+	q.mu.Unlock()
+
+	if start {
+		go sq.drain(q)
+	}
+}
+
+// drain writes queued packets until the queue is empty
+func (sq *sendQueues) drain(q *sendQueue) {
+	for {
+		q.mu.Lock()
+		if len(q.pkts) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		p := q.pkts[0]
+		q.pkts[0] = nil
+		q.pkts = q.pkts[1:]
+		q.mu.Unlock()
+
+		if q.pacer != nil {
+			if d := q.pacer.reserve(len(p.buf), time.Now()); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		sq.write(p)
+	}
+}
+
+// SendQueueStatus is backlog and drops of a peer send queue
+type SendQueueStatus struct {
+	Queued  int   `json:"queued"`
+	Dropped int64 `json:"dropped"`
+}
+
+// SetSendQueue queues packets to each peer up to depth,
+// a full queue drops by policy, drop-tail or drop-head.
+// depth 0 writes packets in the sending goroutine
+func (s *Server) SetSendQueue(depth int, policy string) error {
+	if depth <= 0 {
+		s.sendq = nil
+		return nil
+	}
+
+	sq, err := newSendQueues(depth, policy, s.writeEgress)
+	if err != nil {
+		return err
+	}
+	s.sendq = sq
+	return nil
+}
+
+// SendQueues returns send queue status keyed by peer address
+func (s *Server) SendQueues() map[string]*SendQueueStatus {
+	status := make(map[string]*SendQueueStatus)
+	if s.sendq == nil {
+		return status
+	}
+
+	s.sendq.mu.RLock()
+	defer s.sendq.mu.RUnlock()
+	for peer, q := range s.sendq.peers {
+		q.mu.Lock()
+		status[peer] = &SendQueueStatus{Queued: len(q.pkts), Dropped: q.dropped}
+		q.mu.Unlock()
+	}
+	return status
+}
+
+// forgetQueues removes send queues of addrs no longer serving
+// any cidr, so queues of removed peers are not kept forever
+func (s *Server) forgetQueues(addrs []string) {
+	if s.sendq == nil {
+		return
+	}
+	nets := s.nets.Load().(peerNets)
+	for _, addr := range addrs {
+		if _, ok := nets[addr]; !ok {
+			s.sendq.forget(addr)
+		}
+	}
+}
+
+// egress writes p through the peer send queue if enabled
+func (s *Server) egress(p *egressPkt) {
+	if s.sendq != nil {
+		s.sendq.push(p)
+		return
+	}
+	s.writeEgress(p)
+}
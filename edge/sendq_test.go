@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestSendQueueStalledPeer(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		expect []byte
+	}{
+		// the first packet is being written when the flood begins
+		{dropTail, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{dropHead, []byte{0, 90, 91, 92, 93, 94, 95, 96, 97, 98, 99}},
+	} {
+		started := make(chan struct{}, 1)
+		stall := make(chan struct{})
+		written := make(chan byte, 100)
+		sq, err := newSendQueues(10, tc.policy, func(p *egressPkt) {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-stall
+			written <- p.buf[0]
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		slow := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 58423}
+		sq.push(&egressPkt{addr: slow, buf: []byte{0}})
+		<-started
+		for i := 1; i < 100; i++ {
+			sq.push(&egressPkt{addr: slow, buf: []byte{byte(i)}})
+		}
+
+		q := sq.queue(slow.String())
+		q.mu.Lock()
+		queued, dropped := len(q.pkts), q.dropped
+		q.mu.Unlock()
+		if queued != 10 || dropped != 89 {
+			t.Fatalf("%s: expected 10 queued 89 dropped, got %d %d", tc.policy, queued, dropped)
+		}
+
+		close(stall)
+		got := make([]byte, 0)
+		for len(got) < len(tc.expect) {
+			select {
+			case b := <-written:
+				got = append(got, b)
+			case <-time.After(time.Second):
+				t.Fatalf("%s: queue not drained, got %v", tc.policy, got)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.expect) {
+			t.Fatalf("%s: expected %v, got %v", tc.policy, tc.expect, got)
+		}
+		if v, _ := queueDrops.Value(slow.String()); v < 89 {
+			t.Fatalf("%s: drops not exported, got %v", tc.policy, v)
+		}
+	}
+}
+
+func TestSendQueuePeersIndependent(t *testing.T) {
+	stall := make(chan struct{})
+	defer close(stall)
+	slow := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 58423}
+	fast := &net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 58423}
+
+	written := make(chan string, 10)
+	sq, _ := newSendQueues(4, "", func(p *egressPkt) {
+		if p.addr == slow {
+			<-stall
+		}
+		written <- p.addr.String()
+	})
+
+	sq.push(&egressPkt{addr: slow, buf: []byte{0}})
+	sq.push(&egressPkt{addr: fast, buf: []byte{0}})
+	select {
+	case addr := <-written:
+		if addr != fast.String() {
+			t.Fatalf("unexpected write to %s", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stalled peer blocks others")
+	}
+
+	if _, err := newSendQueues(4, "red", nil); err == nil {
+		t.Fatal("expected error for unsupported policy")
+	}
+}
+
+func TestSendQueueForgetPeer(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+	if err := s.SetSendQueue(1, dropTail); err != nil {
+		t.Fatal(err)
+	}
+	peer := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 58423}
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: peer.String()})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: peer.String()})
+
+	stall := make(chan struct{})
+	defer close(stall)
+	s.sendq.write = func(p *egressPkt) { <-stall }
+	for i := 0; i < 3; i++ {
+		s.egress(&egressPkt{addr: peer, buf: []byte{byte(i)}})
+	}
+	if v, _ := queueDrops.Value(peer.String()); v == 0 {
+		t.Fatalf("drops not counted")
+	}
+
+	// peer still serves another cidr
+	s.DelPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: peer.String()})
+	if _, ok := s.SendQueues()[peer.String()]; !ok {
+		t.Fatalf("queue of peer serving 10.0.2.0/24 removed")
+	}
+
+	s.DelPeer(&codec.Edge{Cidr: "10.0.2.0/24", ListenAddr: peer.String()})
+	if _, ok := s.SendQueues()[peer.String()]; ok {
+		t.Fatalf("queue of removed peer kept")
+	}
+	if _, ok := queueDrops.Value(peer.String()); ok {
+		t.Fatalf("drops of removed peer still exported")
+	}
+}
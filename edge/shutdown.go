@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// Shutdown stops the edge in a fixed order, so traffic routed
+// to tun never meets a closed socket:
+// 1. packets from tun and peers are dropped
+// 2. os routes of peers and static routes are removed
+// 3. peer streams, peer sockets and the listen socket are closed
+func (s *Server) Shutdown() {
+	if !atomic.CompareAndSwapInt32(&s.stopping, 0, 1) {
+		return
+	}
+
+	log.Info("shutdown: stop forwarding")
+	s.RemoveStaticRoutes()
+	removed := s.installed.cleanup()
+	log.Info("shutdown: %d routes removed", removed)
+
+	s.closeSockets()
+	log.Info("shutdown: sockets closed")
+
+	if s.flows != nil {
+		s.flows.expire(time.Time{})
+		s.flows.w.Close()
+	}
+}
+
+// closeSockets closes peer streams, peer sockets and the listen socket
+func (s *Server) closeSockets() {
+	s.unregisterFastPath()
+	s.mu.RLock()
+	tcp, lis := s.tcp, s.tcpLis
+	s.mu.RUnlock()
+	if tcp != nil {
+		tcp.close()
+	}
+	if lis != nil {
+		lis.Close()
+	}
+	for _, conn := range s.peerSocks {
+		conn.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// stopped reports whether Shutdown began, packets are dropped
+func (s *Server) stopped() bool {
+	return atomic.LoadInt32(&s.stopping) == 1
+}
+
+// close closes streams to all peers
+func (t *tcpTransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for addr, conn := range t.conns {
+		conn.Close()
+		delete(t.conns, addr)
+	}
+}
+
+// setTCP records tcp transport and listener closed by Shutdown
+func (s *Server) setTCP(tcp *tcpTransport, lis net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tcp, s.tcpLis = tcp, lis
+}
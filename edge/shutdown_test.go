@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// orderRoutes records whether the listen socket
+// was still open when each route was removed
+type orderRoutes struct {
+	*fakeRoutes
+	s *Server
+
+	mu         sync.Mutex
+	openOnDels []bool
+}
+
+func (m *orderRoutes) DelRoute(cidr, dev string) error {
+	open := m.s.conn.SetReadDeadline(time.Time{}) == nil
+	m.mu.Lock()
+	m.openOnDels = append(m.openOnDels, open)
+	m.mu.Unlock()
+	return m.fakeRoutes.DelRoute(cidr, dev)
+}
+
+func TestShutdownOrder(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	routes := &orderRoutes{fakeRoutes: newFakeRoutes(), s: s}
+	s.SetRouteManager(routes)
+	s.conn = listenLocal(t)
+	done := make(chan struct{})
+	go func() {
+		s.readRemote(s.conn)
+		close(done)
+	}()
+
+	s.AddPeers([]*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"},
+		{Cidr: "10.0.2.1", ListenAddr: "2.2.2.2:58423"},
+	})
+	s.Shutdown()
+
+	routes.mu.Lock()
+	openOnDels := routes.openOnDels
+	routes.mu.Unlock()
+	if len(openOnDels) != 2 {
+		t.Fatalf("expected 2 routes removed, got %d", len(openOnDels))
+	}
+	for i, open := range openOnDels {
+		if !open {
+			t.Fatalf("route %d removed after socket closed", i)
+		}
+	}
+	if n, _ := routes.ListRoutes("cframe.0"); len(n) != 0 {
+		t.Fatalf("routes left after shutdown: %v", n)
+	}
+
+	// socket closed, reader exits
+	if err := s.conn.SetReadDeadline(time.Time{}); err == nil {
+		t.Fatal("listen socket open after shutdown")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reader not stopped")
+	}
+
+	// packets from tun are dropped, second shutdown is a noop
+	s.forwardLocal(listenLocal(t), 0, ipPacket("10.0.9.1", "10.0.1.5"))
+	s.Shutdown()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// staggeredPeers are peer installs pending in stagger workers,
+// key: peer key@listen addr, val: batch of the worker
+type staggeredPeers struct {
+	mu      sync.Mutex
+	pending map[string]*staggerBatch
+}
+
+// staggerBatch is closed once its pending installs are canceled
+type staggerBatch struct {
+	stop chan struct{}
+}
+
+// SetPeerStagger spreads setup of a large peer set,
+// peers are installed about every stagger with jitter, 0 disables
+func (s *Server) SetPeerStagger(stagger time.Duration) {
+	if stagger > 0 {
+		s.stagger = stagger
+	}
+}
+
+// installPeers installs the first peer at once and the rest by a
+// worker waiting jitter in [stagger/2, stagger*3/2) before each,
+// so edges never sync up and callers never wait for the batch.
+// a pending install of the same peer moves to this batch
+func (s *Server) installPeers(peers []*codec.Edge) {
+	if s.stagger <= 0 || len(peers) <= 1 {
+		for _, p := range peers {
+			s.cancelStaggered(peerKey(p) + "@" + p.ListenAddr)
+			s.installPeer(p)
+		}
+		return
+	}
+
+	s.cancelStaggered(peerKey(peers[0]) + "@" + peers[0].ListenAddr)
+	s.installPeer(peers[0])
+
+	// installPeer normalizes the peer, which callers
+	// still hold, eg: for converge
+	rest := make([]*codec.Edge, 0, len(peers)-1)
+	b := &staggerBatch{stop: make(chan struct{})}
+	st := s.staggered
+	st.mu.Lock()
+	for _, p := range peers[1:] {
+		st.pending[peerKey(p)+"@"+p.ListenAddr] = b
+		rest = append(rest, copyEdge(p))
+	}
+	st.mu.Unlock()
+	go s.staggerWorker(b, rest)
+}
+
+func (s *Server) staggerWorker(b *staggerBatch, peers []*codec.Edge) {
+	defer s.guard()
+	for _, p := range peers {
+		select {
+		case <-time.After(s.stagger/2 + time.Duration(rand.Int63n(int64(s.stagger)))):
+		case <-b.stop:
+			return
+		}
+		if s.stopped() {
+			return
+		}
+
+		key := peerKey(p) + "@" + p.ListenAddr
+		st := s.staggered
+		st.mu.Lock()
+		// canceled or moved to another batch meanwhile
+		if st.pending[key] != b {
+			st.mu.Unlock()
+			continue
+		}
+		delete(st.pending, key)
+		st.mu.Unlock()
+
+		s.installPeer(p)
+		s.checkConverge(time.Now())
+	}
+}
+
+// cancelStaggered drops pending install of peer key
+func (s *Server) cancelStaggered(key string) {
+	st := s.staggered
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.pending, key)
+}
+
+// cancelAllStaggered drops all pending installs
+// and stops their workers
+func (s *Server) cancelAllStaggered() {
+	st := s.staggered
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stopped := make(map[*staggerBatch]struct{})
+	for key, b := range st.pending {
+		delete(st.pending, key)
+		if _, ok := stopped[b]; !ok {
+			close(b.stop)
+			stopped[b] = struct{}{}
+		}
+	}
+}
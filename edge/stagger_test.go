@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// timedRoutes records when routes are added
+type timedRoutes struct {
+	*fakeRoutes
+	mu    sync.Mutex
+	added []time.Time
+}
+
+func (m *timedRoutes) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.added)
+}
+
+func (m *timedRoutes) AddRoute(cidr, dev string) error {
+	m.mu.Lock()
+	m.added = append(m.added, time.Now())
+	m.mu.Unlock()
+	return m.fakeRoutes.AddRoute(cidr, dev)
+}
+
+func TestPeerStagger(t *testing.T) {
+	const count = 10
+	peers := make([]*codec.Edge, 0, count)
+	for i := 0; i < count; i++ {
+		peers = append(peers, &codec.Edge{
+			Cidr:       fmt.Sprintf("10.0.%d.0/24", i),
+			ListenAddr: fmt.Sprintf("1.1.1.%d:58423", i),
+		})
+	}
+
+	for _, stagger := range []time.Duration{0, time.Millisecond * 10} {
+		s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+		routes := &timedRoutes{fakeRoutes: newFakeRoutes()}
+		s.SetRouteManager(routes)
+		s.SetPeerStagger(stagger)
+
+		// caller never waits for the schedule
+		start := time.Now()
+		s.AddPeers(peers)
+		if d := time.Since(start); stagger > 0 && d > stagger/2 {
+			t.Fatalf("stagger %v: AddPeers blocked for %v", stagger, d)
+		}
+		deadline := time.Now().Add(time.Second * 2)
+		for routes.count() != count && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 5)
+		}
+		if n := routes.count(); n != count {
+			t.Fatalf("stagger %v: expected %d peers added, got %d", stagger, count, n)
+		}
+		for _, p := range peers {
+			if addr, err := s.route(0, "", p.Cidr[:len(p.Cidr)-4]+"1"); err != nil || addr != p.ListenAddr {
+				t.Fatalf("stagger %v: expected route to %s, got %s %v", stagger, p.ListenAddr, addr, err)
+			}
+		}
+
+		spread := routes.added[count-1].Sub(routes.added[0])
+		if stagger == 0 {
+			if spread > time.Millisecond*50 {
+				t.Fatalf("peers added over %v without stagger", spread)
+			}
+			continue
+		}
+
+		// each gap is at least stagger/2
+		if spread < stagger/2*(count-1) {
+			t.Fatalf("peers added over %v, expected at least %v", spread, stagger/2*(count-1))
+		}
+		for i := 1; i < count; i++ {
+			if gap := routes.added[i].Sub(routes.added[i-1]); gap < stagger/2 {
+				t.Fatalf("peer %d added %v after previous one", i, gap)
+			}
+		}
+	}
+}
+
+func TestPeerStaggerReplaced(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	routes := &timedRoutes{fakeRoutes: newFakeRoutes()}
+	s.SetRouteManager(routes)
+	// first staggered install is due in 100ms at least
+	s.SetPeerStagger(time.Millisecond * 200)
+
+	peers := []*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"},
+		{Cidr: "10.0.2.0/24", ListenAddr: "1.1.1.2:58423"},
+		{Cidr: "10.0.3.0/24", ListenAddr: "1.1.1.3:58423"},
+	}
+	s.AddPeers(peers)
+
+	// pending install of a deleted peer is canceled,
+	// as are those of peers no longer wanted
+	s.DelPeer(peers[2])
+	s.SetPeers(peers[:1])
+	time.Sleep(time.Millisecond * 400)
+	if n := routes.count(); n != 1 {
+		t.Fatalf("expected only the first peer installed, got %d", n)
+	}
+	s.staggered.mu.Lock()
+	pending := len(s.staggered.pending)
+	s.staggered.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("pending installs left %d", pending)
+	}
+}
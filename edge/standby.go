@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+// SetFailback switches traffic back to the primary peer once it
+// recovers, otherwise traffic stays on standby until standby is down
+func (s *Server) SetFailback(failback bool) {
+	s.failback = failback
+}
+
+// activeAddr returns the address serving the cidr of p,
+// standby is selected once the primary is marked down by health check
+func (s *Server) activeAddr(p *peerConn) string {
+	if len(p.standby) == 0 {
+		return p.addr
+	}
+	if len(p.addr) == 0 {
+		return p.standby
+	}
+
+	if atomic.LoadInt32(&p.failover) == 0 {
+		if !s.health.isUp(p.addr) && s.health.isUp(p.standby) {
+			if atomic.CompareAndSwapInt32(&p.failover, 0, 1) {
+				log.Warn("peer %s for %s down, failover to standby %s",
+					p.addr, p.cidr, p.standby)
+			}
+			return p.standby
+		}
+		return p.addr
+	}
+
+	if s.health.isUp(p.addr) && (s.failback || !s.health.isUp(p.standby)) {
+		if atomic.CompareAndSwapInt32(&p.failover, 1, 0) {
+			log.Info("peer %s for %s recovered, failback from standby %s",
+				p.addr, p.cidr, p.standby)
+		}
+		return p.addr
+	}
+	return p.standby
+}
+
+// delPath removes the path of peer, returns true if
+// standby or other equal peers still serve the cidr
+func (s *Server) delPath(peer *codec.Edge) bool {
+	cidr := hostCIDR(peer.Cidr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// runs before unlock, paths removed change vnis of peers
+	defer s.indexPeers()
+	pc, ok := s.peerConns[peer.Vni][cidr]
+	if !ok {
+		return false
+	}
+
+	if peer.Standby {
+		if pc.standby != peer.ListenAddr {
+			return true
+		}
+		pc.standby, pc.standbyID = "", ""
+		atomic.StoreInt32(&pc.failover, 0)
+		return len(pc.addr) > 0
+	}
+
+	if pc.delPath(peer.ListenAddr) && len(pc.paths) > 0 {
+		pc.addr, pc.id = pc.paths[0].addr, pc.paths[0].id
+		return true
+	}
+
+	if len(pc.standby) == 0 {
+		return false
+	}
+	pc.addr, pc.id, pc.draining, pc.paths = "", "", false, nil
+	return true
+}
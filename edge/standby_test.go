@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestStandbyFailover(t *testing.T) {
+	a := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	a.SetRouteManager(newFakeRoutes())
+	a.SetHealthCheck(time.Millisecond*20, 2)
+	a.conn = listenLocal(t)
+	go a.readRemote(a.conn)
+
+	// primary is dead, never replies pong
+	primary := listenLocal(t)
+	standby := NewServer("", "key", nil)
+	standby.conn = listenLocal(t)
+	go standby.readRemote(standby.conn)
+
+	paddr := primary.LocalAddr().String()
+	saddr := standby.conn.LocalAddr().String()
+	a.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: paddr})
+	a.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: saddr, Standby: true})
+
+	if addr, _ := a.route(0, "", "10.0.1.1"); addr != paddr {
+		t.Fatalf("expected route to primary %s, got %s", paddr, addr)
+	}
+
+	go a.healthCheck()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if addr, _ := a.route(0, "", "10.0.1.1"); addr == saddr {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("no failover to standby %s", saddr)
+}
+
+func TestStandbyFailback(t *testing.T) {
+	for _, failback := range []bool{true, false} {
+		s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+		s.SetRouteManager(newFakeRoutes())
+		s.SetHealthCheck(time.Second, 2)
+		s.SetFailback(failback)
+		s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"})
+		s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "2.2.2.2:58423", Standby: true})
+
+		// primary loses 2 pings
+		now := time.Now()
+		for i := 0; i < 3; i++ {
+			s.health.onPing("1.1.1.1:58423", "1.1.1.1:58423", now.Add(time.Duration(i)*time.Second))
+		}
+		if addr, _ := s.route(0, "", "10.0.1.1"); addr != "2.2.2.2:58423" {
+			t.Fatalf("expected failover to standby, got %s", addr)
+		}
+
+		// primary recovers
+		s.health.onPong("1.1.1.1:58423", now.Add(time.Second*3))
+		expect := "2.2.2.2:58423"
+		if failback {
+			expect = "1.1.1.1:58423"
+		}
+		if addr, _ := s.route(0, "", "10.0.1.1"); addr != expect {
+			t.Fatalf("failback %v: expected route to %s, got %s", failback, expect, addr)
+		}
+	}
+}
+
+func TestStandbyDelPrimary(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(routes)
+	primary := &codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "1.1.1.1:58423"}
+	standby := &codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: "2.2.2.2:58423", Standby: true}
+	s.AddPeer(primary)
+	s.AddPeer(standby)
+
+	// standby takes over, route is kept
+	s.DelPeer(primary)
+	if addr, _ := s.route(0, "", "10.0.1.1"); addr != "2.2.2.2:58423" {
+		t.Fatalf("expected route to standby, got %s", addr)
+	}
+	for _, call := range routes.Calls() {
+		if call[:3] == "del" {
+			t.Fatalf("route removed while standby serves the cidr")
+		}
+	}
+
+	s.DelPeer(standby)
+	if _, err := s.route(0, "", "10.0.1.1"); err == nil {
+		t.Fatalf("expected no route after standby removed")
+	}
+}
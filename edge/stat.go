@@ -20,6 +20,7 @@ func init() {
 
 var msgMu sync.Mutex
 var msg = &codec.ReportMsg{}
+var hosts = make(map[string]struct{})
 
 func AddTrafficIn(traffic int64) {
 	msgMu.Lock()
@@ -39,8 +40,21 @@ func AddErrorLog(err error) {
 	msg.Error = append(msg.Error, err.Error())
 }
 
+func AddHost(host string) {
+	msgMu.Lock()
+	defer msgMu.Unlock()
+	hosts[host] = struct{}{}
+}
+
 func ResetStat() *codec.ReportMsg {
+	msgMu.Lock()
+	defer msgMu.Unlock()
 	m := msg
+	m.Hosts = make([]string, 0, len(hosts))
+	for host := range hosts {
+		m.Hosts = append(m.Hosts, host)
+	}
+	hosts = make(map[string]struct{})
 	m.Timestamp = time.Now().Unix()
 	cpu, _ := p.CPUPercent()
 	mem, _ := p.MemoryPercent()
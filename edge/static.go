@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+	log "github.com/ICKelin/cframe/pkg/logs"
+)
+
+const defaultStaticRefresh = time.Second * 30
+
+// staticRoutes are extra routes via peers, installed as peers
+// so they are retried and reconciled like peer routes
+// key: peerKey of the route
+type staticRoutes struct {
+	mu sync.Mutex
+	m  map[string]*codec.Edge
+
+	// routes configured, peers are resolved by name
+	// again each refresh to follow peers moved or joined
+	routes  []*codec.StaticRoute
+	refresh time.Duration
+}
+
+// SetStaticRefresh sets how often peers of static routes are
+// resolved by name again, 0 resolves them only once registered
+func (s *Server) SetStaticRefresh(interval time.Duration) {
+	s.static.refresh = interval
+}
+
+// AddStaticRoutes installs routes via the named peers,
+// routes installed before but not in routes are removed
+func (s *Server) AddStaticRoutes(routes []*codec.StaticRoute, peers []*codec.Edge) {
+	s.static.mu.Lock()
+	defer s.static.mu.Unlock()
+	s.static.routes = routes
+	s.resolveStatic(peers)
+}
+
+// refreshStaticRoutes resolves peers of static routes by
+// the peers known now
+func (s *Server) refreshStaticRoutes() {
+	s.static.mu.Lock()
+	defer s.static.mu.Unlock()
+	s.resolveStatic(s.namedPeers())
+}
+
+func (s *Server) refreshStaticLoop() {
+	defer s.guard()
+	tick := time.NewTicker(s.static.refresh)
+	defer tick.Stop()
+	for range tick.C {
+		s.refreshStaticRoutes()
+	}
+}
+
+// resolveStatic installs static routes via peers by name,
+// must be called with static.mu held
+func (s *Server) resolveStatic(peers []*codec.Edge) {
+	routes := s.static.routes
+	byName := make(map[string]*codec.Edge)
+	for _, peer := range peers {
+		if len(peer.Name) > 0 {
+			byName[peer.Name] = peer
+		}
+	}
+
+	want := make(map[string]*codec.Edge)
+	for _, route := range routes {
+		peer := byName[route.Peer]
+		if peer == nil {
+			log.Warn("static route %s via unknown peer %s", route.Cidr, route.Peer)
+			continue
+		}
+
+		edge := &codec.Edge{
+			Cidr:       route.Cidr,
+			ListenAddr: peer.ListenAddr,
+			Vni:        peer.Vni,
+		}
+		want[peerKey(edge)] = edge
+	}
+
+	for key, old := range s.static.m {
+		if edge, ok := want[key]; ok && edge.ListenAddr == old.ListenAddr {
+			delete(want, key)
+			continue
+		}
+		log.Info("remove static route %s via %s", old.Cidr, old.ListenAddr)
+		s.forgetPeer(old)
+		s.delRoute(copyEdge(old))
+		delete(s.static.m, key)
+	}
+
+	for key, edge := range want {
+		log.Info("add static route %s via %s", edge.Cidr, edge.ListenAddr)
+		s.static.m[key] = edge
+		s.installPeer(copyEdge(edge))
+	}
+}
+
+// isStatic returns whether peer is a static route
+func (s *Server) isStatic(peer *codec.Edge) bool {
+	s.static.mu.Lock()
+	defer s.static.mu.Unlock()
+	old, ok := s.static.m[peerKey(peer)]
+	return ok && old.ListenAddr == peer.ListenAddr
+}
+
+// RemoveStaticRoutes removes all static routes, called on shutdown
+func (s *Server) RemoveStaticRoutes() {
+	s.AddStaticRoutes(nil, nil)
+}
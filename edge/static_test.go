@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestStaticRoutes(t *testing.T) {
+	routes := newFakeRoutes()
+	s := NewServer("", "key", nil)
+	s.SetRouteManager(routes)
+	s.AddInterface(0, &Interface{tun: newFakeTun("cframe.0")})
+	s.AddInterface(1, &Interface{tun: newFakeTun("cframe.1")})
+
+	peers := []*codec.Edge{
+		{Name: "edge2", ListenAddr: "2.2.2.2:58423", Cidr: "10.0.2.0/24"},
+		{Name: "edge3", ListenAddr: "3.3.3.3:58423", Cidr: "10.0.3.0/24", Vni: 1},
+	}
+	s.AddPeers(peers)
+
+	static, err := codec.ParseStaticRoutes("192.168.100.0/24=edge3, 172.16.0.0/16=edge4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddStaticRoutes(static, peers)
+
+	// installed to the iface of the peer's vni
+	if _, ok := routes.routes["cframe.1"]["192.168.100.0/24"]; !ok {
+		t.Fatalf("static route not installed to cframe.1: %v", routes.calls)
+	}
+	peer, err := s.route(1, "", "192.168.100.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer != "3.3.3.3:58423" {
+		t.Fatalf("expected static route via edge3, got %s", peer)
+	}
+
+	// unknown peer is skipped
+	if _, err := s.route(0, "", "172.16.0.1"); err == nil {
+		t.Fatalf("static route via unknown peer installed")
+	}
+
+	s.RemoveStaticRoutes()
+	if _, ok := routes.routes["cframe.1"]["192.168.100.0/24"]; ok {
+		t.Fatalf("static route not removed")
+	}
+	if _, err := s.route(0, "", "10.0.2.1"); err != nil {
+		t.Fatalf("peer route removed with static routes: %v", err)
+	}
+
+	if _, err := codec.ParseStaticRoutes("192.168.100.0/24"); err == nil {
+		t.Fatalf("expected static route without peer rejected")
+	}
+}
+
+func TestSetPeersKeepsStaticRoutes(t *testing.T) {
+	s := NewServer("", "key", nil)
+	s.SetRouteManager(newFakeRoutes())
+	s.AddInterface(0, &Interface{tun: newFakeTun("cframe.0")})
+
+	peers := []*codec.Edge{{Name: "edge2", ListenAddr: "2.2.2.2:58423", Cidr: "10.0.2.0/24"}}
+	s.AddPeers(peers)
+	s.AddStaticRoutes([]*codec.StaticRoute{{Cidr: "192.168.100.0/24", Peer: "edge2"}}, peers)
+
+	s.SetPeers(peers)
+	if _, err := s.route(0, "", "192.168.100.1"); err != nil {
+		t.Fatalf("static route removed by peer set: %v", err)
+	}
+}
+
+func TestStaticRoutesRefresh(t *testing.T) {
+	s := NewServer("", "key", nil)
+	s.SetRouteManager(newFakeRoutes())
+	s.AddInterface(0, &Interface{tun: newFakeTun("cframe.0")})
+
+	peers := []*codec.Edge{{Name: "edge2", ListenAddr: "2.2.2.2:58423", Cidr: "10.0.2.0/24"}}
+	s.AddPeers(peers)
+	s.AddStaticRoutes([]*codec.StaticRoute{
+		{Cidr: "192.168.100.0/24", Peer: "edge2"},
+		{Cidr: "172.16.0.0/16", Peer: "edge3"},
+	}, peers)
+
+	// peer moved and peer joined after register
+	s.AddPeers([]*codec.Edge{
+		{Name: "edge2", ListenAddr: "4.4.4.4:58423", Cidr: "10.0.2.0/24"},
+		{Name: "edge3", ListenAddr: "3.3.3.3:58423", Cidr: "10.0.3.0/24"},
+	})
+	s.refreshStaticRoutes()
+	if peer, err := s.route(0, "", "192.168.100.1"); err != nil || peer != "4.4.4.4:58423" {
+		t.Fatalf("static route not moved with peer: %s %v", peer, err)
+	}
+	if peer, err := s.route(0, "", "172.16.0.1"); err != nil || peer != "3.3.3.3:58423" {
+		t.Fatalf("static route via joined peer not installed: %s %v", peer, err)
+	}
+
+	// removed with its peer
+	s.DelPeer(&codec.Edge{Name: "edge3", ListenAddr: "3.3.3.3:58423", Cidr: "10.0.3.0/24"})
+	s.refreshStaticRoutes()
+	if _, err := s.route(0, "", "172.16.0.1"); err == nil {
+		t.Fatalf("static route via removed peer left")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+// peer table size is logged every tableLogInterval,
+// a slowly growing table hints peers never removed
+var tableLogInterval = time.Minute
+
+var (
+	peerTableSize = metrics.NewGauge("cframe_edge_peer_table_size",
+		"cidrs in the peer table of all vnis")
+	peerTablePeak = metrics.NewGauge("cframe_edge_peer_table_peak",
+		"high-water mark of the peer table size")
+	osRoutesInstalled = metrics.NewGauge("cframe_edge_os_routes_installed",
+		"routes installed to os routing table")
+)
+
+// tableSize keeps size and high-water mark of the peer table
+type tableSize struct {
+	size int
+	peak int
+}
+
+// peerAdded counts a new cidr in the peer table, s.mu held
+func (s *Server) peerAdded() {
+	s.table.size++
+	if s.table.size > s.table.peak {
+		s.table.peak = s.table.size
+		peerTablePeak.Set(int64(s.table.peak))
+	}
+	peerTableSize.Set(int64(s.table.size))
+}
+
+// peerRemoved counts a cidr removed from the peer table, s.mu held
+func (s *Server) peerRemoved() {
+	s.table.size--
+	peerTableSize.Set(int64(s.table.size))
+}
+
+// TableSize returns size and high-water mark of the peer table
+// and routes installed to os
+func (s *Server) TableSize() (size, peak, routes int) {
+	s.mu.RLock()
+	size, peak = s.table.size, s.table.peak
+	s.mu.RUnlock()
+	return size, peak, s.installed.len()
+}
+
+func (r *installedRoutes) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.routes)
+}
+
+func (s *Server) logTableSize() {
+	tick := time.NewTicker(tableLogInterval)
+	defer tick.Stop()
+	for range tick.C {
+		size, peak, routes := s.TableSize()
+		log.Info("peer table size %d, peak %d, os routes %d", size, peak, routes)
+	}
+}
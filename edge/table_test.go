@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestPeerTableSize(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+
+	expect := func(size, peak int) {
+		t.Helper()
+		gotSize, gotPeak, routes := s.TableSize()
+		if gotSize != size || gotPeak != peak || routes != size {
+			t.Fatalf("expected size %d peak %d, got %d %d routes %d",
+				size, peak, gotSize, gotPeak, routes)
+		}
+		if peerTableSize.Value() != int64(size) || peerTablePeak.Value() != int64(peak) ||
+			osRoutesInstalled.Value() != int64(size) {
+			t.Fatalf("expected gauges %d %d, got %d %d %d", size, peak,
+				peerTableSize.Value(), peerTablePeak.Value(), osRoutesInstalled.Value())
+		}
+	}
+
+	peers := make([]*codec.Edge, 0)
+	for i := 0; i < 5; i++ {
+		peers = append(peers, &codec.Edge{
+			Cidr:       fmt.Sprintf("10.0.%d.0/24", i),
+			ListenAddr: fmt.Sprintf("1.1.1.%d:58423", i),
+		})
+	}
+	for _, peer := range peers {
+		s.AddPeer(copyEdge(peer))
+	}
+	expect(5, 5)
+
+	// same cidr again is not a new entry
+	s.AddPeer(copyEdge(peers[0]))
+	expect(5, 5)
+
+	for _, peer := range peers[:3] {
+		s.DelPeer(copyEdge(peer))
+	}
+	expect(2, 5)
+
+	// removing an unknown peer changes nothing
+	s.DelPeer(copyEdge(peers[0]))
+	expect(2, 5)
+
+	s.AddPeer(&codec.Edge{Cidr: "10.1.0.0/24", ListenAddr: "2.2.2.2:58423"})
+	expect(3, 5)
+}
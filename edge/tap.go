@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapSnapLen    = 65535
+	linkTypeRaw    = 101
+	defaultTapRing = 1024
+
+	// records queued to the file writer,
+	// dropped once full rather than stall forwarding
+	tapQueueLen = 4096
+)
+
+var tapDropped = metrics.NewCounter("cframe_edge_tap_dropped_total",
+	"captured packets not written to tap file as writer falls behind")
+
+// tapPacket is a captured packet
+type tapPacket struct {
+	ts  time.Time
+	pkt []byte
+}
+
+// tap captures forwarded inner packets matching src/dst filter,
+// keeps the latest packets in ring and writes to pcap file if set
+type tap struct {
+	src, dst string
+
+	mu   sync.Mutex
+	ring []tapPacket
+	next int
+	full bool
+
+	// records to file writer, nil if no file or closed
+	records chan tapPacket
+	done    chan struct{}
+}
+
+// TapConfig is options of tap, empty src/dst matches any
+type TapConfig struct {
+	Src  string `json:"src"`
+	Dst  string `json:"dst"`
+	File string `json:"file"`
+	Ring int    `json:"ring"`
+}
+
+func newTap(cfg *TapConfig) (*tap, error) {
+	ring := cfg.Ring
+	if ring <= 0 {
+		ring = defaultTapRing
+	}
+
+	t := &tap{
+		src:  cfg.Src,
+		dst:  cfg.Dst,
+		ring: make([]tapPacket, ring),
+	}
+
+	if len(cfg.File) > 0 {
+		fp, err := os.Create(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		w := bufio.NewWriter(fp)
+		if err := writePcapHeader(w); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		t.records = make(chan tapPacket, tapQueueLen)
+		t.done = make(chan struct{})
+		go t.writeFile(fp, w, t.records)
+	}
+	return t, nil
+}
+
+// writeFile writes queued records to fp until records closed
+func (t *tap) writeFile(fp *os.File, w *bufio.Writer, records chan tapPacket) {
+	defer close(t.done)
+	defer fp.Close()
+	for p := range records {
+		if err := writePcapRecord(w, p); err != nil {
+			log.Error("write tap file fail: %v", err)
+			continue
+		}
+		// flush once idle so file is readable while capturing
+		if len(records) == 0 {
+			if err := w.Flush(); err != nil {
+				log.Error("flush tap file fail: %v", err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Error("flush tap file fail: %v", err)
+	}
+}
+
+// tapPath resolves capture file name of admin api under tap dir,
+// absolute paths and paths escaping tap dir are refused
+func (s *Server) tapPath(name string) (string, error) {
+	if len(name) == 0 {
+		return "", nil
+	}
+	if len(s.tapDir) == 0 {
+		return "", fmt.Errorf("tap_dir not configured")
+	}
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("tap file %q not relative", name)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("tap file %q escapes tap_dir", name)
+		}
+	}
+	return filepath.Join(s.tapDir, name), nil
+}
+
+// SetTapDir sets directory of capture files started by admin api
+func (s *Server) SetTapDir(dir string) {
+	s.tapDir = dir
+}
+
+func (t *tap) match(p Packet) bool {
+	if len(t.src) > 0 && p.Src() != t.src {
+		return false
+	}
+	if len(t.dst) > 0 && p.Dst() != t.dst {
+		return false
+	}
+	return true
+}
+
+func (t *tap) capture(pkt []byte) {
+	p := Packet(pkt)
+	if p.Invalid() || !t.match(p) {
+		return
+	}
+
+	cp := tapPacket{ts: time.Now(), pkt: make([]byte, len(pkt))}
+	copy(cp.pkt, pkt)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ring[t.next] = cp
+	t.next = (t.next + 1) % len(t.ring)
+	if t.next == 0 {
+		t.full = true
+	}
+
+	if t.records != nil {
+		select {
+		case t.records <- cp:
+		default:
+			tapDropped.Inc()
+		}
+	}
+}
+
+// packets returns captured packets in ring, the oldest first
+func (t *tap) packets() []tapPacket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.full {
+		return append([]tapPacket{}, t.ring[:t.next]...)
+	}
+	return append(append([]tapPacket{}, t.ring[t.next:]...), t.ring[:t.next]...)
+}
+
+// close stops queueing records and waits queued ones written
+func (t *tap) close() {
+	t.mu.Lock()
+	records := t.records
+	t.records = nil
+	t.mu.Unlock()
+	if records != nil {
+		close(records)
+		<-t.done
+	}
+}
+
+// writePcap writes packets in pcap format
+func writePcap(w io.Writer, pkts []tapPacket) error {
+	if err := writePcapHeader(w); err != nil {
+		return err
+	}
+	for _, p := range pkts {
+		if err := writePcapRecord(w, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePcapHeader(w io.Writer) error {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeRaw)
+	_, err := w.Write(hdr)
+	return err
+}
+
+func writePcapRecord(w io.Writer, p tapPacket) error {
+	buf := bytes.NewBuffer(make([]byte, 0, 16+len(p.pkt)))
+	rec := make([]byte, 16)
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(p.ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(p.ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(p.pkt)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(p.pkt)))
+	buf.Write(rec)
+	buf.Write(p.pkt)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// StartTap starts capturing forwarded packets,
+// running tap is replaced
+func (s *Server) StartTap(cfg *TapConfig) error {
+	t, err := newTap(cfg)
+	if err != nil {
+		return fmt.Errorf("start tap fail: %v", err)
+	}
+
+	old := s.tap.Load().(*tap)
+	s.tap.Store(t)
+	if old != nil {
+		old.close()
+	}
+	log.Info("tap started, src %q dst %q file %q", cfg.Src, cfg.Dst, cfg.File)
+	return nil
+}
+
+// StopTap stops capturing, captured packets are discarded
+func (s *Server) StopTap() {
+	old := s.tap.Load().(*tap)
+	s.tap.Store((*tap)(nil))
+	if old != nil {
+		old.close()
+		log.Info("tap stopped")
+	}
+}
+
+// ToggleTap starts tap with cfg if stopped, otherwise stops it
+func (s *Server) ToggleTap(cfg *TapConfig) error {
+	if s.tap.Load().(*tap) != nil {
+		s.StopTap()
+		return nil
+	}
+	return s.StartTap(cfg)
+}
+
+// WriteTap writes packets captured in ring to w in pcap format
+func (s *Server) WriteTap(w io.Writer) error {
+	t := s.tap.Load().(*tap)
+	if t == nil {
+		return fmt.Errorf("tap not started")
+	}
+	return writePcap(w, t.packets())
+}
+
+// capture is called for each forwarded packet,
+// costs an atomic load when tap is stopped
+func (s *Server) capture(pkt []byte) {
+	if t := s.tap.Load().(*tap); t != nil {
+		t.capture(pkt)
+	}
+}
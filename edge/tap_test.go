@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestTapCapture(t *testing.T) {
+	s := NewServer("", "key", nil)
+	admin := NewAdmin("", s)
+
+	// disabled tap captures nothing
+	s.capture(ipPacket("10.0.0.1", "10.0.0.2"))
+	rec := httptest.NewRecorder()
+	admin.mux.ServeHTTP(rec, httptest.NewRequest("GET", "/tap", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected tap not started, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	admin.mux.ServeHTTP(rec, httptest.NewRequest("POST", "/tap/start?dst=10.0.0.2", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("start tap fail: %d %s", rec.Code, rec.Body)
+	}
+
+	pkt := ipPacket("10.0.0.1", "10.0.0.2")
+	s.capture(pkt)
+	s.capture(ipPacket("10.0.0.1", "10.0.0.3"))
+
+	rec = httptest.NewRecorder()
+	admin.mux.ServeHTTP(rec, httptest.NewRequest("GET", "/tap", nil))
+	buf := rec.Body.Bytes()
+	if len(buf) != 24+16+len(pkt) {
+		t.Fatalf("expected 1 packet captured, got %d bytes", len(buf))
+	}
+	if magic := binary.LittleEndian.Uint32(buf[0:4]); magic != pcapMagic {
+		t.Fatalf("invalid pcap magic 0x%x", magic)
+	}
+	if link := binary.LittleEndian.Uint32(buf[20:24]); link != linkTypeRaw {
+		t.Fatalf("invalid link type %d", link)
+	}
+	if caplen := binary.LittleEndian.Uint32(buf[32:36]); int(caplen) != len(pkt) {
+		t.Fatalf("invalid caplen %d", caplen)
+	}
+	if !bytes.Equal(buf[40:], pkt) {
+		t.Fatalf("captured packet mismatch")
+	}
+
+	s.StopTap()
+	if err := s.WriteTap(&bytes.Buffer{}); err == nil {
+		t.Fatalf("expected tap stopped")
+	}
+}
+
+func TestTapRing(t *testing.T) {
+	tp, _ := newTap(&TapConfig{Ring: 2})
+	for _, dst := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		tp.capture(ipPacket("10.0.1.1", dst))
+	}
+
+	pkts := tp.packets()
+	if len(pkts) != 2 {
+		t.Fatalf("expected 2 packets in ring, got %d", len(pkts))
+	}
+	if Packet(pkts[0].pkt).Dst() != "10.0.0.2" || Packet(pkts[1].pkt).Dst() != "10.0.0.3" {
+		t.Fatalf("ring does not keep the latest packets")
+	}
+}
+
+func TestTapFile(t *testing.T) {
+	s := NewServer("", "key", nil)
+	admin := NewAdmin("", s)
+
+	// file captures refused until tap_dir set
+	rec := httptest.NewRecorder()
+	admin.mux.ServeHTTP(rec, httptest.NewRequest("POST", "/tap/start?file=edge.pcap", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected file refused without tap_dir, got %d", rec.Code)
+	}
+
+	dir := t.TempDir()
+	s.SetTapDir(dir)
+	for _, file := range []string{"/etc/passwd", "../edge.pcap", "a/../../edge.pcap"} {
+		rec = httptest.NewRecorder()
+		admin.mux.ServeHTTP(rec, httptest.NewRequest("POST", "/tap/start?file="+file, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected %s refused, got %d", file, rec.Code)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	admin.mux.ServeHTTP(rec, httptest.NewRequest("POST", "/tap/start?file=edge.pcap", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("start tap fail: %d %s", rec.Code, rec.Body)
+	}
+	pkt := ipPacket("10.0.0.1", "10.0.0.2")
+	s.capture(pkt)
+	s.StopTap()
+
+	// records written by writer and flushed on stop
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "edge.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 24+16+len(pkt) || !bytes.Equal(buf[40:], pkt) {
+		t.Fatalf("unexpected tap file of %d bytes", len(buf))
+	}
+}
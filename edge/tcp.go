@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/proxyproto"
+)
+
+const (
+	transportUDP = "udp"
+	transportTCP = "tcp"
+
+	// stream blocked longer by a frame is dropped and redialed
+	tcpWriteTimeout = time.Second * 5
+)
+
+// tcp transport carries data packets on streams for networks
+// where udp is blocked, control packets stay on udp
+// | 2bytes length | encoded packet |
+// the first frame of a stream is the hello of the dialer
+// | 2bytes listen port | 8bytes unix nano | 32bytes hmac | name |
+// the receiver verifies hmac by the shared key and identifies the
+// named peer by the listen address it knows, as for udp, so peers
+// behind one nat or proxy never collapse. unnamed dialers send the
+// port only and are identified by remote ip and port
+type tcpTransport struct {
+	dialer  dialer
+	port    int
+	timeout time.Duration
+
+	// key signs hello announcing name, port only if name is empty
+	key, name string
+
+	// streams to peers and dials in flight, key: peer listen addr
+	mu      sync.Mutex
+	conns   map[string]net.Conn
+	dialing map[string]*tcpDial
+	closed  bool
+}
+
+// tcpDial is a dial in flight, writers to the same
+// peer wait for it instead of dialing again
+type tcpDial struct {
+	done chan struct{}
+	conn net.Conn
+	err  error
+}
+
+func newTCPTransport(d dialer, port int) *tcpTransport {
+	return &tcpTransport{
+		dialer:  d,
+		port:    port,
+		timeout: tcpWriteTimeout,
+		conns:   make(map[string]net.Conn),
+		dialing: make(map[string]*tcpDial),
+	}
+}
+
+func (t *tcpTransport) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	key := addr.String()
+	conn, err := t.conn(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// a single write keeps the frame intact among writers,
+	// a timed out frame may be partially written so the
+	// stream is dropped as broken
+	err = t.write(conn, tcpFrame(buf))
+	if err != nil {
+		t.drop(key, conn)
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (t *tcpTransport) write(conn net.Conn, frame []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(t.timeout))
+	_, err := conn.Write(frame)
+	return err
+}
+
+// conn returns stream to addr, dialed out of lock so a slow
+// peer never blocks writers to others
+func (t *tcpTransport) conn(addr string) (net.Conn, error) {
+	t.mu.Lock()
+	if conn := t.conns[addr]; conn != nil {
+		t.mu.Unlock()
+		return conn, nil
+	}
+	if d := t.dialing[addr]; d != nil {
+		t.mu.Unlock()
+		<-d.done
+		return d.conn, d.err
+	}
+	d := &tcpDial{done: make(chan struct{})}
+	t.dialing[addr] = d
+	t.mu.Unlock()
+
+	conn, err := t.dial(addr)
+
+	t.mu.Lock()
+	delete(t.dialing, addr)
+	switch {
+	case err != nil:
+	case t.closed:
+		conn.Close()
+		conn, err = nil, fmt.Errorf("tcp transport closed")
+	case t.conns[addr] != nil:
+		conn.Close()
+		conn = t.conns[addr]
+	default:
+		log.Info("connected to peer %s over tcp", addr)
+		t.conns[addr] = conn
+	}
+	t.mu.Unlock()
+
+	d.conn, d.err = conn, err
+	close(d.done)
+	return conn, err
+}
+
+func (t *tcpTransport) dial(addr string) (net.Conn, error) {
+	conn, err := t.dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.write(conn, tcpFrame(tcpHello(t.key, t.name, t.port, time.Now()))); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// tcpHello builds the first frame of a stream, see tcpTransport
+func tcpHello(key, name string, port int, now time.Time) []byte {
+	hello := []byte{byte(port >> 8), byte(port)}
+	if len(name) == 0 {
+		return hello
+	}
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(now.UnixNano()))
+	hello = append(hello, ts...)
+	hello = append(hello, tcpHelloMAC(key, hello[:2], ts, name)...)
+	return append(hello, name...)
+}
+
+func tcpHelloMAC(key string, port, ts []byte, name string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("tcp|"))
+	mac.Write(port)
+	mac.Write(ts)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+// tcpHellos are the latest hello accepted of each peer name,
+// earlier ones are replays
+type tcpHellos struct {
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+// tcpPeer returns address of the peer sending hello on conn,
+// the listen address of the named peer if known
+func (s *Server) tcpPeer(conn net.Conn, hello []byte) (*net.UDPAddr, error) {
+	if len(hello) < 2 {
+		return nil, fmt.Errorf("invalid hello")
+	}
+	from := &net.UDPAddr{
+		IP:   conn.RemoteAddr().(*net.TCPAddr).IP,
+		Port: int(binary.BigEndian.Uint16(hello[:2])),
+	}
+	if len(hello) == 2 {
+		return from, nil
+	}
+	if len(hello) <= 10+sha256.Size {
+		return nil, fmt.Errorf("invalid hello")
+	}
+
+	ts, mac, name := hello[2:10], hello[10:10+sha256.Size], string(hello[10+sha256.Size:])
+	if !hmac.Equal(mac, tcpHelloMAC(s.key, hello[:2], ts, name)) {
+		return nil, fmt.Errorf("hello of %s: invalid mac", name)
+	}
+	at := int64(binary.BigEndian.Uint64(ts))
+	skew := time.Since(time.Unix(0, at))
+	if skew < -migrateMaxSkew || skew > migrateMaxSkew {
+		return nil, fmt.Errorf("hello of %s: clock skew %v", name, skew)
+	}
+
+	s.tcpHellos.mu.Lock()
+	if at <= s.tcpHellos.last[name] {
+		s.tcpHellos.mu.Unlock()
+		return nil, fmt.Errorf("hello of %s replayed", name)
+	}
+	s.tcpHellos.last[name] = at
+	s.tcpHellos.mu.Unlock()
+
+	addr := s.peerAddr(name)
+	if len(addr) == 0 {
+		return from, nil
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+// drop closes broken stream, redialed on next write
+func (t *tcpTransport) drop(addr string, conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns[addr] == conn {
+		delete(t.conns, addr)
+	}
+	conn.Close()
+}
+
+func tcpFrame(buf []byte) []byte {
+	frame := make([]byte, 2, 2+len(buf))
+	binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+	return append(frame, buf...)
+}
+
+// SetTransport sets transport of data packets to peers,
+// tcp streams are dialed through proxy if set
+func (s *Server) SetTransport(name, proxy string) error {
+	switch name {
+	case "", transportUDP:
+		s.transport = transportUDP
+		return nil
+	case transportTCP:
+	default:
+		return fmt.Errorf("unsupported transport %s", name)
+	}
+
+	d, err := NewDialer(proxy)
+	if err != nil {
+		return err
+	}
+	s.transport, s.dialer = transportTCP, d
+	return nil
+}
+
+// peerTransport returns transport of data packets to peer addr,
+// transport announced by the peer overrides the default sock
+func (s *Server) peerTransport(sock transport, addr string) transport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch s.peerTransports[addr] {
+	case transportTCP:
+		if s.tcp != nil {
+			return s.tcp
+		}
+	case transportUDP:
+		if s.conn != nil {
+			return s.conn
+		}
+	}
+	return sock
+}
+
+// SetProxyProtocol reads PROXY protocol v1/v2 header of tcp peers
+// connecting from trusted, eg: the load balancer. peers are known by
+// the client address in the header instead of address of the load
+// balancer, headers of other sources are not read
+func (s *Server) SetProxyProtocol(enabled bool, trusted []string) error {
+	cidrs, err := proxyproto.ParseTrusted(trusted)
+	if err != nil {
+		return err
+	}
+	s.proxyProtocol = enabled
+	s.proxyTrusted = cidrs
+	return nil
+}
+
+// ParseProxyTrusted parses comma separated cidrs or addresses
+// of load balancers, eg: 10.0.0.0/24,192.168.0.1
+func ParseProxyTrusted(s string) ([]string, error) {
+	trusted, err := proxyproto.ParseTrusted(strings.Split(s, ","))
+	if err != nil {
+		return nil, err
+	}
+	cidrs := make([]string, 0, len(trusted))
+	for _, ipnet := range trusted {
+		cidrs = append(cidrs, ipnet.String())
+	}
+	return cidrs, nil
+}
+
+// serveTCP receives data packets from peers over tcp
+func (s *Server) serveTCP(lis net.Listener) {
+	if s.proxyProtocol {
+		lis = proxyproto.NewListener(lis, s.proxyTrusted)
+	}
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if !s.stopped() {
+				log.Error("accept tcp peer fail: %v", err)
+			}
+			return
+		}
+		go s.readTCP(conn)
+	}
+}
+
+func (s *Server) readTCP(conn net.Conn) {
+	defer s.guard()
+	defer conn.Close()
+
+	hdr := make([]byte, 2)
+	buf := make([]byte, maxDatagram)
+	readFrame := func() ([]byte, error) {
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint16(hdr)
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	hello, err := readFrame()
+	if err != nil {
+		log.Error("invalid tcp peer %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	from, err := s.tcpPeer(conn, hello)
+	if err != nil {
+		log.Error("invalid tcp peer %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log.Info("peer %s connected over tcp from %s", from, conn.RemoteAddr())
+
+	for {
+		frame, err := readFrame()
+		if err != nil {
+			log.Error("read tcp peer %s fail: %v", from, err)
+			return
+		}
+		s.onRemote(s.conn, from, frame)
+	}
+}
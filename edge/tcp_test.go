@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestServeTCPProxyProtocol(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetProxyProtocol(true, []string{"127.0.0.1"})
+	s.conn = listenLocal(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go s.serveTCP(lis)
+
+	// the real peer is behind a load balancer on another address
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2")})
+	if err != nil {
+		t.Skipf("listen 127.0.0.2: %v", err)
+	}
+	defer peer.Close()
+	port := peer.LocalAddr().(*net.UDPAddr).Port
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "PROXY TCP4 127.0.0.2 127.0.0.1 40000 58423\r\n")
+	hdr := make([]byte, 2)
+	binary.BigEndian.PutUint16(hdr, uint16(port))
+	conn.Write(tcpFrame(hdr))
+	conn.Write(tcpFrame(s.encap.EncodeCtrl(ctrlPing, []byte("ping"))))
+
+	// pong is replied to the address in the header
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatalf("pong not sent to real peer address: %v", err)
+	}
+	if expect := s.encap.EncodeCtrl(ctrlPong, []byte("ping")); !bytes.Equal(buf[:n], expect) {
+		t.Fatalf("unexpected reply %x", buf[:n])
+	}
+}
+
+func TestServeTCPProxyProtocolRequired(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetProxyProtocol(true, []string{"127.0.0.1"})
+	s.conn = listenLocal(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go s.serveTCP(lis)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(tcpFrame([]byte{0xe3, 0x57}))
+	conn.Write(tcpFrame(s.encap.EncodeCtrl(ctrlPing, []byte("ping"))))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("expected peer without header closed, got %v", err)
+	}
+}
+
+func TestPeerTransport(t *testing.T) {
+	a := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	a.SetRouteManager(newFakeRoutes())
+	a.conn = listenLocal(t)
+	a.setTCP(newTCPTransport(&net.Dialer{Timeout: time.Second}, a.conn.LocalAddr().(*net.UDPAddr).Port), nil)
+
+	// udp peer
+	utun := newFakeTun("cframe.0")
+	u := NewServer("", "key", &Interface{tun: utun})
+	u.conn = listenLocal(t)
+	go u.readRemote(u.conn)
+
+	// tcp peer, listener shares port with udp
+	ttun := newFakeTun("cframe.0")
+	p := NewServer("", "key", &Interface{tun: ttun})
+	p.conn = listenLocal(t)
+	go p.readRemote(p.conn)
+	lis, err := net.Listen("tcp", p.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go p.serveTCP(lis)
+
+	for _, peer := range []*codec.Edge{
+		{Cidr: "10.0.1.0/24", ListenAddr: u.conn.LocalAddr().String(), Transport: transportUDP},
+		{Cidr: "10.0.2.0/24", ListenAddr: p.conn.LocalAddr().String(), Transport: transportTCP},
+	} {
+		a.AddPeer(peer)
+	}
+	if err := a.addRoute(&codec.Edge{Cidr: "10.0.3.0/24", ListenAddr: "127.0.0.1:1", Transport: "quic"}); err == nil {
+		t.Fatalf("expected unsupported transport rejected")
+	}
+
+	a.forwardLocal(a.conn, 0, ipPacket("10.0.9.1", "10.0.1.5"))
+	a.forwardLocal(a.conn, 0, ipPacket("10.0.9.1", "10.0.2.5"))
+	for _, c := range []struct {
+		tun *fakeTun
+		dst string
+	}{{utun, "10.0.1.5"}, {ttun, "10.0.2.5"}} {
+		select {
+		case pkt := <-c.tun.out:
+			if Packet(pkt).Dst() != c.dst {
+				t.Fatalf("unexpected packet %x", pkt)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("packet to %s not delivered", c.dst)
+		}
+	}
+
+	a.tcp.mu.Lock()
+	n := len(a.tcp.conns)
+	a.tcp.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected one tcp stream, got %d", n)
+	}
+}
+
+// pipeDialer dials pipes, dials of addr in block wait until
+// the channel closed. serve runs on the peer end of each pipe
+type pipeDialer struct {
+	mu    sync.Mutex
+	dials map[string]int
+	block map[string]chan struct{}
+	serve func(conn net.Conn)
+}
+
+func (d *pipeDialer) Dial(network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials[addr]++
+	block := d.block[addr]
+	d.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	conn, peer := net.Pipe()
+	go d.serve(peer)
+	return conn, nil
+}
+
+func (d *pipeDialer) Dials(addr string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials[addr]
+}
+
+func TestTCPTransportSlowDial(t *testing.T) {
+	slow := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	fast := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2}
+	release := make(chan struct{})
+	d := &pipeDialer{
+		dials: make(map[string]int),
+		block: map[string]chan struct{}{slow.String(): release},
+		serve: func(conn net.Conn) { io.Copy(ioutil.Discard, conn) },
+	}
+	tcp := newTCPTransport(d, 58423)
+	defer tcp.close()
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := tcp.WriteTo([]byte("slow"), slow)
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(time.Second)
+	for d.Dials(slow.String()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	// other peers are written while slow one dialing
+	done := make(chan error)
+	go func() {
+		_, err := tcp.WriteTo([]byte("fast"), fast)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("write blocked by dial of another peer")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := d.Dials(slow.String()); n != 1 {
+		t.Fatalf("expected one dial of concurrent writers, got %d", n)
+	}
+}
+
+func TestTCPTransportWriteTimeout(t *testing.T) {
+	// peer reads the port preamble then stalls
+	d := &pipeDialer{
+		dials: make(map[string]int),
+		serve: func(conn net.Conn) { io.ReadFull(conn, make([]byte, 4)) },
+	}
+	tcp := newTCPTransport(d, 58423)
+	tcp.timeout = time.Millisecond * 100
+	defer tcp.close()
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	begin := time.Now()
+	if _, err := tcp.WriteTo([]byte("stalled"), addr); err == nil || !isTimeout(err) {
+		t.Fatalf("expected write timeout, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("write not bounded, took %s", elapsed)
+	}
+
+	tcp.mu.Lock()
+	n := len(tcp.conns)
+	tcp.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("timed out stream not dropped")
+	}
+}
+
+func TestTCPHelloNamedPeer(t *testing.T) {
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	pc := newPeerConn("1.1.1.1:58423", "10.0.1.0/24")
+	pc.id = "edge-a"
+	s.peerConns[0] = map[string]*peerConn{"10.0.1.0/24": pc}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// streams of peers behind one nat are identified by name
+	now := time.Now()
+	from, err := s.tcpPeer(conn, tcpHello("key", "edge-a", 40000, now))
+	if err != nil || from.String() != "1.1.1.1:58423" {
+		t.Fatalf("named peer not identified: %v %v", from, err)
+	}
+	from, err = s.tcpPeer(conn, tcpHello("key", "edge-b", 40000, now))
+	if err != nil || from.String() != "127.0.0.1:40000" {
+		t.Fatalf("unknown peer not identified by address: %v %v", from, err)
+	}
+	if _, err := s.tcpPeer(conn, tcpHello("key", "edge-a", 40000, now)); err == nil {
+		t.Fatalf("expected replayed hello rejected")
+	}
+	if _, err := s.tcpPeer(conn, tcpHello("other", "edge-a", 40000, now.Add(time.Second))); err == nil {
+		t.Fatalf("expected forged hello rejected")
+	}
+	if _, err := s.tcpPeer(conn, tcpHello("key", "edge-a", 40000, now.Add(-time.Hour))); err == nil {
+		t.Fatalf("expected stale hello rejected")
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
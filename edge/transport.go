@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+// short writes retried before giving up
+const maxShortWrite = 3
+
+var peerWriteErrors = metrics.NewCounter("cframe_edge_peer_write_errors_total",
+	"packets failed to write to peers")
+
+// write errors of a kind are logged and reported
+// at most once per writeErrorInterval
+var writeErrorInterval = time.Minute
+
+// transport sends encoded packets to peers
+type transport interface {
+	WriteTo(buf []byte, addr net.Addr) (int, error)
+}
+
+// writePeer writes buf to peer, the rest of buf is written again
+// on short write, which only happens on stream transport since
+// a datagram is written entirely or not at all
+func writePeer(t transport, buf []byte, addr net.Addr) error {
+	for retry := 0; ; retry++ {
+		n, err := t.WriteTo(buf, addr)
+		if err != nil {
+			return fmt.Errorf("write to peer %s: %w", addr, err)
+		}
+
+		if n >= len(buf) {
+			return nil
+		}
+
+		if retry >= maxShortWrite {
+			return fmt.Errorf("write to peer %s: %w, %d bytes left",
+				addr, io.ErrShortWrite, len(buf)-n)
+		}
+		buf = buf[n:]
+	}
+}
+
+// writeErrors aggregates failed writes to peers by kind,
+// eg: a down link failing every packet is logged once per interval
+type writeErrors struct {
+	mu sync.Mutex
+	// key: kind
+	kinds map[string]*writeErrorKind
+}
+
+type writeErrorKind struct {
+	logged     time.Time
+	suppressed int
+}
+
+func newWriteErrors() *writeErrors {
+	return &writeErrors{kinds: make(map[string]*writeErrorKind)}
+}
+
+// add counts err, which is logged unless its kind was logged
+// within writeErrorInterval, with the count of those suppressed
+func (w *writeErrors) add(err error, now time.Time) {
+	peerWriteErrors.Inc()
+	kind := writeErrorKindOf(err)
+
+	w.mu.Lock()
+	k := w.kinds[kind]
+	if k == nil {
+		k = &writeErrorKind{}
+		w.kinds[kind] = k
+	}
+	if !k.logged.IsZero() && now.Sub(k.logged) < writeErrorInterval {
+		k.suppressed++
+		w.mu.Unlock()
+		return
+	}
+	suppressed := k.suppressed
+	k.logged, k.suppressed = now, 0
+	w.mu.Unlock()
+
+	if suppressed > 0 {
+		err = fmt.Errorf("%v, %d more %s errors suppressed", err, suppressed, kind)
+	}
+	log.Error("%v", err)
+	AddErrorLog(err)
+}
+
+// writeErrorKindOf classifies err of writePeer
+func writeErrorKindOf(err error) string {
+	if errors.Is(err, io.ErrShortWrite) {
+		return "short"
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return "refused"
+		case syscall.ENETUNREACH, syscall.EHOSTUNREACH:
+			return "unreachable"
+		case syscall.ENOBUFS:
+			return "nobufs"
+		case syscall.EMSGSIZE:
+			return "msgsize"
+		}
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// shortTransport writes at most max bytes each time,
+// max 0 makes no progress at all
+type shortTransport struct {
+	max     int
+	written []byte
+}
+
+func (t *shortTransport) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	n := len(buf)
+	if n > t.max {
+		n = t.max
+	}
+	t.written = append(t.written, buf[:n]...)
+	return n, nil
+}
+
+func TestWritePeerShortWrite(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 58423}
+	buf := ipPacket("10.0.0.1", "10.0.0.2")
+
+	tr := &shortTransport{max: 8}
+	if err := writePeer(tr, buf, addr); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tr.written, buf) {
+		t.Fatalf("short write not completed")
+	}
+
+	err := writePeer(&shortTransport{max: 0}, buf, addr)
+	if err == nil || !strings.Contains(err.Error(), addr.String()) {
+		t.Fatalf("expected short write error with peer addr, got %v", err)
+	}
+}
+
+// stuckTransport never writes anything
+type stuckTransport struct {
+	done chan struct{}
+}
+
+func (t *stuckTransport) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	defer func() { t.done <- struct{}{} }()
+	return 0, fmt.Errorf("no buffer space available")
+}
+
+func TestReadLocalWriteError(t *testing.T) {
+	ResetStat()
+
+	tun := newFakeTun("cframe.0")
+	s := NewServer("", "key", &Interface{tun: tun})
+	s.peerConns[0] = map[string]*peerConn{
+		"10.0.0.0/24": newPeerConn("1.1.1.1:58423", "10.0.0.0/24"),
+	}
+
+	tr := &stuckTransport{done: make(chan struct{}, 1)}
+	go s.readLocal(tr, 0, s.ifaces[0])
+	tun.in <- ipPacket("10.0.1.1", "10.0.0.5")
+
+	select {
+	case <-tr.done:
+	case <-time.After(time.Second):
+		t.Fatalf("packet not written")
+	}
+
+	// error is reported once writePeer returns
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		msgMu.Lock()
+		errs := append([]string{}, msg.Error...)
+		msgMu.Unlock()
+		for _, e := range errs {
+			if strings.Contains(e, "1.1.1.1:58423") {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("write error not reported")
+}
+
+// reportedOf returns errors reported about peer
+func reportedOf(errs []string, peer string) []string {
+	of := make([]string, 0)
+	for _, e := range errs {
+		if strings.Contains(e, peer) {
+			of = append(of, e)
+		}
+	}
+	return of
+}
+
+func TestWriteErrorsAggregated(t *testing.T) {
+	ResetStat()
+	errs := newWriteErrors()
+	count := peerWriteErrors.Value()
+	refused := fmt.Errorf("write to peer 192.0.2.7:58423: %w", syscall.ECONNREFUSED)
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		errs.add(refused, now)
+	}
+	errs.add(fmt.Errorf("write to peer 192.0.2.7:58423: %w", syscall.ENOBUFS), now)
+	if n := peerWriteErrors.Value() - count; n != 101 {
+		t.Fatalf("expected 101 write errors counted, got %d", n)
+	}
+	if reported := reportedOf(ResetStat().Error, "192.0.2.7"); len(reported) != 2 {
+		t.Fatalf("expected 1 error reported per kind, got %v", reported)
+	}
+
+	// next sample carries the count suppressed
+	errs.add(refused, now.Add(writeErrorInterval))
+	reported := reportedOf(ResetStat().Error, "192.0.2.7")
+	if len(reported) != 1 || !strings.Contains(reported[0], "99 more refused errors") {
+		t.Fatalf("unexpected errors reported %v", reported)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"net"
 	"os/exec"
 	"runtime"
 	"time"
@@ -11,7 +13,13 @@ import (
 )
 
 type Interface struct {
-	tun *water.Interface
+	tun tunDevice
+}
+
+// tunDevice is implemented by *water.Interface
+type tunDevice interface {
+	io.ReadWriteCloser
+	Name() string
 }
 
 func NewInterface() (*Interface, error) {
@@ -45,6 +53,15 @@ func (iface *Interface) SetMTU(mtu int) error {
 	return nil
 }
 
+func (iface *Interface) SetAddr(addr *net.IPNet) error {
+	out, err := execCmd("ifconfig", []string{iface.tun.Name(), addr.IP.String(),
+		"netmask", net.IP(addr.Mask).String()})
+	if err != nil {
+		return fmt.Errorf("set address fail: %s %v", out, err)
+	}
+	return nil
+}
+
 func (iface *Interface) Up() error {
 	switch runtime.GOOS {
 	case "linux":
@@ -61,6 +78,26 @@ func (iface *Interface) Up() error {
 	return nil
 }
 
+// Addr returns the first ipv4 ip/cidr of the tun device,
+// empty if no address is assigned
+func (iface *Interface) Addr() string {
+	ifce, err := net.InterfaceByName(iface.tun.Name())
+	if err != nil {
+		return ""
+	}
+
+	addrs, err := ifce.Addrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipn, ok := addr.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			return ipn.String()
+		}
+	}
+	return ""
+}
+
 func (iface *Interface) Read() ([]byte, error) {
 	buf := make([]byte, 2048)
 	n, err := iface.tun.Read(buf)
@@ -75,11 +112,16 @@ func (iface *Interface) Write(buf []byte) (int, error) {
 	return iface.tun.Write(buf)
 }
 
+// ReadPacket reads a packet into buf, returns its size
+func (iface *Interface) ReadPacket(buf []byte) (int, error) {
+	return iface.tun.Read(buf)
+}
+
 func (iface *Interface) Close() {
 	iface.tun.Close()
 }
 
-func execCmd(cmd string, args []string) (string, error) {
+var execCmd = func(cmd string, args []string) (string, error) {
 	b, err := exec.Command(cmd, args...).CombinedOutput()
 	return string(b), err
 }
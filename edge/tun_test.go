@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetTunCidr(t *testing.T) {
+	var calls []string
+	old := execCmd
+	execCmd = func(cmd string, args []string) (string, error) {
+		calls = append(calls, cmd+" "+strings.Join(args, " "))
+		return "", nil
+	}
+	defer func() { execCmd = old }()
+
+	s := NewServer("", "key", &Interface{tun: newFakeTun("cframe.9")})
+	if err := s.SetTunCidr("10.100.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	expect := "ifconfig cframe.9 10.100.1.1 netmask 255.255.255.0"
+	if len(calls) != 1 || calls[0] != expect {
+		t.Fatalf("expected %s, got %v", expect, calls)
+	}
+
+	if err := s.SetTunCidr("invalid"); err == nil {
+		t.Fatal("expected invalid cidr error")
+	}
+}
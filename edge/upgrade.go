@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/ICKelin/cframe/pkg/logs"
+	"github.com/songgao/water"
+)
+
+// graceful binary upgrade, the new process started by Upgrade
+// inherits listen sockets and tun devices of the old process,
+// so peers and os routes never see the edge go away:
+//  1. old process passes its files to the new process by fd,
+//     named in env CFRAME_INHERIT, eg: ready,udp,tcp,tun.0=cframe.0
+//  2. new process serves on the inherited files and signals ready
+//  3. old process stops forwarding and closes its sockets, routes stay
+const inheritEnv = "CFRAME_INHERIT"
+
+// fd of the first inherited file, after stdin, stdout and stderr
+const inheritFd = 3
+
+// max wait for the new process to be ready, replaced by tests
+var upgradeTimeout = time.Second * 30
+
+// command of the new process, the running binary by default
+// which is replaced on disk by the upgrade, replaced by tests
+var upgradeCommand = func() (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(exe, os.Args[1:]...), nil
+}
+
+// fileConn is a socket passed to the new process
+type fileConn interface {
+	File() (*os.File, error)
+}
+
+// ParseInherited returns files inherited from the upgraded process
+// keyed by name, spec is the value of CFRAME_INHERIT.
+// a file named by key=name is keyed by key, eg: tun.0=cframe.0
+func ParseInherited(spec string) map[string]*os.File {
+	files := make(map[string]*os.File)
+	if len(spec) == 0 {
+		return files
+	}
+	for i, name := range strings.Split(spec, ",") {
+		key := name
+		if kv := strings.SplitN(name, "=", 2); len(kv) == 2 {
+			key, name = kv[0], kv[1]
+		}
+		files[key] = os.NewFile(uintptr(inheritFd+i), name)
+	}
+	return files
+}
+
+// SetInherited serves on files inherited from the upgraded process
+func (s *Server) SetInherited(files map[string]*os.File) {
+	s.inherited = files
+}
+
+// inherit takes the inherited file of name, nil if not inherited
+func (s *Server) inherit(name string) *os.File {
+	s.upgradeMu.Lock()
+	defer s.upgradeMu.Unlock()
+	f := s.inherited[name]
+	delete(s.inherited, name)
+	return f
+}
+
+// listenConn listens on udp laddr, retried while the port is
+// in use, or takes over the inherited socket
+func (s *Server) listenConn() (*net.UDPConn, error) {
+	f := s.inherit("udp")
+	if f == nil {
+		return listenRetry(s.laddr, func() (*net.UDPConn, error) {
+			return listenUDP(s.laddr, s.defaultOpts(), s.sharedPort())
+		})
+	}
+	defer f.Close()
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherit udp socket: %v", err)
+	}
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("inherit udp socket: unexpected %T", conn)
+	}
+	log.Info("inherited udp socket %s", udp.LocalAddr())
+	return udp, nil
+}
+
+// listenInherited listens on tcp addr,
+// or takes over the inherited listener of name
+func (s *Server) listenInherited(name, addr string) (net.Listener, error) {
+	f := s.inherit(name)
+	if f == nil {
+		return net.Listen("tcp", addr)
+	}
+	defer f.Close()
+	lis, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherit %s listener: %v", name, err)
+	}
+	log.Info("inherited %s listener %s", name, lis.Addr())
+	return lis, nil
+}
+
+// InheritedInterface returns tun device of vni inherited
+// from the upgraded process, nil if not inherited
+func (s *Server) InheritedInterface(vni uint32) *Interface {
+	f := s.inherit(fmt.Sprintf("tun.%d", vni))
+	if f == nil {
+		return nil
+	}
+	log.Info("inherited tun device %s of vni %d", f.Name(), vni)
+	return &Interface{tun: &fileTun{File: f}}
+}
+
+// fileTun is a tun device inherited as file, named by the file
+type fileTun struct {
+	*os.File
+}
+
+// addHandoff passes conn to the new process on upgrade as name
+func (s *Server) addHandoff(name string, conn fileConn) {
+	s.upgradeMu.Lock()
+	defer s.upgradeMu.Unlock()
+	s.handoffs[name] = conn
+}
+
+// ready tells the upgraded process the edge is serving
+func (s *Server) ready() {
+	f := s.inherit("ready")
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Error("notify upgraded process fail: %v", err)
+	}
+}
+
+// tunFile returns file of tun device, nil if it is not a file
+func tunFile(dev tunDevice) *os.File {
+	switch t := dev.(type) {
+	case *fileTun:
+		return t.File
+	case *water.Interface:
+		f, _ := t.ReadWriteCloser.(*os.File)
+		return f
+	}
+	return nil
+}
+
+// Upgrade starts the new binary with sockets and tun devices
+// of the edge, once it is ready the edge stops forwarding,
+// leaves the controller and closes its sockets without removing
+// routes, then HandedOff is closed so the caller exits.
+// the edge keeps serving if the new process fails
+func (s *Server) Upgrade() error {
+	if s.stopped() {
+		return fmt.Errorf("edge is stopping")
+	}
+	if !atomic.CompareAndSwapInt32(&s.upgrading, 0, 1) {
+		return fmt.Errorf("upgrade in progress")
+	}
+	defer atomic.StoreInt32(&s.upgrading, 0)
+
+	cmd, err := upgradeCommand()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// sockets are passed by copies closed once the new process
+	// started, tun devices stay open as the edge still forwards
+	names, files := []string{"ready"}, []*os.File{w}
+	copies := []*os.File{w}
+	defer func() {
+		for _, f := range copies {
+			f.Close()
+		}
+	}()
+	add := func(name string, f *os.File, err error) error {
+		if err != nil {
+			return fmt.Errorf("pass %s: %v", name, err)
+		}
+		names, files = append(names, name), append(files, f)
+		return nil
+	}
+
+	if s.conn == nil {
+		return fmt.Errorf("edge is not serving")
+	}
+	f, err := s.conn.File()
+	if err := add("udp", f, err); err != nil {
+		return err
+	}
+	copies = append(copies, f)
+	s.upgradeMu.Lock()
+	for name, conn := range s.handoffs {
+		f, err := conn.File()
+		if err := add(name, f, err); err != nil {
+			s.upgradeMu.Unlock()
+			return err
+		}
+		copies = append(copies, f)
+	}
+	s.upgradeMu.Unlock()
+	for vni, iface := range s.ifaces {
+		f := tunFile(iface.tun)
+		if f == nil {
+			log.Warn("upgrade: tun device %s of vni %d not passed", iface.tun.Name(), vni)
+			continue
+		}
+		add(fmt.Sprintf("tun.%d=%s", vni, iface.tun.Name()), f, nil)
+	}
+
+	base := cmd.Env
+	if base == nil {
+		base = os.Environ()
+	}
+	env := make([]string, 0)
+	for _, kv := range base {
+		if !strings.HasPrefix(kv, inheritEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	cmd.Env = append(env, inheritEnv+"="+strings.Join(names, ","))
+	cmd.ExtraFiles = files
+	if cmd.Stdout == nil {
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	}
+
+	log.Info("upgrade: starting %s passing %s", cmd.Path, strings.Join(names, ","))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start new process: %v", err)
+	}
+	// the pipe sees eof if the new process dies before ready
+	w.Close()
+	copies = copies[1:]
+
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		err = fmt.Errorf("new process not ready: %v", err)
+		log.Error("upgrade: %v", err)
+		AddErrorLog(err)
+		return err
+	}
+	log.Info("upgrade: new process %d ready, draining", cmd.Process.Pid)
+	cmd.Process.Release()
+	s.handoff()
+	return nil
+}
+
+// handoff stops forwarding and reading tun, disconnects from
+// controller so the new process registers as the edge, and closes
+// sockets. routes and tun devices are kept for the new process
+func (s *Server) handoff() {
+	if !atomic.CompareAndSwapInt32(&s.stopping, 0, 1) {
+		return
+	}
+	if s.registry != nil {
+		s.registry.Close()
+	}
+	s.closeSockets()
+	log.Info("upgrade: handed off to new process")
+	close(s.handedOff)
+}
+
+// HandedOff is closed once the new process took over
+func (s *Server) HandedOff() <-chan struct{} {
+	return s.handedOff
+}
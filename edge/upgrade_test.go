@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+// TestUpgradeChild is the new process started by TestUpgrade
+func TestUpgradeChild(t *testing.T) {
+	peer := os.Getenv("CFRAME_TEST_UPGRADE_PEER")
+	if len(peer) == 0 {
+		t.Skip("started by TestUpgrade only")
+	}
+
+	s := NewServer("127.0.0.1:0", "key", &Interface{tun: newFakeTun("cframe.0")})
+	s.SetRouteManager(newFakeRoutes())
+	s.SetInherited(ParseInherited(os.Getenv(inheritEnv)))
+	conn, err := s.listenConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.conn = conn
+	s.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: peer})
+	s.ready()
+
+	// forwards on the inherited socket after the old process drained
+	time.Sleep(time.Millisecond * 200)
+	s.forwardLocal(conn, 0, ipPacket("10.0.9.2", "10.0.1.5"))
+}
+
+func TestUpgrade(t *testing.T) {
+	peer := listenLocal(t)
+	routes := newFakeRoutes()
+	old := NewServer("", "key", &Interface{tun: newFakeTun("cframe.0")})
+	old.SetRouteManager(routes)
+	old.conn = listenLocal(t)
+	laddr := old.conn.LocalAddr().String()
+	old.AddPeer(&codec.Edge{Cidr: "10.0.1.0/24", ListenAddr: peer.LocalAddr().String()})
+
+	command := upgradeCommand
+	upgradeCommand = func() (*exec.Cmd, error) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestUpgradeChild$")
+		cmd.Env = []string{"CFRAME_TEST_UPGRADE_PEER=" + peer.LocalAddr().String()}
+		return cmd, nil
+	}
+	upgradeTimeout = time.Second * 10
+	defer func() { upgradeCommand, upgradeTimeout = command, time.Second*30 }()
+
+	recv := func() string {
+		buf := make([]byte, 1500)
+		peer.SetReadDeadline(time.Now().Add(time.Second * 5))
+		n, from, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("no packet from edge: %v", err)
+		}
+		if from.String() != laddr {
+			t.Fatalf("expected packet from %s, got %s", laddr, from)
+		}
+		_, pkt, err := old.encap.Decode(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Packet(pkt).Src()
+	}
+
+	// old process forwards until the new one is ready
+	old.forwardLocal(old.conn, 0, ipPacket("10.0.9.1", "10.0.1.5"))
+	if src := recv(); src != "10.0.9.1" {
+		t.Fatalf("unexpected packet from %s", src)
+	}
+
+	reg := NewRegistry("127.0.0.1:1", "default", "key", "edge1", old)
+	old.SetRegistry(reg)
+	tun := old.ifaces[0].tun.(*fakeTun)
+	reading := make(chan struct{})
+	go func() {
+		old.readLocal(old.conn, 0, old.ifaces[0])
+		close(reading)
+	}()
+
+	if err := old.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	if !old.stopped() {
+		t.Fatalf("old process still forwarding after upgrade")
+	}
+	select {
+	case <-old.HandedOff():
+	default:
+		t.Fatalf("handoff not signaled")
+	}
+	select {
+	case <-reg.stop:
+	default:
+		t.Fatalf("old process still registered")
+	}
+	// tun left to the new process
+	tun.in <- ipPacket("10.0.9.3", "10.0.1.5")
+	select {
+	case <-reading:
+	case <-time.After(time.Second):
+		t.Fatalf("old process still reading tun")
+	}
+	if got, _ := routes.ListRoutes("cframe.0"); len(got) != 1 {
+		t.Fatalf("expected routes kept for new process, got %v", got)
+	}
+
+	// new process forwards on the same socket
+	if src := recv(); src != "10.0.9.2" {
+		t.Fatalf("unexpected packet from %s", src)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ICKelin/cframe/pkg/metrics"
+)
+
+var vniMismatchDropped = metrics.NewCounter("cframe_edge_vni_mismatch_dropped_total",
+	"packets from peers dropped for a vni the peer does not serve")
+
+// ParseVNIs parses vnis served by the edge, one tun device each,
+// with optional routing table of the vni, eg: 1=101,2=102,3
+// vni without table routes in the main table
+func ParseVNIs(s string) (map[uint32]int, error) {
+	vnis := make(map[uint32]int)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		vni, err := strconv.ParseUint(kv[0], 10, 32)
+		if err != nil || vni > maxVNI {
+			return nil, fmt.Errorf("invalid vni %s", item)
+		}
+
+		table := 0
+		if len(kv) == 2 {
+			table, err = strconv.Atoi(kv[1])
+			if err != nil || table < 0 {
+				return nil, fmt.Errorf("invalid vni table %s", item)
+			}
+		}
+
+		if _, ok := vnis[uint32(vni)]; ok {
+			return nil, fmt.Errorf("duplicate vni %s", item)
+		}
+		vnis[uint32(vni)] = table
+	}
+	return vnis, nil
+}
+
+// SetRouteTable installs routes of the vni tun device into table,
+// so cidrs may overlap between vnis. must be called after AddInterface
+func (s *Server) SetRouteTable(vni uint32, table int) error {
+	iface := s.ifaces[vni]
+	if iface == nil {
+		return fmt.Errorf("no interface for vni %d", vni)
+	}
+
+	m, ok := s.routes.(*cmdRouteManager)
+	if !ok {
+		return fmt.Errorf("route manager does not support tables")
+	}
+	m.SetTable(iface.tun.Name(), table)
+	return nil
+}
+
+// peerNets are cidrs of each vni served by each peer address as
+// primary, standby or equal path, rebuilt once peers change so
+// packets are checked without scanning peerConns
+// key: peer addr, vni
+type peerNets map[string]map[uint32][]*net.IPNet
+
+// indexPeers rebuilds cidrs of peers, must be called with s.mu held
+func (s *Server) indexPeers() {
+	idx := make(peerNets)
+	add := func(addr string, vni uint32, ipnet *net.IPNet) {
+		if len(addr) == 0 {
+			return
+		}
+		if idx[addr] == nil {
+			idx[addr] = make(map[uint32][]*net.IPNet)
+		}
+		nets := idx[addr][vni]
+		if ipnet != nil {
+			nets = append(nets, ipnet)
+		}
+		idx[addr][vni] = nets
+	}
+	for vni, peers := range s.peerConns {
+		for _, pc := range peers {
+			add(pc.addr, vni, pc.ipnet)
+			add(pc.standby, vni, pc.ipnet)
+			for _, p := range pc.paths {
+				add(p.addr, vni, pc.ipnet)
+			}
+		}
+	}
+	s.nets.Store(idx)
+}
+
+// dropForeignVNI drops packet of vni from a known peer not serving
+// the vni, so a peer cannot inject into overlays of other tenants.
+// senders known as peers of no vni are left to other checks
+func (s *Server) dropForeignVNI(vni uint32, from string) bool {
+	vnis, ok := s.nets.Load().(peerNets)[from]
+	if !ok {
+		return false
+	}
+	if _, ok := vnis[vni]; ok {
+		return false
+	}
+	vniMismatchDropped.Inc()
+	s.tupleLog.Debug("drop packet from %s: vni %d not served by peer", from, vni)
+	return true
+}
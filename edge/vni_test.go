@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ICKelin/cframe/codec"
+)
+
+func TestParseVNIs(t *testing.T) {
+	vnis, err := ParseVNIs("1=101, 2=102,3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[uint32]int{1: 101, 2: 102, 3: 0}
+	if !reflect.DeepEqual(vnis, expect) {
+		t.Fatalf("expected %v, got %v", expect, vnis)
+	}
+
+	for _, s := range []string{"x", "1=x", "1=-1", "16777216", "1,1=100"} {
+		if _, err := ParseVNIs(s); err == nil {
+			t.Fatalf("%s: expected error", s)
+		}
+	}
+}
+
+func TestRouteTable(t *testing.T) {
+	var calls []string
+	old := execCmd
+	execCmd = func(cmd string, args []string) (string, error) {
+		calls = append(calls, cmd+" "+strings.Join(args, " "))
+		return "10.0.0.0/24 scope link\n10.0.1.1 scope link\n", nil
+	}
+	defer func() { execCmd = old }()
+
+	s := NewServer("", "key", nil)
+	s.AddInterface(1, &Interface{tun: newFakeTun("cframe.1")})
+	s.AddInterface(2, &Interface{tun: newFakeTun("cframe.2")})
+	if err := s.SetRouteTable(2, 102); err != nil {
+		t.Fatal(err)
+	}
+
+	m := s.routes.(*cmdRouteManager)
+	m.AddRoute("10.0.0.0/24", "cframe.1")
+	m.AddRoute("10.0.0.0/24", "cframe.2")
+	m.DelRoute("10.0.0.0/24", "cframe.2")
+	routes, err := m.ListRoutes("cframe.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"route del -net 10.0.0.0/24 dev cframe.1",
+		"route add -net 10.0.0.0/24 dev cframe.1",
+		"ip route replace 10.0.0.0/24 dev cframe.2 table 102",
+		"ip route del 10.0.0.0/24 dev cframe.2 table 102",
+		"ip -4 route show table 102 dev cframe.2",
+	}
+	if !reflect.DeepEqual(calls, expect) {
+		t.Fatalf("expected %v, got %v", expect, calls)
+	}
+	if !reflect.DeepEqual(routes, []string{"10.0.0.0/24", "10.0.1.1/32"}) {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+
+	if err := s.SetRouteTable(3, 103); err == nil {
+		t.Fatal("expected error for vni without interface")
+	}
+}
+
+func TestMultiTunOverlap(t *testing.T) {
+	// one edge with a tun per vni, peers of both vnis
+	// announce the same cidr from different edges
+	t1, t2 := newFakeTun("t1"), newFakeTun("t2")
+	s := NewServer("", "key", nil)
+	s.AddInterface(1, &Interface{tun: t1})
+	s.AddInterface(2, &Interface{tun: t2})
+	routes := newFakeRoutes()
+	s.SetRouteManager(routes)
+
+	lconn := listenLocal(t)
+	p1, p2 := listenLocal(t), listenLocal(t)
+	s.AddPeer(&codec.Edge{Cidr: "10.0.0.0/24", ListenAddr: p1.LocalAddr().String(), Vni: 1})
+	s.AddPeer(&codec.Edge{Cidr: "10.0.0.0/24", ListenAddr: p2.LocalAddr().String(), Vni: 2})
+
+	for _, dev := range []string{"t1", "t2"} {
+		installed, _ := routes.ListRoutes(dev)
+		if !reflect.DeepEqual(installed, []string{"10.0.0.0/24"}) {
+			t.Fatalf("%s: expected route 10.0.0.0/24, got %v", dev, installed)
+		}
+	}
+
+	go s.readRemote(lconn)
+	go s.readLocal(lconn, 1, s.ifaces[1])
+	go s.readLocal(lconn, 2, s.ifaces[2])
+
+	// outbound goes to the peer of the vni of the tun
+	buf := make([]byte, 1500)
+	for _, c := range []struct {
+		in   *fakeTun
+		peer *net.UDPConn
+		vni  uint32
+	}{{t1, p1, 1}, {t2, p2, 2}} {
+		c.in.in <- ipPacket("10.0.9.1", "10.0.0.5")
+		c.peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := c.peer.Read(buf)
+		if err != nil {
+			t.Fatalf("vni %d: packet not sent to peer: %v", c.vni, err)
+		}
+		vni, _ := decodeData(buf[3:n])
+		if vni != c.vni {
+			t.Fatalf("expected vni %d, got %d", c.vni, vni)
+		}
+	}
+
+	// inbound is demuxed to the tun of the vni
+	laddr := lconn.LocalAddr().(*net.UDPAddr)
+	p1.WriteToUDP(encodeData("key", 1, ipPacket("10.0.0.5", "10.0.9.1")), laddr)
+	p2.WriteToUDP(encodeData("key", 2, ipPacket("10.0.0.6", "10.0.9.1")), laddr)
+	for _, c := range []struct {
+		out *fakeTun
+		src string
+	}{{t1, "10.0.0.5"}, {t2, "10.0.0.6"}} {
+		select {
+		case pkt := <-c.out.out:
+			if got := Packet(pkt).Src(); got != c.src {
+				t.Fatalf("%s: expected src %s, got %s", c.out.name, c.src, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: packet not delivered", c.out.name)
+		}
+	}
+}
+
+func TestForeignVNIDropped(t *testing.T) {
+	t1, t2 := newFakeTun("t1"), newFakeTun("t2")
+	s := NewServer("", "key", nil)
+	s.AddInterface(1, &Interface{tun: t1})
+	s.AddInterface(2, &Interface{tun: t2})
+	s.SetRouteManager(newFakeRoutes())
+	s.conn = listenLocal(t)
+
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}
+	s.AddPeer(&codec.Edge{Cidr: "10.0.0.0/24", ListenAddr: peer.String(), Vni: 1})
+
+	// peer of vni 1 injects into vni 2 reusing the cidr
+	dropped := vniMismatchDropped.Value()
+	s.onRemote(s.conn, peer, s.encap.EncodeData(2, ipPacket("10.0.0.5", "10.0.9.1")))
+	select {
+	case <-t2.out:
+		t.Fatalf("packet of foreign vni delivered")
+	default:
+	}
+	if vniMismatchDropped.Value() != dropped+1 {
+		t.Fatalf("drop of foreign vni not counted")
+	}
+
+	s.onRemote(s.conn, peer, s.encap.EncodeData(1, ipPacket("10.0.0.5", "10.0.9.1")))
+	select {
+	case <-t1.out:
+	case <-time.After(time.Second):
+		t.Fatalf("packet of vni served by peer not delivered")
+	}
+
+	// vni of the peer moved with it
+	moved := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40002}
+	s.movePeer(peer.String(), moved.String())
+	s.onRemote(s.conn, moved, s.encap.EncodeData(2, ipPacket("10.0.0.5", "10.0.9.1")))
+	if vniMismatchDropped.Value() != dropped+2 {
+		t.Fatalf("drop of foreign vni from moved peer not counted")
+	}
+}
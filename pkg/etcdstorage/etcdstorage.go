@@ -6,19 +6,34 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/ICKelin/cframe/pkg/storage"
 	"github.com/coreos/etcd/clientv3"
 )
 
+var _ storage.Storage = &Etcd{}
+
 type Etcd struct {
 	cli *clientv3.Client
 }
 
+// Options of etcd client, zero values take clientv3 defaults
+type Options struct {
+	// timeout of establishing a connection
+	DialTimeout time.Duration
+	// ping etcd every KeepAliveTime, connection is closed
+	// if no response in KeepAliveTimeout
+	KeepAliveTime    time.Duration
+	KeepAliveTimeout time.Duration
+}
+
 func NewEtcd(endpoints []string) *Etcd {
-	cfg := clientv3.Config{
-		Endpoints: endpoints,
-	}
+	return NewEtcdWithOptions(endpoints, Options{})
+}
 
-	conn, err := clientv3.New(cfg)
+// NewEtcdWithOptions creates etcd client with timeouts of opts,
+// eg: longer dial timeout for high latency links
+func NewEtcdWithOptions(endpoints []string, opts Options) *Etcd {
+	conn, err := clientv3.New(clientConfig(endpoints, opts))
 	if err != nil {
 		// just panic....
 		panic(err)
@@ -29,6 +44,23 @@ func NewEtcd(endpoints []string) *Etcd {
 	}
 }
 
+func clientConfig(endpoints []string, opts Options) clientv3.Config {
+	return clientv3.Config{
+		Endpoints:            endpoints,
+		DialTimeout:          opts.DialTimeout,
+		DialKeepAliveTime:    opts.KeepAliveTime,
+		DialKeepAliveTimeout: opts.KeepAliveTimeout,
+	}
+}
+
+// Ping checks etcd is serving requests
+func (s *Etcd) Ping() error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*3))
+	defer cancel()
+	_, err := s.cli.Get(ctx, "/", clientv3.WithCountOnly())
+	return err
+}
+
 func (s *Etcd) Set(key string, val interface{}) error {
 	b, _ := json.Marshal(val)
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
@@ -37,6 +69,28 @@ func (s *Etcd) Set(key string, val interface{}) error {
 	return err
 }
 
+// SetWithTTL sets key attached to a new lease,
+// key is deleted once the lease expires without KeepAlive
+func (s *Etcd) SetWithTTL(key string, val interface{}, ttl time.Duration) (int64, error) {
+	b, _ := json.Marshal(val)
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
+	defer cancel()
+	lease, err := s.cli.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.cli.Put(ctx, key, string(b), clientv3.WithLease(lease.ID))
+	return int64(lease.ID), err
+}
+
+// KeepAlive renews the lease once
+func (s *Etcd) KeepAlive(lease int64) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
+	defer cancel()
+	_, err := s.cli.KeepAliveOnce(ctx, clientv3.LeaseID(lease))
+	return err
+}
+
 func (s *Etcd) Get(key string, obj interface{}) error {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
 	defer cancel()
@@ -77,8 +131,42 @@ func (s *Etcd) List(root string) (map[string]string, error) {
 	return res, nil
 }
 
-func (s *Etcd) Watch(prefix string) clientv3.WatchChan {
-	return s.cli.Watch(context.Background(), prefix,
+func (s *Etcd) Watch(ctx context.Context, prefix string) <-chan storage.WatchResponse {
+	chs := s.cli.Watch(ctx, prefix,
 		clientv3.WithPrefix(), clientv3.WithPrevKV())
 
+	out := make(chan storage.WatchResponse)
+	go func() {
+		defer close(out)
+		for c := range chs {
+			select {
+			case out <- watchResponse(c):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// watchResponse converts etcd watch response to storage one
+func watchResponse(c clientv3.WatchResponse) storage.WatchResponse {
+	resp := storage.WatchResponse{
+		Events: make([]*storage.Event, 0, len(c.Events)),
+		Err:    c.Err(),
+	}
+	for _, evt := range c.Events {
+		e := &storage.Event{Type: storage.EventTypePut}
+		if evt.Type == clientv3.EventTypeDelete {
+			e.Type = storage.EventTypeDelete
+		}
+		if evt.Kv != nil {
+			e.Kv = &storage.KeyValue{Key: evt.Kv.Key, Value: evt.Kv.Value}
+		}
+		if evt.PrevKv != nil {
+			e.PrevKv = &storage.KeyValue{Key: evt.PrevKv.Key, Value: evt.PrevKv.Value}
+		}
+		resp.Events = append(resp.Events, e)
+	}
+	return resp
 }
@@ -0,0 +1,33 @@
+package etcdstorage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClientConfig(t *testing.T) {
+	endpoints := []string{"10.0.0.1:2379", "10.0.0.2:2379"}
+	cfg := clientConfig(endpoints, Options{
+		DialTimeout:      time.Second * 10,
+		KeepAliveTime:    time.Second * 30,
+		KeepAliveTimeout: time.Second * 5,
+	})
+
+	if !reflect.DeepEqual(cfg.Endpoints, endpoints) {
+		t.Fatalf("expected endpoints %v, got %v", endpoints, cfg.Endpoints)
+	}
+	if cfg.DialTimeout != time.Second*10 {
+		t.Fatalf("expected dial timeout 10s, got %v", cfg.DialTimeout)
+	}
+	if cfg.DialKeepAliveTime != time.Second*30 || cfg.DialKeepAliveTimeout != time.Second*5 {
+		t.Fatalf("expected keepalive 30s/5s, got %v/%v",
+			cfg.DialKeepAliveTime, cfg.DialKeepAliveTimeout)
+	}
+
+	// unset options take client defaults
+	cfg = clientConfig(endpoints, Options{})
+	if cfg.DialTimeout != 0 || cfg.DialKeepAliveTime != 0 || cfg.DialKeepAliveTimeout != 0 {
+		t.Fatalf("expected zero timeouts, got %+v", cfg)
+	}
+}
@@ -72,6 +72,7 @@ const (
 	AdapterJianLiao  = "jianliao"
 	AdapterSlack     = "slack"
 	AdapterAliLS     = "alils"
+	AdapterSyslog    = "syslog"
 )
 
 // Legacy log level constants to ensure backwards compatibility.
@@ -552,6 +553,12 @@ var levelMap = map[string]int{
 	"critical": LevelCritical,
 }
 
+// ValidLevel reports whether l is a known level name
+func ValidLevel(l string) bool {
+	_, ok := levelMap[l]
+	return ok
+}
+
 func Level(l string) {
 	lvl, ok := levelMap[l]
 	if !ok {
@@ -560,9 +567,20 @@ func Level(l string) {
 	beeLogger.SetLevel(lvl)
 }
 
+// Init logs to file path, or to syslog if path is a syslog url,
+// eg: syslog://, syslog+udp://10.0.0.1:514?facility=local0
 func Init(path, level string, maxDay int64) {
-	param := fmt.Sprintf(`{"filename": "%s", "maxdays": %d}`, path, maxDay)
-	beeLogger.SetLogger(AdapterFile, param)
+	if strings.HasPrefix(path, "syslog") {
+		param, err := syslogConfig(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "logs: %v\n", err)
+		} else {
+			beeLogger.SetLogger(AdapterSyslog, param)
+		}
+	} else {
+		param := fmt.Sprintf(`{"filename": "%s", "maxdays": %d}`, path, maxDay)
+		beeLogger.SetLogger(AdapterFile, param)
+	}
 	beeLogger.SetLogFuncCallDepth(3)
 	beeLogger.EnableFuncCallDepth(true)
 	Level(level)
@@ -0,0 +1,71 @@
+package logs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Sampler limits hot path messages,
+// logs 1 in every N messages and at most M messages per second.
+// counters are atomic so packet workers never contend on a lock
+//
+//	sampler := NewSampler(100, 10)
+//	sampler.Debug("tuple %s => %s", src, dst)
+type Sampler struct {
+	// log 1 in every messages, <= 1 means all
+	every int64
+
+	// max messages per second, <= 0 means no limit
+	limit int64
+
+	count int64
+
+	// unix second of secCount, reset by the first message of a second,
+	// messages racing the reset may exceed limit by a few
+	sec      int64
+	secCount int64
+}
+
+// NewSampler creates a sampler logs 1 in every
+// messages and at most limit messages per second
+func NewSampler(every, limit int) *Sampler {
+	return &Sampler{
+		every: int64(every),
+		limit: int64(limit),
+	}
+}
+
+// Allow reports whether the current message should be emitted
+func (s *Sampler) Allow() bool {
+	if s.every > 1 && atomic.AddInt64(&s.count, 1)%s.every != 1 {
+		return false
+	}
+
+	if s.limit > 0 {
+		now := time.Now().Unix()
+		if sec := atomic.LoadInt64(&s.sec); sec != now &&
+			atomic.CompareAndSwapInt64(&s.sec, sec, now) {
+			atomic.StoreInt64(&s.secCount, 0)
+		}
+
+		if atomic.AddInt64(&s.secCount, 1) > s.limit {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Info logs a sampled message at info level.
+func (s *Sampler) Info(f interface{}, v ...interface{}) {
+	if s.Allow() {
+		beeLogger.Info(formatLog(f, v...))
+	}
+}
+
+// Debug logs a sampled message at debug level.
+func (s *Sampler) Debug(f interface{}, v ...interface{}) {
+	if s.Allow() {
+		beeLogger.Debug(formatLog(f, v...))
+	}
+}
@@ -0,0 +1,67 @@
+package logs
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSamplerEvery(t *testing.T) {
+	s := NewSampler(10, 0)
+	emitted := 0
+	for i := 0; i < 1000; i++ {
+		if s.Allow() {
+			emitted++
+		}
+	}
+
+	if emitted != 100 {
+		t.Fatalf("expected 100 messages emitted, got %d", emitted)
+	}
+}
+
+func TestSamplerConcurrent(t *testing.T) {
+	s := NewSampler(10, 0)
+	var emitted int64
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if s.Allow() {
+					atomic.AddInt64(&emitted, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if emitted != 800 {
+		t.Fatalf("expected 800 messages emitted, got %d", emitted)
+	}
+}
+
+func TestSamplerLimit(t *testing.T) {
+	s := NewSampler(1, 5)
+	emitted := 0
+	for i := 0; i < 1000; i++ {
+		if s.Allow() {
+			emitted++
+		}
+	}
+
+	// may cross one second boundary
+	if emitted < 5 || emitted > 10 {
+		t.Fatalf("expected 5-10 messages emitted, got %d", emitted)
+	}
+}
+
+func TestSamplerAll(t *testing.T) {
+	s := NewSampler(0, 0)
+	for i := 0; i < 100; i++ {
+		if !s.Allow() {
+			t.Fatalf("message %d dropped without sampling", i)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// local syslog sockets, tried in order
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// unavailable syslog endpoint is retried after syslogRetry,
+// messages go to stderr meanwhile
+var syslogRetry = time.Second * 5
+
+var syslogFacilities = map[string]int{
+	"kern":   0,
+	"user":   1,
+	"daemon": 3,
+	"auth":   4,
+	"syslog": 5,
+	"local0": 16,
+	"local1": 17,
+	"local2": 18,
+	"local3": 19,
+	"local4": 20,
+	"local5": 21,
+	"local6": 22,
+	"local7": 23,
+}
+
+// syslogWriter implements Logger.
+// net is udp, tcp or empty for local syslog socket,
+// levels of the package are RFC5424 severities
+type syslogWriter struct {
+	Net      string `json:"net"`
+	Addr     string `json:"addr"`
+	Facility string `json:"facility"`
+	Tag      string `json:"tag"`
+	Level    int    `json:"level"`
+
+	mu       sync.Mutex
+	facility int
+	hostname string
+	conn     net.Conn
+	retryAt  time.Time
+}
+
+func newSyslogWriter() Logger {
+	return &syslogWriter{Level: LevelDebug}
+}
+
+// Init init syslog writer with json config, eg:
+// {"net":"udp","addr":"10.0.0.1:514","facility":"local0","tag":"cframe"}
+func (w *syslogWriter) Init(jsonConfig string) error {
+	if err := json.Unmarshal([]byte(jsonConfig), w); err != nil {
+		return err
+	}
+
+	switch w.Net {
+	case "", "udp", "tcp":
+	default:
+		return fmt.Errorf("unsupported syslog net %s", w.Net)
+	}
+
+	if len(w.Facility) == 0 {
+		w.Facility = "daemon"
+	}
+	facility, ok := syslogFacilities[w.Facility]
+	if !ok {
+		return fmt.Errorf("unsupported syslog facility %s", w.Facility)
+	}
+	w.facility = facility
+
+	if len(w.Tag) == 0 {
+		w.Tag = filepath.Base(os.Args[0])
+	}
+	w.hostname, _ = os.Hostname()
+	if len(w.hostname) == 0 {
+		w.hostname = "-"
+	}
+
+	// endpoint unavailable is not fatal, retried on write
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.connect(); err != nil {
+		fmt.Fprintf(os.Stderr, "logs: syslog unavailable: %v\n", err)
+	}
+	return nil
+}
+
+func (w *syslogWriter) connect() error {
+	if len(w.Net) > 0 {
+		conn, err := net.DialTimeout(w.Net, w.Addr, time.Second*3)
+		if err != nil {
+			w.retryAt = time.Now().Add(syslogRetry)
+			return err
+		}
+		w.conn = conn
+		return nil
+	}
+
+	var err error
+	for _, sock := range syslogSockets {
+		var conn net.Conn
+		conn, err = net.Dial("unixgram", sock)
+		if err == nil {
+			w.conn = conn
+			return nil
+		}
+	}
+	w.retryAt = time.Now().Add(syslogRetry)
+	return err
+}
+
+// format builds RFC5424 message
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+func (w *syslogWriter) format(when time.Time, msg string, level int) []byte {
+	if level < LevelEmergency {
+		level = LevelEmergency
+	}
+	if level > LevelDebug {
+		level = LevelDebug
+	}
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		w.facility*8+level, when.Format(time.RFC3339Nano),
+		w.hostname, w.Tag, os.Getpid(), strings.TrimRight(msg, "\n"))
+
+	// octet counting framing over tcp, RFC6587
+	if w.Net == "tcp" {
+		line = strconv.Itoa(len(line)) + " " + line
+	}
+	return []byte(line)
+}
+
+// WriteMsg writes message to syslog,
+// falls back to stderr while syslog is unavailable
+func (w *syslogWriter) WriteMsg(when time.Time, msg string, level int) error {
+	if level > w.Level {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil && time.Now().After(w.retryAt) {
+		w.connect()
+	}
+	if w.conn != nil {
+		_, err := w.conn.Write(w.format(when, msg, level))
+		if err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+		w.retryAt = time.Now().Add(syslogRetry)
+	}
+
+	h, _ := formatTimeHeader(when)
+	os.Stderr.Write(append(append(h, msg...), '\n'))
+	return nil
+}
+
+// Flush implementing method. empty.
+func (w *syslogWriter) Flush() {}
+
+// Destroy closes syslog connection
+func (w *syslogWriter) Destroy() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// syslogConfig converts syslog url to adapter config, eg:
+// syslog:// local socket
+// syslog+udp://10.0.0.1:514?facility=local0&tag=cframe
+// syslog+tcp://10.0.0.1:601
+func syslogConfig(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	cfg := syslogWriter{
+		Facility: u.Query().Get("facility"),
+		Tag:      u.Query().Get("tag"),
+		Level:    LevelDebug,
+	}
+	switch u.Scheme {
+	case "syslog":
+	case "syslog+udp", "syslog+tcp":
+		cfg.Net = strings.TrimPrefix(u.Scheme, "syslog+")
+		cfg.Addr = u.Host
+	default:
+		return "", fmt.Errorf("unsupported syslog url %s", rawurl)
+	}
+
+	b, err := json.Marshal(&cfg)
+	return string(b), err
+}
+
+func init() {
+	Register(AdapterSyslog, newSyslogWriter)
+}
@@ -0,0 +1,115 @@
+package logs
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var rfc5424 = regexp.MustCompile(`^<(\d+)>1 \S+ \S+ cframe \d+ - - (.*)$`)
+
+func TestSyslogUDP(t *testing.T) {
+	lis, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	cfg, err := syslogConfig("syslog+udp://" + lis.LocalAddr().String() + "?facility=local0&tag=cframe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := NewLogger()
+	if err := log.SetLogger(AdapterSyslog, cfg); err != nil {
+		t.Fatal(err)
+	}
+	log.Error("route add fail")
+
+	buf := make([]byte, 1024)
+	lis.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := lis.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := rfc5424.FindStringSubmatch(string(buf[:n]))
+	if m == nil {
+		t.Fatalf("unexpected syslog message %q", buf[:n])
+	}
+	// local0 * 8 + error
+	if m[1] != "131" {
+		t.Fatalf("expected pri 131, got %s", m[1])
+	}
+	if m[2] != "[E] route add fail" {
+		t.Fatalf("unexpected msg %q", m[2])
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// octet counting framing
+		r := bufio.NewReader(conn)
+		size, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(size))
+		line := make([]byte, n)
+		io.ReadFull(r, line)
+		lines <- string(line)
+	}()
+
+	cfg, err := syslogConfig("syslog+tcp://" + lis.Addr().String() + "?tag=cframe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := NewLogger()
+	log.SetLogger(AdapterSyslog, cfg)
+	log.Warn("peer down")
+
+	select {
+	case line := <-lines:
+		m := rfc5424.FindStringSubmatch(line)
+		// daemon * 8 + warning
+		if m == nil || m[1] != "28" || m[2] != "[W] peer down" {
+			t.Fatalf("unexpected syslog message %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no syslog message received")
+	}
+}
+
+func TestSyslogUnavailable(t *testing.T) {
+	lis, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := lis.Addr().String()
+	lis.Close()
+
+	cfg, _ := syslogConfig("syslog+tcp://" + addr)
+	log := NewLogger()
+	if err := log.SetLogger(AdapterSyslog, cfg); err != nil {
+		t.Fatalf("unavailable syslog should not fail init: %v", err)
+	}
+	// written to stderr
+	log.Info("fallback")
+
+	if _, err := syslogConfig("syslog+http://127.0.0.1"); err == nil {
+		t.Fatalf("expected unsupported syslog url fail")
+	}
+}
@@ -0,0 +1,460 @@
+// Package metrics exports counters and gauges of cframe binaries
+// in prometheus text exposition format
+//
+//	var registrations = metrics.NewCounter("cframe_edge_registrations_total", "...")
+//	http.Handle("/metrics", metrics.Handler())
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	name() string
+	// labels are static labels of the registry rendered,
+	// eg: region="us-east",env="prod", empty if none
+	write(w io.Writer, labels string) error
+}
+
+// series returns name of a sample with labels joined
+func series(name string, labels ...string) string {
+	set := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if len(l) > 0 {
+			set = append(set, l)
+		}
+	}
+	if len(set) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(set, ",") + "}"
+}
+
+type Counter struct {
+	n, help string
+	v       int64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds n to counter, n must not be negative
+func (c *Counter) Add(n int64) {
+	if n > 0 {
+		atomic.AddInt64(&c.v, n)
+	}
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+func (c *Counter) name() string { return c.n }
+
+func (c *Counter) write(w io.Writer, labels string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+		c.n, c.help, c.n, series(c.n, labels), c.Value())
+	return err
+}
+
+type Gauge struct {
+	n, help string
+	v       int64
+}
+
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) name() string { return g.n }
+
+func (g *Gauge) write(w io.Writer, labels string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n",
+		g.n, g.help, g.n, series(g.n, labels), g.Value())
+	return err
+}
+
+// GaugeVec is a gauge per value of a label, eg: per peer
+type GaugeVec struct {
+	n, help, label string
+
+	mu sync.Mutex
+	v  map[string]float64
+}
+
+func (g *GaugeVec) Set(value string, v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.v[value] = v
+}
+
+// Delete removes the gauge of label value
+func (g *GaugeVec) Delete(value string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.v, value)
+}
+
+func (g *GaugeVec) Value(value string) (float64, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	v, ok := g.v[value]
+	return v, ok
+}
+
+func (g *GaugeVec) name() string { return g.n }
+
+func (g *GaugeVec) write(w io.Writer, labels string) error {
+	g.mu.Lock()
+	values := make([]string, 0, len(g.v))
+	for value := range g.v {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	samples := make([]float64, 0, len(values))
+	for _, value := range values {
+		samples = append(samples, g.v[value])
+	}
+	g.mu.Unlock()
+
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.n, g.help, g.n)
+	for i, value := range values {
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s %g\n",
+			series(g.n, labels, fmt.Sprintf("%s=%q", g.label, value)), samples[i])
+	}
+	return err
+}
+
+// CounterVec is a counter per value of a label, eg: per peer
+type CounterVec struct {
+	n, help, label string
+
+	mu sync.Mutex
+	v  map[string]int64
+}
+
+func (c *CounterVec) Inc(value string) {
+	c.Add(value, 1)
+}
+
+// Add adds n to counter of label value, n must not be negative
+func (c *CounterVec) Add(value string, n int64) {
+	if n <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.v[value] += n
+}
+
+// Delete removes the counter of label value
+func (c *CounterVec) Delete(value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.v, value)
+}
+
+func (c *CounterVec) Value(value string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.v[value]
+	return v, ok
+}
+
+func (c *CounterVec) name() string { return c.n }
+
+func (c *CounterVec) write(w io.Writer, labels string) error {
+	c.mu.Lock()
+	values := make([]string, 0, len(c.v))
+	for value := range c.v {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	samples := make([]int64, 0, len(values))
+	for _, value := range values {
+		samples = append(samples, c.v[value])
+	}
+	c.mu.Unlock()
+
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.n, c.help, c.n)
+	for i, value := range values {
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s %d\n",
+			series(c.n, labels, fmt.Sprintf("%s=%q", c.label, value)), samples[i])
+	}
+	return err
+}
+
+// Histogram counts observations in buckets of upper bounds,
+// observing takes a binary search and two atomic adds
+type Histogram struct {
+	n, help string
+	bounds  []float64
+
+	// count per bucket, last one is +Inf
+	counts []int64
+	// float64 bits of sum
+	sum uint64
+}
+
+// ExponentialBuckets returns count bounds from start,
+// each factor times the previous one, eg: 64, 128, 256
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	if start <= 0 || factor <= 1 || count < 1 {
+		panic(fmt.Sprintf("invalid exponential buckets %g %g %d", start, factor, count))
+	}
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+func (h *Histogram) Observe(v float64) {
+	atomic.AddInt64(&h.counts[sort.SearchFloat64s(h.bounds, v)], 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+// Buckets returns cumulative count of each bound
+// and the total count, which is the +Inf bucket
+func (h *Histogram) Buckets() ([]int64, int64) {
+	cum := make([]int64, len(h.bounds))
+	total := int64(0)
+	for i := range h.counts {
+		total += atomic.LoadInt64(&h.counts[i])
+		if i < len(cum) {
+			cum[i] = total
+		}
+	}
+	return cum, total
+}
+
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sum))
+}
+
+func (h *Histogram) name() string { return h.n }
+
+func (h *Histogram) write(w io.Writer, labels string) error {
+	cum, total := h.Buckets()
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.n, h.help, h.n)
+	for i, bound := range h.bounds {
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s %d\n",
+			series(h.n+"_bucket", labels, fmt.Sprintf("le=\"%g\"", bound)), cum[i])
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s %d\n%s %g\n%s %d\n",
+		series(h.n+"_bucket", labels, `le="+Inf"`), total,
+		series(h.n+"_sum", labels), h.Sum(),
+		series(h.n+"_count", labels), total)
+	return err
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+	labels  string
+}
+
+// at most maxLabels static labels, values never vary
+// per flow or peer so cardinality stays one per process
+const maxLabels = 8
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// SetLabels adds static labels to every sample written,
+// eg: edge=edge1 region=us-east env=prod
+func (r *Registry) SetLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("%d labels exceed %d", len(labels), maxLabels)
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	set := make([]string, 0, len(names))
+	for _, name := range names {
+		set = append(set, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		if g, ok := m.(*GaugeVec); ok {
+			if _, dup := labels[g.label]; dup {
+				return fmt.Errorf("label %q used by %s", g.label, g.n)
+			}
+		}
+		if c, ok := m.(*CounterVec); ok {
+			if _, dup := labels[c.label]; dup {
+				return fmt.Errorf("label %q used by %s", c.label, c.n)
+			}
+		}
+		if h, ok := m.(*Histogram); ok {
+			if _, dup := labels["le"]; dup {
+				return fmt.Errorf("label \"le\" used by %s", h.n)
+			}
+		}
+	}
+	r.labels = strings.Join(set, ",")
+	return nil
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// NewCounter registers a counter, panics if name is registered
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{n: name, help: help}
+	r.register(c)
+	return c
+}
+
+// NewGauge registers a gauge, panics if name is registered
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{n: name, help: help}
+	r.register(g)
+	return g
+}
+
+// NewGaugeVec registers a gauge vector of label,
+// panics if name is registered
+func (r *Registry) NewGaugeVec(name, help, label string) *GaugeVec {
+	g := &GaugeVec{n: name, help: help, label: label, v: make(map[string]float64)}
+	r.register(g)
+	return g
+}
+
+// NewCounterVec registers a counter vector of label,
+// panics if name is registered
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{n: name, help: help, label: label, v: make(map[string]int64)}
+	r.register(c)
+	return c
+}
+
+// NewHistogram registers a histogram of ascending bucket bounds,
+// panics if name is registered
+func (r *Registry) NewHistogram(name, help string, bounds []float64) *Histogram {
+	if !sort.Float64sAreSorted(bounds) {
+		panic(fmt.Sprintf("buckets of %s not sorted", name))
+	}
+	h := &Histogram{n: name, help: help, bounds: bounds, counts: make([]int64, len(bounds)+1)}
+	r.register(h)
+	return h
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[m.name()]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", m.name()))
+	}
+	r.metrics[m.name()] = m
+}
+
+// Write writes all metrics sorted by name
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	labels := r.labels
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w, labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+// default registry of the process
+var defaultRegistry = NewRegistry()
+
+func NewCounter(name, help string) *Counter {
+	return defaultRegistry.NewCounter(name, help)
+}
+
+func NewGauge(name, help string) *Gauge {
+	return defaultRegistry.NewGauge(name, help)
+}
+
+func NewGaugeVec(name, help, label string) *GaugeVec {
+	return defaultRegistry.NewGaugeVec(name, help, label)
+}
+
+func NewCounterVec(name, help, label string) *CounterVec {
+	return defaultRegistry.NewCounterVec(name, help, label)
+}
+
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	return defaultRegistry.NewHistogram(name, help, bounds)
+}
+
+// SetLabels adds static labels to metrics of the default registry
+func SetLabels(labels map[string]string) error {
+	return defaultRegistry.SetLabels(labels)
+}
+
+// Handler serves metrics of the default registry
+func Handler() http.Handler {
+	return defaultRegistry
+}
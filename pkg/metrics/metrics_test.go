@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_events_total", "events processed")
+	g := r.NewGauge("test_online", "online sessions")
+
+	c.Inc()
+	c.Add(2)
+	c.Add(-1)
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `# HELP test_events_total events processed
+# TYPE test_events_total counter
+test_events_total 3
+# HELP test_online online sessions
+# TYPE test_online gauge
+test_online 1
+`
+	if buf.String() != expect {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "test_events_total 3") {
+		t.Fatalf("metric not served:\n%s", w.Body.String())
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic on duplicated metric")
+		}
+	}()
+	r.NewGauge("test_total", "")
+}
+
+func TestGaugeVecWrite(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGaugeVec("test_rtt_seconds", "rtt of peer", "peer")
+	g.Set("2.2.2.2:58423", 0.02)
+	g.Set("1.1.1.1:58423", 0.015)
+	g.Set("3.3.3.3:58423", 1)
+	g.Delete("3.3.3.3:58423")
+
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `# HELP test_rtt_seconds rtt of peer
+# TYPE test_rtt_seconds gauge
+test_rtt_seconds{peer="1.1.1.1:58423"} 0.015
+test_rtt_seconds{peer="2.2.2.2:58423"} 0.02
+`
+	if buf.String() != expect {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestCounterVecWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_drops_total", "drops of peer", "peer")
+	c.Inc("2.2.2.2:58423")
+	c.Add("1.1.1.1:58423", 3)
+	c.Add("1.1.1.1:58423", -1)
+	c.Inc("3.3.3.3:58423")
+	c.Delete("3.3.3.3:58423")
+
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `# HELP test_drops_total drops of peer
+# TYPE test_drops_total counter
+test_drops_total{peer="1.1.1.1:58423"} 3
+test_drops_total{peer="2.2.2.2:58423"} 1
+`
+	if buf.String() != expect {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+	if err := r.SetLabels(map[string]string{"peer": "x"}); err == nil {
+		t.Fatalf("expected label of counter vector rejected")
+	}
+}
+
+func TestRegistryLabels(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_events_total", "events processed")
+	g := r.NewGaugeVec("test_rtt_seconds", "rtt of peer", "peer")
+	c.Inc()
+	g.Set("1.1.1.1:58423", 0.015)
+
+	err := r.SetLabels(map[string]string{"region": "us-east", "edge": "edge1", "env": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	expect := `# HELP test_events_total events processed
+# TYPE test_events_total counter
+test_events_total{edge="edge1",env="prod",region="us-east"} 1
+# HELP test_rtt_seconds rtt of peer
+# TYPE test_rtt_seconds gauge
+test_rtt_seconds{edge="edge1",env="prod",region="us-east",peer="1.1.1.1:58423"} 0.015
+`
+	if buf.String() != expect {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+
+	for _, labels := range []map[string]string{
+		{"peer": "x"},
+		{"1region": "x"},
+		{"__name__": "x"},
+		{"a": "", "b": "", "c": "", "d": "", "e": "", "f": "", "g": "", "h": "", "i": ""},
+	} {
+		if err := r.SetLabels(labels); err == nil {
+			t.Errorf("expected error for labels %v", labels)
+		}
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("test_size_bytes", "size of packets", ExponentialBuckets(64, 4, 3))
+	for _, v := range []float64{40, 64, 65, 1000, 1500} {
+		h.Observe(v)
+	}
+	r.SetLabels(map[string]string{"edge": "edge1"})
+
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `# HELP test_size_bytes size of packets
+# TYPE test_size_bytes histogram
+test_size_bytes_bucket{edge="edge1",le="64"} 2
+test_size_bytes_bucket{edge="edge1",le="256"} 3
+test_size_bytes_bucket{edge="edge1",le="1024"} 4
+test_size_bytes_bucket{edge="edge1",le="+Inf"} 5
+test_size_bytes_sum{edge="edge1"} 2669
+test_size_bytes_count{edge="edge1"} 5
+`
+	if buf.String() != expect {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+	if err := r.SetLabels(map[string]string{"le": "1"}); err == nil {
+		t.Fatalf("expected label le of histogram rejected")
+	}
+}
@@ -0,0 +1,298 @@
+// Package proxyproto reads PROXY protocol v1/v2 headers sent by load balancers
+// in front of tcp servers, so the real client address is known
+//
+//	trusted, _ := proxyproto.ParseTrusted([]string{"10.0.0.0/24"})
+//	lis = proxyproto.NewListener(lis, trusted)
+//	conn, _ := lis.Accept()
+//	conn.Read(buf)      // header is consumed on first read
+//	conn.RemoteAddr()   // client address carried by the header
+//
+// the header is required on every connection from trusted upstreams,
+// headers of other sources are not read, so clients can not spoof
+// their address. see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	sigV1 = []byte("PROXY ")
+	sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	maxV1Len = 107
+
+	// header of an accepted connection must arrive in time
+	headerTimeout = time.Second * 5
+
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+
+	famTCP4 = 0x11
+	famTCP6 = 0x21
+)
+
+// ReadHeader reads a PROXY protocol header from r, returns the source
+// address it carries, nil for LOCAL or UNKNOWN connections
+// eg: health checks of the load balancer
+func ReadHeader(r *bufio.Reader) (*net.TCPAddr, error) {
+	sig, err := r.Peek(len(sigV1))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, sigV1) {
+		return readV1(r)
+	}
+
+	sig, err = r.Peek(len(sigV2))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, sigV2) {
+		return readV2(r)
+	}
+	return nil, fmt.Errorf("proxy protocol header not found")
+}
+
+// readV1 parses text header
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readV1(r *bufio.Reader) (*net.TCPAddr, error) {
+	line := make([]byte, 0, maxV1Len)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxV1Len {
+			return nil, fmt.Errorf("proxy v1 header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid proxy v1 header")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid proxy v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid proxy v1 source %s %s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 parses binary header
+// | 12bytes signature | ver_cmd | family | 2bytes length | addresses and tlv |
+func readV2(r *bufio.Reader) (*net.TCPAddr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy v2 version %d", hdr[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch hdr[12] & 0xf {
+	case cmdLocal:
+		return nil, nil
+	case cmdProxy:
+	default:
+		return nil, fmt.Errorf("unsupported proxy v2 command %d", hdr[12]&0xf)
+	}
+
+	// src addr, dst addr, src port, dst port
+	switch hdr[13] {
+	case famTCP4:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short proxy v2 ipv4 addresses")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[:4]...)),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+
+	case famTCP6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short proxy v2 ipv6 addresses")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[:16]...)),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+	}
+
+	// unix sockets and udp are not relayed to tcp servers
+	return nil, nil
+}
+
+// ParseTrusted parses cidrs or addresses of upstreams
+// sending PROXY protocol headers, eg: the load balancer
+func ParseTrusted(cidrs []string) ([]*net.IPNet, error) {
+	trusted := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if len(c) == 0 {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			if strings.Contains(c, ":") {
+				c += "/128"
+			} else {
+				c += "/32"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s", c)
+		}
+		trusted = append(trusted, ipnet)
+	}
+	return trusted, nil
+}
+
+// Conn reads PROXY protocol header on first read, the remote
+// address is the underlying one until the header is read
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// header must be read within timeout, 0 waits forever
+	timeout time.Duration
+
+	once sync.Once
+	err  error
+
+	mu       sync.Mutex
+	remote   net.Addr
+	deadline time.Time
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *Conn) readHeader() {
+	// header deadline never outlasts the one set by user,
+	// which is restored once the header is read
+	if c.timeout > 0 {
+		c.mu.Lock()
+		deadline := time.Now().Add(c.timeout)
+		if c.deadline.IsZero() || deadline.Before(c.deadline) {
+			c.Conn.SetReadDeadline(deadline)
+		}
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			c.Conn.SetReadDeadline(c.deadline)
+			c.mu.Unlock()
+		}()
+	}
+
+	addr, err := ReadHeader(c.r)
+	if err != nil {
+		c.err = fmt.Errorf("read proxy header from %s: %v", c.Conn.RemoteAddr(), err)
+		return
+	}
+	if addr != nil {
+		c.mu.Lock()
+		c.remote = addr
+		c.mu.Unlock()
+	}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+type listener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// NewListener wraps connections accepted by lis from trusted
+// upstreams as Conn, connections of other sources are returned
+// as is, their headers if any are left to the reader
+func NewListener(lis net.Listener, trusted []*net.IPNet) net.Listener {
+	return &listener{Listener: lis, trusted: trusted, timeout: headerTimeout}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	c := NewConn(conn)
+	c.timeout = l.timeout
+	return c, nil
+}
+
+func (l *listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipnet := range l.trusted {
+		if ipnet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
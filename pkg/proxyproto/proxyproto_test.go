@@ -0,0 +1,190 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func v2Header(cmd, fam byte, body []byte) []byte {
+	hdr := append([]byte(nil), sigV2...)
+	hdr = append(hdr, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(body)))
+	return append(hdr, body...)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	copy(v6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v6[32:], 4000)
+	binary.BigEndian.PutUint16(v6[34:], 443)
+
+	cases := []struct {
+		hdr    []byte
+		expect string
+		fail   bool
+	}{
+		{[]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n"), "192.168.0.1:56324", false},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 443\r\n"), "[2001:db8::1]:4000", false},
+		{[]byte("PROXY UNKNOWN\r\n"), "", false},
+		{[]byte("PROXY TCP4 2001:db8::1 10.0.0.1 4000 443\r\n"), "", true},
+		{[]byte("PROXY TCP4 192.168.0.1 10.0.0.1 70000 443\r\n"), "", true},
+		{[]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\n"), "", true},
+		{v2Header(cmdProxy, famTCP4, v4), "192.168.0.1:56324", false},
+		{v2Header(cmdProxy, famTCP6, v6), "[2001:db8::1]:4000", false},
+		{v2Header(cmdProxy, famTCP4, append(v4, 0x04, 0, 1, 'x')), "192.168.0.1:56324", false},
+		{v2Header(cmdLocal, 0, nil), "", false},
+		{v2Header(cmdProxy, famTCP4, v4[:8]), "", true},
+		{[]byte("GET / HTTP/1.1\r\n\r\n"), "", true},
+	}
+
+	for _, c := range cases {
+		r := bufio.NewReader(bytes.NewReader(append(c.hdr, "payload"...)))
+		addr, err := ReadHeader(r)
+		if c.fail {
+			if err == nil {
+				t.Fatalf("%q: expected fail, got %v", c.hdr, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", c.hdr, err)
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != c.expect {
+			t.Fatalf("%q: expected %s, got %s", c.hdr, c.expect, got)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+			t.Fatalf("%q: header not consumed, left %q", c.hdr, rest)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := ParseTrusted([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis = NewListener(lis, trusted)
+	defer lis.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 40000 58422\r\nhello"))
+	}()
+
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("unexpected payload %q %v", buf, err)
+	}
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:40000" {
+		t.Fatalf("expected real client address, got %s", got)
+	}
+}
+
+func TestListenerUntrusted(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := ParseTrusted([]string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis = NewListener(lis, trusted)
+	defer lis.Close()
+
+	hdr := "PROXY TCP4 203.0.113.7 10.0.0.1 40000 58422\r\n"
+	go func() {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(hdr + "hello"))
+	}()
+
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// header of untrusted source is not read
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil || string(buf) != hdr+"hello" {
+		t.Fatalf("unexpected payload %q %v", buf, err)
+	}
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Fatalf("address of untrusted source replaced by %s", conn.RemoteAddr())
+	}
+}
+
+func TestListenerHeaderTimeout(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, _ := ParseTrusted([]string{"127.0.0.0/8"})
+	lis = NewListener(lis, trusted)
+	lis.(*listener).timeout = time.Millisecond * 100
+	defer lis.Close()
+
+	// connected without sending header
+	client, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	begin := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected header read timeout")
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("header read not bounded, took %s", elapsed)
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	trusted, err := ParseTrusted([]string{"10.0.0.0/24", " 192.168.0.1 ", "2001:db8::1", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, ipnet := range trusted {
+		got = append(got, ipnet.String())
+	}
+	if len(got) != 3 || got[0] != "10.0.0.0/24" || got[1] != "192.168.0.1/32" || got[2] != "2001:db8::1/128" {
+		t.Fatalf("unexpected trusted %v", got)
+	}
+	if _, err := ParseTrusted([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatalf("expected invalid cidr fail")
+	}
+}
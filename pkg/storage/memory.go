@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Storage kept in process, for tests and
+// single controller setups that need no persistence
+type Memory struct {
+	mu       sync.Mutex
+	kvs      map[string][]byte
+	leases   map[int64]*memLease
+	keyLease map[string]int64
+	nextID   int64
+	watchers []*memWatcher
+}
+
+type memLease struct {
+	ttl   time.Duration
+	timer *time.Timer
+	keys  map[string]bool
+
+	// expire fired before a KeepAlive is
+	// ignored until the renewed deadline
+	deadline time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		kvs:      make(map[string][]byte),
+		leases:   make(map[int64]*memLease),
+		keyLease: make(map[string]int64),
+	}
+}
+
+func (s *Memory) Ping() error {
+	return nil
+}
+
+func (s *Memory) Set(key string, val interface{}) error {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.detach(key)
+	s.put(key, b)
+	return nil
+}
+
+func (s *Memory) SetWithTTL(key string, val interface{}, ttl time.Duration) (int64, error) {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	id := s.nextID
+	s.leases[id] = &memLease{
+		ttl:      ttl,
+		deadline: time.Now().Add(ttl),
+		timer:    time.AfterFunc(ttl, func() { s.expire(id) }),
+		keys:     map[string]bool{key: true},
+	}
+	s.detach(key)
+	s.keyLease[key] = id
+	s.put(key, b)
+	return id, nil
+}
+
+func (s *Memory) KeepAlive(lease int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[lease]
+	if !ok {
+		return fmt.Errorf("lease %d not found", lease)
+	}
+	l.deadline = time.Now().Add(l.ttl)
+	l.timer.Reset(l.ttl)
+	return nil
+}
+
+// expire deletes keys of lease unless it is renewed
+// while the timer fired
+func (s *Memory) expire(lease int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[lease]
+	if !ok || time.Now().Before(l.deadline) {
+		return
+	}
+	delete(s.leases, lease)
+	for key := range l.keys {
+		delete(s.keyLease, key)
+		s.del(key)
+	}
+}
+
+// detach removes key from its lease, the lease is
+// revoked once no key is attached
+func (s *Memory) detach(key string) {
+	id, ok := s.keyLease[key]
+	if !ok {
+		return
+	}
+	delete(s.keyLease, key)
+	l := s.leases[id]
+	delete(l.keys, key)
+	if len(l.keys) == 0 {
+		l.timer.Stop()
+		delete(s.leases, id)
+	}
+}
+
+func (s *Memory) Get(key string, obj interface{}) error {
+	s.mu.Lock()
+	val, ok := s.kvs[key]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("empty value")
+	}
+	return json.Unmarshal(val, obj)
+}
+
+func (s *Memory) Del(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.detach(key)
+	s.del(key)
+}
+
+func (s *Memory) DelPrefix(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.kvs {
+		if strings.HasPrefix(key, prefix) {
+			s.detach(key)
+			s.del(key)
+		}
+	}
+}
+
+func (s *Memory) List(root string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]string)
+	for key, val := range s.kvs {
+		if strings.HasPrefix(key, root) {
+			res[key] = string(val)
+		}
+	}
+	return res, nil
+}
+
+func (s *Memory) put(key string, val []byte) {
+	evt := &Event{Type: EventTypePut, Kv: &KeyValue{Key: []byte(key), Value: val}}
+	if prev, ok := s.kvs[key]; ok {
+		evt.PrevKv = &KeyValue{Key: []byte(key), Value: prev}
+	}
+	s.kvs[key] = val
+	s.notify(key, evt)
+}
+
+func (s *Memory) del(key string) {
+	prev, ok := s.kvs[key]
+	if !ok {
+		return
+	}
+	delete(s.kvs, key)
+	s.notify(key, &Event{
+		Type:   EventTypeDelete,
+		Kv:     &KeyValue{Key: []byte(key)},
+		PrevKv: &KeyValue{Key: []byte(key), Value: prev},
+	})
+}
+
+func (s *Memory) notify(key string, evt *Event) {
+	for _, w := range s.watchers {
+		if strings.HasPrefix(key, w.prefix) {
+			w.push(evt)
+		}
+	}
+}
+
+// Watch never blocks writers, events are queued
+// for the watcher until read
+func (s *Memory) Watch(ctx context.Context, prefix string) <-chan WatchResponse {
+	w := &memWatcher{
+		prefix: prefix,
+		ch:     make(chan WatchResponse),
+		done:   ctx.Done(),
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	s.mu.Lock()
+	s.watchers = append(s.watchers, w)
+	s.mu.Unlock()
+
+	go w.run()
+	go func() {
+		<-ctx.Done()
+		s.unwatch(w)
+		w.close()
+	}()
+	return w.ch
+}
+
+// unwatch removes w, no event is pushed to it later
+func (s *Memory) unwatch(w *memWatcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.watchers {
+		if o == w {
+			s.watchers = append(s.watchers[:i], s.watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+type memWatcher struct {
+	prefix string
+	done   <-chan struct{}
+	mu     sync.Mutex
+	cond   *sync.Cond
+	events []*Event
+	closed bool
+	ch     chan WatchResponse
+}
+
+func (w *memWatcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.cond.Signal()
+}
+
+func (w *memWatcher) push(evt *Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.events = append(w.events, evt)
+	w.cond.Signal()
+}
+
+// run delivers queued events until closed, events
+// not read by then are dropped
+func (w *memWatcher) run() {
+	defer close(w.ch)
+	for {
+		w.mu.Lock()
+		for len(w.events) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		events := w.events
+		w.events = nil
+		w.mu.Unlock()
+
+		select {
+		case w.ch <- WatchResponse{Events: events}:
+		case <-w.done:
+			return
+		}
+	}
+}
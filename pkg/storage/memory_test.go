@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryWatchCancel(t *testing.T) {
+	s := NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	chs := s.Watch(ctx, "/edges/")
+
+	s.Set("/edges/ns/edge1", "edge1")
+	s.Set("/routes/ns/r1", "r1")
+	select {
+	case resp := <-chs:
+		if len(resp.Events) != 1 || string(resp.Events[0].Kv.Key) != "/edges/ns/edge1" {
+			t.Fatalf("unexpected events %+v", resp.Events)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("put not watched")
+	}
+
+	// channel closed and watcher removed once canceled
+	cancel()
+	select {
+	case _, ok := <-chs:
+		if ok {
+			t.Fatalf("event watched after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("watch channel not closed")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.watchers)
+		s.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("canceled watcher left")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	s.Set("/edges/ns/edge2", "edge2")
+}
+
+func TestMemoryKeepAliveExpiring(t *testing.T) {
+	s := NewMemory()
+	lease, err := s.SetWithTTL("/presence/ns/edge1", "edge1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// timer fired and expire waits for the lock
+	// while the lease is renewed
+	if err := s.KeepAlive(lease); err != nil {
+		t.Fatal(err)
+	}
+	s.expire(lease)
+	var val string
+	if err := s.Get("/presence/ns/edge1", &val); err != nil || val != "edge1" {
+		t.Fatalf("renewed lease expired: %v", err)
+	}
+
+	// expires once not renewed in ttl
+	lease, _ = s.SetWithTTL("/presence/ns/edge2", "edge2", time.Millisecond*50)
+	time.Sleep(time.Millisecond * 200)
+	if err := s.Get("/presence/ns/edge2", &val); err == nil {
+		t.Fatalf("lease not expired")
+	}
+	if err := s.KeepAlive(lease); err == nil {
+		t.Fatalf("expected expired lease not renewed")
+	}
+}
@@ -0,0 +1,70 @@
+// Package storage defines the key value store of controller,
+// implemented by etcd and memory for tests
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Storage stores json values by key, keys are paths like
+// /edges/<namespace>/<name> listed and watched by prefix
+type Storage interface {
+	// Ping checks the store is serving requests
+	Ping() error
+
+	Set(key string, val interface{}) error
+
+	// SetWithTTL sets key attached to a new lease,
+	// key is deleted once the lease expires without KeepAlive
+	SetWithTTL(key string, val interface{}, ttl time.Duration) (int64, error)
+
+	// KeepAlive renews the lease once
+	KeepAlive(lease int64) error
+
+	// Get unmarshals value of key to obj
+	Get(key string, obj interface{}) error
+
+	Del(key string)
+	DelPrefix(prefix string)
+
+	// List returns values of keys with prefix root
+	List(root string) (map[string]string, error)
+
+	// Watch returns changes of keys with prefix,
+	// the channel is closed once ctx is done
+	Watch(ctx context.Context, prefix string) <-chan WatchResponse
+}
+
+type EventType int
+
+const (
+	EventTypePut EventType = iota
+	EventTypeDelete
+)
+
+func (t EventType) String() string {
+	if t == EventTypeDelete {
+		return "DELETE"
+	}
+	return "PUT"
+}
+
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+}
+
+// Event is a change of key, Kv of delete event has only the key,
+// PrevKv is the value before the change, nil if none
+type Event struct {
+	Type   EventType
+	Kv     *KeyValue
+	PrevKv *KeyValue
+}
+
+// WatchResponse is events of a watch, or Err if the watch failed
+type WatchResponse struct {
+	Events []*Event
+	Err    error
+}
@@ -0,0 +1,39 @@
+// Package version holds build information of cframe binaries,
+// set by ldflags when building, see build.sh
+//
+//	go build -ldflags "-X github.com/ICKelin/cframe/pkg/version.Version=v1.0.0"
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+func Get() *Info {
+	return &Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+	}
+}
+
+func (i *Info) String() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s %s)",
+		i.Version, i.Commit, i.BuildDate, i.GoVersion, i.Platform)
+}
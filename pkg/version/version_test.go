@@ -0,0 +1,22 @@
+package version
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	Version, Commit, BuildDate = "v1.0.0", "abcdef", "2020-07-05"
+	info := Get()
+	if info.Version != "v1.0.0" || info.Commit != "abcdef" || info.BuildDate != "2020-07-05" {
+		t.Fatalf("unexpected version info %+v", info)
+	}
+
+	if len(info.GoVersion) == 0 || len(info.Platform) == 0 {
+		t.Fatalf("runtime info not populated %+v", info)
+	}
+
+	if !strings.HasPrefix(info.String(), "v1.0.0 (commit abcdef") {
+		t.Fatalf("unexpected version string %s", info.String())
+	}
+}